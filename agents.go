@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// IntervalCounts are the results of a command over a reporting interval: the
+// commands sent, the ones that failed and the sum and maximum of the latencies
+// of the others.
+type IntervalCounts struct {
+	Commands     uint64  `json:"commands"`
+	Errors       uint64  `json:"errors"`
+	LatencyMs    float64 `json:"latencyMs"`
+	MaxLatencyMs float64 `json:"maxLatencyMs"`
+}
+
+func (c *IntervalCounts) add(other IntervalCounts) {
+	c.Commands += other.Commands
+	c.Errors += other.Errors
+	c.LatencyMs += other.LatencyMs
+	if other.MaxLatencyMs > c.MaxLatencyMs {
+		c.MaxLatencyMs = other.MaxLatencyMs
+	}
+}
+
+// AgentReport is what an agent recorded since its previous report, by command.
+type AgentReport struct {
+	Agent    string                    `json:"agent"`
+	At       time.Time                 `json:"at"`
+	Seconds  float64                   `json:"seconds"`
+	Commands map[string]IntervalCounts `json:"commands"`
+}
+
+// AgentReply is the coordinator's answer to a report. Stop asks the agent to
+// end its run, as a global stop condition was met.
+type AgentReply struct {
+	Stop   bool   `json:"stop"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AgentReporter streams an agent's results to its coordinator every Interval
+// while the run goes on, so the coordinator shows live numbers of the whole
+// distributed run and can stop it. Stop is called once with the reason when
+// the coordinator asks the agent to stop. Observe is safe to call on a nil
+// reporter, which reports nothing.
+type AgentReporter struct {
+	URL      string
+	Agent    string
+	Interval time.Duration
+	Log      Logger
+	Stop     func(reason string)
+
+	client  *http.Client
+	mu      sync.Mutex
+	counts  map[string]*IntervalCounts
+	since   time.Time
+	stopped bool
+}
+
+func CreateAgentReporter(url, agent string, interval time.Duration) *AgentReporter {
+	return &AgentReporter{
+		URL:      strings.TrimSuffix(url, "/"),
+		Agent:    agent,
+		Interval: interval,
+		Log:      ZerologLogger{},
+		client:   &http.Client{Timeout: 5 * time.Second},
+		counts:   map[string]*IntervalCounts{},
+		since:    clock.Now(),
+	}
+}
+
+// UseTLS makes the reporter reach its coordinator with config.
+func (a *AgentReporter) UseTLS(config *tls.Config) {
+	a.client.Transport = &http.Transport{TLSClientConfig: config}
+}
+
+// Observe takes a results record as it is written.
+func (a *AgentReporter) Observe(record []string) {
+	if a == nil || len(record) < len(csvHeader) {
+		return
+	}
+	name := commandName(record[0])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.counts[name]
+	if !ok {
+		c = &IntervalCounts{}
+		a.counts[name] = c
+	}
+	c.Commands++
+	if record[5] == "true" {
+		c.Errors++
+	} else if ms, ok := recordLatency(record); ok {
+		c.LatencyMs += ms
+		if ms > c.MaxLatencyMs {
+			c.MaxLatencyMs = ms
+		}
+	}
+}
+
+// Run reports every Interval for as long as the tester runs.
+func (a *AgentReporter) Run() {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.report()
+	}
+}
+
+// Flush reports the results since the previous report straight away, such as
+// the last ones of a run that ended. It is safe to call on a nil reporter.
+func (a *AgentReporter) Flush() {
+	if a == nil {
+		return
+	}
+	a.report()
+}
+
+// take is the report of the results since the previous one, starting the next.
+func (a *AgentReporter) take() AgentReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := clock.Now()
+	report := AgentReport{Agent: a.Agent, At: now, Seconds: now.Sub(a.since).Seconds(), Commands: map[string]IntervalCounts{}}
+	for name, c := range a.counts {
+		report.Commands[name] = *c
+	}
+	a.counts = map[string]*IntervalCounts{}
+	a.since = now
+	return report
+}
+
+// restore puts back the results of a report the coordinator didn't take, so
+// they are sent with the next one.
+func (a *AgentReporter) restore(report AgentReport) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.since = a.since.Add(-time.Duration(report.Seconds * float64(time.Second)))
+	for name, counts := range report.Commands {
+		c, ok := a.counts[name]
+		if !ok {
+			c = &IntervalCounts{}
+			a.counts[name] = c
+		}
+		c.add(counts)
+	}
+}
+
+func (a *AgentReporter) report() {
+	report := a.take()
+	reply, err := a.send(report)
+	if err != nil {
+		a.Log.Warn("unable to report results to coordinator, sending them with the next report", "error", err, "coordinator", a.URL)
+		a.restore(report)
+		return
+	}
+	if !reply.Stop {
+		return
+	}
+	a.mu.Lock()
+	first := !a.stopped
+	a.stopped = true
+	a.mu.Unlock()
+	if first && a.Stop != nil {
+		a.Log.Warn("coordinator stopped the run", "reason", reply.Reason)
+		go a.Stop("coordinator: " + reply.Reason)
+	}
+}
+
+func (a *AgentReporter) send(report AgentReport) (*AgentReply, error) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode report")
+	}
+	resp, err := a.client.Post(a.URL+"/api/v1/agents/report", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to send report to coordinator")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("coordinator responded with status %d to report", resp.StatusCode)
+	}
+	var reply AgentReply
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode coordinator reply")
+	}
+	return &reply, nil
+}
+
+// minGlobalCommands is the fewest commands of all agents a global error rate
+// is judged on, so the first failures of a run don't stop it.
+const minGlobalCommands = 100
+
+// AgentStats consolidates the reports of a coordinator's agents. Once the
+// agents' commands reach MaxCommands, or more than MaxErrorRate of them
+// failed, every agent is told to stop with its next report and Stop is called
+// once, for the coordinator to stop its own routines.
+type AgentStats struct {
+	MaxCommands  uint64
+	MaxErrorRate float64
+	Stop         func(reason string)
+	Log          Logger
+
+	mu      sync.Mutex
+	agents  map[string]*agentState
+	stopped string
+}
+
+type agentState struct {
+	last AgentReport
+	// received is when the last report arrived, by the coordinator's clock
+	received time.Time
+	totals   map[string]IntervalCounts
+}
+
+func CreateAgentStats() *AgentStats {
+	return &AgentStats{Log: ZerologLogger{}, agents: map[string]*agentState{}}
+}
+
+// ReportEndpoint is POST /api/v1/agents/report, where agents send their results.
+func (s *AgentStats) ReportEndpoint(c *gin.Context) {
+	var report AgentReport
+	err := c.ShouldBindJSON(&report)
+	if err != nil || report.Agent == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "report must be json with an agent"})
+		return
+	}
+	c.JSON(http.StatusOK, s.Record(report))
+}
+
+// Record adds an agent's report and checks the global stop conditions.
+func (s *AgentStats) Record(report AgentReport) AgentReply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[report.Agent]
+	if !ok {
+		agent = &agentState{totals: map[string]IntervalCounts{}}
+		s.agents[report.Agent] = agent
+		s.Log.Info("agent reporting results", "agent", report.Agent)
+	}
+	agent.last, agent.received = report, clock.Now()
+	for name, counts := range report.Commands {
+		total := agent.totals[name]
+		total.add(counts)
+		agent.totals[name] = total
+	}
+
+	if s.stopped == "" {
+		s.stopped = s.stopCondition()
+		if s.stopped != "" {
+			s.Log.Warn("global stop condition met, stopping every agent", "reason", s.stopped)
+			if s.Stop != nil {
+				go s.Stop(s.stopped)
+			}
+		}
+	}
+	return AgentReply{Stop: s.stopped != "", Reason: s.stopped}
+}
+
+// stopCondition is the global stop condition the agents met, empty when none
+// is; s.mu is held.
+func (s *AgentStats) stopCondition() string {
+	var total IntervalCounts
+	for _, agent := range s.agents {
+		for _, counts := range agent.totals {
+			total.add(counts)
+		}
+	}
+	if s.MaxCommands > 0 && total.Commands >= s.MaxCommands {
+		return fmt.Sprintf("agents sent %d commands, global max is %d", total.Commands, s.MaxCommands)
+	}
+	if s.MaxErrorRate > 0 && total.Commands >= minGlobalCommands {
+		if rate := float64(total.Errors) / float64(total.Commands); rate > s.MaxErrorRate {
+			return fmt.Sprintf("%.1f%% of the agents' commands failed, global max is %.1f%%", rate*100, s.MaxErrorRate*100)
+		}
+	}
+	return ""
+}
+
+// AgentSummary is an agent's last report and everything it reported.
+type AgentSummary struct {
+	LastReport time.Time                 `json:"lastReport"`
+	Live       bool                      `json:"live"`
+	Interval   map[string]IntervalCounts `json:"interval"`
+	Totals     map[string]IntervalCounts `json:"totals"`
+}
+
+// LiveCommand is a command's consolidated results over the agents' last
+// reports.
+type LiveCommand struct {
+	Command       string  `json:"command"`
+	Commands      uint64  `json:"commands"`
+	Errors        uint64  `json:"errors"`
+	RatePerSecond float64 `json:"ratePerSecond"`
+	MeanLatencyMs float64 `json:"meanLatencyMs"`
+	MaxLatencyMs  float64 `json:"maxLatencyMs"`
+}
+
+// AgentsEndpoint is GET /api/v1/agents: every agent's results and the live
+// numbers of the agents still reporting, consolidated by command. An agent is
+// live while its last report is no older than three of its intervals.
+func (s *AgentStats) AgentsEndpoint(c *gin.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	agents := map[string]AgentSummary{}
+	live := map[string]*LiveCommand{}
+	var totals IntervalCounts
+	for name, agent := range s.agents {
+		window := time.Duration(3 * agent.last.Seconds * float64(time.Second))
+		summary := AgentSummary{
+			LastReport: agent.received,
+			Live:       now.Sub(agent.received) <= window,
+			Interval:   agent.last.Commands,
+			Totals:     agent.totals,
+		}
+		agents[name] = summary
+		for _, counts := range agent.totals {
+			totals.add(counts)
+		}
+		if !summary.Live || agent.last.Seconds <= 0 {
+			continue
+		}
+		for command, counts := range agent.last.Commands {
+			l, ok := live[command]
+			if !ok {
+				l = &LiveCommand{Command: command}
+				live[command] = l
+			}
+			l.Commands += counts.Commands
+			l.Errors += counts.Errors
+			l.RatePerSecond += float64(counts.Commands) / agent.last.Seconds
+			// summed for now, averaged below
+			l.MeanLatencyMs += counts.LatencyMs
+			if counts.MaxLatencyMs > l.MaxLatencyMs {
+				l.MaxLatencyMs = counts.MaxLatencyMs
+			}
+		}
+	}
+
+	commands := []LiveCommand{}
+	for _, l := range live {
+		if ok := l.Commands - l.Errors; ok > 0 {
+			l.MeanLatencyMs /= float64(ok)
+		} else {
+			l.MeanLatencyMs = 0
+		}
+		commands = append(commands, *l)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Command < commands[j].Command })
+
+	c.JSON(http.StatusOK, gin.H{
+		"at":       now,
+		"agents":   agents,
+		"live":     commands,
+		"commands": totals.Commands,
+		"errors":   totals.Errors,
+		"stopped":  s.stopped,
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// recordTimeLayout is the layout of the timestamps in the results CSVs, that of
+// time.Time.String() minus the monotonic clock reading older runs still have.
+const recordTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// recordTime formats a timestamp for the results CSVs. Times are recorded in
+// UTC so results from sites in different time zones line up; the site's zone
+// is kept in the manifest.
+func recordTime(t time.Time) string {
+	return t.UTC().Format(recordTimeLayout)
+}
+
+// parseRecordTime parses a timestamp column of the results CSV. The zero time
+// marks a step the command never reached.
+func parseRecordTime(s string) (time.Time, error) {
+	if i := strings.Index(s, " m="); i >= 0 {
+		s = s[:i]
+	}
+	return time.Parse(recordTimeLayout, s)
+}
+
+// commandName groups records of one kind of command; markers carry their
+// correlation id and queued washes their lane after the name.
+func commandName(column string) string {
+	if i := strings.IndexByte(column, ' '); i >= 0 {
+		return column[:i]
+	}
+	return column
+}
+
+// CommandSummary is what a run looked like for one command. Latencies are the
+// milliseconds between writing the command and reading its reply, for
+// successful commands only.
+type CommandSummary struct {
+	Command   string    `json:"command"`
+	Count     int       `json:"count"`
+	Errors    int       `json:"errors"`
+	Latencies []float64 `json:"-"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+func (s *CommandSummary) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count)
+}
+
+// Rate is the commands per second between the first and last command.
+func (s *CommandSummary) Rate() float64 {
+	elapsed := s.Last.Sub(s.First).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Count-1) / elapsed
+}
+
+func (s *CommandSummary) Percentile(p float64) float64 {
+	return percentile(s.Latencies, p)
+}
+
+type RunSummary struct {
+	Dir      string
+	Commands map[string]*CommandSummary
+}
+
+// CommandNames are the run's commands in a stable order.
+func (r *RunSummary) CommandNames() []string {
+	names := make([]string, 0, len(r.Commands))
+	for name := range r.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SummariseRun reads the results CSV of a run directory.
+func SummariseRun(dir string) (*RunSummary, error) {
+	f, err := os.Open(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open results of run %s", dir)
+	}
+	defer f.Close()
+
+	summary, err := summariseResults(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read results of run %s", dir)
+	}
+	summary.Dir = dir
+	return summary, nil
+}
+
+func summariseResults(r io.Reader) (*RunSummary, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	summary := &RunSummary{Commands: map[string]*CommandSummary{}}
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 0 && record[0] == csvHeader[0] {
+			continue
+		}
+		if len(record) < len(csvHeader) {
+			continue
+		}
+		if baselinePhase(record) {
+			continue
+		}
+
+		name := commandName(record[0])
+		command, ok := summary.Commands[name]
+		if !ok {
+			command = &CommandSummary{Command: name}
+			summary.Commands[name] = command
+		}
+		command.Count++
+
+		initiated, initErr := parseRecordTime(record[2])
+		if initErr == nil && !initiated.IsZero() {
+			if command.First.IsZero() || initiated.Before(command.First) {
+				command.First = initiated
+			}
+			if initiated.After(command.Last) {
+				command.Last = initiated
+			}
+		}
+
+		if record[5] == "true" {
+			command.Errors++
+			continue
+		}
+		if ms, ok := recordLatency(record); ok {
+			command.Latencies = append(command.Latencies, ms)
+		}
+	}
+
+	for _, command := range summary.Commands {
+		sort.Float64s(command.Latencies)
+	}
+	return summary, nil
+}
+
+// recordLatency is the milliseconds between a command being sent and its reply
+// being read, false for failed commands and records missing either time.
+func recordLatency(record []string) (float64, bool) {
+	if len(record) < len(csvHeader) || record[5] == "true" {
+		return 0, false
+	}
+	initiated, initErr := parseRecordTime(record[2])
+	retrieved, retErr := parseRecordTime(record[3])
+	if initErr != nil || retErr != nil || initiated.IsZero() || retrieved.IsZero() {
+		return 0, false
+	}
+	return float64(retrieved.Sub(initiated)) / float64(time.Millisecond), true
+}
+
+// percentile of already sorted values, interpolating between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+var annotationHeader = []string{"Start", "End", "Label"}
+
+// Annotation marks a span of the run, e.g. a surge, on the results timeline.
+// End equals Start for annotations of a single moment.
+type Annotation struct {
+	Start time.Time
+	End   time.Time
+	Label string
+}
+
+func (a Annotation) Record() []string {
+	return []string{recordTime(a.Start), recordTime(a.End), a.Label}
+}
+
+// Annotator puts annotations on the results timeline and, when GrafanaURL is
+// set, on the Grafana dashboards showing the run.
+type Annotator struct {
+	Writer *ResultWriter
+	Log    Logger
+	// GrafanaURL is the base url of Grafana, e.g. http://grafana:3000.
+	GrafanaURL   string
+	GrafanaToken string
+	Tags         []string
+
+	client *http.Client
+}
+
+func CreateAnnotator(writer *ResultWriter, tags ...string) *Annotator {
+	return &Annotator{
+		Writer: writer,
+		Log:    ZerologLogger{},
+		Tags:   tags,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Annotate records a. The annotation is always written to the results; an
+// error means Grafana didn't get it.
+func (a *Annotator) Annotate(annotation Annotation) error {
+	err := a.Writer.Write(annotation.Record())
+	if err != nil {
+		a.Log.Warn("error writing annotation to CSV", "error", err, "label", annotation.Label)
+	}
+	if a.GrafanaURL == "" {
+		return nil
+	}
+	return a.postToGrafana(annotation)
+}
+
+func (a *Annotator) postToGrafana(annotation Annotation) error {
+	body := map[string]interface{}{
+		"time": annotation.Start.UnixMilli(),
+		"text": annotation.Label,
+		"tags": a.Tags,
+	}
+	if annotation.End.After(annotation.Start) {
+		body["timeEnd"] = annotation.End.UnixMilli()
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode grafana annotation")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(a.GrafanaURL, "/")+"/api/annotations", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "unable to create grafana annotation request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.GrafanaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.GrafanaToken)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to post annotation to grafana")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("grafana responded with status %d to annotation", resp.StatusCode)
+	}
+	return nil
+}
+
+type annotateRequest struct {
+	Text string `json:"text"`
+}
+
+// AnnotateEndpoint is POST /api/v1/annotate, for operators to note manual
+// interventions such as {"text": "rebooted rTC"} while a test runs.
+func (a *Annotator) AnnotateEndpoint(c *gin.Context) {
+	var req annotateRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || strings.TrimSpace(req.Text) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be JSON with a non-empty text"})
+		return
+	}
+
+	now := clock.Now()
+	annotation := Annotation{Start: now, End: now, Label: req.Text}
+	err = a.Annotate(annotation)
+	if err != nil {
+		a.Log.Warn("annotation not sent to grafana", "error", err, "label", req.Text)
+		c.JSON(http.StatusOK, gin.H{"at": now, "grafanaError": err.Error()})
+		return
+	}
+	a.Log.Info("annotated run", "label", req.Text)
+	c.JSON(http.StatusOK, gin.H{"at": now})
+}
+
+// readAnnotations reads annotations.csv of a run directory.
+func readAnnotations(dir string) ([]Annotation, error) {
+	f, err := os.Open(filepath.Join(dir, "annotations.csv"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	var annotations []Annotation
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read annotations")
+		}
+		if line == 0 && record[0] == annotationHeader[0] {
+			continue
+		}
+
+		start, err := parseRecordTime(record[0])
+		if err != nil {
+			continue
+		}
+		end, err := parseRecordTime(record[1])
+		if err != nil {
+			continue
+		}
+		annotations = append(annotations, Annotation{Start: start, End: end, Label: record[2]})
+	}
+	return annotations, nil
+}
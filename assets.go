@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// assets are the report templates and example presets built into the binary,
+// so a site install is the executable alone. --extract-assets writes them out
+// to be customised, e.g. a report template passed back with `report -template`.
+//
+//go:embed templates examples
+var assets embed.FS
+
+// assetTemplate parses a built in template of the templates directory.
+func assetTemplate(name string) *template.Template {
+	return template.Must(template.ParseFS(assets, "templates/"+name))
+}
+
+// extractAssets writes every built in asset under dir. Files that are already
+// there are left alone so customised copies aren't overwritten.
+func extractAssets(dir string) error {
+	return fs.WalkDir(assets, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if _, err := os.Stat(target); err == nil {
+			log.Warn().Str("path", target).Msg("asset already exists, leaving it as is")
+			return nil
+		}
+
+		b, err := assets.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read asset %s", path)
+		}
+		err = os.WriteFile(target, b, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "unable to write asset %s", target)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// authUse is what the credential flags of the tester's commands say they're for.
+const authUse = "sent in every command to secured rTCs"
+
+// redacted replaces credentials wherever they would be logged or written.
+const redacted = "REDACTED"
+
+// CommandAuth is the site code and terminal PIN secured rTCs require in every
+// command, e.g. <src><siteCode>S-104</siteCode><terminalPin>4821</terminalPin><getQueue/></src>.
+// Only the credentials that are set are sent.
+type CommandAuth struct {
+	SiteCode string
+	PIN      string
+}
+
+// authElements match the credentials in a payload, whatever they are.
+var authElements = regexp.MustCompile(`<(siteCode|terminalPin)>[^<]*</(siteCode|terminalPin)>`)
+
+// replyErrors match the errors of an rTC reply.
+var replyErrors = regexp.MustCompile(`<error>[^<]*</error>`)
+
+// minRedactedLength is the shortest credential redacted outside of its element,
+// e.g. when an rTC echoes it in an error; shorter ones would mangle ids.
+const minRedactedLength = 4
+
+// addAuthFlags adds the credential flags to fs, defaulting to $RTC_SITE_CODE
+// and $RTC_TERMINAL_PIN so they needn't show in the process list. use says
+// what the credentials are for, e.g. "sent in every command to secured rTCs".
+func addAuthFlags(fs *flag.FlagSet, use string) func() *CommandAuth {
+	siteCode := fs.String("site-code", os.Getenv("RTC_SITE_CODE"), "site code "+use+", defaults to $RTC_SITE_CODE")
+	pin := fs.String("terminal-pin", os.Getenv("RTC_TERMINAL_PIN"), "terminal PIN "+use+", defaults to $RTC_TERMINAL_PIN")
+	return func() *CommandAuth {
+		return CreateCommandAuth(*siteCode, *pin)
+	}
+}
+
+// CreateCommandAuth is nil when neither credential is set, for rTCs that
+// don't need them.
+func CreateCommandAuth(siteCode, pin string) *CommandAuth {
+	if siteCode == "" && pin == "" {
+		return nil
+	}
+	return &CommandAuth{SiteCode: siteCode, PIN: pin}
+}
+
+// Authorize puts the credentials first in a command's envelope. A command
+// that isn't in a plain <src> envelope is sent as it is.
+func (a *CommandAuth) Authorize(commandXML string) string {
+	if a == nil || !strings.HasPrefix(commandXML, "<src>") {
+		return commandXML
+	}
+	var b strings.Builder
+	b.WriteString("<src>")
+	if a.SiteCode != "" {
+		b.WriteString("<siteCode>" + escapeXML(a.SiteCode) + "</siteCode>")
+	}
+	if a.PIN != "" {
+		b.WriteString("<terminalPin>" + escapeXML(a.PIN) + "</terminalPin>")
+	}
+	b.WriteString(strings.TrimPrefix(commandXML, "<src>"))
+	return b.String()
+}
+
+// Redact blanks out the credentials of s, a payload, reply or error message.
+// It is safe to call on a nil auth, which leaves s as it is.
+func (a *CommandAuth) Redact(s string) string {
+	if a == nil {
+		return s
+	}
+	s = authElements.ReplaceAllString(s, "<$1>"+redacted+"</$2>")
+	for _, secret := range []string{a.SiteCode, a.PIN} {
+		if len(secret) >= minRedactedLength {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// RedactReply blanks out the credentials of an rTC reply before it is parsed,
+// so they can't reach the results or the logs through its errors. Only the
+// errors are redacted of more than the credential elements, leaving the ids
+// of the rest of the reply as they are.
+func (a *CommandAuth) RedactReply(reply string) string {
+	if a == nil {
+		return reply
+	}
+	reply = authElements.ReplaceAllString(reply, "<$1>"+redacted+"</$2>")
+	return replyErrors.ReplaceAllStringFunc(reply, a.Redact)
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Batch commands put several operations inside one <src> envelope, e.g.
+// <src><addTail><washPkgNum>1</washPkgNum></addTail><addTail>...</addTail></src>
+
+type AddTail struct {
+	WashPkgNum int    `xml:"washPkgNum"`
+	Lane       string `xml:"lane,omitempty"`
+}
+
+type BatchAddRequest struct {
+	XMLName xml.Name  `xml:"src"`
+	Adds    []AddTail `xml:"addTail"`
+}
+
+type BatchAddResponse struct {
+	XMLName xml.Name `xml:"tc"`
+	WashIDs []int    `xml:"carAdded>id"`
+	Errors  []string `xml:"error"`
+}
+
+type DeleteItem struct {
+	WashID int `xml:"id"`
+}
+
+type BatchDeleteRequest struct {
+	XMLName xml.Name     `xml:"src"`
+	Deletes []DeleteItem `xml:"delete"`
+}
+
+type BatchDeleteResponse struct {
+	XMLName xml.Name `xml:"tc"`
+	WashIDs []int    `xml:"carDeleted>id"`
+	Errors  []string `xml:"error"`
+}
+
+// BuildBatchAddTailXML builds count adds in one message, the i-th to lanes[i]
+// when lanes are given.
+func (r *RTCClient) BuildBatchAddTailXML(washPackage int, count int, lanes []string) (string, error) {
+	req := BatchAddRequest{Adds: make([]AddTail, count)}
+	for i := range req.Adds {
+		req.Adds[i].WashPkgNum = washPackage
+		if i < len(lanes) {
+			req.Adds[i].Lane = lanes[i]
+		}
+	}
+
+	enc, err := xml.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal batch add to XML")
+	}
+	return string(enc), nil
+}
+
+func (r *RTCClient) BuildBatchDeleteXML(washIDs []int) (string, error) {
+	req := BatchDeleteRequest{Deletes: make([]DeleteItem, len(washIDs))}
+	for i, id := range washIDs {
+		req.Deletes[i].WashID = id
+	}
+
+	enc, err := xml.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal batch delete to XML")
+	}
+	return string(enc), nil
+}
+
+// QueueWashBatch queues one wash per request in a single message. The rTC may
+// accept only part of a batch, in which case the accepted washIDs are returned
+// together with an error.
+func (r *RTCClient) QueueWashBatch(washRequests []WashRequest) (*BatchAddResponse, []string, error) {
+	orderIDs := make([]string, len(washRequests))
+	for i, req := range washRequests {
+		orderIDs[i] = req.OrderID
+	}
+	resp, record, err := r.queueWashBatch(washRequests)
+	return resp, r.withOrderIDs(record, orderIDs...), err
+}
+
+func (r *RTCClient) queueWashBatch(washRequests []WashRequest) (*BatchAddResponse, []string, error) {
+	// a batch is queued by one routine, its washes to the same package from the same lanes
+	var first WashRequest
+	if len(washRequests) > 0 {
+		first = washRequests[0]
+	}
+	assigner := first.lanes(r)
+	var lanes []string
+	if assigner != nil {
+		for _, req := range washRequests {
+			lanes = append(lanes, req.LaneID)
+		}
+	}
+	command := assigner.commandName("QUEUE_BATCH", lanes...)
+	batchXML, xmlErr := r.BuildBatchAddTailXML(first.washPackage(), len(washRequests), lanes)
+	if xmlErr != nil {
+		r.Log.Error("error building xml to queue wash batch", "error", xmlErr)
+		return nil, failedRecord(command, xmlErr), xmlErr
+	}
+
+	start := clock.Now()
+	readMessage, record, err := r.SendCommand(command, batchXML, true)
+	if err != nil {
+		return nil, record, err
+	}
+
+	var resp BatchAddResponse
+	err = xml.Unmarshal([]byte(*readMessage), &resp)
+	if err != nil {
+		return nil, markFailed(record, err), err
+	}
+	r.Throughput.Observe("QUEUE_BATCH", len(resp.WashIDs), start)
+
+	if r.WashIDs != nil {
+		for _, washID := range resp.WashIDs {
+			r.WashIDs.Issued(washID)
+		}
+	}
+	if r.Registry != nil {
+		for i, washID := range resp.WashIDs {
+			if i >= len(washRequests) {
+				break
+			}
+			regErr := r.Registry.Add(washID, washRequests[i].OrderID, r.Tunnel, first.washPackage())
+			if regErr != nil {
+				r.Log.Warn("unable to record queued wash in registry", "error", regErr, "washID", washID)
+			}
+		}
+	}
+
+	if len(resp.Errors) > 0 || len(resp.WashIDs) != len(washRequests) {
+		err = &RTCError{Command: "QUEUE_BATCH", Message: fmt.Sprintf("%d of %d washes added, errors: %v", len(resp.WashIDs), len(washRequests), resp.Errors)}
+		return &resp, markFailed(record, err), err
+	}
+	return &resp, record, nil
+}
+
+func (r *RTCClient) DeleteQueuedCarBatch(washIDs []int) (*BatchDeleteResponse, []string, error) {
+	batchXML, xmlErr := r.BuildBatchDeleteXML(washIDs)
+	if xmlErr != nil {
+		r.Log.Error("error building xml to delete wash batch", "error", xmlErr, "washIDs", washIDs)
+		return nil, failedRecord("DELETE_BATCH", xmlErr), xmlErr
+	}
+
+	start := clock.Now()
+	readMessage, record, err := r.SendCommand("DELETE_BATCH", batchXML, true)
+	if err != nil {
+		return nil, record, err
+	}
+
+	var resp BatchDeleteResponse
+	err = xml.Unmarshal([]byte(*readMessage), &resp)
+	if err != nil {
+		return nil, markFailed(record, err), err
+	}
+	r.Throughput.Observe("DELETE_BATCH", len(resp.WashIDs), start)
+
+	if r.WashIDs != nil {
+		for _, washID := range resp.WashIDs {
+			r.WashIDs.Deleted(washID)
+		}
+	}
+	if r.Registry != nil {
+		for _, washID := range resp.WashIDs {
+			regErr := r.Registry.Remove(washID)
+			if regErr != nil {
+				r.Log.Warn("unable to remove deleted wash from registry", "error", regErr, "washID", washID)
+			}
+		}
+	}
+
+	if len(resp.Errors) > 0 || len(resp.WashIDs) != len(washIDs) {
+		err = &RTCError{Command: "DELETE_BATCH", Message: fmt.Sprintf("%d of %d washes deleted, errors: %v", len(resp.WashIDs), len(washIDs), resp.Errors)}
+		return &resp, markFailed(record, err), err
+	}
+	return &resp, record, nil
+}
+
+// ThroughputStats compares operations per second between single and batched
+// commands. Only the operations the rTC accepted are counted, and each
+// command's rate is taken over the time from when it was first sent to when it
+// last completed, so commands only sent for part of a run, such as batched
+// deletes at cleanup, aren't diluted by the rest of it.
+type ThroughputStats struct {
+	mu       sync.Mutex
+	commands map[string]*ThroughputSummary
+}
+
+type ThroughputSummary struct {
+	Messages   int       `json:"messages"`
+	Operations int       `json:"operations"`
+	First      time.Time `json:"first"`
+	Last       time.Time `json:"last"`
+	OpsPerSec  float64   `json:"opsPerSec"`
+}
+
+func CreateThroughputStats() *ThroughputStats {
+	return &ThroughputStats{commands: map[string]*ThroughputSummary{}}
+}
+
+// Observe counts a message sent at start, and the ops of it the rTC accepted.
+func (t *ThroughputStats) Observe(command string, ops int, start time.Time) {
+	now := clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.commands[command]
+	if !ok {
+		s = &ThroughputSummary{First: start}
+		t.commands[command] = s
+	}
+	if start.Before(s.First) {
+		s.First = start
+	}
+	if now.After(s.Last) {
+		s.Last = now
+	}
+	s.Messages++
+	s.Operations += ops
+}
+
+func (t *ThroughputStats) Snapshot() map[string]ThroughputSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[string]ThroughputSummary, len(t.commands))
+	for command, s := range t.commands {
+		summary := *s
+		if window := s.Last.Sub(s.First); window > 0 {
+			summary.OpsPerSec = float64(s.Operations) / window.Seconds()
+		}
+		snapshot[command] = summary
+	}
+	return snapshot
+}
+
+func (r *Routines) GetThroughput(c *gin.Context) {
+	c.JSON(http.StatusOK, r.RTC.Throughput.Snapshot())
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Bisection looks for the first firmware build whose run fails the SLO. Builds
+// are ordered oldest first; the first has to pass and the last to fail. Flash
+// is a shell command that puts a build on the rTC, with {build} replaced by the
+// build and BUILD set in its environment. Every run uses the same Args for
+// Duration once Settle has passed after flashing.
+type Bisection struct {
+	Name     string   `json:"name"`
+	Builds   []string `json:"builds"`
+	Flash    string   `json:"flash"`
+	Settle   string   `json:"settle"`
+	Duration string   `json:"duration"`
+	Args     []string `json:"args"`
+	SLO      string   `json:"slo"`
+
+	settle time.Duration
+	slo    *SLO
+	runs   *Experiment
+}
+
+// BisectionStep is the run of one build.
+type BisectionStep struct {
+	Build   string
+	Dir     string
+	Passed  bool
+	Results []SLOResult
+	Summary *RunSummary
+}
+
+func LoadBisection(path string) (*Bisection, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read bisection %s", path)
+	}
+
+	var bisection Bisection
+	err = json.Unmarshal(b, &bisection)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse bisection %s", path)
+	}
+
+	if bisection.Name == "" {
+		bisection.Name = filepath.Base(path[:len(path)-len(filepath.Ext(path))])
+	}
+	if len(bisection.Builds) < 2 {
+		return nil, errors.Errorf("bisection %s needs at least two builds", bisection.Name)
+	}
+	if bisection.Flash == "" {
+		return nil, errors.Errorf("bisection %s needs a flash command", bisection.Name)
+	}
+	if bisection.Settle != "" {
+		bisection.settle, err = time.ParseDuration(bisection.Settle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid settle %q", bisection.Settle)
+		}
+	}
+	duration, err := time.ParseDuration(bisection.Duration)
+	if err != nil || duration <= 0 {
+		return nil, errors.Errorf("bisection %s needs a positive duration, got %q", bisection.Name, bisection.Duration)
+	}
+	if bisection.SLO == "" {
+		return nil, errors.Errorf("bisection %s needs an slo to tell good builds from bad", bisection.Name)
+	}
+	bisection.slo, err = LoadSLO(bisection.SLO)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{}, bisection.Args...)
+	args = append(args, "--slo="+bisection.SLO)
+	bisection.runs = &Experiment{Name: bisection.Name, Args: args, duration: duration}
+	return &bisection, nil
+}
+
+// flash runs the flash command for build, logging its output into dir.
+func (b *Bisection) flash(build, dir string) error {
+	logFile, err := os.Create(filepath.Join(dir, "flash.log"))
+	if err != nil {
+		return errors.Wrap(err, "unable to create flash log")
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command("sh", "-c", strings.ReplaceAll(b.Flash, "{build}", build))
+	cmd.Env = append(os.Environ(), "BUILD="+build)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "unable to flash build %s, see %s", build, logFile.Name())
+	}
+	return nil
+}
+
+// test flashes a build, runs the tester against it and checks the run against the SLO.
+func (b *Bisection) test(executable, control, dir, build string) (*BisectionStep, error) {
+	step := &BisectionStep{Build: build, Dir: filepath.Join(dir, build)}
+	err := os.MkdirAll(step.Dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create run directory")
+	}
+
+	log.Info().Str("build", build).Msg("flashing build")
+	err = b.flash(build, step.Dir)
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(b.settle)
+
+	log.Info().Str("build", build).Msg("running load test")
+	run := ExperimentRun{Name: build, Params: map[string]string{"firmware": build}, Dir: step.Dir}
+	err = b.runs.execute(executable, control, run)
+	if err != nil {
+		return nil, err
+	}
+
+	step.Summary, err = SummariseRun(step.Dir)
+	if err != nil {
+		return nil, err
+	}
+	step.Results = b.slo.Evaluate(step.Summary)
+	step.Passed = sloPassed(step.Results)
+	log.Info().Str("build", build).Bool("passed", step.Passed).Msg("build tested")
+	return step, nil
+}
+
+// Bisect tests the first and last builds and then halves the range between the
+// last passing and the first failing build until they're neighbours. It returns
+// every step in the order they ran and the index of the first failing build.
+func (b *Bisection) Bisect(executable, control, dir string) ([]*BisectionStep, int, error) {
+	var steps []*BisectionStep
+	test := func(i int) (bool, error) {
+		step, err := b.test(executable, control, dir, b.Builds[i])
+		if err != nil {
+			return false, err
+		}
+		steps = append(steps, step)
+		return step.Passed, nil
+	}
+
+	good, bad := 0, len(b.Builds)-1
+	passed, err := test(good)
+	if err != nil {
+		return steps, -1, err
+	}
+	if !passed {
+		return steps, -1, errors.Errorf("the first build %s already fails the slo", b.Builds[good])
+	}
+	passed, err = test(bad)
+	if err != nil {
+		return steps, -1, err
+	}
+	if passed {
+		return steps, -1, errors.Errorf("the last build %s passes the slo, there's no regression to find", b.Builds[bad])
+	}
+
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		passed, err := test(mid)
+		if err != nil {
+			return steps, -1, err
+		}
+		if passed {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return steps, bad, nil
+}
+
+var bisectionReportTemplate = assetTemplate("bisection.html")
+
+// writeBisectionReport writes report.html for the bisection and report.html for
+// each build's run.
+func writeBisectionReport(b *Bisection, dir string, steps []*BisectionStep, conclusion string) error {
+	for _, step := range steps {
+		report, err := BuildRunReport(step.Dir, nil)
+		if err != nil {
+			log.Warn().Err(err).Str("build", step.Build).Msg("unable to build report of run")
+			continue
+		}
+		err = report.Write(filepath.Join(step.Dir, "report.html"))
+		if err != nil {
+			log.Warn().Err(err).Str("build", step.Build).Msg("unable to write report of run")
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, "report.html"))
+	if err != nil {
+		return errors.Wrap(err, "unable to create bisection report")
+	}
+	defer f.Close()
+
+	return bisectionReportTemplate.Execute(f, map[string]interface{}{
+		"Name":       b.Name,
+		"Conclusion": conclusion,
+		"Steps":      steps,
+	})
+}
+
+// runBisect implements the `bisect` subcommand.
+func runBisect(args []string) {
+	fs := flag.NewFlagSet("bisect", flag.ExitOnError)
+	output := fs.String("output", "bisections", "directory the bisection's runs and report are written to")
+	control := fs.String("control", "http://127.0.0.1:3001", "base url of the tester's http server, used to stop each run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: bisect [flags] <bisection.json>")
+		os.Exit(2)
+	}
+
+	b, err := LoadBisection(fs.Arg(0))
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load bisection")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to find tester executable")
+	}
+
+	dir := filepath.Join(*output, fmt.Sprintf("%s-%s", b.Name, time.Now().Format("2006-01-02-150405")))
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create bisection directory")
+	}
+	log.Info().Str("bisection", b.Name).Int("builds", len(b.Builds)).Str("dir", dir).Msg("starting bisection")
+
+	steps, first, bisectErr := b.Bisect(executable, *control, dir)
+	conclusion := ""
+	if bisectErr != nil {
+		conclusion = "Bisection stopped: " + bisectErr.Error()
+	} else {
+		conclusion = fmt.Sprintf("The first build that fails the SLO is %s; the last one that passes is %s. %d of %d builds were tested.",
+			b.Builds[first], b.Builds[first-1], len(steps), len(b.Builds))
+	}
+
+	err = writeBisectionReport(b, dir, steps, conclusion)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to write bisection report")
+	}
+	fmt.Println(conclusion)
+	fmt.Printf("bisection report written to %s\n", filepath.Join(dir, "report.html"))
+	if bisectErr != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MoveBoundaryCase is one edge of the move matrix. Before computes the
+// toBefore position from the queue length and the test wash's own index.
+type MoveBoundaryCase struct {
+	Name   string
+	Before func(queueLen, self int) int
+}
+
+var moveBoundaryCases = []MoveBoundaryCase{
+	{Name: "front", Before: func(queueLen, self int) int { return 0 }},
+	{Name: "end", Before: func(queueLen, self int) int { return queueLen }},
+	{Name: "past-end", Before: func(queueLen, self int) int { return queueLen + 5 }},
+	{Name: "negative", Before: func(queueLen, self int) int { return -1 }},
+	{Name: "self", Before: func(queueLen, self int) int { return self }},
+}
+
+// MoveBoundarySummary tallies how the rTC responded to every attempt of one case.
+type MoveBoundarySummary struct {
+	Case      string   `json:"case"`
+	Attempts  int      `json:"attempts"`
+	Errors    int      `json:"errors"`
+	Moved     int      `json:"moved"`
+	Unchanged int      `json:"unchanged"`
+	Missing   int      `json:"missing"`
+	Messages  []string `json:"errorMessages,omitempty"`
+}
+
+func (s *MoveBoundarySummary) addMessage(msg string) {
+	for _, m := range s.Messages {
+		if m == msg {
+			return
+		}
+	}
+	if len(s.Messages) < 5 {
+		s.Messages = append(s.Messages, msg)
+	}
+}
+
+// RunMoveBoundaries runs every boundary case iterations times. Each attempt queues
+// its own wash, moves it, checks where it ended up and deletes it again.
+func RunMoveBoundaries(client *RTCClient, writer *ResultWriter, ids IDAllocator, iterations int) []MoveBoundarySummary {
+	summaries := make([]MoveBoundarySummary, 0, len(moveBoundaryCases))
+	for _, bc := range moveBoundaryCases {
+		summary := MoveBoundarySummary{Case: bc.Name}
+		for i := 0; i < iterations; i++ {
+			summary.Attempts++
+			runMoveBoundaryAttempt(bc, &summary, client, writer, ids)
+		}
+		client.Log.Info("finished move boundary case", "summary", summary)
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+func runMoveBoundaryAttempt(bc MoveBoundaryCase, summary *MoveBoundarySummary, client *RTCClient, writer *ResultWriter, ids IDAllocator) {
+	orderID, err := ids.NextOrderID()
+	if err != nil {
+		summary.Errors++
+		summary.addMessage(err.Error())
+		return
+	}
+
+	added, records, err := client.QueueWash(WashRequest{
+		LaneID:      client.Lanes.Next(),
+		OrderID:     orderID,
+		VehicleID:   "NO-VALID-ID",
+		WashPackage: 1,
+	})
+	writer.Write(records)
+	if err != nil {
+		client.Log.Warn("unable to queue wash for move boundary case", "error", err, "case", bc.Name)
+		summary.Errors++
+		summary.addMessage(err.Error())
+		return
+	}
+	defer func() {
+		_, records, err := client.DeleteQueuedCar(added.WashID)
+		writer.Write(records)
+		if err != nil {
+			client.Log.Error("error deleting wash used for move boundary case", "error", err, "washID", added.WashID)
+		}
+	}()
+
+	queue, records, err := client.GetQueue()
+	writer.Write(records)
+	if err != nil {
+		summary.Errors++
+		summary.addMessage(err.Error())
+		return
+	}
+
+	self := indexOfWash(queue, added.WashID)
+	before := bc.Before(len(queue.Queue.QueueItems), self)
+	_, records, err = client.MoveWash(MoveWashReqParams{
+		WashID:   added.WashID,
+		ToBefore: before,
+	})
+	writer.Write(records)
+	if err != nil {
+		client.Log.Info("rTC rejected boundary move", "error", err, "case", bc.Name, "toBefore", before)
+		summary.Errors++
+		summary.addMessage(err.Error())
+		return
+	}
+
+	queue, records, err = client.GetQueue()
+	writer.Write(records)
+	if err != nil {
+		summary.Errors++
+		summary.addMessage(err.Error())
+		return
+	}
+
+	switch after := indexOfWash(queue, added.WashID); {
+	case after < 0:
+		summary.Missing++
+	case after == self:
+		summary.Unchanged++
+	default:
+		summary.Moved++
+	}
+}
+
+func indexOfWash(queue *GetQueueResponse, washID int) int {
+	for i, wash := range queue.Queue.QueueItems {
+		if wash.WashID == washID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Routines) TestMoveBoundaries(c *gin.Context) {
+	iterations, err := strconv.Atoi(c.Param("iterations"))
+	if err != nil || iterations <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "iterations must be a positive integer"})
+		return
+	}
+
+	summaries := RunMoveBoundaries(r.RTC, r.Writer, r.QueueRoutine.IDs, iterations)
+	c.JSON(http.StatusOK, gin.H{"cases": summaries})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// CanarySample is one timed canary command, as sent to the results database.
+type CanarySample struct {
+	Site      string    `json:"site"`
+	Command   string    `json:"command"`
+	Time      time.Time `json:"time"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Canary sends a trickle of commands to an rTC for as long as it runs, so a
+// site's latency can be tracked over weeks rather than the length of a load
+// test. Records go to a load-test.csv per day under Dir, which `report` reads
+// like any run, and each sample is posted to ResultsURL when it is set.
+type Canary struct {
+	Client     *RTCClient
+	Log        Logger
+	IDs        IDAllocator
+	Site       string
+	Dir        string
+	ResultsURL string
+
+	GetEvery   time.Duration
+	QueueEvery time.Duration
+	// Drift, when set, alerts on latencies drifting from the canary's baseline.
+	Drift *DriftMonitor
+
+	day    string
+	file   *os.File
+	writer *ResultWriter
+	client *http.Client
+}
+
+func CreateCanary(client *RTCClient, site, dir, resultsURL string) *Canary {
+	return &Canary{
+		Client:     client,
+		Log:        ZerologLogger{},
+		IDs:        CreatePrefixAllocator("CANARY"),
+		Site:       site,
+		Dir:        dir,
+		ResultsURL: resultsURL,
+		GetEvery:   30 * time.Second,
+		QueueEvery: 5 * time.Minute,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run sends a get every GetEvery and a queue and delete pair every QueueEvery
+// until done is closed.
+func (c *Canary) Run(done chan struct{}) {
+	get := clock.NewTicker(c.GetEvery)
+	defer get.Stop()
+	queue := clock.NewTicker(c.QueueEvery)
+	defer queue.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-get.C():
+			c.time("GET", func() ([]string, error) {
+				_, records, err := c.Client.GetQueue()
+				return records, err
+			})
+		case <-queue.C():
+			c.queueAndDelete()
+		}
+	}
+}
+
+func (c *Canary) queueAndDelete() {
+	orderID, err := c.IDs.NextOrderID()
+	if err != nil {
+		c.Log.Warn("unable to allocate canary order id", "error", err)
+		return
+	}
+
+	var washID int
+	err = c.time("QUEUE", func() ([]string, error) {
+		resp, records, err := c.Client.QueueWash(WashRequest{LaneID: c.Client.Lanes.Next(), OrderID: orderID, VehicleID: "NO-VALID-ID", WashPackage: 1})
+		if err == nil {
+			washID = resp.WashID
+		}
+		return records, err
+	})
+	if err != nil {
+		return
+	}
+	c.time("DELETE", func() ([]string, error) {
+		_, records, err := c.Client.DeleteQueuedCar(washID)
+		return records, err
+	})
+}
+
+// time runs op, records it and sends its sample.
+func (c *Canary) time(command string, op func() ([]string, error)) error {
+	began := clock.Now()
+	records, err := op()
+	sample := CanarySample{
+		Site:      c.Site,
+		Command:   command,
+		Time:      began.UTC(),
+		LatencyMs: float64(clock.Now().Sub(began)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		sample.Error = err.Error()
+		c.Log.Warn("canary command failed", "command", command, "error", err)
+	}
+
+	writer, werr := c.writerFor(began)
+	if werr != nil {
+		c.Log.Error("unable to open canary results", "error", werr, "dir", c.Dir)
+	} else {
+		writer.Write(records)
+	}
+	if c.Drift != nil {
+		c.Drift.Observe(began, records)
+	}
+
+	if perr := c.post(sample); perr != nil {
+		c.Log.Warn("canary sample not sent to results database", "error", perr, "command", command)
+	}
+	return err
+}
+
+// writerFor returns the writer of the day at falls on, starting a new file when
+// the day changed.
+func (c *Canary) writerFor(at time.Time) (*ResultWriter, error) {
+	day := at.Format(time.DateOnly)
+	if day == c.day {
+		return c.writer, nil
+	}
+	c.close()
+
+	dir := filepath.Join(c.Dir, day)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create canary results directory")
+	}
+	// a canary restarted during the day carries on with the day's file
+	writer := CreateResultWriter(nil)
+	f, _, err := writer.Open(filepath.Join(dir, "load-test.csv"), true)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, errors.Wrap(err, "unable to open canary csv file")
+	}
+	c.day, c.file, c.writer = day, f, writer
+	return writer, nil
+}
+
+func (c *Canary) close() {
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.day, c.file, c.writer = "", nil, nil
+}
+
+func (c *Canary) post(sample CanarySample) error {
+	if c.ResultsURL == "" {
+		return nil
+	}
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode canary sample")
+	}
+	resp, err := c.client.Post(c.ResultsURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "unable to post canary sample")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("results database responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runCanary implements the `canary` subcommand.
+func runCanary(args []string) {
+	fs := flag.NewFlagSet("canary", flag.ExitOnError)
+	rtcHost := fs.String("client", "192.168.1.80", "ip of rTC")
+	rtcPort := fs.Int("port", 20250, "port for rTC")
+	getEvery := fs.Duration("get-every", 30*time.Second, "time between canary getQueue commands")
+	queueEvery := fs.Duration("queue-every", 5*time.Minute, "time between canary add and delete pairs")
+	resultsDir := fs.String("results-dir", "canary", "directory a load-test.csv per day is written under")
+	resultsURL := fs.String("results-url", "", "url each canary sample is posted to as JSON, e.g. the results database's ingest endpoint")
+	site := fs.String("site", "", "site name sent with each sample, defaults to the hostname")
+	idPrefix := fs.String("id-prefix", "CANARY", "prefix for order ids of canary washes")
+	drift := fs.Bool("drift", true, "alert when latencies drift from the baseline of the days before")
+	driftDays := fs.Int("drift-days", 7, "days of canary results the drift baseline is taken from")
+	driftWindow := fs.Duration("drift-window", time.Hour, "window of recent latencies compared with the baseline")
+	driftBand := fs.Float64("drift-band", 0.5, "share of the baseline a percentile may move by before it drifts")
+	driftMinSamples := fs.Int("drift-min-samples", 20, "samples both the window and the baseline need before a command is checked")
+	alertURL := fs.String("alert-url", "", "webhook url drift alerts and recoveries are posted to as JSON")
+	listen := fs.String("listen", "", "address to serve drift metrics on at /metrics, e.g. :3002, empty to not serve them")
+	auth := addAuthFlags(fs, authUse)
+	fs.Parse(args)
+
+	if *getEvery <= 0 || *queueEvery <= 0 {
+		log.Fatal().Msg("--get-every and --queue-every must be positive")
+	}
+	if *site == "" {
+		*site, _ = os.Hostname()
+	}
+
+	client := CreateRTCClient(*rtcHost, *rtcPort)
+	client.Log = NopLogger{}
+	client.Auth = auth()
+	canary := CreateCanary(client, *site, *resultsDir, *resultsURL)
+	canary.IDs = CreatePrefixAllocator(*idPrefix)
+	canary.GetEvery = *getEvery
+	canary.QueueEvery = *queueEvery
+	if *drift {
+		canary.Drift = CreateDriftMonitor(*site, *resultsDir)
+		canary.Drift.Days = *driftDays
+		canary.Drift.Window = *driftWindow
+		canary.Drift.Band = *driftBand
+		canary.Drift.MinSamples = *driftMinSamples
+		canary.Drift.AlertURL = *alertURL
+
+		if *listen != "" {
+			r := gin.New()
+			r.GET("/metrics", canary.Drift.Metrics)
+			go func() {
+				log.Fatal().Err(r.Run(*listen)).Msg("canary metrics server stopped")
+			}()
+		}
+	}
+
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(done)
+	}()
+
+	log.Info().Str("site", *site).Dur("getEvery", *getEvery).Dur("queueEvery", *queueEvery).Msg("canary started")
+	canary.Run(done)
+	log.Info().Msg("canary stopped")
+}
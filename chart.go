@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ChartPoint struct {
+	At    time.Time
+	Value float64
+}
+
+type ChartSeries struct {
+	Name   string
+	Points []ChartPoint
+}
+
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+const (
+	chartWidth  = 900
+	chartHeight = 300
+	chartMargin = 50
+	chartLegend = 130
+)
+
+// svgLineChart draws series over time as an inline SVG so reports stay a single
+// self contained html file. Times are labelled in loc. Annotations are shaded
+// behind the series.
+func svgLineChart(title, unit string, loc *time.Location, series []ChartSeries, annotations ...Annotation) template.HTML {
+	var start, end time.Time
+	maxValue := 0.0
+	for _, s := range series {
+		for _, p := range s.Points {
+			if start.IsZero() || p.At.Before(start) {
+				start = p.At
+			}
+			if p.At.After(end) {
+				end = p.At
+			}
+			maxValue = math.Max(maxValue, p.Value)
+		}
+	}
+	if maxValue == 0 {
+		maxValue = 1
+	}
+	span := end.Sub(start).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+
+	plotWidth := float64(chartWidth - chartMargin - chartLegend)
+	plotHeight := float64(chartHeight - 2*chartMargin)
+	x := func(t time.Time) float64 {
+		return chartMargin + t.Sub(start).Seconds()/span*plotWidth
+	}
+	y := func(v float64) float64 {
+		return chartMargin + plotHeight - v/maxValue*plotHeight
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="20" font-size="14">%s</text>`, chartMargin, template.HTMLEscapeString(title))
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, chartMargin, chartHeight-chartMargin, chartWidth-chartLegend, chartHeight-chartMargin)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, chartMargin, chartMargin, chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%.4g %s</text>`, chartMargin-4, chartMargin+4, maxValue, template.HTMLEscapeString(unit))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartMargin-4, chartHeight-chartMargin)
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, chartMargin, chartHeight-chartMargin+16, start.In(loc).Format("15:04:05 MST"))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartWidth-chartLegend, chartHeight-chartMargin+16, end.In(loc).Format("15:04:05 MST"))
+
+	for _, a := range annotations {
+		if a.End.Before(start) || a.Start.After(end) {
+			continue
+		}
+		from, to := a.Start, a.End
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="#f2c14e" fill-opacity="0.3"><title>%s</title></rect>`,
+			x(from), chartMargin, math.Max(x(to)-x(from), 1), chartHeight-2*chartMargin, template.HTMLEscapeString(a.Label))
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" fill="#8a6d00">%s</text>`, x(from)+2, chartMargin-4, template.HTMLEscapeString(a.Label))
+	}
+
+	for i, s := range series {
+		color := chartColors[i%len(chartColors)]
+		points := make([]string, 0, len(s.Points))
+		for _, p := range s.Points {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(p.At), y(p.Value)))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`, color, strings.Join(points, " "))
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, chartWidth-chartLegend+10, chartMargin+i*16, color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, chartWidth-chartLegend+24, chartMargin+i*16+9, template.HTMLEscapeString(s.Name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// seriesByName turns name → points into series sorted by name.
+func seriesByName(points map[string][]ChartPoint) []ChartSeries {
+	names := make([]string, 0, len(points))
+	for name := range points {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	series := make([]ChartSeries, 0, len(names))
+	for _, name := range names {
+		series = append(series, ChartSeries{Name: name, Points: points[name]})
+	}
+	return series
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// runCleanup implements the `cleanup` subcommand: it deletes every wash a previous
+// run of this instance left in its registry, e.g. after the tester crashed. A
+// registered washID is only deleted while it is still queued with the package
+// it was registered with: the tunnel may have washed it since, and the rTC may
+// have reused its washID for a customer's car. Washes no longer queued are
+// dropped from the registry.
+func runCleanup(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	rtcHost := fs.String("client", "192.168.1.80", "ip of rTC")
+	rtcPort := fs.Int("port", 20250, "port for rTC")
+	registryPath := fs.String("registry", "wash-registry.db", "path of the wash registry written by previous runs")
+	instance := fs.String("instance", defaultInstanceName(), "instance name the washes were registered under")
+	auth := addAuthFlags(fs, authUse)
+	fs.Parse(args)
+
+	registry, err := OpenWashRegistry(*registryPath, *instance)
+	if err != nil {
+		log.Fatal().Err(err).Str("registry", *registryPath).Msg("unable to open wash registry")
+	}
+
+	washes, err := registry.Outstanding()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to list outstanding washes")
+	}
+	if len(washes) == 0 {
+		fmt.Printf("no outstanding washes registered for instance %s\n", *instance)
+		return
+	}
+
+	client := CreateRTCClient(*rtcHost, *rtcPort)
+	client.Registry = registry
+	client.Auth = auth()
+
+	// the queue of every tunnel the washes were queued to, by washID
+	queues := map[string]map[int]WashQueueItem{}
+	for _, wash := range washes {
+		if _, ok := queues[wash.Tunnel]; ok {
+			continue
+		}
+		queue, _, err := client.OnTunnel(wash.Tunnel).GetQueue()
+		if err != nil {
+			log.Fatal().Err(err).Str("tunnel", wash.Tunnel).Msg("unable to get queue to check registered washes against")
+		}
+		queued := map[int]WashQueueItem{}
+		for _, item := range queue.Queue.QueueItems {
+			queued[item.WashID] = item
+		}
+		queues[wash.Tunnel] = queued
+	}
+
+	deleted, gone, failed := 0, 0, 0
+	for _, wash := range washes {
+		item, ok := queues[wash.Tunnel][wash.WashID]
+		if !ok || item.WashPkgNum != wash.WashPackage {
+			if ok {
+				log.Warn().Int("washID", wash.WashID).Str("orderId", wash.OrderID).Int("registeredPackage", wash.WashPackage).Int("queuedPackage", item.WashPkgNum).Msg("registered washID was reused by another car, not deleting it")
+			}
+			err := registry.Remove(wash.WashID)
+			if err != nil {
+				log.Warn().Err(err).Int("washID", wash.WashID).Msg("unable to drop wash no longer queued from registry")
+			}
+			gone++
+			continue
+		}
+
+		_, _, err := client.OnTunnel(wash.Tunnel).DeleteQueuedCar(wash.WashID)
+		if err != nil {
+			log.Error().Err(err).Int("washID", wash.WashID).Str("orderId", wash.OrderID).Str("tunnel", wash.Tunnel).Msg("unable to delete registered wash")
+			failed++
+			continue
+		}
+		deleted++
+	}
+
+	fmt.Printf("deleted %d of %d washes registered for instance %s, %d no longer queued\n", deleted, len(washes), *instance, gone)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func defaultInstanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "load-tester"
+	}
+	return host
+}
+
+// CleanupPlan is what /cleanup/preview showed; /cleanup/confirm only deletes
+// these washes, and only when given the plan's token.
+type CleanupPlan struct {
+	Token   string          `json:"token"`
+	Washes  []WashQueueItem `json:"washes"`
+	Expires time.Time       `json:"expires"`
+}
+
+func (r *Routines) CleanupPreview(c *gin.Context) {
+	washes, err := r.cleanupCandidates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch rtc queue"})
+		return
+	}
+
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create cleanup token"})
+		return
+	}
+
+	plan := &CleanupPlan{
+		Token:   hex.EncodeToString(b),
+		Washes:  washes,
+		Expires: time.Now().Add(5 * time.Minute),
+	}
+
+	r.cleanupMu.Lock()
+	r.pendingCleanup = plan
+	r.cleanupMu.Unlock()
+
+	c.JSON(http.StatusOK, plan)
+}
+
+func (r *Routines) CleanupConfirm(c *gin.Context) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	err := c.ShouldBindJSON(&body)
+	if err != nil || body.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "confirm requires the token returned by /cleanup/preview"})
+		return
+	}
+
+	r.cleanupMu.Lock()
+	plan := r.pendingCleanup
+	if plan != nil && plan.Token == body.Token {
+		r.pendingCleanup = nil
+	}
+	r.cleanupMu.Unlock()
+
+	if plan == nil || plan.Token != body.Token {
+		c.JSON(http.StatusConflict, gin.H{"error": "unknown cleanup token, request a new preview"})
+		return
+	}
+	if time.Now().After(plan.Expires) {
+		c.JSON(http.StatusConflict, gin.H{"error": "cleanup preview expired, request a new preview"})
+		return
+	}
+
+	deleted := r.deleteWashes(plan.Washes)
+	r.Log.Info("cleanup confirmed", "deleted", deleted, "previewed", len(plan.Washes))
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted, "previewed": len(plan.Washes)})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the routines' schedules and the timestamps
+// in the results. The real clock is used unless SetClock installs another one,
+// e.g. a FakeClock so scheduling can run deterministically or faster than real
+// time. Network deadlines always use real time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Ticker is the part of time.Ticker the routines use.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+var clock Clock = realClock{}
+
+// SetClock replaces the clock; it has to be called before any routine is created.
+func SetClock(c Clock) {
+	clock = c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock only moves when Advance is called. Tickers and timers due within the
+// advanced span fire in order, each seeing Now() at its due time; like
+// time.Ticker, a tick is dropped when the previous one hasn't been received.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+	fired   []*fakeTimer
+}
+
+type fakeTicker struct {
+	clock   *FakeClock
+	ch      chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+type fakeTimer struct {
+	ch  chan time.Time
+	due time.Time
+}
+
+func CreateFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{clock: c, ch: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{ch: make(chan time.Time, 1), due: c.now.Add(d)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t.ch
+	}
+	c.timers = append(c.timers, t)
+	return t.ch
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// NextEvent is when the next ticker or timer is due, false when nothing is scheduled.
+func (c *FakeClock) NextEvent() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nextEvent()
+}
+
+func (c *FakeClock) nextEvent() (time.Time, bool) {
+	var next time.Time
+	for _, t := range c.tickers {
+		if !t.stopped && (next.IsZero() || t.next.Before(next)) {
+			next = t.next
+		}
+	}
+	for _, t := range c.timers {
+		if next.IsZero() || t.due.Before(next) {
+			next = t.due
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Pending is the number of ticks and timers fired but not yet received.
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := 0
+	for _, t := range c.tickers {
+		pending += len(t.ch)
+	}
+	waiting := c.fired[:0]
+	for _, t := range c.fired {
+		if len(t.ch) > 0 {
+			pending++
+			waiting = append(waiting, t)
+		}
+	}
+	c.fired = waiting
+	return pending
+}
+
+// Advance moves the clock forward by d, firing everything due on the way.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		next, ok := c.nextEvent()
+		if !ok || next.After(target) {
+			break
+		}
+		c.now = next
+		c.fire(next)
+	}
+	c.now = target
+}
+
+func (c *FakeClock) fire(at time.Time) {
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(at) {
+			continue
+		}
+		select {
+		case t.ch <- at:
+		default:
+		}
+		t.next = t.next.Add(t.period)
+	}
+
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].due.Before(c.timers[j].due) })
+	remaining := c.timers[:0]
+	for _, t := range c.timers {
+		if t.due.After(at) {
+			remaining = append(remaining, t)
+			continue
+		}
+		t.ch <- at
+		c.fired = append(c.fired, t)
+	}
+	c.timers = remaining
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.period = d
+	t.next = t.clock.now.Add(d)
+	if t.stopped {
+		t.stopped = false
+		t.clock.tickers = append(t.clock.tickers, t)
+	}
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.stopped = true
+	remaining := t.clock.tickers[:0]
+	for _, other := range t.clock.tickers {
+		if other != t {
+			remaining = append(remaining, other)
+		}
+	}
+	t.clock.tickers = remaining
+}
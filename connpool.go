@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConnPool keeps up to Size long-lived connections to the rTC open and sends
+// commands over them one at a time, instead of dialling a connection per
+// command, so a run loads the queue engine rather than the rTC's connection
+// setup. The rTC answers commands in order without tagging its replies, so a
+// connection carries one command at a time; commands wait for a free one when
+// all of them are busy. A connection that fails, or that a command left in an
+// unknown state, is closed and a new one dialled when next needed.
+type ConnPool struct {
+	Size int
+	// Wait bounds how long a command waits for a free connection.
+	Wait time.Duration
+
+	dial  func(ctx context.Context) (net.Conn, error)
+	idle  chan *pooledConn
+	slots chan struct{}
+
+	dials   uint64
+	reuses  uint64
+	discard uint64
+}
+
+// pooledConn is a connection of a pool, with the reader its replies are read
+// through kept across commands so nothing buffered is lost between them.
+type pooledConn struct {
+	net.Conn
+	reader *bufio.Reader
+	broken bool
+}
+
+func CreateConnPool(size int, dial func(ctx context.Context) (net.Conn, error)) *ConnPool {
+	return &ConnPool{
+		Size:  size,
+		Wait:  3 * time.Second,
+		dial:  dial,
+		idle:  make(chan *pooledConn, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Acquire takes a free connection, dialling one when none is open yet.
+func (p *ConnPool) Acquire(ctx context.Context) (*pooledConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "cancelled waiting for a pooled rTC connection")
+	case <-time.After(p.Wait):
+		return nil, errors.Errorf("no pooled rTC connection free after %s", p.Wait)
+	}
+
+	select {
+	case conn := <-p.idle:
+		atomic.AddUint64(&p.reuses, 1)
+		return conn, nil
+	default:
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	atomic.AddUint64(&p.dials, 1)
+	return &pooledConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// tryAcquire is Acquire without waiting for a free connection; it returns nil
+// when all of them are taken.
+func (p *ConnPool) tryAcquire(ctx context.Context) (*pooledConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return nil, nil
+	}
+
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	atomic.AddUint64(&p.dials, 1)
+	return &pooledConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// PrewarmResult is what a Prewarm found.
+type PrewarmResult struct {
+	// Open are the connections that answered the probe, Replaced the ones
+	// that didn't and were dialled again. Busy were sending commands.
+	Open     int
+	Busy     int
+	Dialled  uint64
+	Replaced int
+	Took     time.Duration
+	// Err is the last dial or probe that failed.
+	Err error
+}
+
+// Prewarm opens every connection of the pool that isn't already, and probes
+// every free one so a connection the rTC dropped while idle is replaced now
+// rather than by the first command that gets it. Connections in use by a
+// command are left alone.
+func (p *ConnPool) Prewarm(ctx context.Context, probe func(conn *pooledConn) error) PrewarmResult {
+	start := time.Now()
+	dials := atomic.LoadUint64(&p.dials)
+	var result PrewarmResult
+	// a second pass replaces the connections that failed the first
+	for pass := 0; pass < 2; pass++ {
+		var conns []*pooledConn
+		for {
+			conn, err := p.tryAcquire(ctx)
+			if err != nil {
+				result.Err = err
+			}
+			if conn == nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+
+		failed := 0
+		result.Open, result.Busy = 0, p.Size-len(conns)
+		for _, conn := range conns {
+			err := probe(conn)
+			if err != nil {
+				conn.broken = true
+				result.Err = err
+				failed++
+				continue
+			}
+			result.Open++
+		}
+		for _, conn := range conns {
+			p.Release(conn)
+		}
+		result.Replaced += failed
+		if failed == 0 || result.Open == 0 {
+			break
+		}
+	}
+	result.Dialled = atomic.LoadUint64(&p.dials) - dials
+	result.Took = time.Since(start)
+	return result
+}
+
+// Release hands a connection back for the next command, or closes it when it broke.
+func (p *ConnPool) Release(conn *pooledConn) {
+	defer func() { <-p.slots }()
+	if conn.broken {
+		atomic.AddUint64(&p.discard, 1)
+		conn.Close()
+		return
+	}
+	p.idle <- conn
+}
+
+// Close closes the idle connections.
+func (p *ConnPool) Close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// ConnPoolStats counts how often the pool had to dial and how often a command
+// reused an open connection.
+type ConnPoolStats struct {
+	Size      int    `json:"size"`
+	InUse     int    `json:"inUse"`
+	Dials     uint64 `json:"dials"`
+	Reuses    uint64 `json:"reuses"`
+	Discarded uint64 `json:"discarded"`
+}
+
+func (p *ConnPool) Stats() ConnPoolStats {
+	return ConnPoolStats{
+		Size:      p.Size,
+		InUse:     len(p.slots),
+		Dials:     atomic.LoadUint64(&p.dials),
+		Reuses:    atomic.LoadUint64(&p.reuses),
+		Discarded: atomic.LoadUint64(&p.discard),
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// CommandDiff compares one command's latencies between a baseline and a candidate
+// run, e.g. two firmware builds. A change only counts as real when the
+// Mann-Whitney p-value is below alpha; the confidence interval says how big it is.
+type CommandDiff struct {
+	Command       string
+	Baseline      *CommandSummary
+	Candidate     *CommandSummary
+	P95Delta      float64
+	P95Low        float64
+	P95High       float64
+	PValue        float64
+	Significant   bool
+	BaselineOnly  bool
+	CandidateOnly bool
+}
+
+func (d CommandDiff) Verdict() string {
+	switch {
+	case d.BaselineOnly:
+		return "missing from candidate"
+	case d.CandidateOnly:
+		return "missing from baseline"
+	case !d.Significant:
+		return "no significant change"
+	case d.P95Delta > 0:
+		return "slower"
+	default:
+		return "faster"
+	}
+}
+
+// DiffRuns compares every command found in either run.
+func DiffRuns(baseline, candidate *RunSummary, alpha float64, iterations int, rng *rand.Rand) []CommandDiff {
+	names := baseline.CommandNames()
+	for _, name := range candidate.CommandNames() {
+		if baseline.Commands[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []CommandDiff
+	for _, name := range names {
+		d := CommandDiff{
+			Command:   name,
+			Baseline:  baseline.Commands[name],
+			Candidate: candidate.Commands[name],
+			PValue:    1,
+		}
+		switch {
+		case d.Candidate == nil:
+			d.BaselineOnly = true
+		case d.Baseline == nil:
+			d.CandidateOnly = true
+		default:
+			d.P95Delta = d.Candidate.Percentile(95) - d.Baseline.Percentile(95)
+			d.P95Low, d.P95High = bootstrapPercentileDiff(d.Baseline.Latencies, d.Candidate.Latencies, 95, iterations, rng)
+			_, d.PValue = mannWhitneyU(d.Baseline.Latencies, d.Candidate.Latencies)
+			d.Significant = d.PValue < alpha
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// runDiff implements the `diff` subcommand comparing two run directories.
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	alpha := fs.Float64("alpha", 0.05, "significance level a latency change has to reach to be reported as real")
+	iterations := fs.Int("bootstrap", 1000, "bootstrap resamples used for the p95 confidence interval")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "seed of the bootstrap resampling")
+	htmlPath := fs.String("html", "", "also write the comparison as an html report to this file")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: diff [flags] <baseline run dir> <candidate run dir>")
+		os.Exit(2)
+	}
+
+	baseline, err := SummariseRun(fs.Arg(0))
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read baseline run")
+	}
+	candidate, err := SummariseRun(fs.Arg(1))
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read candidate run")
+	}
+
+	diffs := DiffRuns(baseline, candidate, *alpha, *iterations, rand.New(rand.NewSource(*seed)))
+	writeDiffText(os.Stdout, diffs)
+
+	if *htmlPath != "" {
+		err = writeDiffHTML(*htmlPath, baseline, candidate, *alpha, diffs)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to write diff report")
+		}
+	}
+}
+
+func writeDiffText(out io.Writer, diffs []CommandDiff) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tN\tP50 MS\tP95 MS\tP95 DELTA (95% CI)\tP99 MS\tP\tVERDICT")
+	for _, d := range diffs {
+		if d.BaselineOnly || d.CandidateOnly {
+			fmt.Fprintf(w, "%s\t\t\t\t\t\t\t%s\n", d.Command, d.Verdict())
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d → %d\t%.1f → %.1f\t%.1f → %.1f\t%+.1f (%+.1f, %+.1f)\t%.1f → %.1f\t%.3g\t%s\n",
+			d.Command,
+			len(d.Baseline.Latencies), len(d.Candidate.Latencies),
+			d.Baseline.Percentile(50), d.Candidate.Percentile(50),
+			d.Baseline.Percentile(95), d.Candidate.Percentile(95),
+			d.P95Delta, d.P95Low, d.P95High,
+			d.Baseline.Percentile(99), d.Candidate.Percentile(99),
+			d.PValue, d.Verdict())
+	}
+	w.Flush()
+}
+
+var diffReportTemplate = assetTemplate("diff.html")
+
+func writeDiffHTML(path string, baseline, candidate *RunSummary, alpha float64, diffs []CommandDiff) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to create diff report")
+	}
+	defer f.Close()
+	return renderDiffHTML(f, baseline, candidate, alpha, diffs)
+}
+
+func renderDiffHTML(w io.Writer, baseline, candidate *RunSummary, alpha float64, diffs []CommandDiff) error {
+	return diffReportTemplate.Execute(w, map[string]interface{}{
+		"Baseline":  baseline.Dir,
+		"Candidate": candidate.Dir,
+		"Alpha":     alpha,
+		"Diffs":     diffs,
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var disconnectHeader = []string{"Time", "rTC Command", "Kind", "Persistent", "After Ms", "Bytes Read"}
+
+// Kinds of disconnects by the rTC: it either closed the connection (FIN) or
+// reset it (RST) before its reply was read.
+const (
+	DisconnectClosed = "closed"
+	DisconnectReset  = "reset"
+)
+
+// DisconnectError is returned when the rTC ended the connection before the
+// reply to a command was read, rather than the command failing any other way.
+type DisconnectError struct {
+	Kind string
+	// Persistent is set for a pooled connection the rTC ended between or
+	// during commands.
+	Persistent bool
+	// Partial is the part of a reply read before the connection ended.
+	Partial int
+	Err     error
+}
+
+func (e *DisconnectError) Error() string {
+	what := "connection"
+	if e.Persistent {
+		what = "persistent connection"
+	}
+	verb := "closed"
+	if e.Kind == DisconnectReset {
+		verb = "reset"
+	}
+	if e.Partial > 0 {
+		return fmt.Sprintf("rTC %s the %s after %d bytes of its reply", verb, what, e.Partial)
+	}
+	return fmt.Sprintf("rTC %s the %s before replying", verb, what)
+}
+
+func (e *DisconnectError) Unwrap() error {
+	return e.Err
+}
+
+// classifyDisconnect turns a read error into a DisconnectError when it was
+// the rTC ending the connection, and returns nil otherwise.
+func classifyDisconnect(err error, partial int, persistent bool) *DisconnectError {
+	switch {
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF):
+		return &DisconnectError{Kind: DisconnectClosed, Persistent: persistent, Partial: partial, Err: err}
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return &DisconnectError{Kind: DisconnectReset, Persistent: persistent, Partial: partial, Err: err}
+	}
+	return nil
+}
+
+// DisconnectTracker records every disconnect by the rTC to disconnects.csv and
+// counts them, since a controller dropping connections under load is a failure
+// of its own and not a slow reply. When Capture is set it is run with sh after
+// a disconnect, e.g. to grab the rTC's logs or a packet capture, at most once
+// per Cooldown.
+type DisconnectTracker struct {
+	Writer   *ResultWriter
+	Log      Logger
+	Capture  string
+	Cooldown time.Duration
+	// Dir is where the output of captures is kept.
+	Dir string
+
+	mu          sync.Mutex
+	counts      map[string]uint64
+	recent      []time.Time
+	lastCapture time.Time
+	captures    int
+}
+
+func CreateDisconnectTracker(writer *ResultWriter) *DisconnectTracker {
+	return &DisconnectTracker{
+		Writer:   writer,
+		Log:      ZerologLogger{},
+		Cooldown: time.Minute,
+		counts:   map[string]uint64{DisconnectClosed: 0, DisconnectReset: 0},
+	}
+}
+
+// Observe records a disconnect of a command, after being the time between
+// sending the command and the connection ending.
+func (t *DisconnectTracker) Observe(command string, d *DisconnectError, after time.Duration) {
+	if t == nil {
+		return
+	}
+	now := clock.Now()
+	t.mu.Lock()
+	t.counts[d.Kind]++
+	t.recent = append(t.prune(now), now)
+	capture := t.Capture != "" && (t.lastCapture.IsZero() || now.Sub(t.lastCapture) >= t.Cooldown)
+	if capture {
+		t.lastCapture = now
+		t.captures++
+	}
+	n := t.captures
+	t.mu.Unlock()
+
+	t.Log.Warn("rTC ended the connection before replying", "command", command, "kind", d.Kind, "persistent", d.Persistent, "afterMs", after.Milliseconds())
+	err := t.Writer.Write([]string{recordTime(now), command, d.Kind, strconv.FormatBool(d.Persistent),
+		strconv.FormatInt(after.Milliseconds(), 10), strconv.Itoa(d.Partial)})
+	if err != nil {
+		t.Log.Warn("error writing disconnect record to CSV", "error", err)
+	}
+	if capture {
+		go t.capture(n, command, d)
+	}
+}
+
+// prune drops the disconnects older than a minute; t.mu is held.
+func (t *DisconnectTracker) prune(now time.Time) []time.Time {
+	i := 0
+	for i < len(t.recent) && now.Sub(t.recent[i]) > time.Minute {
+		i++
+	}
+	return append(t.recent[:0], t.recent[i:]...)
+}
+
+func (t *DisconnectTracker) capture(n int, command string, d *DisconnectError) {
+	logFile, err := os.Create(filepath.Join(t.Dir, fmt.Sprintf("disconnect-capture-%d.log", n)))
+	if err != nil {
+		t.Log.Warn("unable to create disconnect capture log", "error", err)
+		return
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command("sh", "-c", t.Capture)
+	cmd.Env = append(os.Environ(), "RTC_COMMAND="+command, "RTC_DISCONNECT="+d.Kind, "RUN_DIR="+t.Dir)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Run()
+	if err != nil {
+		t.Log.Warn("disconnect capture failed", "error", err, "log", logFile.Name())
+		return
+	}
+	t.Log.Info("disconnect captured", "log", logFile.Name())
+}
+
+// DisconnectCounts are the disconnects of the run by kind, and all of them in
+// the last minute.
+type DisconnectCounts struct {
+	Closed     uint64 `json:"closed"`
+	Reset      uint64 `json:"reset"`
+	LastMinute int    `json:"lastMinute"`
+	Captures   int    `json:"captures"`
+}
+
+func (t *DisconnectTracker) Counts() DisconnectCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recent = t.prune(clock.Now())
+	return DisconnectCounts{
+		Closed:     t.counts[DisconnectClosed],
+		Reset:      t.counts[DisconnectReset],
+		LastMinute: len(t.recent),
+		Captures:   t.captures,
+	}
+}
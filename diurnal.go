@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DiurnalProfile gives a routine the shape of a site's day: quiet at night, a
+// ramp from opening to the lunchtime peak and a decay into the evening. The
+// rate averages out over the day to the routine's base rate, so a queue
+// routine with a base of 24h/cars queues about that many cars a day.
+type DiurnalProfile struct {
+	// Start is the time of day the run starts at.
+	Start time.Duration
+	// Open, Peak and Close are times of day.
+	Open  time.Duration
+	Peak  time.Duration
+	Close time.Duration
+	// Night is the rate outside opening hours and Shoulder the rate at opening
+	// and closing, both as fractions of the peak rate.
+	Night    float64
+	Shoulder float64
+	// MaxInterval caps the time between ticks so a routine sleeping through the
+	// night still notices the morning ramp.
+	MaxInterval time.Duration
+
+	mean float64
+}
+
+func CreateDiurnalProfile(start, open, peak, closing time.Duration) (*DiurnalProfile, error) {
+	if !(0 <= open && open < peak && peak < closing && closing <= 24*time.Hour) {
+		return nil, errors.Errorf("the day needs open < peak < close, got %s, %s and %s", open, peak, closing)
+	}
+	p := &DiurnalProfile{
+		Start:       start % (24 * time.Hour),
+		Open:        open,
+		Peak:        peak,
+		Close:       closing,
+		Night:       0.02,
+		Shoulder:    0.25,
+		MaxInterval: 10 * time.Minute,
+	}
+
+	// average the weight over the day a minute at a time
+	total := 0.0
+	for m := 0; m < 24*60; m++ {
+		total += p.Weight(time.Duration(m) * time.Minute)
+	}
+	p.mean = total / (24 * 60)
+	return p, nil
+}
+
+// Weight is the rate at a time of day as a fraction of the peak rate.
+func (p *DiurnalProfile) Weight(timeOfDay time.Duration) float64 {
+	if timeOfDay < p.Open || timeOfDay >= p.Close {
+		return p.Night
+	}
+	if timeOfDay < p.Peak {
+		f := float64(timeOfDay-p.Open) / float64(p.Peak-p.Open)
+		return p.Shoulder + (1-p.Shoulder)*f*f*(3-2*f)
+	}
+	f := float64(timeOfDay-p.Peak) / float64(p.Close-p.Peak)
+	return p.Shoulder + (1-p.Shoulder)*math.Exp(-4*f)
+}
+
+func (p *DiurnalProfile) Interval(elapsed, base time.Duration) time.Duration {
+	timeOfDay := (p.Start + elapsed) % (24 * time.Hour)
+	interval := time.Duration(float64(base) * p.mean / p.Weight(timeOfDay))
+	if p.MaxInterval > base && interval > p.MaxInterval {
+		return p.MaxInterval
+	}
+	return interval
+}
+
+// parseTimeOfDay parses a 24 hour clock time such as 07:00 or 12:30.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, errors.Errorf("time of day must look like 07:30, got %q", s)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, errors.Errorf("invalid hour in time of day %q", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m > 0) {
+		return 0, errors.Errorf("invalid minutes in time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func diurnalProfileFromFlags(start, open, peak, closing string) (*DiurnalProfile, error) {
+	times := map[string]time.Duration{}
+	for name, s := range map[string]string{"open": open, "peak": peak, "close": closing} {
+		t, err := parseTimeOfDay(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid diurnal %s", name)
+		}
+		times[name] = t
+	}
+
+	now := clock.Now()
+	startAt := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	if start != "" {
+		t, err := parseTimeOfDay(start)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid diurnal start")
+		}
+		startAt = t
+	}
+	return CreateDiurnalProfile(startAt, times["open"], times["peak"], times["close"])
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// driftQuantiles are the latency percentiles compared against the baseline.
+var driftQuantiles = []float64{50, 95}
+
+// DriftAlert is sent when a command's latency leaves its band around the
+// baseline, and again with Drifting false once it is back inside.
+type DriftAlert struct {
+	Site       string    `json:"site"`
+	Command    string    `json:"command"`
+	Quantile   string    `json:"quantile"`
+	BaselineMs float64   `json:"baselineMs"`
+	CurrentMs  float64   `json:"currentMs"`
+	Band       float64   `json:"band"`
+	Drifting   bool      `json:"drifting"`
+	Time       time.Time `json:"time"`
+}
+
+type driftSample struct {
+	at time.Time
+	ms float64
+}
+
+// DriftMonitor compares the canary's recent latencies with a baseline of the
+// Days before today, read from the canary's daily results under Dir. A
+// percentile drifts when it moves more than Band, as a share of the baseline,
+// away from it. Drifts and recoveries are logged, posted to AlertURL when it is
+// set and served as metrics.
+type DriftMonitor struct {
+	Site       string
+	Dir        string
+	Days       int
+	Window     time.Duration
+	Band       float64
+	MinSamples int
+	AlertURL   string
+	Log        Logger
+
+	mu          sync.Mutex
+	baselineDay string
+	baseline    map[string][]float64
+	recent      map[string][]driftSample
+	current     map[string]map[string]float64
+	drifting    map[string]bool
+	client      *http.Client
+}
+
+func CreateDriftMonitor(site, dir string) *DriftMonitor {
+	return &DriftMonitor{
+		Site:       site,
+		Dir:        dir,
+		Days:       7,
+		Window:     time.Hour,
+		Band:       0.5,
+		MinSamples: 20,
+		Log:        ZerologLogger{},
+		recent:     map[string][]driftSample{},
+		current:    map[string]map[string]float64{},
+		drifting:   map[string]bool{},
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Observe adds a canary record and checks its command against the baseline.
+func (d *DriftMonitor) Observe(at time.Time, record []string) {
+	if len(record) == 0 {
+		return
+	}
+	ms, ok := recordLatency(record)
+	if !ok {
+		return
+	}
+	command := commandName(record[0])
+
+	d.mu.Lock()
+	d.loadBaseline(at)
+	samples := append(d.recent[command], driftSample{at: at, ms: ms})
+	cutoff := at.Add(-d.Window)
+	for len(samples) > 0 && samples[0].at.Before(cutoff) {
+		samples = samples[1:]
+	}
+	d.recent[command] = samples
+	alerts := d.check(at, command)
+	d.mu.Unlock()
+
+	for _, alert := range alerts {
+		d.alert(alert)
+	}
+}
+
+// loadBaseline reads the baseline days again once the day changed.
+func (d *DriftMonitor) loadBaseline(now time.Time) {
+	today := now.Format(time.DateOnly)
+	if today == d.baselineDay {
+		return
+	}
+	d.baselineDay = today
+
+	d.baseline = map[string][]float64{}
+	for i := 1; i <= d.Days; i++ {
+		day := now.AddDate(0, 0, -i).Format(time.DateOnly)
+		summary, err := SummariseRun(filepath.Join(d.Dir, day))
+		if err != nil {
+			continue
+		}
+		for name, command := range summary.Commands {
+			d.baseline[name] = append(d.baseline[name], command.Latencies...)
+		}
+	}
+	for name := range d.baseline {
+		sort.Float64s(d.baseline[name])
+	}
+	d.Log.Info("canary baseline loaded", "days", d.Days, "commands", len(d.baseline))
+}
+
+func (d *DriftMonitor) check(at time.Time, command string) []DriftAlert {
+	baseline := d.baseline[command]
+	samples := d.recent[command]
+	if len(baseline) < d.MinSamples || len(samples) < d.MinSamples {
+		return nil
+	}
+
+	latencies := make([]float64, len(samples))
+	for i, s := range samples {
+		latencies[i] = s.ms
+	}
+	sort.Float64s(latencies)
+
+	if d.current[command] == nil {
+		d.current[command] = map[string]float64{}
+	}
+	var alerts []DriftAlert
+	for _, q := range driftQuantiles {
+		label := fmt.Sprintf("p%g", q)
+		base, current := percentile(baseline, q), percentile(latencies, q)
+		d.current[command][label] = current
+
+		key := command + " " + label
+		drifting := base > 0 && (current > base*(1+d.Band) || current < base*(1-d.Band))
+		if drifting == d.drifting[key] {
+			continue
+		}
+		d.drifting[key] = drifting
+		alerts = append(alerts, DriftAlert{
+			Site:       d.Site,
+			Command:    command,
+			Quantile:   label,
+			BaselineMs: base,
+			CurrentMs:  current,
+			Band:       d.Band,
+			Drifting:   drifting,
+			Time:       at.UTC(),
+		})
+	}
+	return alerts
+}
+
+func (d *DriftMonitor) alert(a DriftAlert) {
+	if a.Drifting {
+		d.Log.Warn("canary latency drifted from baseline", "command", a.Command, "quantile", a.Quantile, "baselineMs", a.BaselineMs, "currentMs", a.CurrentMs)
+	} else {
+		d.Log.Info("canary latency back within baseline band", "command", a.Command, "quantile", a.Quantile, "baselineMs", a.BaselineMs, "currentMs", a.CurrentMs)
+	}
+
+	if d.AlertURL == "" {
+		return
+	}
+	err := d.post(a)
+	if err != nil {
+		d.Log.Warn("drift alert not sent", "error", err, "command", a.Command)
+	}
+}
+
+func (d *DriftMonitor) post(a DriftAlert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode drift alert")
+	}
+	resp, err := d.client.Post(d.AlertURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "unable to post drift alert")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("alert webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Metrics serves the current and baseline percentiles and whether each drifts
+// in the Prometheus text format.
+func (d *DriftMonitor) Metrics(c *gin.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	commands := make([]string, 0, len(d.current))
+	for command := range d.current {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	var b strings.Builder
+	metrics := []struct {
+		name, help string
+		value      func(command string, q float64, label string) float64
+	}{
+		{"rtc_canary_latency_ms", "canary latency percentile over the recent window", func(command string, _ float64, label string) float64 {
+			return d.current[command][label]
+		}},
+		{"rtc_canary_baseline_latency_ms", "canary latency percentile over the baseline days", func(command string, q float64, _ string) float64 {
+			return percentile(d.baseline[command], q)
+		}},
+		{"rtc_canary_drifting", "1 while the percentile is outside its band around the baseline", func(command string, _ float64, label string) float64 {
+			if d.drifting[command+" "+label] {
+				return 1
+			}
+			return 0
+		}},
+	}
+	for _, m := range metrics {
+		help := m.help
+		for _, command := range commands {
+			for _, q := range driftQuantiles {
+				label := fmt.Sprintf("p%g", q)
+				writeMetric(&b, m.name, "gauge", help, map[string]string{"command": command, "quantile": label}, m.value(command, q, label))
+				help = ""
+			}
+		}
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var eventHeader = []string{"Time", "Event", "Wash ID", "Tunnel", "rTC Time"}
+
+var subscribeXML = "<src><subscribe/></src>"
+
+// The events the rTC pushes to subscribed connections.
+const (
+	EventCarEntered    = "carEntered"
+	EventWashStarted   = "washStarted"
+	EventWashCompleted = "washCompleted"
+)
+
+// eventWindow is how close to a tunnel event a command has to be sent to count
+// as sent during tunnel activity.
+const eventWindow = time.Second
+
+// minEventSamples is the fewest latencies of a command both near and away from
+// tunnel events for them to be compared.
+const minEventSamples = 10
+
+// RTCEvent is a line the rTC writes to a subscribed connection: an event, e.g.
+// <tc><event><type>washStarted</type><id>104</id><time>2024-05-02T10:04:05.120Z</time></event></tc>,
+// or the confirmation <tc><subscribed/></tc> of the subscription.
+type RTCEvent struct {
+	XMLName    xml.Name  `xml:"tc"`
+	Type       string    `xml:"event>type"`
+	WashID     int       `xml:"event>id"`
+	Tunnel     string    `xml:"event>tunnel"`
+	At         string    `xml:"event>time"`
+	Subscribed *struct{} `xml:"subscribed"`
+	Error      string    `xml:"error"`
+}
+
+// EventStats are the events received by type, when the last one was, whether
+// the listener is subscribed and how often it had to subscribe again.
+type EventStats struct {
+	Connected  bool              `json:"connected"`
+	Counts     map[string]uint64 `json:"counts"`
+	Last       time.Time         `json:"last,omitempty"`
+	Reconnects uint64            `json:"reconnects"`
+	Malformed  uint64            `json:"malformed"`
+}
+
+// EventListener keeps a connection to the rTC subscribed to the events it
+// pushes as cars go through the tunnel, and writes every one to events.csv
+// stamped with when it was received, alongside the rTC's own time for it.
+// The connection isn't a command: it is neither recorded in the results nor
+// counted against the command limits. A lost connection is subscribed again
+// after Reconnect, until Done.
+type EventListener struct {
+	Client *RTCClient
+	Writer *ResultWriter
+	Log    Logger
+	// Reconnect is how long the listener waits before subscribing again.
+	Reconnect time.Duration
+	Done      chan bool
+
+	mu    sync.Mutex
+	stats EventStats
+}
+
+func CreateEventListener(client *RTCClient, writer *ResultWriter, reconnect time.Duration, doneChannel chan bool) *EventListener {
+	return &EventListener{
+		Client:    client,
+		Writer:    writer,
+		Log:       ZerologLogger{},
+		Reconnect: reconnect,
+		Done:      doneChannel,
+		stats:     EventStats{Counts: map[string]uint64{}},
+	}
+}
+
+func (l *EventListener) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-l.Done
+		cancel()
+	}()
+
+	for {
+		err := l.listen(ctx)
+		l.mu.Lock()
+		l.stats.Connected = false
+		l.mu.Unlock()
+		if ctx.Err() != nil {
+			l.Log.Info("event listener received done signal")
+			return
+		}
+		l.Log.Warn("lost rTC event subscription, subscribing again", "error", err, "after", l.Reconnect)
+		select {
+		case <-clock.After(l.Reconnect):
+		case <-ctx.Done():
+			l.Log.Info("event listener received done signal")
+			return
+		}
+		l.mu.Lock()
+		l.stats.Reconnects++
+		l.mu.Unlock()
+	}
+}
+
+// listen subscribes on a new connection and reads events from it until it
+// fails or ctx is done.
+func (l *EventListener) listen(ctx context.Context) error {
+	_, commandXML := l.Client.address("SUBSCRIBE", subscribeXML)
+	conn, err := l.Client.dial(ctx, l.Client.Timeouts.For("SUBSCRIBE").Dial)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to subscribe to rTC events")
+	}
+	stop := abortOnCancel(ctx, conn)
+	defer func() {
+		stop()
+		conn.Close()
+	}()
+	l.Client.WriteToRTC(conn, commandXML)
+	l.Log.Info("subscribing to rTC events", "host", l.Client.Host, "port", l.Client.Port)
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		atomic.AddUint64(&l.Client.state.bytesReceived, uint64(len(line)))
+		if err != nil {
+			return err
+		}
+		err = l.observe(strings.TrimSpace(line))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// observe takes a line read from the subscription. Lines that aren't XML are
+// counted and skipped; an error from the rTC ends the subscription.
+func (l *EventListener) observe(line string) error {
+	if line == "" {
+		return nil
+	}
+	received := clock.Now()
+	var event RTCEvent
+	err := xml.Unmarshal([]byte(line), &event)
+	if err != nil {
+		l.Log.Warn("unable to parse rTC event", "error", err, "line", line)
+		l.mu.Lock()
+		l.stats.Malformed++
+		l.mu.Unlock()
+		return nil
+	}
+	if event.Error != "" {
+		return &RTCError{Command: "SUBSCRIBE", Message: event.Error}
+	}
+	if event.Type == "" {
+		if event.Subscribed != nil {
+			l.mu.Lock()
+			l.stats.Connected = true
+			l.mu.Unlock()
+		}
+		return nil
+	}
+
+	rtcTime := event.At
+	if at, err := time.Parse(time.RFC3339Nano, event.At); err == nil {
+		rtcTime = recordTime(at)
+	}
+	l.mu.Lock()
+	// a pushed event is as good a confirmation as any
+	l.stats.Connected = true
+	l.stats.Counts[event.Type]++
+	l.stats.Last = received
+	l.mu.Unlock()
+
+	err = l.Writer.Write([]string{recordTime(received), event.Type, strconv.Itoa(event.WashID), event.Tunnel, rtcTime})
+	if err != nil {
+		l.Log.Warn("error writing event record to CSV", "error", err)
+	}
+	return nil
+}
+
+func (l *EventListener) Stats() EventStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Counts = map[string]uint64{}
+	for name, n := range l.stats.Counts {
+		stats.Counts[name] = n
+	}
+	return stats
+}
+
+// readEvents loads events.csv of a run as the times it received each type of
+// event.
+func readEvents(dir string) (map[string][]time.Time, error) {
+	f, err := os.Open(filepath.Join(dir, "events.csv"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	events := map[string][]time.Time{}
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read events")
+		}
+		if len(record) < 2 || (line == 0 && record[0] == eventHeader[0]) {
+			continue
+		}
+		at, err := parseRecordTime(record[0])
+		if err != nil {
+			continue
+		}
+		events[record[1]] = append(events[record[1]], at)
+	}
+	return events, nil
+}
+
+// eventsPerMinute counts the events of each type by minute, for the report's
+// chart of tunnel activity.
+func eventsPerMinute(events map[string][]time.Time) map[string][]ChartPoint {
+	series := map[string][]ChartPoint{}
+	for name, times := range events {
+		counts := map[int64]float64{}
+		for _, at := range times {
+			counts[at.Truncate(time.Minute).Unix()]++
+		}
+		points := make([]ChartPoint, 0, len(counts))
+		for minute, n := range counts {
+			points = append(points, ChartPoint{At: time.Unix(minute, 0).UTC(), Value: n})
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i].At.Before(points[j].At) })
+		series[name] = points
+	}
+	return series
+}
+
+// EventCorrelation is a command's latency when it was sent within eventWindow
+// of a tunnel event and when it wasn't.
+type EventCorrelation struct {
+	Command   string
+	NearCount int
+	NearP50   float64
+	NearP95   float64
+	AwayCount int
+	AwayP50   float64
+	AwayP95   float64
+}
+
+// correlateEvents splits every command's latencies by whether they were sent
+// near a tunnel event. Commands without enough latencies on both sides are
+// left out.
+func correlateEvents(latencies map[string][]ChartPoint, events map[string][]time.Time) []EventCorrelation {
+	var times []time.Time
+	for _, at := range events {
+		times = append(times, at...)
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	near := func(at time.Time) bool {
+		i := sort.Search(len(times), func(i int) bool { return !times[i].Before(at.Add(-eventWindow)) })
+		return i < len(times) && !times[i].After(at.Add(eventWindow))
+	}
+
+	var correlations []EventCorrelation
+	for name, points := range latencies {
+		var during, away []float64
+		for _, p := range points {
+			if near(p.At) {
+				during = append(during, p.Value)
+			} else {
+				away = append(away, p.Value)
+			}
+		}
+		if len(during) < minEventSamples || len(away) < minEventSamples {
+			continue
+		}
+		sort.Float64s(during)
+		sort.Float64s(away)
+		correlations = append(correlations, EventCorrelation{
+			Command:   name,
+			NearCount: len(during),
+			NearP50:   percentile(during, 50),
+			NearP95:   percentile(during, 95),
+			AwayCount: len(away),
+			AwayP50:   percentile(away, 50),
+			AwayP95:   percentile(away, 95),
+		})
+	}
+	sort.Slice(correlations, func(i, j int) bool { return correlations[i].Command < correlations[j].Command })
+	return correlations
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Experiment runs the tester once for every combination of the values in Grid,
+// e.g. {"queue": ["1", "2"], "close-mode": ["graceful", "immediate"]}. Grid keys
+// and Args are ordinary tester flags.
+type Experiment struct {
+	Name     string              `json:"name"`
+	Duration string              `json:"duration"`
+	Pause    string              `json:"pause"`
+	Repeat   int                 `json:"repeat"`
+	Args     []string            `json:"args"`
+	Grid     map[string][]string `json:"grid"`
+
+	duration time.Duration
+	pause    time.Duration
+}
+
+// ExperimentRun is one combination of grid values.
+type ExperimentRun struct {
+	Name   string
+	Params map[string]string
+	Dir    string
+}
+
+func LoadExperiment(path string) (*Experiment, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read experiment %s", path)
+	}
+
+	var e Experiment
+	err = json.Unmarshal(b, &e)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse experiment %s", path)
+	}
+
+	if e.Name == "" {
+		e.Name = filepath.Base(path[:len(path)-len(filepath.Ext(path))])
+	}
+	e.duration, err = time.ParseDuration(e.Duration)
+	if err != nil || e.duration <= 0 {
+		return nil, errors.Errorf("experiment %s needs a positive duration, got %q", e.Name, e.Duration)
+	}
+	if e.Pause != "" {
+		e.pause, err = time.ParseDuration(e.Pause)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pause %q", e.Pause)
+		}
+	}
+	if e.Repeat <= 0 {
+		e.Repeat = 1
+	}
+	for name, values := range e.Grid {
+		if len(values) == 0 {
+			return nil, errors.Errorf("grid parameter %s has no values", name)
+		}
+	}
+	return &e, nil
+}
+
+// Runs expands the grid in a stable order, the last parameter varying fastest.
+func (e *Experiment) Runs(dir string) []ExperimentRun {
+	names := make([]string, 0, len(e.Grid))
+	for name := range e.Grid {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range e.Grid[name] {
+				params := map[string]string{name: value}
+				for k, v := range combination {
+					params[k] = v
+				}
+				next = append(next, params)
+			}
+		}
+		combinations = next
+	}
+
+	var runs []ExperimentRun
+	for repeat := 0; repeat < e.Repeat; repeat++ {
+		for _, params := range combinations {
+			name := fmt.Sprintf("run-%03d", len(runs)+1)
+			runs = append(runs, ExperimentRun{Name: name, Params: params, Dir: filepath.Join(dir, name)})
+		}
+	}
+	return runs
+}
+
+// runExperiment implements the `experiment` subcommand.
+func runExperiment(args []string) {
+	fs := flag.NewFlagSet("experiment", flag.ExitOnError)
+	output := fs.String("output", "experiments", "directory the experiment's runs and report are written to")
+	control := fs.String("control", "http://127.0.0.1:3001", "base url of the tester's http server, used to stop each run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: experiment [flags] <experiment.json>")
+		os.Exit(2)
+	}
+
+	e, err := LoadExperiment(fs.Arg(0))
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load experiment")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to find tester executable")
+	}
+
+	dir := filepath.Join(*output, fmt.Sprintf("%s-%s", e.Name, time.Now().Format("2006-01-02-150405")))
+	runs := e.Runs(dir)
+	log.Info().Str("experiment", e.Name).Int("runs", len(runs)).Str("dir", dir).Msg("starting experiment")
+
+	for i, run := range runs {
+		if i > 0 && e.pause > 0 {
+			time.Sleep(e.pause)
+		}
+		err := e.execute(executable, *control, run)
+		if err != nil {
+			log.Error().Err(err).Str("run", run.Name).Interface("params", run.Params).Msg("experiment run failed")
+			continue
+		}
+		log.Info().Str("run", run.Name).Interface("params", run.Params).Msg("experiment run finished")
+	}
+
+	err = writeExperimentReport(e, dir, runs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to write experiment report")
+	}
+	fmt.Printf("experiment report written to %s\n", filepath.Join(dir, "report.html"))
+}
+
+// execute runs the tester for the experiment's duration, then stops its routines
+// through the http server and ends the process.
+func (e *Experiment) execute(executable, control string, run ExperimentRun) error {
+	err := os.MkdirAll(run.Dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "unable to create run directory")
+	}
+	logFile, err := os.Create(filepath.Join(run.Dir, "tester.log"))
+	if err != nil {
+		return errors.Wrap(err, "unable to create run log")
+	}
+	defer logFile.Close()
+
+	args := append([]string{}, e.Args...)
+	names := make([]string, 0, len(run.Params))
+	for name := range run.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("--%s=%s", name, run.Params[name]))
+	}
+	args = append(args, "--results-dir="+run.Dir)
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if err != nil {
+		return errors.Wrap(err, "unable to start tester")
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		return errors.Wrapf(err, "tester exited early, see %s", logFile.Name())
+	case <-time.After(e.duration):
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(control + "/stop")
+	if err != nil {
+		log.Warn().Err(err).Str("run", run.Name).Msg("unable to stop routines before ending run")
+	} else {
+		resp.Body.Close()
+	}
+
+	cmd.Process.Kill()
+	<-exited
+	return nil
+}
+
+var experimentReportTemplate = assetTemplate("experiment.html")
+
+// writeExperimentReport compares every run of the experiment, one row per run
+// and command, as report.html and report.csv.
+func writeExperimentReport(e *Experiment, dir string, runs []ExperimentRun) error {
+	params := make([]string, 0, len(e.Grid))
+	for name := range e.Grid {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+
+	var rows [][]string
+	for _, run := range runs {
+		summary, err := SummariseRun(run.Dir)
+		if err != nil {
+			log.Warn().Err(err).Str("run", run.Name).Msg("leaving run out of experiment report")
+			continue
+		}
+
+		for _, name := range summary.CommandNames() {
+			command := summary.Commands[name]
+			row := []string{run.Name}
+			for _, param := range params {
+				row = append(row, run.Params[param])
+			}
+			row = append(row,
+				name,
+				strconv.Itoa(command.Count),
+				strconv.Itoa(command.Errors),
+				strconv.FormatFloat(command.ErrorRate()*100, 'f', 2, 64),
+				strconv.FormatFloat(command.Rate(), 'f', 2, 64),
+				strconv.FormatFloat(command.Percentile(50), 'f', 1, 64),
+				strconv.FormatFloat(command.Percentile(95), 'f', 1, 64),
+				strconv.FormatFloat(command.Percentile(99), 'f', 1, 64),
+			)
+			rows = append(rows, row)
+		}
+	}
+
+	csvFile, err := os.Create(filepath.Join(dir, "report.csv"))
+	if err != nil {
+		return errors.Wrap(err, "unable to create report csv")
+	}
+	defer csvFile.Close()
+
+	w := csv.NewWriter(csvFile)
+	header := append(append([]string{"Run"}, params...), "Command", "Count", "Errors", "Error %", "Rate/s", "p50 ms", "p95 ms", "p99 ms")
+	w.Write(header)
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		return errors.Wrap(err, "unable to write report csv")
+	}
+
+	htmlFile, err := os.Create(filepath.Join(dir, "report.html"))
+	if err != nil {
+		return errors.Wrap(err, "unable to create report")
+	}
+	defer htmlFile.Close()
+
+	return experimentReportTemplate.Execute(htmlFile, map[string]interface{}{
+		"Name":     e.Name,
+		"Duration": e.duration,
+		"Params":   params,
+		"Rows":     rows,
+	})
+}
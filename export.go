@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ExportRunXLSX writes a run as an Excel workbook for the wash operations
+// people who read results in Excel: a summary of the run, each command's
+// statistics, every failed command and the raw samples. Times are UTC like
+// in the CSVs.
+func ExportRunXLSX(dir string, w io.Writer) error {
+	summary, err := SummariseRun(dir)
+	if err != nil {
+		return err
+	}
+	var manifest *Manifest
+	if b, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		var m Manifest
+		if json.Unmarshal(b, &m) == nil {
+			manifest = &m
+		}
+	}
+
+	book := CreateXLSXWorkbook(w)
+	err = exportSummarySheet(book, dir, manifest, summary)
+	if err != nil {
+		return err
+	}
+	err = exportCommandSheet(book, summary)
+	if err != nil {
+		return err
+	}
+	err = exportRecordSheets(book, dir)
+	if err != nil {
+		return err
+	}
+	return book.Close()
+}
+
+func exportSummarySheet(book *XLSXWorkbook, dir string, manifest *Manifest, summary *RunSummary) error {
+	err := book.AddSheet("Summary")
+	if err != nil {
+		return err
+	}
+	rows := [][]interface{}{{"Run", dir}}
+	if manifest != nil {
+		rows = append(rows,
+			[]interface{}{"Started", recordTime(manifest.Started)},
+			[]interface{}{"Instance", manifest.Instance},
+			[]interface{}{"Time zone", manifest.Timezone},
+			[]interface{}{"Purpose", manifest.Notes.Purpose},
+			[]interface{}{"Operator", manifest.Notes.Operator},
+			[]interface{}{"Firmware", manifest.Notes.Firmware},
+			[]interface{}{"Seed", fmt.Sprint(manifest.Seed)},
+		)
+		if manifest.Shutdown != nil {
+			rows = append(rows, []interface{}{"Ended", manifest.Shutdown.Reason})
+		}
+	}
+	count, errs := 0, 0
+	for _, command := range summary.Commands {
+		count += command.Count
+		errs += command.Errors
+	}
+	rows = append(rows, []interface{}{"Commands", count}, []interface{}{"Errors", errs})
+
+	for _, row := range rows {
+		_, err = book.WriteRow(row...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportCommandSheet(book *XLSXWorkbook, summary *RunSummary) error {
+	err := book.AddSheet("Commands")
+	if err != nil {
+		return err
+	}
+	_, err = book.WriteRow("Command", "Count", "Errors", "Error %", "Rate/s", "p50 ms", "p95 ms", "p99 ms")
+	if err != nil {
+		return err
+	}
+	for _, name := range summary.CommandNames() {
+		command := summary.Commands[name]
+		_, err = book.WriteRow(name, command.Count, command.Errors, command.ErrorRate()*100, command.Rate(),
+			command.Percentile(50), command.Percentile(95), command.Percentile(99))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportRecordSheets writes the failed commands and then every sample. The
+// results file is read twice rather than held in memory, a soak's can be large.
+func exportRecordSheets(book *XLSXWorkbook, dir string) error {
+	err := book.AddSheet("Errors")
+	if err != nil {
+		return err
+	}
+	_, err = book.WriteRow("Command", "Initiated", "Error")
+	if err != nil {
+		return err
+	}
+	err = eachResult(dir, func(record []string) (bool, error) {
+		if record[5] != "true" {
+			return true, nil
+		}
+		return book.WriteRow(record[0], record[2], record[6])
+	})
+	if err != nil {
+		return err
+	}
+
+	err = book.AddSheet("Samples")
+	if err != nil {
+		return err
+	}
+	_, err = book.WriteRow("Command", "Initiated", "Latency ms", "Error", "Phase")
+	if err != nil {
+		return err
+	}
+	return eachResult(dir, func(record []string) (bool, error) {
+		phase := ""
+		if len(record) > len(csvHeader) {
+			phase = record[len(csvHeader)]
+		}
+		if ms, ok := recordLatency(record); ok {
+			return book.WriteRow(record[0], record[2], ms, record[5], phase)
+		}
+		return book.WriteRow(record[0], record[2], "", record[5], phase)
+	})
+}
+
+// eachResult calls fn with every record of the run's results until it returns
+// false. Records beyond what a sheet holds are counted and logged.
+func eachResult(dir string, fn func(record []string) (bool, error)) error {
+	f, err := os.Open(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		return errors.Wrapf(err, "unable to open results of run %s", dir)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	left := 0
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to read results of run %s", dir)
+		}
+		if (line == 0 && record[0] == csvHeader[0]) || len(record) < len(csvHeader) {
+			continue
+		}
+		if left > 0 {
+			left++
+			continue
+		}
+		ok, err := fn(record)
+		if err != nil {
+			return errors.Wrap(err, "unable to write workbook")
+		}
+		if !ok {
+			left = 1
+		}
+	}
+	if left > 0 {
+		log.Warn().Int("records", left).Msg("results don't fit on a sheet, the rest were left out of the workbook")
+	}
+	return nil
+}
+
+// runExport implements the `export` subcommand.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("output", "", "workbook to write, defaults to results.xlsx in the run directory")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: export [flags] <run dir>")
+		os.Exit(2)
+	}
+	dir := fs.Arg(0)
+	path := *output
+	if path == "" {
+		path = filepath.Join(dir, "results.xlsx")
+	}
+	if !strings.HasSuffix(strings.ToLower(path), ".xlsx") {
+		log.Warn().Str("output", path).Msg("workbook doesn't end in .xlsx, Excel may not open it")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal().Err(err).Str("output", path).Msg("unable to create workbook")
+	}
+	err = ExportRunXLSX(dir, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("run", dir).Msg("unable to export run")
+	}
+	fmt.Printf("run exported to %s\n", path)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxHeadAdds is the most washes one request to the head endpoint queues.
+const maxHeadAdds = 100
+
+// HeadRoutine queues a wash at the head of the queue every tick, ahead of the
+// washes the queue routine adds to its tail, so the rTC reorders its queue on
+// every add rather than only on moves. Washes are queued with the ids,
+// package and lanes of Queue and retained like its own.
+type HeadRoutine struct {
+	TickedRoutine
+
+	Queue *QueueRoutine
+}
+
+func CreateHeadRoutine(tickerTime int, queue *QueueRoutine) *HeadRoutine {
+	h := &HeadRoutine{Queue: queue}
+	h.init("head", tickerTime, 10*time.Second, h.head)
+	return h
+}
+
+func (h *HeadRoutine) head(client *RTCClient, writer *ResultWriter) {
+	orderID, err := h.Queue.IDs.NextOrderID()
+	if err != nil {
+		h.Log.Warn("unable to allocate order id, not attempting head queue", "error", err, "strategy", h.Queue.IDs.Strategy())
+		return
+	}
+
+	resp, records, err := client.QueueWashAtHead(h.Queue.request(client, orderID))
+	if err != nil {
+		h.Log.Warn("unable to queue wash at head in head routine", "error", err)
+	} else {
+		client.Rates.Achieve()
+	}
+	writer.Write(records)
+	if err == nil && h.Queue.Retain != nil {
+		h.Queue.Retain.Retain(client, writer, resp.WashID)
+	}
+}
+
+// HeadWash is a wash the head endpoint queued and where the queue read after
+// its adds has it, 0 when it isn't queued any more.
+type HeadWash struct {
+	OrderID  string `json:"orderId"`
+	WashID   int    `json:"washId"`
+	Position int    `json:"position"`
+}
+
+// QueueHead is POST /api/v1/queue/head?count=n, which queues n washes at the
+// head of the queue back to back, 1 by default, and reads the queue after
+// them to show where the rTC put them. Every command is recorded like the
+// routines'.
+func (r *Routines) QueueHead(c *gin.Context) {
+	count := 1
+	if value := c.Query("count"); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count <= 0 || count > maxHeadAdds {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "count must be an integer from 1 to " + strconv.Itoa(maxHeadAdds)})
+			return
+		}
+	}
+
+	washes := []HeadWash{}
+	var washIDs []int
+	for i := 0; i < count; i++ {
+		orderID, err := r.QueueRoutine.IDs.NextOrderID()
+		if err != nil {
+			r.Log.Warn("unable to allocate order id, not attempting head queue", "error", err, "strategy", r.QueueRoutine.IDs.Strategy())
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unable to allocate order id: " + err.Error(), "washes": washes})
+			return
+		}
+		resp, records, err := r.RTC.QueueWashAtHead(r.QueueRoutine.request(r.RTC, orderID))
+		writeErr := r.Writer.Write(records)
+		if writeErr != nil {
+			r.Log.Warn("error writing head queue record to CSV", "error", writeErr, "record", records)
+		}
+		if err != nil {
+			r.Log.Error("error queueing wash at head for api", "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to queue wash at head: " + err.Error(), "washes": washes})
+			return
+		}
+		washes = append(washes, HeadWash{OrderID: orderID, WashID: resp.WashID})
+		washIDs = append(washIDs, resp.WashID)
+	}
+	if r.QueueRoutine.Retain != nil {
+		r.QueueRoutine.Retain.Retain(r.RTC, r.Writer, washIDs...)
+	}
+
+	queue, records, err := r.RTC.GetQueue()
+	writeErr := r.Writer.Write(records)
+	if writeErr != nil {
+		r.Log.Warn("error writing get queue record to CSV", "error", writeErr, "record", records)
+	}
+	if err != nil {
+		r.Log.Error("error getting queue after head queue for api", "error", err)
+		c.JSON(http.StatusOK, gin.H{"washes": washes, "error": "washes queued, failed to fetch rtc queue: " + err.Error()})
+		return
+	}
+	positions := map[int]int{}
+	for _, car := range queue.Queue.QueueItems {
+		positions[car.WashID] = car.Position
+	}
+	for i := range washes {
+		washes[i].Position = positions[washes[i].WashID]
+	}
+	c.JSON(http.StatusOK, gin.H{"washes": washes, "count": len(queue.Queue.QueueItems)})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// RunHistory finds the runs kept on the machine, every directory under Root
+// with a manifest.json, so a site machine's results can be browsed, reported
+// on and compared from the web UI instead of copied off as CSVs.
+type RunHistory struct {
+	Root string
+	// MaxDepth is how many directories below Root runs are looked for, runs
+	// being written to <date>/<time> by default.
+	MaxDepth int
+}
+
+// HistoryRun is a run directory as listed on the history page.
+type HistoryRun struct {
+	// Dir is relative to the history's root.
+	Dir      string
+	Started  time.Time
+	Instance string
+	Notes    RunNotes
+	Ended    string
+	Report   bool
+}
+
+func CreateRunHistory(root string) *RunHistory {
+	return &RunHistory{Root: root, MaxDepth: 4}
+}
+
+// Runs lists the runs under the root, newest first.
+func (h *RunHistory) Runs() ([]HistoryRun, error) {
+	var runs []HistoryRun
+	err := filepath.WalkDir(h.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// unreadable directories are skipped rather than failing the listing
+			return fs.SkipDir
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(h.Root, path)
+		if rel != "." && strings.Count(rel, string(filepath.Separator))+1 > h.MaxDepth {
+			return fs.SkipDir
+		}
+
+		b, err := os.ReadFile(filepath.Join(path, "manifest.json"))
+		if err != nil {
+			return nil
+		}
+		var manifest Manifest
+		if json.Unmarshal(b, &manifest) != nil {
+			return nil
+		}
+		run := HistoryRun{Dir: filepath.ToSlash(rel), Started: manifest.Started, Instance: manifest.Instance, Notes: manifest.Notes}
+		if manifest.Shutdown != nil {
+			run.Ended = manifest.Shutdown.Reason
+		}
+		_, err = os.Stat(filepath.Join(path, "load-test.csv"))
+		run.Report = err == nil
+		runs = append(runs, run)
+		return fs.SkipDir
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look for runs under %s", h.Root)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.After(runs[j].Started) })
+	return runs, nil
+}
+
+// runDir resolves a run directory given by the page, refusing anything that
+// isn't a run under the root.
+func (h *RunHistory) runDir(dir string) (string, error) {
+	if dir == "" || filepath.IsAbs(dir) {
+		return "", errors.Errorf("run %q isn't under the history's root", dir)
+	}
+	path := filepath.Join(h.Root, filepath.FromSlash(dir))
+	rel, err := filepath.Rel(h.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("run %q isn't under the history's root", dir)
+	}
+	_, err = os.Stat(filepath.Join(path, "manifest.json"))
+	if err != nil {
+		return "", errors.Errorf("%s isn't a run directory", dir)
+	}
+	return path, nil
+}
+
+var historyPage = assetTemplate("history.html")
+
+// HistoryEndpoint is GET /runs, the list of runs on the machine.
+func (h *RunHistory) HistoryEndpoint(c *gin.Context) {
+	runs, err := h.Runs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err = historyPage.Execute(c.Writer, map[string]interface{}{"Root": h.Root, "Runs": runs})
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+	}
+}
+
+// ReportEndpoint is GET /runs/report?dir=, the report of a run built from its results.
+func (h *RunHistory) ReportEndpoint(c *gin.Context) {
+	dir, err := h.runDir(c.Query("dir"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := BuildRunReport(dir, nil)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err = report.Render(c.Writer)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+	}
+}
+
+// ExportEndpoint is GET /runs/export?dir=, the run as an Excel workbook.
+func (h *RunHistory) ExportEndpoint(c *gin.Context) {
+	dir, err := h.runDir(c.Query("dir"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var b bytes.Buffer
+	err = ExportRunXLSX(dir, &b)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.ReplaceAll(filepath.ToSlash(c.Query("dir")), "/", "-") + ".xlsx"
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", b.Bytes())
+}
+
+// CompareEndpoint is GET /runs/compare?baseline=&candidate=, the diff of two runs.
+func (h *RunHistory) CompareEndpoint(c *gin.Context) {
+	var summaries []*RunSummary
+	for _, param := range []string{"baseline", "candidate"} {
+		dir, err := h.runDir(c.Query(param))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": param + ": " + err.Error()})
+			return
+		}
+		summary, err := SummariseRun(dir)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": param + ": " + err.Error()})
+			return
+		}
+		summaries = append(summaries, summary)
+	}
+
+	alpha := 0.05
+	diffs := DiffRuns(summaries[0], summaries[1], alpha, 1000, rand.New(rand.NewSource(time.Now().UnixNano())))
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err := renderDiffHTML(c.Writer, summaries[0], summaries[1], alpha, diffs)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// IDAllocator hands out the order IDs attached to every wash the generators queue.
+// The rTC issues the washIDs itself, but when several testers run against the same
+// controller their order IDs must not collide or their records can't be told apart.
+type IDAllocator interface {
+	NextOrderID() (string, error)
+	Strategy() string
+}
+
+// CreateIDAllocator builds the allocator for the given strategy: "prefix" numbers
+// IDs sequentially behind a per-instance prefix, "uuid" uses random v4 UUIDs and
+// "range" takes blocks of IDs from a coordinator so no two agents overlap.
+func CreateIDAllocator(strategy, prefix, coordinator string, blockSize int) (IDAllocator, error) {
+	switch strategy {
+	case "prefix":
+		return CreatePrefixAllocator(prefix), nil
+	case "uuid":
+		return CreateUUIDAllocator(prefix), nil
+	case "range":
+		if coordinator == "" {
+			return nil, errors.New("range id strategy requires a coordinator url")
+		}
+		return CreateRangeAllocator(prefix, coordinator, blockSize), nil
+	default:
+		return nil, errors.Errorf("unknown id strategy %q", strategy)
+	}
+}
+
+// defaultIDPrefix is the order id prefix of an instance left on the defaults,
+// its own so testers sharing a controller don't issue the same ids.
+func defaultIDPrefix(instance string) string {
+	return "LOAD-TESTING-" + instance
+}
+
+// orderIDHeader is the column of the order ids of the washes a command queued.
+// The rTC's adds have no field for them, so they only tell the testers' washes
+// apart in their results.
+const orderIDHeader = "Order ID"
+
+// withOrderIDs adds the order ids of the washes a command queued to its
+// record, after its wait, when the client records them.
+func (r *RTCClient) withOrderIDs(record []string, orderIDs ...string) []string {
+	if record == nil || !r.OrderIDs {
+		return record
+	}
+	width := len(csvHeader)
+	if r.MaxInFlight != nil {
+		width++
+	}
+	for len(record) < width {
+		record = append(record, "")
+	}
+	return append(record, strings.Join(orderIDs, " "))
+}
+
+type PrefixAllocator struct {
+	Prefix  string
+	counter uint64
+}
+
+func CreatePrefixAllocator(prefix string) *PrefixAllocator {
+	return &PrefixAllocator{Prefix: prefix}
+}
+
+func (p *PrefixAllocator) NextOrderID() (string, error) {
+	n := atomic.AddUint64(&p.counter, 1)
+	return fmt.Sprintf("%s-%06d", p.Prefix, n), nil
+}
+
+func (p *PrefixAllocator) Strategy() string {
+	return "prefix"
+}
+
+type UUIDAllocator struct {
+	Prefix string
+}
+
+func CreateUUIDAllocator(prefix string) *UUIDAllocator {
+	return &UUIDAllocator{Prefix: prefix}
+}
+
+func (u *UUIDAllocator) NextOrderID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read random bytes for uuid")
+	}
+	// version 4, variant 10
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	if u.Prefix == "" {
+		return id, nil
+	}
+	return fmt.Sprintf("%s-%s", u.Prefix, id), nil
+}
+
+func (u *UUIDAllocator) Strategy() string {
+	return "uuid"
+}
+
+// IDRange is a half open block [Start, End) of order ID numbers issued by a coordinator.
+type IDRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type RangeAllocator struct {
+	Prefix      string
+	Coordinator string
+	BlockSize   int
+
+	mu      sync.Mutex
+	current IDRange
+	next    int64
+	client  *http.Client
+}
+
+func CreateRangeAllocator(prefix, coordinator string, blockSize int) *RangeAllocator {
+	if blockSize <= 0 {
+		blockSize = 1000
+	}
+	return &RangeAllocator{
+		Prefix:      prefix,
+		Coordinator: coordinator,
+		BlockSize:   blockSize,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (r *RangeAllocator) NextOrderID() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= r.current.End {
+		block, err := r.fetchRange()
+		if err != nil {
+			return "", err
+		}
+		r.current = *block
+		r.next = block.Start
+		log.Info().Int64("start", block.Start).Int64("end", block.End).Msg("received new order id range from coordinator")
+	}
+
+	n := r.next
+	r.next++
+	return fmt.Sprintf("%s-%d", r.Prefix, n), nil
+}
+
+func (r *RangeAllocator) Strategy() string {
+	return "range"
+}
+
+func (r *RangeAllocator) fetchRange() (*IDRange, error) {
+	url := fmt.Sprintf("%s/api/v1/ids/range?size=%d", r.Coordinator, r.BlockSize)
+	resp, err := r.client.Post(url, "application/json", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to request id range from coordinator")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("coordinator responded with status %d when requesting id range", resp.StatusCode)
+	}
+
+	var block IDRange
+	err = json.NewDecoder(resp.Body).Decode(&block)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode id range from coordinator")
+	}
+	if block.End <= block.Start {
+		return nil, errors.Errorf("coordinator issued empty id range [%d, %d)", block.Start, block.End)
+	}
+
+	return &block, nil
+}
+
+var (
+	idRangeBucket  = []byte("idRanges")
+	idRangeNextKey = []byte("next")
+)
+
+// IDRangeCoordinator issues non-overlapping ID blocks to agents using the range strategy.
+// The start of the next block is saved before a block is issued, so a restarted
+// coordinator carries on after the blocks agents already hold.
+type IDRangeCoordinator struct {
+	mu   sync.Mutex
+	next int64
+	db   *bolt.DB
+}
+
+func CreateIDRangeCoordinator(path string) (*IDRangeCoordinator, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open id range state %s", path)
+	}
+
+	i := &IDRangeCoordinator{next: 1, db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(idRangeBucket)
+		if err != nil {
+			return err
+		}
+		if value := bucket.Get(idRangeNextKey); value != nil {
+			i.next = int64(binary.BigEndian.Uint64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "unable to read id range state %s", path)
+	}
+	return i, nil
+}
+
+func (i *IDRangeCoordinator) IssueRange(c *gin.Context) {
+	size := 1000
+	if s := c.Query("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be a positive integer"})
+			return
+		}
+		size = n
+	}
+
+	i.mu.Lock()
+	block := IDRange{Start: i.next, End: i.next + int64(size)}
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(block.End))
+		return tx.Bucket(idRangeBucket).Put(idRangeNextKey, value)
+	})
+	if err == nil {
+		i.next = block.End
+	}
+	i.mu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Str("agent", c.ClientIP()).Msg("unable to save id range state, not issuing range")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to save id range state"})
+		return
+	}
+
+	log.Info().Str("agent", c.ClientIP()).Int64("start", block.Start).Int64("end", block.End).Msg("issued order id range")
+	c.JSON(http.StatusOK, block)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// waitHeader is the column of the time a command waited for a slot under
+// --max-inflight, apart from its latency.
+const waitHeader = "Wait Ms"
+
+// InFlightLimiter caps the commands sent to the rTC at once, whichever
+// routines, workers or scripts send them, so the connections open to the rTC
+// never exceed Max however many of them run together. A command over the cap
+// waits for one to finish. Its methods are safe to call on a nil limiter,
+// which never makes a command wait.
+type InFlightLimiter struct {
+	Max int
+
+	slots   chan struct{}
+	waiting int64
+	waited  uint64
+	waitNs  int64
+}
+
+func CreateInFlightLimiter(max int) *InFlightLimiter {
+	return &InFlightLimiter{Max: max, slots: make(chan struct{}, max)}
+}
+
+// Acquire takes a slot, waiting for one until ctx is done, and returns how
+// long it waited.
+func (l *InFlightLimiter) Acquire(ctx context.Context) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return 0, nil
+	default:
+	}
+
+	start := clock.Now()
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	select {
+	case l.slots <- struct{}{}:
+		wait := clock.Now().Sub(start)
+		atomic.AddUint64(&l.waited, 1)
+		atomic.AddInt64(&l.waitNs, int64(wait))
+		return wait, nil
+	case <-ctx.Done():
+		return clock.Now().Sub(start), errors.Wrap(ctx.Err(), "command cancelled while waiting for an in-flight slot")
+	}
+}
+
+// Release gives back a slot taken by Acquire.
+func (l *InFlightLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// record adds the wait of a command to its record when commands are limited.
+func (l *InFlightLimiter) record(record []string, wait time.Duration) []string {
+	if l == nil {
+		return record
+	}
+	return append(record, strconv.FormatFloat(float64(wait)/float64(time.Millisecond), 'f', 1, 64))
+}
+
+// InFlightLimitStats are the commands holding and waiting for a slot, and the
+// commands that had to wait so far and how long they waited in total.
+type InFlightLimitStats struct {
+	Max     int     `json:"max"`
+	InUse   int     `json:"inUse"`
+	Waiting int64   `json:"waiting"`
+	Waited  uint64  `json:"waited"`
+	WaitMs  float64 `json:"waitMs"`
+}
+
+func (l *InFlightLimiter) Stats() InFlightLimitStats {
+	return InFlightLimitStats{
+		Max:     l.Max,
+		InUse:   len(l.slots),
+		Waiting: atomic.LoadInt64(&l.waiting),
+		Waited:  atomic.LoadUint64(&l.waited),
+		WaitMs:  float64(atomic.LoadInt64(&l.waitNs)) / float64(time.Millisecond),
+	}
+}
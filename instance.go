@@ -0,0 +1,147 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// scenarioHeader is the column of the scenario instance whose routine sent a
+// command, empty for the routines the flags configure.
+const scenarioHeader = "Scenario"
+
+var instanceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// InstanceConfig is a named set of queue, get and move routines running
+// alongside the ones the flags configure, at rates, on lanes and with a wash
+// package of its own, e.g. a "noise" instance queueing slowly in the
+// background and an "aggressive-mover" instance moving twice a second. Its
+// routines are named after it, e.g. noise.queue, for /update and
+// /api/v1/routines, and its commands are tagged with it in the results.
+type InstanceConfig struct {
+	Name string `json:"name"`
+	// Queue, Get and Move are the intervals of the instance's routines, in
+	// seconds like "5" or "0.5" or as a duration like "500ms". A routine
+	// without one doesn't run in the instance.
+	Queue string `json:"queue"`
+	Get   string `json:"get"`
+	Move  string `json:"move"`
+	// Lanes are the comma separated lanes washes are queued to, in LaneOrder,
+	// round-robin by default; the run's --lanes otherwise.
+	Lanes     string `json:"lanes"`
+	LaneOrder string `json:"laneOrder"`
+	// WashPackage is the package washes are queued with and the package of the
+	// washes moved, 1 by default.
+	WashPackage int `json:"washPackage"`
+	// Tunnel is the tunnel the instance's commands are addressed to, the run's
+	// by default, so instances can load the tunnels of one controller together.
+	Tunnel string `json:"tunnel"`
+}
+
+func (c InstanceConfig) Validate() error {
+	if !instanceName.MatchString(c.Name) {
+		return errors.Errorf("instance name %q must be letters, digits, - and _", c.Name)
+	}
+	if c.Queue == "" && c.Get == "" && c.Move == "" {
+		return errors.New("instance runs none of queue, get and move")
+	}
+	for routine, interval := range map[string]string{"queue": c.Queue, "get": c.Get, "move": c.Move} {
+		if interval == "" {
+			continue
+		}
+		if _, err := ParseIntervalSeconds(interval); err != nil {
+			return errors.Wrapf(err, "invalid %s interval", routine)
+		}
+	}
+	if c.Lanes != "" {
+		if _, err := c.lanes(); err != nil {
+			return err
+		}
+	}
+	if c.WashPackage < 0 {
+		return errors.Errorf("wash package can't be negative, got %d", c.WashPackage)
+	}
+	return ValidateTunnel(c.Tunnel)
+}
+
+func (c InstanceConfig) lanes() (*LaneAssigner, error) {
+	order := c.LaneOrder
+	if order == "" {
+		order = "round-robin"
+	}
+	return ParseLanes(c.Lanes, order)
+}
+
+// AddInstances creates and registers the routines of every instance. They
+// queue with the ids, batch size and retention of the queue routine the flags
+// configure, so it has to be set up first.
+func (r *Routines) AddInstances(instances []InstanceConfig) error {
+	for _, config := range instances {
+		pkg := config.WashPackage
+		if pkg == 0 {
+			pkg = defaultWashPackage
+		}
+
+		// the routines are created on a second and moved to their interval once named
+		var routines []Routine
+		if config.Queue != "" {
+			q := CreateQueueRoutine(1, r.QueueRoutine.IDs)
+			q.BatchSize = r.QueueRoutine.BatchSize
+			q.Retain = r.QueueRoutine.Retain
+			q.WashPackage = pkg
+			if config.Lanes != "" {
+				lanes, err := config.lanes()
+				if err != nil {
+					return errors.Wrapf(err, "invalid lanes of instance %s", config.Name)
+				}
+				q.Lanes = lanes
+			}
+			routines = append(routines, q)
+		}
+		if config.Get != "" {
+			routines = append(routines, CreateGetRoutine(1))
+		}
+		if config.Move != "" {
+			m := CreateMoveRoutine(1)
+			m.WashPackage = pkg
+			routines = append(routines, m)
+		}
+
+		intervals := map[string]string{"queue": config.Queue, "get": config.Get, "move": config.Move}
+		for _, routine := range routines {
+			t := routine.Ticked()
+			t.instance = config.Name
+			t.Tunnel = config.Tunnel
+			t.Log = r.Log
+			d, err := ParseIntervalSeconds(intervals[t.name])
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s interval of instance %s", t.name, config.Name)
+			}
+			t.Ticker.Set(d)
+			err = r.Timed.Register(routine)
+			if err != nil {
+				return err
+			}
+		}
+		r.Instances = append(r.Instances, config)
+	}
+	return nil
+}
+
+// washPackages are the packages the routines queue washes with, which tell
+// their washes apart from a site's real ones.
+func (r *Routines) washPackages() map[int]bool {
+	packages := map[int]bool{r.QueueRoutine.WashPackage: true}
+	for _, instance := range r.Instances {
+		if instance.WashPackage > 0 {
+			packages[instance.WashPackage] = true
+		}
+	}
+	if r.Modify != nil {
+		// washes the modify routine changed are test washes all the same
+		for _, pkg := range r.Modify.Packages {
+			packages[pkg] = true
+		}
+	}
+	return packages
+}
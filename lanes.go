@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// defaultLane is the lane washes were always queued to before --lanes, and
+// still are without it.
+const defaultLane = "4"
+
+// LaneAssigner picks the lane of every wash queued, in turn or at random, so
+// an rTC configured with several lanes gets traffic on all of them. The lane
+// is sent with the add and recorded after the command's name, e.g. "QUEUE lane=2".
+type LaneAssigner struct {
+	Lanes  []string
+	Random bool
+	Rand   *SeededRand
+
+	next uint64
+}
+
+// ParseLanes reads --lanes, a comma separated list of lane ids, and
+// --lane-order, either round-robin or random.
+func ParseLanes(list, order string) (*LaneAssigner, error) {
+	l := &LaneAssigner{}
+	for _, lane := range strings.Split(list, ",") {
+		lane = strings.TrimSpace(lane)
+		if lane == "" {
+			continue
+		}
+		l.Lanes = append(l.Lanes, lane)
+	}
+	if len(l.Lanes) == 0 {
+		return nil, errors.Errorf("no lanes in %q", list)
+	}
+	switch order {
+	case "round-robin":
+	case "random":
+		l.Random = true
+	default:
+		return nil, errors.Errorf("lane order must be round-robin or random, got %q", order)
+	}
+	return l, nil
+}
+
+// Next is the lane of the next wash queued.
+func (l *LaneAssigner) Next() string {
+	if l == nil {
+		return defaultLane
+	}
+	if l.Random && l.Rand != nil {
+		return l.Lanes[l.Rand.Intn(len(l.Lanes))]
+	}
+	i := atomic.AddUint64(&l.next, 1) - 1
+	return l.Lanes[i%uint64(len(l.Lanes))]
+}
+
+// commandName is how a command queueing to lanes is recorded, its name alone
+// when no lanes are configured.
+func (l *LaneAssigner) commandName(command string, lanes ...string) string {
+	if l == nil || len(lanes) == 0 {
+		return command
+	}
+	return command + " lane=" + strings.Join(lanes, ",")
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The verdicts of a leak hunt.
+const (
+	LeakNone         = "no leak detected"
+	LeakSuspected    = "possible leak"
+	LeakInconclusive = "inconclusive"
+)
+
+// leakBucket is the span of results each point of a leak trend sums up: the
+// median latency and the failure rate of the commands sent in it.
+const leakBucket = 5 * time.Minute
+
+// minLeakSpan is the shortest leak hunt whose trends are trusted for a verdict.
+const minLeakSpan = time.Hour
+
+// recommendedLeakSpan is how long a leak hunt should run for a slow leak to
+// show, hours of a controller's memory growing before it slows it down.
+const recommendedLeakSpan = 8 * time.Hour
+
+// minLeakBuckets is the fewest points a command's trend is fitted to.
+const minLeakBuckets = 6
+
+// minLeakBucketSamples is the fewest latencies a bucket needs for its median.
+const minLeakBucketSamples = 3
+
+// minLeakRSquared is how much of the variance of the points a trend has to
+// explain to be flagged, so one slow stretch doesn't make a leak.
+const minLeakRSquared = 0.3
+
+// Default thresholds of a leak hunt, when the run doesn't say.
+const (
+	defaultLeakGrowth      = 0.25
+	defaultLeakErrorGrowth = 0.01
+)
+
+// LeakThresholds are how far a command's trends may go over a leak hunt
+// before they are flagged. Growth is the share the fitted median latency may
+// grow by from the start of the run to its end, e.g. 0.25 for 25%, and
+// ErrorGrowth the most the fitted failure rate may rise by, e.g. 0.01 for one
+// percentage point.
+type LeakThresholds struct {
+	Growth      float64 `json:"growth"`
+	ErrorGrowth float64 `json:"errorGrowth"`
+}
+
+// LeakTrend is the linear trend over a leak hunt of a command's median
+// latency and failure rate, both taken every leakBucket. Start and End are
+// the trends' values at the start and end of the run. LatencyBuckets are the
+// buckets with enough latencies for a median, the latency trend only being
+// fitted with minLeakBuckets of them.
+type LeakTrend struct {
+	Command        string `json:"command"`
+	Samples        int    `json:"samples"`
+	Buckets        int    `json:"buckets"`
+	LatencyBuckets int    `json:"latencyBuckets"`
+
+	StartMs   float64 `json:"startMs"`
+	EndMs     float64 `json:"endMs"`
+	MsPerHour float64 `json:"msPerHour"`
+	RSquared  float64 `json:"rSquared"`
+
+	StartErrorRate float64 `json:"startErrorRate"`
+	EndErrorRate   float64 `json:"endErrorRate"`
+	ErrorRSquared  float64 `json:"errorRSquared"`
+	LatencyLeak    bool    `json:"latencyLeak"`
+	ErrorLeak      bool    `json:"errorLeak"`
+}
+
+// GrowthPercent is how much the fitted latency grew over the run, in percent
+// of where it started.
+func (t LeakTrend) GrowthPercent() float64 {
+	if t.StartMs <= 0 {
+		return 0
+	}
+	return 100 * (t.EndMs/t.StartMs - 1)
+}
+
+// StartErrorPercent and EndErrorPercent are the fitted failure rates in
+// percent.
+func (t LeakTrend) StartErrorPercent() float64 {
+	return 100 * t.StartErrorRate
+}
+
+func (t LeakTrend) EndErrorPercent() float64 {
+	return 100 * t.EndErrorRate
+}
+
+// LeakVerdict is the outcome of a leak hunt and the trends it rests on.
+type LeakVerdict struct {
+	Verdict    string         `json:"verdict"`
+	Hours      float64        `json:"hours"`
+	Reasons    []string       `json:"reasons,omitempty"`
+	Trends     []LeakTrend    `json:"trends"`
+	Thresholds LeakThresholds `json:"thresholds"`
+}
+
+func (v *LeakVerdict) Suspected() bool {
+	return v.Verdict == LeakSuspected
+}
+
+func (v *LeakVerdict) Clear() bool {
+	return v.Verdict == LeakNone
+}
+
+// leakSample is a command of the results, placed in time.
+type leakSample struct {
+	at     time.Time
+	name   string
+	ms     float64
+	failed bool
+}
+
+// AnalyseLeaks fits the trends of a leak hunt's results and gives its
+// verdict. The warm-up and re-baseline are left out. Commands that failed
+// before they were sent have no times of their own and are placed at the
+// command recorded before them.
+func AnalyseLeaks(dir string, thresholds LeakThresholds) (*LeakVerdict, error) {
+	f, err := os.Open(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open results of run %s", dir)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	var samples []leakSample
+	var start, end, last time.Time
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read results of run %s", dir)
+		}
+		if (line == 0 && record[0] == csvHeader[0]) || len(record) < len(csvHeader) || baselinePhase(record) {
+			continue
+		}
+		if initiated, err := parseRecordTime(record[2]); err == nil && !initiated.IsZero() {
+			last = initiated
+		}
+		if last.IsZero() {
+			continue
+		}
+		if start.IsZero() || last.Before(start) {
+			start = last
+		}
+		if last.After(end) {
+			end = last
+		}
+		s := leakSample{at: last, name: commandName(record[0]), failed: record[5] == "true"}
+		if !s.failed {
+			s.ms, _ = recordLatency(record)
+		}
+		samples = append(samples, s)
+	}
+
+	verdict := &LeakVerdict{Verdict: LeakNone, Hours: end.Sub(start).Hours(), Thresholds: thresholds}
+	verdict.Trends = fitLeakTrends(samples, start, end)
+	for i := range verdict.Trends {
+		t := &verdict.Trends[i]
+		t.LatencyLeak = t.LatencyBuckets >= minLeakBuckets && t.RSquared >= minLeakRSquared &&
+			t.EndMs > t.StartMs*(1+thresholds.Growth) && t.EndMs-t.StartMs >= minDegradationMs
+		t.ErrorLeak = t.ErrorRSquared >= minLeakRSquared && t.EndErrorRate-t.StartErrorRate > thresholds.ErrorGrowth
+		if t.LatencyLeak {
+			verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("%s median latency grew %.0f%%, from %.1f to %.1f ms (R² %.2f)",
+				t.Command, t.GrowthPercent(), t.StartMs, t.EndMs, t.RSquared))
+		}
+		if t.ErrorLeak {
+			verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("%s failure rate rose from %.2f%% to %.2f%% (R² %.2f)",
+				t.Command, t.StartErrorPercent(), t.EndErrorPercent(), t.ErrorRSquared))
+		}
+	}
+
+	span := end.Sub(start)
+	switch {
+	case span < minLeakSpan:
+		// too short for trends that did show to be trusted
+		verdict.Verdict = LeakInconclusive
+		verdict.Reasons = append([]string{fmt.Sprintf("ran for %s, trends need at least %s", span.Round(time.Second), minLeakSpan)}, verdict.Reasons...)
+	case len(verdict.Reasons) > 0:
+		verdict.Verdict = LeakSuspected
+	case len(verdict.Trends) == 0:
+		verdict.Verdict = LeakInconclusive
+		verdict.Reasons = []string{fmt.Sprintf("no command had latencies in %d stretches of %s to fit a trend to", minLeakBuckets, leakBucket)}
+	}
+	return verdict, nil
+}
+
+// fitLeakTrends fits the trends of every command of samples sent between
+// start and end. Commands with too few buckets to fit are left out.
+func fitLeakTrends(samples []leakSample, start, end time.Time) []LeakTrend {
+	type bucket struct {
+		latencies []float64
+		count     int
+		failed    int
+	}
+	commands := map[string]map[int]*bucket{}
+	counts := map[string]int{}
+	for _, s := range samples {
+		buckets, ok := commands[s.name]
+		if !ok {
+			buckets = map[int]*bucket{}
+			commands[s.name] = buckets
+		}
+		i := int(s.at.Sub(start) / leakBucket)
+		b, ok := buckets[i]
+		if !ok {
+			b = &bucket{}
+			buckets[i] = b
+		}
+		b.count++
+		counts[s.name]++
+		if s.failed {
+			b.failed++
+		} else if s.ms > 0 {
+			b.latencies = append(b.latencies, s.ms)
+		}
+	}
+
+	hours := end.Sub(start).Hours()
+	var trends []LeakTrend
+	for name, buckets := range commands {
+		var latencyX, latencyY, errorX, errorY []float64
+		for i, b := range buckets {
+			// the middle of the bucket, in hours from the start
+			x := (time.Duration(i)*leakBucket + leakBucket/2).Hours()
+			errorX = append(errorX, x)
+			errorY = append(errorY, float64(b.failed)/float64(b.count))
+			if len(b.latencies) >= minLeakBucketSamples {
+				sort.Float64s(b.latencies)
+				latencyX = append(latencyX, x)
+				latencyY = append(latencyY, percentile(b.latencies, 50))
+			}
+		}
+		if len(errorX) < minLeakBuckets {
+			continue
+		}
+
+		t := LeakTrend{Command: name, Samples: counts[name], Buckets: len(buckets), LatencyBuckets: len(latencyX)}
+		if slope, intercept, r2, ok := fitLine(errorX, errorY); ok {
+			t.StartErrorRate = clampRate(intercept)
+			t.EndErrorRate = clampRate(intercept + slope*hours)
+			t.ErrorRSquared = r2
+		}
+		if len(latencyX) >= minLeakBuckets {
+			if slope, intercept, r2, ok := fitLine(latencyX, latencyY); ok {
+				t.StartMs = intercept
+				t.EndMs = intercept + slope*hours
+				t.MsPerHour = slope
+				t.RSquared = r2
+			}
+		}
+		trends = append(trends, t)
+	}
+	sort.Slice(trends, func(i, j int) bool { return trends[i].Command < trends[j].Command })
+	return trends
+}
+
+func clampRate(rate float64) float64 {
+	if rate < 0 {
+		return 0
+	}
+	if rate > 1 {
+		return 1
+	}
+	return rate
+}
+
+// fitLine is the least squares line through xs and ys, with the share of the
+// variance of ys it explains. It fails when xs don't vary.
+func fitLine(xs, ys []float64) (slope, intercept, rSquared float64, ok bool) {
+	n := float64(len(xs))
+	if n == 0 {
+		return 0, 0, 0, false
+	}
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	var sxx, sxy, syy float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		return 0, 0, 0, false
+	}
+	slope = sxy / sxx
+	if syy > 0 {
+		rSquared = sxy * sxy / (sxx * syy)
+	}
+	return slope, meanY - slope*meanX, rSquared, true
+}
+
+// CheckLeakHunt makes sure the routines send the constant, low load a leak
+// hunt needs: no load profile of any kind, nothing sending as fast as the rTC
+// replies and at most maxRate operations per second in total.
+func (r *Routines) CheckLeakHunt(maxRate float64) error {
+	var problems []string
+	for _, routine := range r.Timed.All() {
+		if routine.Ticked().Ticker.Profiled() {
+			problems = append(problems, routine.Name()+" has a load profile, e.g. a ramp, spike, surge or steps")
+		}
+	}
+	load := r.PlannedLoad()
+	for _, what := range load.Unbounded {
+		problems = append(problems, what+" sends at a rate nothing bounds")
+	}
+	if load.Workers > 0 {
+		problems = append(problems, fmt.Sprintf("%d workers send as fast as the rTC replies", load.Workers))
+	}
+	if load.Total > maxRate {
+		problems = append(problems, fmt.Sprintf("%.2f operations per second in total, over --leak-hunt-max-rate %.2f", load.Total, maxRate))
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("load isn't constant and low enough to hunt leaks: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// leakHuntThresholds are the thresholds a run hunted leaks with, from its
+// manifest's flags, false when it didn't hunt leaks.
+func leakHuntThresholds(manifest *Manifest) (LeakThresholds, bool) {
+	thresholds := LeakThresholds{Growth: defaultLeakGrowth, ErrorGrowth: defaultLeakErrorGrowth}
+	if manifest == nil || manifest.Flags["leak-hunt"] != "true" {
+		return thresholds, false
+	}
+	if g, err := strconv.ParseFloat(manifest.Flags["leak-growth"], 64); err == nil && g > 0 {
+		thresholds.Growth = g
+	}
+	if g, err := strconv.ParseFloat(manifest.Flags["leak-error-growth"], 64); err == nil && g > 0 {
+		thresholds.ErrorGrowth = g
+	}
+	return thresholds, true
+}
+
+func printLeakVerdict(out io.Writer, verdict *LeakVerdict) {
+	if len(verdict.Trends) > 0 {
+		printLeakTrends(out, verdict.Trends)
+	}
+	fmt.Fprintf(out, "leak hunt over %.1fh: %s\n", verdict.Hours, verdict.Verdict)
+	for _, reason := range verdict.Reasons {
+		fmt.Fprintf(out, "  %s\n", reason)
+	}
+}
+
+func printLeakTrends(out io.Writer, trends []LeakTrend) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tBUCKETS\tSTART P50\tEND P50\tMS/HOUR\tR²\tSTART ERRORS\tEND ERRORS\t")
+	for _, t := range trends {
+		flag := ""
+		if t.LatencyLeak || t.ErrorLeak {
+			flag = "LEAK?"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%+.2f\t%.2f\t%.2f%%\t%.2f%%\t%s\n",
+			t.Command, t.Buckets, t.StartMs, t.EndMs, t.MsPerHour, t.RSquared, t.StartErrorPercent(), t.EndErrorPercent(), flag)
+	}
+	w.Flush()
+}
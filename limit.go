@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OpLimit ends a run after an exact number of operations, either in total or
+// per name, so runs against different firmware produce the same sample
+// counts. Names are routines for --max-ops and rTC commands for
+// --max-commands. An operation is taken before it is sent and marked done once
+// it completed; Reached is closed when the last allowed operation is done.
+// Names without a limit of their own aren't counted. Its methods are safe to
+// call on a nil limit, which allows everything.
+type OpLimit struct {
+	Total int
+	Names map[string]int
+
+	mu        sync.Mutex
+	taken     map[string]int
+	remaining int
+	reached   chan struct{}
+	lifted    bool
+}
+
+// parseOpLimit reads --max-ops: a total such as 1000, or per routine limits
+// such as queue=500,get=1000.
+func parseOpLimit(s string) (*OpLimit, error) {
+	return parseLimit(s, "max ops", "routine", func(name string) error {
+		if name != "queue" && name != "get" && name != "move" {
+			return errors.Errorf("unknown routine %q in max ops, expected queue, get or move", name)
+		}
+		return nil
+	})
+}
+
+// parseCommandLimit reads --max-commands: a total of rTC commands such as
+// 10000, or per command limits such as QUEUE=10000,GET=5000, the command being
+// the first word of a results record's command column.
+func parseCommandLimit(s string) (*OpLimit, error) {
+	return parseLimit(s, "max commands", "COMMAND", func(name string) error {
+		if name == "" || strings.ToUpper(name) != name {
+			return errors.Errorf("command %q in max commands must be upper case as it is recorded, e.g. QUEUE", name)
+		}
+		return nil
+	})
+}
+
+// parseLimit reads a limit called what, a total or comma separated counts of
+// names checked by check. kind is what the names are, for errors.
+func parseLimit(s, what, kind string, check func(name string) error) (*OpLimit, error) {
+	l := &OpLimit{taken: map[string]int{}, reached: make(chan struct{})}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return nil, errors.Errorf("%s must be positive, got %d", what, n)
+		}
+		l.Total, l.remaining = n, n
+		return l, nil
+	}
+
+	l.Names = map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		name, count, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, errors.Errorf("%s %q is neither a count nor %s=count", what, part, kind)
+		}
+		if err := check(name); err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return nil, errors.Errorf("%s for %s must be a positive count, got %q", what, name, count)
+		}
+		l.Names[name] = n
+		l.remaining += n
+	}
+	return l, nil
+}
+
+// key is what an operation of name counts against, false when it isn't limited.
+func (l *OpLimit) key(name string) (string, int, bool) {
+	if l.lifted {
+		return "", 0, false
+	}
+	if l.Total > 0 {
+		return "", l.Total, true
+	}
+	n, ok := l.Names[name]
+	return name, n, ok
+}
+
+// Take reserves an operation of name, returning false once its limit is used up.
+func (l *OpLimit) Take(name string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key, max, ok := l.key(name)
+	if !ok {
+		return true
+	}
+	if l.taken[key] >= max {
+		return false
+	}
+	l.taken[key]++
+	return true
+}
+
+// Cancel gives back an operation that was taken but never sent.
+func (l *OpLimit) Cancel(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if key, _, ok := l.key(name); ok {
+		l.taken[key]--
+	}
+}
+
+// Done marks a taken operation of name as completed.
+func (l *OpLimit) Done(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, _, ok := l.key(name); !ok {
+		return
+	}
+	l.remaining--
+	if l.remaining == 0 {
+		close(l.reached)
+	}
+}
+
+// Lift stops limiting once the run ended, so the washes it left can still be
+// deleted when the limit counts every command.
+func (l *OpLimit) Lift() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lifted = true
+}
+
+// Progress is the number of limited operations completed and allowed in all.
+// Both are zero on a nil limit.
+func (l *OpLimit) Progress() (done, total int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	total = l.Total
+	for _, n := range l.Names {
+		total += n
+	}
+	return total - l.remaining, total
+}
+
+// Reached is closed once every limited operation completed. It is nil, and so
+// never ready, on a nil limit.
+func (l *OpLimit) Reached() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.reached
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Logger is what the rTC client and the routines log through. Fields are passed
+// as alternating keys and values, errors conventionally under the "error" key:
+//
+//	r.Log.Warn("unable to queue wash", "error", err, "orderId", orderID)
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// ZerologLogger writes through a zerolog logger, the global one when Logger is nil.
+type ZerologLogger struct {
+	Logger *zerolog.Logger
+}
+
+func (z ZerologLogger) logger() *zerolog.Logger {
+	if z.Logger == nil {
+		return &log.Logger
+	}
+	return z.Logger
+}
+
+func (z ZerologLogger) Debug(msg string, keyvals ...interface{}) {
+	z.logger().Debug().Fields(keyvals).Msg(msg)
+}
+
+func (z ZerologLogger) Info(msg string, keyvals ...interface{}) {
+	z.logger().Info().Fields(keyvals).Msg(msg)
+}
+
+func (z ZerologLogger) Warn(msg string, keyvals ...interface{}) {
+	z.logger().Warn().Fields(keyvals).Msg(msg)
+}
+
+func (z ZerologLogger) Error(msg string, keyvals ...interface{}) {
+	z.logger().Error().Fields(keyvals).Msg(msg)
+}
+
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...interface{}) {}
+func (NopLogger) Info(string, ...interface{})  {}
+func (NopLogger) Warn(string, ...interface{})  {}
+func (NopLogger) Error(string, ...interface{}) {}
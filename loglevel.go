@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// LogControl changes how much the tester logs while it runs, so an engineer
+// can grab detail during a live incident without restarting a long soak. A
+// change only lasts a while: once it expires the level and tracing go back to
+// what the run was started with, so a forgotten debug session can't fill the
+// disk over a weekend.
+type LogControl struct {
+	// Base is the level the run was started with and changes revert to.
+	Base zerolog.Level
+	// MaxDuration caps how long a change is allowed to last.
+	MaxDuration time.Duration
+	Tracer      *PayloadTracer
+	Log         Logger
+
+	mu      sync.Mutex
+	revert  *time.Timer
+	expires time.Time
+}
+
+func CreateLogControl(base zerolog.Level, tracer *PayloadTracer) *LogControl {
+	zerolog.SetGlobalLevel(base)
+	return &LogControl{
+		Base:        base,
+		MaxDuration: time.Hour,
+		Tracer:      tracer,
+		Log:         ZerologLogger{},
+	}
+}
+
+// Set changes the log level and payload tracing for d, after which both revert.
+func (l *LogControl) Set(level zerolog.Level, trace bool, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.revert != nil {
+		l.revert.Stop()
+	}
+	zerolog.SetGlobalLevel(level)
+	l.Tracer.Enable(trace)
+	expires := time.Now().Add(d)
+	l.expires = expires
+	l.revert = time.AfterFunc(d, func() { l.expire(expires) })
+	l.Log.Info("log level changed", "logLevel", level.String(), "trace", trace, "revertsAfter", d.String())
+}
+
+// Revert goes back to the level the run was started with and stops tracing.
+func (l *LogControl) Revert() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revertLocked()
+}
+
+// expire reverts the change that was due to expire at expires, unless a later
+// change replaced it while its timer was firing.
+func (l *LogControl) expire(expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.expires.Equal(expires) {
+		l.revertLocked()
+	}
+}
+
+func (l *LogControl) revertLocked() {
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+	l.expires = time.Time{}
+	zerolog.SetGlobalLevel(l.Base)
+	l.Tracer.Enable(false)
+	l.Log.Info("log level reverted", "logLevel", l.Base.String(), "tracesDropped", l.Tracer.Dropped())
+}
+
+func (l *LogControl) state() gin.H {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := gin.H{
+		"level":   zerolog.GlobalLevel().String(),
+		"base":    l.Base.String(),
+		"trace":   l.Tracer.Enabled(),
+		"dropped": l.Tracer.Dropped(),
+	}
+	if !l.expires.IsZero() {
+		state["revertsAt"] = l.expires
+	}
+	return state
+}
+
+type logLevelRequest struct {
+	Level   string  `json:"level"`
+	Trace   bool    `json:"trace"`
+	Minutes float64 `json:"minutes"`
+	Revert  bool    `json:"revert"`
+}
+
+// LogLevelEndpoint is POST /api/v1/loglevel. {"level": "debug", "trace": true,
+// "minutes": 15} logs at debug and traces rTC payloads for 15 minutes, the
+// default being 10; {"revert": true} ends it early.
+func (l *LogControl) LogLevelEndpoint(c *gin.Context) {
+	var req logLevelRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be JSON like {\"level\": \"debug\", \"trace\": true, \"minutes\": 10}"})
+		return
+	}
+	if req.Revert {
+		l.Revert()
+		c.JSON(http.StatusOK, l.state())
+		return
+	}
+
+	level := zerolog.GlobalLevel()
+	if req.Level != "" {
+		level, err = zerolog.ParseLevel(req.Level)
+		if err != nil || level == zerolog.NoLevel {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "level must be one of trace, debug, info, warn, error, fatal, panic or disabled"})
+			return
+		}
+	}
+	if req.Minutes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "minutes must be positive"})
+		return
+	}
+	d := 10 * time.Minute
+	if req.Minutes > 0 {
+		d = time.Duration(req.Minutes * float64(time.Minute))
+	}
+	if d > l.MaxDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "changes can last at most " + l.MaxDuration.String()})
+		return
+	}
+
+	l.Set(level, req.Trace, d)
+	c.JSON(http.StatusOK, l.state())
+}
+
+// LogLevelStatus is GET /api/v1/loglevel.
+func (l *LogControl) LogLevelStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, l.state())
+}
+
+// PayloadTracer logs the XML of every command sent to the rTC and of its reply
+// while enabled. A busy run sends far more than anyone can read, so at most
+// PerSecond payloads are logged each second and the rest only counted.
+type PayloadTracer struct {
+	PerSecond int64
+	Log       Logger
+
+	enabled int32
+	dropped uint64
+
+	mu     sync.Mutex
+	second int64
+	count  int64
+}
+
+func CreatePayloadTracer(perSecond int64) *PayloadTracer {
+	return &PayloadTracer{PerSecond: perSecond, Log: ZerologLogger{}}
+}
+
+func (p *PayloadTracer) Enable(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&p.enabled, v)
+}
+
+// Enabled is safe to call on a nil tracer, which is never enabled.
+func (p *PayloadTracer) Enabled() bool {
+	return p != nil && atomic.LoadInt32(&p.enabled) == 1
+}
+
+func (p *PayloadTracer) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Trace logs a payload sent to or received from the rTC when tracing is enabled.
+func (p *PayloadTracer) Trace(command, direction, payload string) {
+	if !p.Enabled() {
+		return
+	}
+	if !p.take() {
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	}
+	p.Log.Info("rtc payload", "command", command, "direction", direction, "payload", payload)
+}
+
+func (p *PayloadTracer) take() bool {
+	if p.PerSecond <= 0 {
+		return true
+	}
+	now := time.Now().Unix()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now != p.second {
+		p.second = now
+		p.count = 0
+	}
+	if p.count >= p.PerSecond {
+		return false
+	}
+	p.count++
+	return true
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -19,67 +23,1213 @@ import (
 // 2. every y seconds we are going to get the queue from the rTC
 // 3. every z seconds we are going to swap a vehicle from place 1 to place rand int [2:len(queue)]
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		runCleanup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mock-rtc" {
+		runMockRTC(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		runReport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trend" {
+		runTrend(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "experiment" {
+		runExperiment(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bisect" {
+		runBisect(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "max-throughput" {
+		runMaxThroughput(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		runSign(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		runCerts(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "canary" {
+		runCanary(os.Args[2:])
+		return
+	}
+
 	// flags
 	queueCar := flag.Int("queue", 2, "number of seconds between car queueing")
 	getQueue := flag.Int("get", 4, "number of seconds between calls to get queue")
 	moveCar := flag.Int("move", 6, "number of seconds between calls to move lead car")
 	rtcHost := flag.String("client", "192.168.1.80", "ip of rTC")
 	rtcPort := flag.Int("port", 20250, "port for rTC")
+	idStrategy := flag.String("id-strategy", "prefix", "order id allocation strategy: prefix, uuid or range")
+	idPrefix := flag.String("id-prefix", "", "prefix for order ids generated by this instance, LOAD-TESTING- followed by --instance by default")
+	idCoordinator := flag.String("id-coordinator", "", "base url of the tester issuing id ranges, required by the range strategy")
+	idBlockSize := flag.Int("id-block-size", 1000, "number of ids requested from the coordinator at a time")
+	serveIDRanges := flag.Bool("serve-id-ranges", false, "act as the id range coordinator for other testers")
+	idRangeState := flag.String("id-range-state", "id-ranges.db", "file the id range coordinator saves the next range to, so a restart doesn't issue ranges agents already hold")
+	reportTo := flag.String("report-to", "", "base url of the coordinator this agent streams its results to every --report-interval, for the live numbers of a distributed run; defaults to --id-coordinator")
+	reportInterval := flag.Duration("report-interval", 5*time.Second, "how often an agent reports its results to its coordinator, 0 to never report them")
+	globalMaxCommands := flag.Uint64("global-max-commands", 0, "as a coordinator, stop every agent once they sent this many commands between them, 0 for no limit")
+	globalMaxErrorRate := flag.Float64("global-max-error-rate", 0, "as a coordinator, stop every agent once more than this share of their commands failed, e.g. 0.05, 0 for no limit")
+	signKey := flag.String("sign-key", "", "ed25519 private key the run's files are signed with when it ends, see the sign and verify subcommands")
+	tlsCert := flag.String("tls-cert", "", "certificate this tester presents to its coordinator and agents, see the certs subcommand; with --tls-key and --tls-ca the api on :3001 only accepts clients with a certificate from the same ca")
+	tlsKey := flag.String("tls-key", "", "private key of --tls-cert")
+	tlsCA := flag.String("tls-ca", "", "ca certificate coordinator and agent certificates are checked against")
+	batchSize := flag.Int("batch", 1, "number of washes queued and deleted per message; 1 sends one command per message")
+	pipelineDepth := flag.Int("pipeline", 0, "number of commands the pipeline routine writes on one connection before reading their replies, for rTCs that take several framed messages per connection; 0 to not run it")
+	pipelineTime := flag.Int("pipeline-time", 5, "number of seconds between pipelines")
+	pipelineCommands := flag.String("pipeline-commands", "get", "comma separated commands pipelines are filled with in turn, get or queue")
+	statusTime := flag.Int("status", 0, "number of seconds between reads of the tunnel's state, running, stopped or fault, by the status routine; 0 to not run it")
+	tunnelChaosTime := flag.Int("tunnel-chaos", 0, "number of seconds between the windows the tunnel chaos routine pauses the tunnel for during load; 0 to not run it")
+	tunnelChaosWindow := flag.Duration("tunnel-chaos-window", 30*time.Second, "how long the tunnel chaos routine keeps the tunnel paused, shorter than --tunnel-chaos")
+	headTime := flag.Int("head", 0, "number of seconds between washes the head routine queues at the head of the queue with addHead, to have the rTC reorder its queue; 0 to not run it")
+	modifyTime := flag.Int("modify", 0, "number of seconds between package changes of a random test wash by the modify routine, with setWashPkg; 0 to not run it")
+	modifyPackages := flag.String("modify-packages", "", "comma separated packages the modify routine switches test washes to and back from, which only test washes may use as they are deleted at the end of the run")
+	scenarioPath := flag.String("scenario", "", "path to a scenario JSON file with additional workloads")
+	registryPath := flag.String("registry", "wash-registry.db", "path of the registry of queued washes used by the cleanup subcommand, empty to disable")
+	instance := flag.String("instance", defaultInstanceName(), "name this instance registers its washes under")
+	closeMode := flag.String("close-mode", "graceful", "how connections to the rTC are closed: graceful or immediate")
+	verifyDeletes := flag.Bool("verify-deletes", false, "re-read the queue after every delete to verify the wash is gone, the same as --verify delete=100")
+	verify := flag.String("verify", "", "percentage of adds, moves, deletes and package changes verified by re-reading the queue straight after them, e.g. queue=10,move=5,delete=100,modify=20")
+	closeTimeout := flag.Duration("close-timeout", 500*time.Millisecond, "maximum time a graceful close waits for the rTC to close its end")
+	connections := flag.Int("connections", 0, "keep this many persistent connections to the rTC open and send every command over them, 0 to dial a connection per command")
+	failOnWriteErrors := flag.Int("fail-on-write-errors", 0, "stop the run after this many consecutive failed CSV writes, 0 to keep running")
+	strict := flag.Bool("strict", false, "fail fast on invalid configuration and ticker times instead of falling back to defaults")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long stopping waits for operations already sent to the rTC to finish before flushing results and cleaning up")
+	cleanupOnStop := flag.Bool("cleanup-on-stop", false, "delete the routines' washes when /stop is called instead of waiting for /cleanup/confirm")
+	lenient := flag.Bool("lenient", false, "fall back to defaults on invalid configuration and ticker times (the default)")
+	gogc := flag.Int("gogc", 0, "garbage collection target percentage, 0 keeps the runtime default and -1 turns the collector off")
+	ballastMB := flag.Int("ballast-mb", 0, "megabytes of heap ballast allocated at startup to make the collector run less often at high rates")
+	markerInterval := flag.Duration("marker-interval", 0, "how often a marker command with a correlation id is sent for lining up rTC logs, 0 to disable")
+	markerXML := flag.String("marker-xml", defaultMarkerXML, "marker command sent to the rTC, %s is replaced by the correlation id")
+	washIDJump := flag.Int("wash-id-jump", 1000, "gap between consecutive wash ids issued by the rTC that is flagged, 0 to disable")
+	washIDReuseWindow := flag.Duration("wash-id-reuse-window", 10*time.Minute, "how long deleted wash ids are remembered to detect the rTC reusing them")
+	pauseHostCPU := flag.Float64("pause-host-cpu", 0, "pause load while the host's cpu use is above this percentage, 0 to disable")
+	pauseHostMemory := flag.Float64("pause-host-memory", 0, "pause load while the host's memory use is above this percentage, 0 to disable")
+	pauseFDs := flag.Int("pause-fds", 0, "pause load while the tester has more than this many open file descriptors, 0 to disable")
+	rampFrom := flag.Duration("ramp-from", 0, "interval the ramped routines start at, e.g. 5s; ramping is off unless set")
+	rampTo := flag.Duration("ramp-to", 0, "interval the ramped routines end the ramp at, e.g. 200ms")
+	rampDuration := flag.Duration("ramp-duration", 10*time.Minute, "time taken to ramp from --ramp-from to --ramp-to")
+	rampShape := flag.String("ramp-shape", "linear", "how the rate grows during the ramp: linear or exponential")
+	rampRoutines := flag.String("ramp-routines", "queue,move,get", "comma separated routines the ramp applies to")
+	diurnalCars := flag.Int("diurnal-cars", 0, "shape the run like a site's day that queues this many cars; the queue interval becomes 24h/cars and is 0 to disable")
+	diurnalStart := flag.String("diurnal-start", "", "time of day the run starts at in the diurnal profile, e.g. 06:00, defaults to the current time")
+	diurnalOpen := flag.String("diurnal-open", "07:00", "time of day the site opens and the morning ramp starts")
+	diurnalPeak := flag.String("diurnal-peak", "12:30", "time of day of the lunchtime peak")
+	diurnalClose := flag.String("diurnal-close", "20:00", "time of day the site closes after the evening decay")
+	diurnalRoutines := flag.String("diurnal-routines", "queue,move,get", "comma separated routines that follow the day's shape")
+	openModel := flag.Bool("open-model", false, "fire queues and moves at their scheduled rate without waiting for earlier ones to complete")
+	maxInFlight := flag.Int("max-inflight", 0, "most commands sent to the rTC at once across every routine and worker, 0 for no cap; the time a command waited is recorded in the Wait Ms column")
+	retain := flag.Bool("retain", false, "leave the washes queue workers add queued instead of deleting each straight away, and bound the washes the queue routine and workers leave queued with --retain-max and --retain-ttl")
+	retainMax := flag.Int("retain-max", 100, "most washes left queued with --retain, the oldest are deleted to make room; 0 for no max")
+	retainTTL := flag.Duration("retain-ttl", 10*time.Minute, "how long a wash is left queued with --retain before it's deleted; 0 to keep it until the run ends")
+	openModelMax := flag.Int("open-model-max-in-flight", 100, "most queue and move operations in flight at once in the open model; ticks over the cap are dropped")
+	grafanaURL := flag.String("grafana-url", "", "base url of Grafana to add the run's annotations to, e.g. http://grafana:3000")
+	grafanaToken := flag.String("grafana-token", os.Getenv("GRAFANA_TOKEN"), "Grafana api token for annotations, defaults to $GRAFANA_TOKEN")
+	queueWorkers := flag.Int("queue-workers", 0, "concurrent virtual users each queueing a wash and deleting it again as fast as the rTC allows, on top of the queue routine")
+	getWorkers := flag.Int("get-workers", 0, "concurrent virtual users each reading the queue as fast as the rTC allows, on top of the get routine")
+	moveWorkers := flag.Int("move-workers", 0, "concurrent virtual users each moving a wash as fast as the rTC allows, on top of the move routine")
+	burstSize := flag.Int("burst", 1, "operations each tick of the burst routines sends at once instead of one")
+	burstRoutines := flag.String("burst-routines", "queue,get,move", "comma separated routines that send --burst operations per tick")
+	replayPath := flag.String("replay", "", "load-test.csv of a recorded run, e.g. a canary day, whose queue, get and move commands are replayed in order instead of running the routines")
+	replaySpeed := flag.String("speed", "1x", "replay speed multiplier, e.g. 2x to replay twice as fast or 0.5x at half speed")
+	replayMaxRate := flag.Float64("replay-max-rate", 0, "most commands per second a replay sends however fast it is sped up, 0 for no cap")
+	mixSpec := flag.String("mix", "", "weighted mix of operations sent by a shared pool of workers instead of the queue, get and move routines, e.g. queue=70,get=20,move=10")
+	mixWorkers := flag.Int("mix-workers", 1, "concurrent virtual users sending the --mix, each waiting --worker-think between operations")
+	workerThink := flag.Duration("worker-think", 0, "time each virtual user waits between its operations")
+	siteConfigPath := flag.String("site-config", "", "path to a JSON file of the most load each site takes safely, by site id; runs over the caps of --site are refused")
+	site := flag.String("site", "", "id of the site under test, whose caps in --site-config the run has to stay within")
+	overrideSiteCaps := flag.Bool("override-site-caps", false, "run even when the load is over the caps of --site, e.g. to find a site's limits")
+	siteTimezone := flag.String("site-timezone", "", "IANA time zone of the site, e.g. America/Chicago, noted in the manifest; defaults to the tester's zone. Results are always recorded in UTC")
+	purpose := flag.String("purpose", "", "why the run is done, recorded in the manifest and report")
+	operator := flag.String("operator", "", "name of the person running the test, recorded in the manifest and report")
+	firmware := flag.String("firmware", "", "firmware version of the rTC under test, recorded in the manifest and report")
+	noPrompt := flag.Bool("no-prompt", false, "don't ask for a missing purpose, operator or firmware when run from a terminal")
+	sloPath := flag.String("slo", "", "path to a JSON file of latency and error rate limits per command that the run is evaluated against")
+	retryAttempts := flag.Int("retry-attempts", 1, "most times a command is sent when it fails transiently, 1 never retries; retried commands are recorded as e.g. \"GET retries=1\"")
+	retryBackoff := flag.Duration("retry-backoff", 100*time.Millisecond, "wait before the first retry, doubled for every further one")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", 2*time.Second, "longest wait between retries")
+	retryJitter := flag.Float64("retry-jitter", 0.2, "share of the wait between retries it randomly varies by")
+	retryOn := flag.String("retry-on", RetryDial, "comma separated failures retried: dial (refused or timed out) and read-timeout, which may send a command the rTC took twice")
+	retryBudget := flag.Float64("retry-budget", 0.1, "retries allowed per command sent across the run, 0 for no budget")
+	retryBudgetBurst := flag.Float64("retry-budget-burst", 10, "retries the budget allows before any commands were sent")
+	prewarm := flag.Bool("prewarm", false, "open and probe the --connections before load starts, and --prewarm-lead before every phase of --steps")
+	prewarmLead := flag.Duration("prewarm-lead", 5*time.Second, "how long before a phase of --steps the connections are prewarmed")
+	dialTimeout := flag.Duration("dial-timeout", defaultTimeouts.Dial, "time a command may take to connect to the rTC")
+	writeTimeout := flag.Duration("write-timeout", defaultTimeouts.Write, "time a command may take to be written once connected")
+	readTimeout := flag.Duration("read-timeout", defaultTimeouts.Read, "time the rTC has to reply once a command was written")
+	commandTimeouts := flag.String("timeouts", "", "timeouts of single commands overriding the ones above, e.g. GET.read=500ms,QUEUE.dial=1s; changeable at /api/v1/timeouts")
+	lanes := flag.String("lanes", "", "comma separated lanes washes are queued to, e.g. 1,2,3,4; sent with every add and recorded with the command, otherwise lane 4 is assumed and not sent")
+	laneOrder := flag.String("lane-order", "round-robin", "how lanes are picked from --lanes, round-robin or random")
+	auth := addAuthFlags(flag.CommandLine, authUse)
+	tunnel := flag.String("tunnel", "", "tunnel of the rTC commands are addressed to, for controllers running several tunnels with a queue each; scenario instances, sequences, scripts and commands may name their own")
+	disconnectCapture := flag.String("disconnect-capture", "", "shell command run when the rTC ends a connection before replying, e.g. to save its logs; gets RTC_COMMAND, RTC_DISCONNECT and RUN_DIR")
+	disconnectCooldown := flag.Duration("disconnect-capture-cooldown", time.Minute, "least time between two runs of --disconnect-capture")
+	events := flag.Bool("events", false, "subscribe to the events the rTC pushes as cars go through the tunnel on a connection of its own and record them to events.csv")
+	eventsReconnect := flag.Duration("events-reconnect", 5*time.Second, "how long the event listener waits before subscribing again after losing its connection")
+	metricsPath := flag.String("metrics", "", "path to a JSON file of derived metrics, expressions over each record's times such as \"rtt_ms - write_ms\", shown in the status, Prometheus metrics and report")
+	warmUpDuration := flag.Duration("warm-up", 0, "time at the start of the run whose records are tagged with a warm-up phase and left out of summaries")
+	warmUpExclude := flag.Bool("warm-up-exclude", false, "don't write records sent during the warm-up at all instead of tagging them")
+	rebaseline := flag.Bool("rebaseline", false, "once the run ends, repeat the --warm-up's load for as long before stopping and flag the commands whose latency got significantly worse than during the warm-up, a hint the controller degraded under stress")
+	leakHunt := flag.Bool("leak-hunt", false, "hunt controller leaks: hold a constant, low load for many hours and fit the trend of every command's median latency and failure rate over the run for a verdict in the summary and report")
+	leakHuntMaxRate := flag.Float64("leak-hunt-max-rate", 1, "most operations per second in total a leak hunt may send")
+	leakGrowth := flag.Float64("leak-growth", defaultLeakGrowth, "share a command's fitted median latency may grow by over a leak hunt before it is flagged, e.g. 0.25 for 25%")
+	leakErrorGrowth := flag.Float64("leak-error-growth", defaultLeakErrorGrowth, "most a command's fitted failure rate may rise by over a leak hunt before it is flagged, e.g. 0.01 for one percentage point")
+	rebaselineThreshold := flag.Float64("rebaseline-threshold", defaultRebaselineThreshold, "share a command's p50 or p95 latency during the re-baseline may be above the warm-up's before it is flagged, e.g. 0.5 for 50%")
+	stepsPath := flag.String("steps", "", "path to a YAML or CSV step profile of phases setting the queue, get and move intervals; results get a Phase column")
+	var surges surgeFlags
+	flag.Var(&surges, "surge", "multiply the rate of the surge routines for a window of the run, START:DURATION:FACTOR[:LABEL] e.g. 2h:45m:3:post-rain; repeatable")
+	surgeRoutines := flag.String("surge-routines", "queue", "comma separated routines that surge")
+	spikeEvery := flag.Duration("spike-every", 0, "length of a spike cycle: baseline load, then a spike at its end; spikes are off unless set")
+	spikeDuration := flag.Duration("spike-duration", time.Minute, "length of each spike")
+	spikeFactor := flag.Float64("spike-factor", 5, "factor the rate of the spiked routines is multiplied by during a spike")
+	spikeRoutines := flag.String("spike-routines", "queue,move", "comma separated routines that spike")
+	sinePeriod := flag.Duration("sine-period", 0, "period of a sine wave the rate of the sine routines follows, starting at its trough, e.g. 1h for a day of traffic in an hour; off unless set")
+	sineAmplitude := flag.Float64("sine-amplitude", 0.8, "share of the base rate the sine wave swings by either side of it, between 0 and 1")
+	sineRoutines := flag.String("sine-routines", "queue", "comma separated routines that follow the sine wave")
+	throttleErrorRate := flag.Float64("throttle-error-rate", 0, "share of rTC commands failing to connect or get a reply above which the throttled routines back off; off unless set")
+	throttleWindow := flag.Duration("throttle-window", 10*time.Second, "how often the rTC error rate is checked and the throttled rate adjusted")
+	throttleBackoff := flag.Float64("throttle-backoff", 0.5, "factor the throttled rate is multiplied by each window the error rate is too high")
+	throttleRecovery := flag.Float64("throttle-recovery", 0.1, "share of the configured rate added back each window the error rate is below the threshold")
+	throttleMin := flag.Float64("throttle-min", 0.05, "lowest share of the configured rate the throttled routines back off to")
+	throttleRoutines := flag.String("throttle-routines", "queue,move", "comma separated routines that back off when the rTC is failing")
+	backfillMissed := flag.Bool("backfill-missed-ticks", false, "add a result per tick a routine was too busy to take, sent when it was due and completed with the command that went out late, so latencies aren't understated by a slow rTC")
+	queueOffset := flag.Duration("queue-offset", 0, "delay before the queue routine's first tick")
+	getOffset := flag.Duration("get-offset", 0, "delay before the get routine's first tick")
+	moveOffset := flag.Duration("move-offset", 0, "delay before the move routine's first tick")
+	stagger := flag.Bool("stagger", false, "add a random delay within each routine's interval to its offset so queue, get and move don't tick together")
+	startAt := flag.String("start-at", "", "wait to start load until this time of day, e.g. 02:00, or RFC 3339 timestamp")
+	stopAt := flag.String("stop-at", "", "end the run like --duration at this time of day, e.g. 04:00, or RFC 3339 timestamp; a time of day is taken after the start")
+	rateGapTolerance := flag.Float64("rate-gap-tolerance", 0.1, "share of the offered operations a second may fall short by before it counts towards a rate gap")
+	rateGapSeconds := flag.Int("rate-gap-seconds", 10, "seconds in a row the achieved rate has to fall short of the offered rate to be flagged as a gap")
+	progressInterval := flag.Duration("progress-interval", time.Minute, "how often to log the percent complete and ETA of a run bounded by --duration, --stop-at, --max-ops, --max-commands or --replay, 0 to never log it")
+	duration := flag.Duration("duration", 0, "stop the run after this long, delete its test washes and exit with a summary, 0 to run until stopped")
+	maxOps := flag.String("max-ops", "", "stop the run like --duration after exactly this many queue, get and move operations, either in total, e.g. 1000, or per routine, e.g. queue=500,get=1000")
+	maxCommands := flag.String("max-commands", "", "stop the run like --duration after exactly this many rTC commands of every routine, either in total, e.g. 10000, or per command as recorded, e.g. QUEUE=10000,GET=5000; commands over it aren't sent")
+	simulate := flag.Duration("simulate", 0, "simulate this much time against an in-process mock rTC as fast as possible, then write the report and exit")
+	simulateWashTime := flag.Duration("simulate-wash-time", 2*time.Second, "time the simulated rTC takes to wash each car; the queue grows without bound when cars are queued faster")
+	resultsDir := flag.String("results-dir", "", "directory the run's results are written to, defaults to <date>/<time>")
+	appendResults := flag.Bool("append-results", false, "append to the results already in --results-dir, e.g. when a continuous run is restarted, after a restart marker row; fails when their columns differ instead of writing load-test.csv+1")
+	historyRoot := flag.String("history-root", ".", "directory the run history page lists runs under")
+	resourceInterval := flag.Duration("resource-interval", 5*time.Second, "how often the tester's own cpu, memory, descriptors and network usage are recorded, 0 to disable")
+	seedFlag := flag.Int64("seed", 0, "seed of the routines' random choices such as move targets and stagger, recorded in the manifest so a run can be repeated; 0 picks one")
+	logLevel := flag.String("log-level", "debug", "level the run logs at; POST /api/v1/loglevel changes it for a while")
+	traceRate := flag.Int64("trace-rate", 20, "most rTC payloads logged per second while tracing is enabled through /api/v1/loglevel, 0 for no limit")
+	extract := flag.String("extract-assets", "", "write the built in report templates and example presets to this directory and exit")
 
 	flag.Parse()
 
+	if *extract != "" {
+		err := extractAssets(*extract)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", *extract).Msg("unable to extract assets")
+		}
+		log.Info().Str("dir", *extract).Msg("assets extracted")
+		return
+	}
+
+	baseLevel, err := zerolog.ParseLevel(*logLevel)
+	if err != nil || baseLevel == zerolog.NoLevel {
+		log.Fatal().Str("level", *logLevel).Msg("--log-level must be one of trace, debug, info, warn, error, fatal, panic or disabled")
+	}
+	logControl := CreateLogControl(baseLevel, CreatePayloadTracer(*traceRate))
+
+	if *strict && *lenient {
+		log.Fatal().Msg("--strict and --lenient are mutually exclusive")
+	}
+	if *globalMaxErrorRate < 0 || *globalMaxErrorRate >= 1 {
+		log.Fatal().Msg("--global-max-error-rate must be between 0 and 1")
+	}
+
+	var start, stop time.Time
+	if *startAt != "" || *stopAt != "" {
+		if *simulate > 0 {
+			log.Fatal().Msg("--start-at and --stop-at can't be used with --simulate")
+		}
+		if *stopAt != "" && *duration > 0 {
+			log.Fatal().Msg("--stop-at and --duration are mutually exclusive")
+		}
+		var err error
+		if *startAt != "" {
+			start, err = nextScheduled(*startAt, time.Now())
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid --start-at")
+			}
+		}
+		if *stopAt != "" {
+			from := time.Now()
+			if !start.IsZero() {
+				from = start
+			}
+			stop, err = nextScheduled(*stopAt, from)
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid --stop-at")
+			}
+		}
+	}
+	if *strict {
+		err := validateStrictConfig(map[string]int{
+			"queue":         *queueCar,
+			"get":           *getQueue,
+			"move":          *moveCar,
+			"batch":         *batchSize,
+			"id-block-size": *idBlockSize,
+		}, *closeTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid configuration in strict mode")
+		}
+	}
+
+	effectiveGOGC := tuneGC(*gogc, *ballastMB)
+
+	var fakeClock *FakeClock
+	if *simulate > 0 {
+		fakeClock = CreateFakeClock(time.Now())
+		SetClock(fakeClock)
+
+		mock := CreateMockRTC(*simulateWashTime)
+		addr, err := mock.Start("127.0.0.1:0")
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to start simulated rTC")
+		}
+		defer mock.Close()
+		*rtcHost = addr.IP.String()
+		*rtcPort = addr.Port
+		// simulated washes must never end up in the registry used to clean the real rTC
+		*registryPath = ""
+	}
+
 	// csv creation
-	t := time.Now().String()
-	date, err := time.Parse("DateOnly", t)
+	now := time.Now()
+	dir := filepath.Join(now.Format(time.DateOnly), now.Format("150405"))
+	if *resultsDir != "" {
+		dir = *resultsDir
+	}
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
-		log.Fatal().Err(err).Msg("error parsing current time to date only")
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create results directory")
 		panic(err)
 	}
-	time, err := time.Parse("TimeOnly", t)
+
+	var slo *SLO
+	if *sloPath != "" {
+		slo, err = LoadSLO(*sloPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("slo", *sloPath).Msg("unable to load slo")
+			panic(err)
+		}
+		err = slo.Write(dir)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", dir).Msg("unable to copy slo into results directory")
+			panic(err)
+		}
+	}
+
+	var derivedMetrics *DerivedMetrics
+	if *metricsPath != "" {
+		derivedMetrics, err = LoadDerivedMetrics(*metricsPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("metrics", *metricsPath).Msg("unable to load metrics")
+			panic(err)
+		}
+		err = derivedMetrics.Write(dir)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", dir).Msg("unable to copy metrics into results directory")
+			panic(err)
+		}
+	}
+
+	manifest := CreateManifest(now, *instance, effectiveGOGC)
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	manifest.Seed = seed
+	log.Info().Int64("seed", seed).Msg("seeded random choices, pass --seed to repeat them")
+	if *siteTimezone != "" {
+		err = manifest.SetTimezone(*siteTimezone)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --site-timezone")
+			panic(err)
+		}
+	}
+	manifest.Notes = RunNotes{Purpose: *purpose, Operator: *operator, Firmware: *firmware}
+	if len(manifest.Notes.Missing()) > 0 && !*noPrompt && *simulate == 0 && interactive() {
+		manifest.Notes.Prompt(os.Stdin, os.Stderr)
+	}
+	if missing := manifest.Notes.Missing(); len(missing) > 0 {
+		log.Warn().Strs("missing", missing).Msg("run notes missing, the results won't say who ran the test or why")
+	}
+	err = manifest.Write(dir)
 	if err != nil {
-		log.Fatal().Err(err).Msg("error parsing current time to time only")
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to write run manifest")
 		panic(err)
 	}
 
-	fileName := fmt.Sprintf("%s/%s/load-test.csv", date, time)
-	_, err = os.Stat(fileName)
-	var f *os.File
-	if os.IsNotExist(err) {
-		f, err = os.Create(fileName)
-	} else {
+	fileName := filepath.Join(dir, "load-test.csv")
+	if _, err := os.Stat(fileName); err == nil && !*appendResults {
 		fileName = fmt.Sprintf("%s+1", fileName)
-		f, err = os.Create(fileName)
 	}
 
+	var steps *StepProfile
+	// the file is opened once the columns are known, to check them against
+	// the ones of the results appended to
+	resultWriter := CreateResultWriter(nil)
+	if *stepsPath != "" {
+		steps, err = LoadStepProfile(*stepsPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("steps", *stepsPath).Msg("unable to load step profile")
+			panic(err)
+		}
+		resultWriter.Phase = steps.Label
+	}
+	var warmUp *WarmUp
+	if *warmUpDuration > 0 {
+		warmUp = CreateWarmUp(*warmUpDuration, resultWriter.Phase)
+		if *warmUpExclude {
+			resultWriter.Exclude = warmUp.Active
+		} else {
+			resultWriter.Phase = warmUp.Phase
+		}
+	}
+	if *rebaseline {
+		switch {
+		case warmUp == nil || *warmUpExclude:
+			log.Fatal().Msg("--rebaseline needs a --warm-up whose records are kept to compare to")
+		case *simulate > 0 || *mixSpec != "" || *replayPath != "":
+			log.Fatal().Msg("--rebaseline can't be used with --simulate, --mix or --replay")
+		case *rebaselineThreshold <= 0:
+			log.Fatal().Msg("--rebaseline-threshold must be positive")
+		}
+	}
+	if *maxInFlight < 0 {
+		log.Fatal().Int("maxInFlight", *maxInFlight).Msg("--max-inflight can't be negative")
+	}
+	if *leakHunt {
+		switch {
+		case *mixSpec != "" || *replayPath != "":
+			log.Fatal().Msg("--leak-hunt can't be used with --mix or --replay, its load has to be constant")
+		case *throttleErrorRate > 0 || *tunnelChaosTime > 0:
+			log.Fatal().Msg("--leak-hunt can't be used with --throttle-error-rate or --tunnel-chaos, its load has to be constant")
+		case *leakHuntMaxRate <= 0 || *leakGrowth <= 0 || *leakErrorGrowth <= 0:
+			log.Fatal().Msg("--leak-hunt-max-rate, --leak-growth and --leak-error-growth must be positive")
+		}
+		span := *duration
+		if *simulate > 0 {
+			span = *simulate
+		}
+		if span > 0 && span < recommendedLeakSpan {
+			log.Warn().Dur("duration", span).Dur("recommended", recommendedLeakSpan).Msg("leak hunt is short, a slow leak may not show")
+		}
+	}
+	if *events {
+		switch {
+		case *simulate > 0:
+			log.Fatal().Msg("--events can't be used with --simulate")
+		case *eventsReconnect <= 0:
+			log.Fatal().Msg("--events-reconnect must be positive")
+		}
+	}
+	if *maxInFlight > 0 {
+		resultWriter.Columns = []string{waitHeader}
+	}
+	resultWriter.Columns = append(resultWriter.Columns, orderIDHeader)
+	var scenario *Scenario
+	if *scenarioPath != "" {
+		scenario, err = LoadScenario(*scenarioPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("scenario", *scenarioPath).Msg("unable to load scenario")
+			panic(err)
+		}
+		if len(scenario.Instances) > 0 || len(scenario.Streams) > 0 {
+			resultWriter.Columns = append(resultWriter.Columns, scenarioHeader)
+		}
+	}
+	_, appended, err := resultWriter.Open(fileName, *appendResults)
 	if err != nil {
 		log.Fatal().Err(err).Str("fileName", fileName).Msg("unable to create csv file")
 		panic(err)
 	}
+	if appended {
+		log.Info().Str("fileName", fileName).Msg("appending to the results of an earlier start")
+	}
+	go watchWriteErrors(resultWriter, *failOnWriteErrors)
+
+	if *closeMode != "graceful" && *closeMode != "immediate" {
+		log.Fatal().Str("closeMode", *closeMode).Msg("close mode must be graceful or immediate")
+	}
 
-	csvWriter := csv.NewWriter(f)
-	err = csvWriter.Write([]string{"rTC Command", "Connected", "Command Initiated", "Command Retrieved", "Closed", "Error", "Error Message"})
+	mtls := MutualTLS{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}
+	// streams allocate order ids behind prefixes of their own the same way
+	newIDs := func(prefix string) (IDAllocator, error) {
+		ids, err := CreateIDAllocator(*idStrategy, prefix, *idCoordinator, *idBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		if ranges, ok := ids.(*RangeAllocator); ok && mtls.Enabled() {
+			config, err := mtls.ClientConfig()
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to set up mutual tls to the coordinator")
+			}
+			ranges.UseTLS(config)
+		}
+		return ids, nil
+	}
+	if *idPrefix == "" {
+		*idPrefix = defaultIDPrefix(*instance)
+	}
+	ids, err := newIDs(*idPrefix)
 	if err != nil {
-		log.Fatal().Err(err).Str("fileName", fileName).Msg("error writing headers to csv file")
+		log.Fatal().Err(err).Str("strategy", *idStrategy).Msg("unable to create order id allocator")
 		panic(err)
 	}
 
 	// create and run routines
-	routines := CreateRoutines(*queueCar, *getQueue, *moveCar)
+	routines := CreateRoutines(*queueCar, *getQueue, *moveCar, ids)
 	routines.RTC = CreateRTCClient(*rtcHost, *rtcPort)
-	routines.Writer = csvWriter
-	routines.RunAll()
+	if *maxInFlight > 0 {
+		routines.RTC.MaxInFlight = CreateInFlightLimiter(*maxInFlight)
+	}
+	routines.RTC.Trace = logControl.Tracer
+	routines.RTC.Auth = auth()
+	routines.RTC.OrderIDs = true
+	routines.RTC.CloseMode = *closeMode
+	routines.RTC.CloseTimeout = *closeTimeout
+	if *dialTimeout <= 0 || *writeTimeout <= 0 || *readTimeout <= 0 {
+		log.Fatal().Msg("--dial-timeout, --write-timeout and --read-timeout must be positive")
+	}
+	routines.RTC.Timeouts = CreateCommandTimeouts(Timeouts{Dial: *dialTimeout, Write: *writeTimeout, Read: *readTimeout})
+	err = routines.RTC.Timeouts.Parse(*commandTimeouts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid --timeouts")
+	}
+	if *connections < 0 {
+		log.Fatal().Int("connections", *connections).Msg("--connections can't be negative")
+	}
+	if *connections > 0 {
+		routines.RTC.Pool = CreateConnPool(*connections, routines.RTC.dialConn)
+	} else if *prewarm {
+		log.Fatal().Msg("--prewarm needs --connections to keep the connections it opens")
+	}
+	if *verify != "" || *verifyDeletes {
+		spec := *verify
+		if *verifyDeletes {
+			spec += ",delete=100"
+		}
+		routines.RTC.Verify, err = ParseVerify(spec, CreateSeededRand(time.Now().UnixNano(), "verify"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --verify")
+		}
+	}
+	if *retryAttempts < 1 || *retryBackoff < 0 || *retryJitter < 0 || *retryJitter > 1 || *retryBudget < 0 {
+		log.Fatal().Msg("--retry-attempts must be at least 1, --retry-backoff and --retry-budget can't be negative and --retry-jitter is between 0 and 1")
+	}
+	if *retryAttempts > 1 {
+		retry := CreateRetryPolicy(*retryAttempts, *retryBackoff)
+		retry.MaxBackoff = *retryMaxBackoff
+		retry.Jitter = *retryJitter
+		retry.On, err = ParseRetryOn(*retryOn)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --retry-on")
+		}
+		if *retryBudget > 0 {
+			retry.Budget = CreateRetryBudget(*retryBudget, *retryBudgetBurst)
+		}
+		routines.RTC.Retry = retry
+	}
+	if *maxOps != "" {
+		routines.RTC.Limit, err = parseOpLimit(*maxOps)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --max-ops")
+			panic(err)
+		}
+	}
+	if *maxCommands != "" {
+		routines.RTC.CommandLimit, err = parseCommandLimit(*maxCommands)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --max-commands")
+			panic(err)
+		}
+	}
+	if *registryPath != "" {
+		registry, err := OpenWashRegistry(*registryPath, *instance)
+		if err != nil {
+			log.Fatal().Err(err).Str("registry", *registryPath).Msg("unable to open wash registry")
+			panic(err)
+		}
+		routines.RTC.Registry = registry
+	}
+	routines.Writer = resultWriter
+	routines.QueueRoutine.BatchSize = *batchSize
+	if *retain {
+		if *retainMax < 0 || *retainTTL < 0 {
+			log.Fatal().Msg("--retain-max and --retain-ttl can't be negative")
+		}
+		routines.QueueRoutine.Retain = CreateQueueRetention(*retainMax, *retainTTL)
+	}
+	if *pipelineDepth < 0 {
+		log.Fatal().Int("pipeline", *pipelineDepth).Msg("--pipeline can't be negative")
+	}
+	if *pipelineDepth > 0 {
+		commands, err := ParsePipelineCommands(*pipelineCommands)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --pipeline-commands")
+		}
+		routines.Timed.Register(CreatePipelineRoutine(*pipelineTime, *pipelineDepth, commands, routines.QueueRoutine))
+	}
+	if *headTime < 0 {
+		log.Fatal().Int("head", *headTime).Msg("--head can't be negative")
+	}
+	if *modifyTime < 0 {
+		log.Fatal().Int("modify", *modifyTime).Msg("--modify can't be negative")
+	}
+	if *statusTime < 0 {
+		log.Fatal().Int("status", *statusTime).Msg("--status can't be negative")
+	}
+	if *tunnelChaosTime < 0 {
+		log.Fatal().Int("tunnel-chaos", *tunnelChaosTime).Msg("--tunnel-chaos can't be negative")
+	}
+	if *tunnelChaosTime > 0 {
+		routines.TunnelChaos = CreateTunnelChaosRoutine(*tunnelChaosTime, *tunnelChaosWindow)
+		err = routines.TunnelChaos.Validate()
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --tunnel-chaos-window")
+		}
+		routines.Timed.Register(routines.TunnelChaos)
+	}
+	if *statusTime > 0 {
+		routines.TunnelStatus = CreateStatusRoutine(*statusTime)
+		routines.Timed.Register(routines.TunnelStatus)
+	}
+	if *headTime > 0 {
+		routines.Timed.Register(CreateHeadRoutine(*headTime, routines.QueueRoutine))
+	}
+	if *modifyTime > 0 {
+		packages, err := ParseModifyPackages(*modifyPackages, routines.QueueRoutine.WashPackage)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --modify-packages")
+		}
+		routines.Modify = CreateModifyRoutine(*modifyTime, packages)
+		routines.Timed.Register(routines.Modify)
+	}
+	routines.Strict = *strict
+	if scenario != nil {
+		err = routines.AddInstances(scenario.Instances)
+		if err != nil {
+			log.Fatal().Err(err).Str("scenario", *scenarioPath).Msg("unable to create scenario instances")
+		}
+		err = routines.AddStreams(scenario.Streams, *idPrefix, newIDs)
+		if err != nil {
+			log.Fatal().Err(err).Str("scenario", *scenarioPath).Msg("unable to create scenario streams")
+		}
+	}
+	if *diurnalCars > 0 {
+		day, err := diurnalProfileFromFlags(*diurnalStart, *diurnalOpen, *diurnalPeak, *diurnalClose)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid diurnal profile")
+		}
+		names, err := parseRoutineNames(*diurnalRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid diurnal routines")
+		}
+		routines.QueueRoutine.Ticker.Set(24 * time.Hour / time.Duration(*diurnalCars))
+		routines.ApplyProfile(day, names)
+		log.Info().
+			Int("cars", *diurnalCars).
+			Dur("averageQueueInterval", routines.QueueRoutine.Ticker.Interval()).
+			Msg("running diurnal load profile")
+	}
+	if steps != nil {
+		for name := range steps.Routines() {
+			routines.ApplyProfile(steps.Routine(name), map[string]bool{name: true})
+		}
+	}
+	if *rampFrom > 0 || *rampTo > 0 {
+		ramp, err := CreateRampProfile(*rampFrom, *rampTo, *rampDuration, *rampShape)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid ramp")
+		}
+		names, err := parseRoutineNames(*rampRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid ramp routines")
+		}
+		routines.ApplyProfile(ramp, names)
+	}
+	if *spikeEvery > 0 {
+		spike, err := CreateSpikeProfile(*spikeEvery, *spikeDuration, *spikeFactor)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid spike")
+		}
+		names, err := parseRoutineNames(*spikeRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid spike routines")
+		}
+		routines.ApplyProfile(spike, names)
+	}
+	if *sinePeriod > 0 {
+		sine, err := CreateSineProfile(*sinePeriod, *sineAmplitude)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid sine wave")
+		}
+		names, err := parseRoutineNames(*sineRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid sine routines")
+		}
+		routines.ApplyProfile(sine, names)
+	}
+	var surge *SurgeProfile
+	surgeStart := clock.Now()
+	if len(surges) > 0 {
+		names, err := parseRoutineNames(*surgeRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid surge routines")
+		}
+		surge = &SurgeProfile{Windows: surges}
+		routines.ApplyProfile(surge, names)
+	}
+	routines.CleanupOnStop = *cleanupOnStop
+	routines.DrainTimeout = *drainTimeout
+	if *signKey != "" {
+		routines.SigningKey, err = LoadSigningKey(*signKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load signing key")
+		}
+	}
+	routines.WorkerThink = *workerThink
+	for name, workers := range map[string]int{"queue": *queueWorkers, "get": *getWorkers, "move": *moveWorkers} {
+		if workers == 0 {
+			continue
+		}
+		if *simulate > 0 && *workerThink <= 0 {
+			log.Fatal().Msg("simulated workers need a positive --worker-think, or they never let simulated time pass")
+		}
+		err := routines.AddWorkers(name, workers, *workerThink)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid workers")
+		}
+	}
+	if *burstSize != 1 {
+		if *burstSize < 1 {
+			log.Fatal().Int("burst", *burstSize).Msg("burst must be at least 1")
+		}
+		names, err := parseRoutineNames(*burstRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid burst routines")
+		}
+		if names["queue"] {
+			routines.QueueRoutine.Burst = *burstSize
+		}
+		if names["get"] {
+			routines.GetRoutine.Burst = *burstSize
+		}
+		if names["move"] {
+			routines.MoveRoutine.Burst = *burstSize
+		}
+	}
+	if *replayPath != "" {
+		if *mixSpec != "" {
+			log.Fatal().Msg("--replay and --mix can't be used together")
+		}
+		speed, err := parseMultiplier(*replaySpeed)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid replay speed")
+		}
+		if *replayMaxRate < 0 {
+			log.Fatal().Float64("maxRate", *replayMaxRate).Msg("replay max rate can't be negative")
+		}
+		events, err := LoadReplay(*replayPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load replay")
+		}
+		routines.SetReplay(events, speed, *replayMaxRate)
+	}
+	if *mixSpec != "" {
+		if *simulate > 0 && *workerThink <= 0 {
+			log.Fatal().Msg("a simulated mix needs a positive --worker-think, or it never lets simulated time pass")
+		}
+		err := routines.SetMix(*mixSpec, *mixWorkers, *workerThink)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid mix")
+		}
+	}
+	if *openModel {
+		if *openModelMax <= 0 {
+			log.Fatal().Int("max", *openModelMax).Msg("open model in-flight cap must be positive")
+		}
+		open := CreateOpenModel(*openModelMax)
+		routines.QueueRoutine.Open = open
+		routines.MoveRoutine.Open = open
+	}
+	routines.QueueRoutine.Offset = *queueOffset
+	routines.GetRoutine.Offset = *getOffset
+	routines.MoveRoutine.Offset = *moveOffset
+	if *stagger {
+		jitter := CreateSeededRand(seed, "stagger")
+		routines.QueueRoutine.Offset += time.Duration(jitter.Int63n(int64(routines.QueueRoutine.Ticker.Interval())))
+		routines.GetRoutine.Offset += time.Duration(jitter.Int63n(int64(routines.GetRoutine.Ticker.Interval())))
+		routines.MoveRoutine.Offset += time.Duration(jitter.Int63n(int64(routines.MoveRoutine.Ticker.Interval())))
+		log.Info().
+			Dur("queue", routines.QueueRoutine.Offset).
+			Dur("get", routines.GetRoutine.Offset).
+			Dur("move", routines.MoveRoutine.Offset).
+			Msg("staggered routine start offsets")
+	}
+
+	if *leakHunt {
+		err = routines.CheckLeakHunt(*leakHuntMaxRate)
+		if err != nil {
+			log.Fatal().Err(err).Msg("refusing to hunt leaks")
+		}
+		log.Info().Float64("opsPerSecond", routines.PlannedLoad().Total).Msg("hunting leaks with a constant load")
+	}
+	var leakThresholds *LeakThresholds
+	if *leakHunt {
+		leakThresholds = &LeakThresholds{Growth: *leakGrowth, ErrorGrowth: *leakErrorGrowth}
+	}
+
+	if *siteConfigPath != "" {
+		if *site == "" {
+			log.Fatal().Msg("--site-config needs the --site under test")
+		}
+		siteConfig, err := LoadSiteConfig(*siteConfigPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --site-config")
+		}
+		check, err := routines.CheckSite(siteConfig, *site, *overrideSiteCaps)
+		if err != nil {
+			log.Fatal().Err(err).Msg("refusing to run, use --override-site-caps to run all the same")
+		}
+		switch {
+		case check.Caps == nil:
+			log.Warn().Str("site", *site).Str("config", *siteConfigPath).Msg("no caps recorded for site, its load isn't checked")
+		case check.Overridden:
+			log.Warn().Str("site", *site).Strs("violations", check.Violations).Msg("load is over the site's caps, running all the same as overridden")
+		default:
+			log.Info().Str("site", *site).Float64("opsPerSecond", check.Planned.Total).Msg("load is within the site's caps")
+		}
+		manifest.Site = check
+		err = manifest.Write(dir)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", dir).Msg("unable to write run manifest")
+		}
+	}
+
+	stateWriter, _, err := CreateCSVWriter(filepath.Join(dir, "queue-states.csv"), queueStateHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create queue states csv file")
+		panic(err)
+	}
+	go watchWriteErrors(stateWriter, *failOnWriteErrors)
+	routines.GetRoutine.States = CreateQueueStateTracker(stateWriter)
+
+	washIDWriter, _, err := CreateCSVWriter(filepath.Join(dir, "wash-id-anomalies.csv"), washIDAnomalyHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create wash id anomalies csv file")
+		panic(err)
+	}
+	go watchWriteErrors(washIDWriter, *failOnWriteErrors)
+	routines.RTC.WashIDs = CreateWashIDTracker(washIDWriter)
+	routines.RTC.WashIDs.Jump = *washIDJump
+	routines.RTC.WashIDs.ReuseWindow = *washIDReuseWindow
+
+	annotationWriter, _, err := CreateCSVWriter(filepath.Join(dir, "annotations.csv"), annotationHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create annotations csv file")
+		panic(err)
+	}
+	go watchWriteErrors(annotationWriter, *failOnWriteErrors)
+	annotator := CreateAnnotator(annotationWriter, "rtc-load-test", *instance)
+	annotator.GrafanaURL = *grafanaURL
+	annotator.GrafanaToken = *grafanaToken
+	if appended {
+		now := clock.Now()
+		annotator.Annotate(Annotation{Start: now, End: now, Label: "tester restarted"})
+	}
+	if surge != nil {
+		go surge.Annotate(surgeStart, annotator)
+	}
+	if routines.TunnelChaos != nil {
+		routines.TunnelChaos.Annotator = annotator
+	}
+	var baseline *Rebaseline
+	if *rebaseline {
+		baseline = CreateRebaseline(routines, warmUp, *rebaselineThreshold)
+		baseline.Annotator = annotator
+	}
+
+	rateWriter, _, err := CreateCSVWriter(filepath.Join(dir, "rates.csv"), rateHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create rates csv file")
+		panic(err)
+	}
+	go watchWriteErrors(rateWriter, *failOnWriteErrors)
+	routines.RTC.Rates = CreateRateMeter(rateWriter, annotator)
+	routines.RTC.Rates.Tolerance = 1 - *rateGapTolerance
+	routines.RTC.Rates.GapAfter = *rateGapSeconds
+	go routines.RTC.Rates.Run(make(chan struct{}))
+
+	var throttleWriter *ResultWriter
+	if *throttleErrorRate > 0 {
+		if *throttleBackoff <= 0 || *throttleBackoff >= 1 || *throttleRecovery <= 0 || *throttleMin <= 0 || *throttleMin > 1 {
+			log.Fatal().Msg("--throttle-backoff must be between 0 and 1, --throttle-recovery positive and --throttle-min between 0 and 1")
+		}
+		names, err := parseRoutineNames(*throttleRoutines)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid throttle routines")
+		}
+		throttleWriter, _, err = CreateCSVWriter(filepath.Join(dir, "throttle.csv"), throttleHeader, *appendResults)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", dir).Msg("unable to create throttle csv file")
+			panic(err)
+		}
+		go watchWriteErrors(throttleWriter, *failOnWriteErrors)
+		throttle := CreateThrottle(*throttleErrorRate, throttleWriter)
+		throttle.Window = *throttleWindow
+		throttle.Backoff = *throttleBackoff
+		throttle.Recovery = *throttleRecovery
+		throttle.MinFactor = *throttleMin
+		routines.RTC.Throttle = throttle
+		routines.ApplyProfile(throttle, names)
+		go throttle.Run(make(chan struct{}))
+	}
+
+	if *markerInterval > 0 {
+		if !strings.Contains(*markerXML, "%s") {
+			log.Fatal().Str("markerXml", *markerXML).Msg("marker xml must contain %s for the correlation id")
+		}
+		routines.Marker = CreateMarkerRoutine(*markerInterval, ids)
+		routines.Marker.XML = *markerXML
+	}
+
+	var resourceWriter *ResultWriter
+	if *resourceInterval > 0 {
+		resourceWriter, _, err = CreateCSVWriter(filepath.Join(dir, "resources.csv"), resourceHeader, *appendResults)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", dir).Msg("unable to create resources csv file")
+			panic(err)
+		}
+		go watchWriteErrors(resourceWriter, *failOnWriteErrors)
+
+		routines.Resources = CreateResourceSampler(*resourceInterval, make(chan bool))
+	}
+
+	pauseWriter, _, err := CreateCSVWriter(filepath.Join(dir, "pauses.csv"), pauseHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create pauses csv file")
+		panic(err)
+	}
+	go watchWriteErrors(pauseWriter, *failOnWriteErrors)
+	routines.Pauses = pauseWriter
+
+	watchdog := CreatePressureWatchdog(routines.RTC.Gate, pauseWriter)
+	watchdog.MaxHostCPUPercent = *pauseHostCPU
+	watchdog.MaxHostMemoryPercent = *pauseHostMemory
+	watchdog.MaxOpenFDs = *pauseFDs
+	if watchdog.Enabled() {
+		if routines.Resources == nil {
+			log.Fatal().Msg("pausing on resource pressure needs --resource-interval to be positive")
+		}
+		routines.Resources.Watchdog = watchdog
+	}
+	if routines.Resources != nil {
+		go routines.Resources.Run(routines.RTC, resourceWriter)
+	}
+
+	tickWriter, _, err := CreateCSVWriter(filepath.Join(dir, "ticks.csv"), ticksHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create ticks csv file")
+		panic(err)
+	}
+	go watchWriteErrors(tickWriter, *failOnWriteErrors)
+	routines.TrackSchedules(tickWriter, *backfillMissed)
+
+	disconnectWriter, _, err := CreateCSVWriter(filepath.Join(dir, "disconnects.csv"), disconnectHeader, *appendResults)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create disconnects csv file")
+		panic(err)
+	}
+	go watchWriteErrors(disconnectWriter, *failOnWriteErrors)
+	if *lanes != "" {
+		routines.RTC.Lanes, err = ParseLanes(*lanes, *laneOrder)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --lanes")
+		}
+	}
+
+	if err := ValidateTunnel(*tunnel); err != nil {
+		log.Fatal().Err(err).Msg("invalid --tunnel")
+	}
+	routines.RTC.Tunnel = *tunnel
+	routines.RTC.Tunnels = CreateTunnelStats()
+
+	routines.RTC.Disconnects = CreateDisconnectTracker(disconnectWriter)
+	routines.RTC.Disconnects.Capture = *disconnectCapture
+	routines.RTC.Disconnects.Cooldown = *disconnectCooldown
+	routines.RTC.Disconnects.Dir = dir
+
+	var eventWriter *ResultWriter
+	if *events {
+		eventWriter, _, err = CreateCSVWriter(filepath.Join(dir, "events.csv"), eventHeader, *appendResults)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", dir).Msg("unable to create events csv file")
+			panic(err)
+		}
+		go watchWriteErrors(eventWriter, *failOnWriteErrors)
+		routines.Events = CreateEventListener(routines.RTC, eventWriter, *eventsReconnect, make(chan bool))
+		go routines.Events.Run()
+	}
+
+	sla := &SLAConfig{}
+	if scenario != nil {
+		if scenario.SLA != nil {
+			sla = scenario.SLA
+		}
+		err = routines.AddScenario(scenario, ids)
+		if err != nil {
+			log.Fatal().Err(err).Str("scenario", *scenarioPath).Msg("unable to create scenario routines")
+			panic(err)
+		}
+	}
+
+	err = sla.Validate()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid sla")
+	}
+	slaMonitor := CreateSLAMonitor(sla)
+	if derivedMetrics != nil {
+		routines.Derived = CreateDerivedAggregator(derivedMetrics)
+	}
+	coordinatorURL := *reportTo
+	if coordinatorURL == "" {
+		coordinatorURL = *idCoordinator
+	}
+	var reporter *AgentReporter
+	if coordinatorURL != "" && *reportInterval > 0 && fakeClock == nil {
+		reporter = CreateAgentReporter(coordinatorURL, *instance, *reportInterval)
+		if mtls.Enabled() {
+			config, err := mtls.ClientConfig()
+			if err != nil {
+				log.Fatal().Err(err).Msg("unable to set up mutual tls to the coordinator")
+			}
+			reporter.UseTLS(config)
+		}
+	}
+	resultWriter.Observe = func(record []string) {
+		slaMonitor.Observe(record)
+		routines.RTC.Tunnels.Observe(record)
+		routines.Derived.Observe(record)
+		reporter.Observe(record)
+	}
+
+	routines.Seed(seed)
+
+	writers := map[string]*ResultWriter{
+		"load-test.csv":         resultWriter,
+		"resources.csv":         resourceWriter,
+		"queue-states.csv":      stateWriter,
+		"wash-id-anomalies.csv": washIDWriter,
+		"pauses.csv":            pauseWriter,
+		"annotations.csv":       annotationWriter,
+		"rates.csv":             rateWriter,
+		"ticks.csv":             tickWriter,
+		"disconnects.csv":       disconnectWriter,
+	}
+	if throttleWriter != nil {
+		writers["throttle.csv"] = throttleWriter
+	}
+	if eventWriter != nil {
+		writers["events.csv"] = eventWriter
+	}
+	go routines.shutdownOnSignal(manifest, dir, writers)
+
+	if *prewarm && steps != nil {
+		go routines.prewarmBeforePhases(steps, *prewarmLead)
+	}
+	if start.IsZero() {
+		if *prewarm {
+			routines.prewarmConnections("start")
+		}
+		routines.RunAll()
+	}
+
+	if fakeClock != nil {
+		sim := CreateSimulation(fakeClock, routines.RTC, *simulate)
+		sim.Stop = routines.RTC.Limit.Reached()
+		if routines.RTC.CommandLimit != nil {
+			sim.Stop = routines.RTC.CommandLimit.Reached()
+		}
+		if routines.Replay != nil {
+			sim.Stop = routines.Replay.Finished
+		}
+		sim.Run()
+		routines.stopRoutines()
+		routines.writeShutdown(manifest, dir, "simulation finished", writers)
+
+		report, err := BuildRunReport(dir, nil)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to read simulated run")
+		}
+		err = report.Write(filepath.Join(dir, "report.html"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to write simulation report")
+		}
+		log.Info().Str("report", filepath.Join(dir, "report.html")).Msg("simulation report written")
+		if report.Leak != nil {
+			printLeakVerdict(os.Stdout, report.Leak)
+		}
+		if slo != nil {
+			printSLOResults(os.Stdout, report.SLO)
+			if !sloPassed(report.SLO) {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	deadline := CreateRunDeadline(routines, manifest, dir, writers)
+	deadline.SLO = slo
+	deadline.Rebaseline = baseline
+	deadline.Leak = leakThresholds
+	if reporter != nil {
+		deadline.Reporter = reporter
+		reporter.Stop = deadline.End
+		go reporter.Run()
+		log.Info().Str("coordinator", reporter.URL).Dur("interval", reporter.Interval).Msg("reporting results to coordinator")
+	}
+	routines.Deadline = deadline
+	if *progressInterval > 0 {
+		go routines.logProgress(*progressInterval)
+	}
+	setDeadline := func() {
+		if *duration > 0 {
+			deadline.Set(*duration)
+		}
+		if !stop.IsZero() {
+			deadline.Set(time.Until(stop))
+		}
+	}
+	if routines.RTC.Limit != nil {
+		go func() {
+			<-routines.RTC.Limit.Reached()
+			deadline.End("max ops reached")
+		}()
+	}
+	if routines.RTC.CommandLimit != nil {
+		go func() {
+			<-routines.RTC.CommandLimit.Reached()
+			deadline.End("max commands reached")
+		}()
+	}
+	if routines.Replay != nil {
+		go func() {
+			<-routines.Replay.Finished
+			deadline.End("replay finished")
+		}()
+	}
+	if start.IsZero() {
+		setDeadline()
+	} else {
+		log.Info().Time("start", start).Msg("waiting for scheduled start")
+		go func() {
+			time.Sleep(time.Until(start))
+			if *prewarm {
+				routines.prewarmConnections("start")
+			}
+			if warmUp != nil {
+				warmUp.Begin()
+			}
+			routines.RunAll()
+			setDeadline()
+		}()
+	}
 
 	r := gin.New()
 	r.GET("/stop", routines.StopAll)
-	r.GET("/stop/queue-and-move", routines.StartQueueAndMove)
-	r.GET("/start/queue-and-move", routines.StartQueueAndMove)
-	r.GET("/delete", routines.DeleteQueuedCars)
-	r.GET("/update/queue/:seconds", routines.UpdateQueueTime)
-	r.GET("/update/move/:seconds", routines.UpdateMoveTime)
-	r.GET("/update/get/:seconds", routines.UpdateGetTime)
+	r.GET("/pause", routines.PauseEndpoint)
+	r.GET("/resume", routines.ResumeEndpoint)
+	r.GET("/run/:duration", deadline.SetDuration)
+	r.GET("/stop/queue-and-move", routines.ToggleRoutines(false, "queue", "move"))
+	r.GET("/start/queue-and-move", routines.ToggleRoutines(true, "queue", "move"))
+	r.GET("/api/v1/routines", routines.RoutinesEndpoint)
+	r.POST("/api/v1/routines/:name/start", routines.ToggleRoutineEndpoint(true))
+	r.POST("/api/v1/routines/:name/stop", routines.ToggleRoutineEndpoint(false))
+	r.GET("/cleanup/preview", routines.CleanupPreview)
+	r.POST("/cleanup/confirm", routines.CleanupConfirm)
 	r.GET("/update/:queueTime/:moveTime/:getTime", routines.UpdateAllTimes)
+	for _, name := range routines.Timed.Names() {
+		r.GET("/update/"+name+"/:seconds", routines.UpdateTime(name))
+		r.GET("/update/"+name+"/faster/:factor", routines.ScaleTime(name, true))
+		r.GET("/update/"+name+"/slower/:factor", routines.ScaleTime(name, false))
+	}
+	r.GET("/test/move-boundaries/:iterations", routines.TestMoveBoundaries)
+	r.GET("/scale/:pool/:workers", routines.ScaleWorkers)
+	r.GET("/throughput", routines.GetThroughput)
+	r.GET("/status", routines.Status)
+	r.GET("/metrics", routines.Metrics)
+	r.GET("/api/v1/queue", routines.Queue)
+	r.POST("/api/v1/queue/head", routines.QueueHead)
+	r.GET("/rtc/status", routines.RTCStatus)
+	r.POST("/api/v1/annotate", annotator.AnnotateEndpoint)
+	r.GET("/api/v1/sla", slaMonitor.SLAEndpoint)
+	history := CreateRunHistory(*historyRoot)
+	r.GET("/runs", history.HistoryEndpoint)
+	r.GET("/runs/report", history.ReportEndpoint)
+	r.GET("/runs/compare", history.CompareEndpoint)
+	r.GET("/runs/export", history.ExportEndpoint)
+	r.GET("/dashboard", slaMonitor.Dashboard)
+	r.GET("/api/v1/loglevel", logControl.LogLevelStatus)
+	r.GET("/api/v1/timeouts", routines.RTC.Timeouts.TimeoutsStatus)
+	r.POST("/api/v1/timeouts", routines.RTC.Timeouts.TimeoutsEndpoint)
+	r.POST("/api/v1/loglevel", logControl.LogLevelEndpoint)
+
+	if *serveIDRanges {
+		coordinator, err := CreateIDRangeCoordinator(*idRangeState)
+		if err != nil {
+			log.Fatal().Err(err).Str("state", *idRangeState).Msg("unable to start id range coordinator")
+		}
+		r.POST("/api/v1/ids/range", coordinator.IssueRange)
+	}
+	agents := CreateAgentStats()
+	agents.MaxCommands, agents.MaxErrorRate = *globalMaxCommands, *globalMaxErrorRate
+	agents.Stop = func(reason string) {
+		if routines.stopRoutines() {
+			routines.drain()
+		}
+		routines.Log.Info("routines stopped", "reason", reason)
+	}
+	r.POST("/api/v1/agents/report", agents.ReportEndpoint)
+	r.GET("/api/v1/agents", agents.AgentsEndpoint)
 
 	// start server
+	if mtls.Enabled() {
+		config, err := mtls.ServerConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to set up mutual tls for the api")
+		}
+		server := &http.Server{Addr: ":3001", Handler: r, TLSConfig: config}
+		log.Fatal().Err(server.ListenAndServeTLS("", ""))
+	}
 	log.Fatal().Err(r.Run(":3001"))
 }
 
@@ -87,119 +1237,435 @@ type Routines struct {
 	*QueueRoutine
 	*GetRoutine
 	*MoveRoutine
+	Sequences []*SequenceRoutine
+	Scripts   []*ScriptRoutine
+	Commands  []*TemplateCommandRoutine
+	// Timed are the routines sending an operation on every tick, queue, get
+	// and move to begin with.
+	Timed *RoutineRegistry
+	// Instances are the scenario's instances, whose routines are in Timed.
+	Instances []InstanceConfig
+	// Streams are the queue routines of the scenario's pay station streams,
+	// which are in Timed too.
+	Streams []*QueueRoutine
+	// TunnelStatus reads the tunnel's state; nil when it isn't read periodically.
+	TunnelStatus *StatusRoutine
+	// TunnelChaos pauses the tunnel now and then; nil when it doesn't.
+	TunnelChaos *TunnelChaosRoutine
+	// Modify changes the packages of test washes; nil when it doesn't.
+	Modify *ModifyRoutine
 	RTC    *RTCClient
-	Writer *csv.Writer
+	Writer *ResultWriter
+	Log    Logger
+	// Marker sends correlation markers; nil when markers are disabled.
+	Marker *MarkerRoutine
+	// Workers are pools of closed-model virtual users.
+	Workers []*WorkerPool
+	// WorkerThink is the think time of pools added through /scale.
+	WorkerThink time.Duration
+	// Mix, when set, sends a weighted mix of operations in place of the queue,
+	// get and move routines.
+	Mix *WorkerPool
+	// Replay, when set, replays a recorded run in place of the queue, get and
+	// move routines.
+	Replay *ReplayRoutine
+	// Deadline ends the run at the time --duration, --stop-at or /run set; nil
+	// in simulations.
+	Deadline *RunDeadline
+	// Resources samples the tester's own usage; nil when sampling is disabled.
+	Resources *ResourceSampler
+	// Events listens to the rTC's tunnel events; nil when it doesn't.
+	Events *EventListener
+	// Derived computes the metrics of --metrics from the results.
+	Derived *DerivedAggregator
+	// Strict rejects invalid ticker times instead of falling back to defaults.
+	Strict bool
+	// CleanupOnStop deletes the routines' washes as part of /stop.
+	CleanupOnStop bool
+	// DrainTimeout bounds how long stopping waits for operations under way.
+	DrainTimeout time.Duration
+	// SigningKey, when set, signs the run's files once it has ended.
+	SigningKey ed25519.PrivateKey
+	// Pauses records pausing and resuming through the api.
+	Pauses *ResultWriter
+
+	lifecycle routinesLifecycle
+	// ctx is cancelled once the routines stop for good.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// running tracks the goroutines of every routine, so stopping can wait for
+	// the last of their records before flushing them.
+	running sync.WaitGroup
+
+	// workersMu guards Workers, which /scale can add to while the test runs.
+	workersMu sync.Mutex
+
+	// toggleMu guards stoppedRoutines, the routines stopped on their own
+	// through /api/v1/routines.
+	toggleMu        sync.Mutex
+	stoppedRoutines map[string]bool
+
+	cleanupMu      sync.Mutex
+	pendingCleanup *CleanupPlan
 }
 
-func CreateRoutines(queueTime, getTime, moveTime int) *Routines {
-	queueDone := make(chan bool)
-	getDone := make(chan bool)
-	moveDone := make(chan bool)
+func CreateRoutines(queueTime, getTime, moveTime int, ids IDAllocator) *Routines {
+	q := CreateQueueRoutine(queueTime, ids)
+	g := CreateGetRoutine(getTime)
+	m := CreateMoveRoutine(moveTime)
 
-	q := CreateQueueRoutine(queueTime, queueDone)
-	g := CreateGetRoutine(getTime, getDone)
-	m := CreateMoveRoutine(moveTime, moveDone)
+	timed := &RoutineRegistry{}
+	for _, routine := range []Routine{q, g, m} {
+		timed.Register(routine)
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Routines{
 		QueueRoutine: q,
 		GetRoutine:   g,
 		MoveRoutine:  m,
+		Timed:        timed,
+		Log:          ZerologLogger{},
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// SetLogger replaces the logger of the routines container, every routine in it and its rTC client.
+func (r *Routines) SetLogger(l Logger) {
+	r.Log = l
+	for _, routine := range r.Timed.All() {
+		routine.Ticked().Log = l
+	}
+	if r.QueueRoutine.Retain != nil {
+		r.QueueRoutine.Retain.Log = l
+	}
+	for _, seq := range r.Sequences {
+		seq.Log = l
+	}
+	for _, script := range r.Scripts {
+		script.Log = l
+	}
+	for _, command := range r.Commands {
+		command.Log = l
+	}
+	if r.RTC != nil {
+		r.RTC.Log = l
+		if r.RTC.WashIDs != nil {
+			r.RTC.WashIDs.Log = l
+		}
+		if r.RTC.Disconnects != nil {
+			r.RTC.Disconnects.Log = l
+		}
+		if r.RTC.Retry != nil {
+			r.RTC.Retry.Log = l
+		}
+	}
+	if r.Resources != nil {
+		r.Resources.Log = l
+		if r.Resources.Watchdog != nil {
+			r.Resources.Watchdog.Log = l
+		}
+	}
+	if r.Marker != nil {
+		r.Marker.Log = l
+	}
+	if r.Events != nil {
+		r.Events.Log = l
+	}
+	r.workersMu.Lock()
+	for _, pool := range r.Workers {
+		pool.Log = l
+	}
+	r.workersMu.Unlock()
+	if r.Mix != nil {
+		r.Mix.Log = l
+	}
+}
+
+func (r *Routines) AddScenario(scenario *Scenario, ids IDAllocator) error {
+	for _, config := range scenario.Sequences {
+		seq := CreateSequenceRoutine(config, ids)
+		seq.Log = r.Log
+		r.Sequences = append(r.Sequences, seq)
+	}
+
+	for _, config := range scenario.Scripts {
+		script, err := CreateScriptRoutine(config, ids)
+		if err != nil {
+			return err
+		}
+		script.Log = r.Log
+		r.Scripts = append(r.Scripts, script)
+	}
+
+	for _, config := range scenario.Commands {
+		command, err := CreateTemplateCommandRoutine(config, ids)
+		if err != nil {
+			return err
+		}
+		command.Log = r.Log
+		r.Commands = append(r.Commands, command)
+	}
+
+	return nil
+}
+
+// ApplyProfile shapes the rate of the named routines (queue, get and move) with
+// profile, applied to the interval each routine was created with. A routine
+// that already has a profile gets the new one applied on top of it.
+func (r *Routines) ApplyProfile(profile LoadProfile, names map[string]bool) {
+	for _, routine := range r.Timed.All() {
+		if names[routine.Name()] {
+			routine.Ticked().Ticker.Profile(profile)
+		}
 	}
 }
 
 func (r *Routines) RunAll() {
-	go r.QueueRoutine.Run(r.RTC, r.Writer)
-	log.Info().Msg("queue routine started")
+	if _, err := r.lifecycle.transition(RoutinesRunning, RoutinesWaiting); err != nil {
+		r.Log.Warn("not starting routines", "error", err)
+		return
+	}
+	if r.Mix != nil || r.Replay != nil {
+		// unread ticks would keep a simulation from ever settling
+		for _, routine := range r.Timed.All() {
+			routine.Ticked().Ticker.Stop()
+		}
+	}
+	if r.Mix != nil {
+		r.startRun(&r.Mix.routineRunner, func(ctx context.Context) { r.Mix.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("operation mix started", "routines", r.Mix.Mix.Names, "weights", r.Mix.Mix.Weights, "workers", r.Mix.Size())
+	} else if r.Replay != nil {
+		r.startRun(&r.Replay.routineRunner, func(ctx context.Context) { r.Replay.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("replay started", "events", len(r.Replay.Events), "speed", r.Replay.Speed, "maxRate", r.Replay.MaxRate)
+	} else {
+		for _, routine := range r.Timed.All() {
+			r.startTimed(routine)
+			r.Log.Info(routine.Name() + " routine started")
+		}
+	}
 
-	go r.GetRoutine.Run(r.RTC, r.Writer)
-	log.Info().Msg("get routine started")
+	if r.QueueRoutine.Retain != nil {
+		r.spawn(func() { r.QueueRoutine.Retain.Run(r.ctx, r.Writer) })
+	}
+
+	for _, seq := range r.Sequences {
+		seq := seq
+		r.startRun(&seq.routineRunner, func(ctx context.Context) { seq.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("sequence routine started", "sequence", seq.Config.Name)
+	}
+
+	for _, script := range r.Scripts {
+		script := script
+		r.startRun(&script.routineRunner, func(ctx context.Context) { script.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("script routine started", "script", script.Config.Name)
+	}
+
+	for _, command := range r.Commands {
+		command := command
+		r.startRun(&command.routineRunner, func(ctx context.Context) { command.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("template command routine started", "command", command.Config.Name)
+	}
 
-	go r.MoveRoutine.Run(r.RTC, r.Writer)
-	log.Info().Msg("move routine started")
+	if r.Marker != nil {
+		r.startRun(&r.Marker.routineRunner, func(ctx context.Context) { r.Marker.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("marker routine started")
+	}
+
+	r.workersMu.Lock()
+	for _, pool := range r.Workers {
+		pool := pool
+		r.startRun(&pool.routineRunner, func(ctx context.Context) { pool.Run(ctx, r.RTC, r.Writer) })
+		r.Log.Info("worker pool started", "pool", pool.Name, "workers", pool.Size())
+	}
+	r.workersMu.Unlock()
 }
 
-func (r *Routines) StopAll(c *gin.Context) {
-	r.QueueRoutine.Done <- true
-	r.GetRoutine.Done <- true
-	r.MoveRoutine.Done <- true
+// spawn runs a routine in a goroutine of its own that stopping waits for.
+func (r *Routines) spawn(run func()) {
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		run()
+	}()
+}
 
-	c.Redirect(http.StatusOK, "/delete")
+// startTimed starts a new run of a timed routine, ending its previous one.
+func (r *Routines) startTimed(routine Routine) {
+	ctx := routine.Ticked().start(r.ctx)
+	r.spawn(func() { routine.Run(ctx, r.RTC, r.Writer) })
 }
 
-func (r *Routines) StopQueueAndMove(c *gin.Context) {
-	r.QueueRoutine.Done <- true
-	r.MoveRoutine.Done <- true
+// startRun starts a new run of a routine that isn't timed, such as a sequence
+// or a worker pool, ending its previous one.
+func (r *Routines) startRun(runner *routineRunner, run func(ctx context.Context)) {
+	ctx := runner.start(r.ctx)
+	r.spawn(func() { run(ctx) })
+}
 
-	c.Redirect(http.StatusOK, "/delete")
+func (r *Routines) StopAll(c *gin.Context) {
+	if !r.stopRoutines() {
+		c.JSON(http.StatusConflict, gin.H{"error": "routines are already stopped", "state": r.lifecycle.State()})
+		return
+	}
+	r.drain()
+	r.respondStopped(c)
 }
 
-func (r *Routines) StartQueueAndMove(c *gin.Context) {
-	go r.QueueRoutine.Run(r.RTC, r.Writer)
-	log.Info().Msg("queue routine started")
+// stopRoutines ends the routines' goroutines. It returns false when they were
+// already stopped, so a /stop and the end of the run don't both wait on them.
+func (r *Routines) stopRoutines() bool {
+	previous, err := r.lifecycle.transition(RoutinesStopped, RoutinesWaiting, RoutinesRunning, RoutinesPaused)
+	if err != nil {
+		return false
+	}
+	r.RTC.Gate.Resume(operatorPause)
+	if previous == RoutinesWaiting {
+		return true
+	}
+	// ends every routine, whether it's running or was stopped through the api
+	r.cancel()
+	return true
+}
 
-	go r.MoveRoutine.Run(r.RTC, r.Writer)
-	log.Info().Msg("move routine started")
+// respondStopped only deletes the routines' washes when cleanup on stop was
+// asked for; otherwise cleanup goes through /cleanup/preview and /cleanup/confirm.
+func (r *Routines) respondStopped(c *gin.Context) {
+	status, body := r.cleanupStopped()
+	body["stopped"] = true
+	c.JSON(status, body)
 }
 
-func (r *Routines) DeleteQueuedCars(c *gin.Context) {
-	queue, times, err := r.RTC.GetQueue()
-	writeErr := r.Writer.Write(times)
-	if writeErr != nil {
-		log.Warn().Err(err).Strs("record", times).Msg("error writing get queue record to CSV")
+// cleanupStopped deletes the routines' washes when cleanup on stop was asked
+// for, and returns what it did as the response to the stop.
+func (r *Routines) cleanupStopped() (int, gin.H) {
+	if !r.CleanupOnStop {
+		return http.StatusOK, gin.H{}
 	}
 
+	washes, err := r.cleanupCandidates()
 	if err != nil {
-		log.Error().Err(err).Msg("error getting queue to delete all washes queued by routine")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch rtc queue"})
-		return
+		return http.StatusInternalServerError, gin.H{"error": "failed to fetch rtc queue"}
 	}
+	deleted := r.deleteWashes(washes)
+	return http.StatusOK, gin.H{"deleted": deleted, "candidates": len(washes)}
+}
 
-	for _, wash := range queue.Queue.QueueItems {
-		if wash.WashPkgNum == 1 {
-			times, err := r.RTC.DeleteQueuedCar(wash.WashID)
+// cleanupCandidates lists the washes queued by the routines, identified by
+// the wash packages they queue with, in the queue of every tunnel they send to.
+func (r *Routines) cleanupCandidates() ([]WashQueueItem, error) {
+	packages := r.washPackages()
+	var washes []WashQueueItem
+	for _, tunnel := range r.tunnels() {
+		queue, times, err := r.RTC.OnTunnel(tunnel).GetQueue()
+		writeErr := r.Writer.Write(times)
+		if writeErr != nil {
+			r.Log.Warn("error writing get queue record to CSV", "error", writeErr, "record", times)
+		}
+
+		if err != nil {
+			r.Log.Error("error getting queue to find washes queued by routines", "error", err, "tunnel", tunnel)
+			return nil, err
+		}
+
+		for _, wash := range queue.Queue.QueueItems {
+			if packages[wash.WashPkgNum] {
+				wash.Tunnel = tunnel
+				washes = append(washes, wash)
+			}
+		}
+	}
+	return washes, nil
+}
+
+// deleteWashes deletes the given washes from the queues of their tunnels, in
+// batches when batch mode is on, and returns how many of them the rTC confirmed.
+func (r *Routines) deleteWashes(washes []WashQueueItem) int {
+	var tunnels []string
+	byTunnel := map[string][]int{}
+	for _, wash := range washes {
+		if _, ok := byTunnel[wash.Tunnel]; !ok {
+			tunnels = append(tunnels, wash.Tunnel)
+		}
+		byTunnel[wash.Tunnel] = append(byTunnel[wash.Tunnel], wash.WashID)
+	}
+
+	deleted := 0
+	for _, tunnel := range tunnels {
+		client := r.RTC.OnTunnel(tunnel)
+		if r.QueueRoutine.BatchSize > 1 {
+			deleted += r.deleteWashesInBatches(client, byTunnel[tunnel])
+			continue
+		}
+		for _, washID := range byTunnel[tunnel] {
+			_, times, err := client.DeleteQueuedCar(washID)
 			writeErr := r.Writer.Write(times)
 			if writeErr != nil {
-				log.Warn().Err(err).Strs("record", times).Msg("error writing delete record to CSV")
+				r.Log.Warn("error writing delete record to CSV", "error", writeErr, "record", times)
 			}
 
 			if err != nil {
-				log.Error().Err(err).Interface("wash", wash).Msg("error deleting wash from queue")
+				r.Log.Error("error deleting wash from queue", "error", err, "washID", washID)
+				continue
 			}
+			deleted++
 		}
 	}
+	return deleted
 }
 
-func (r *Routines) UpdateQueueTime(c *gin.Context) {
-	s := c.Param("seconds")
-	if s == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no time span specified"})
-		return
-	}
-	r.QueueRoutine.UpdateTime(s)
-	r.QueueRoutine.Run(r.RTC, r.Writer)
-	log.Info().Str("newTickerTime", s).Msg("successfully updated queue routine's ticker time")
-}
+func (r *Routines) deleteWashesInBatches(client *RTCClient, washIDs []int) int {
+	deleted := 0
+	for start := 0; start < len(washIDs); start += r.QueueRoutine.BatchSize {
+		end := start + r.QueueRoutine.BatchSize
+		if end > len(washIDs) {
+			end = len(washIDs)
+		}
 
-func (r *Routines) UpdateMoveTime(c *gin.Context) {
-	s := c.Param("seconds")
-	if s == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no time span specified"})
-		return
+		resp, times, err := client.DeleteQueuedCarBatch(washIDs[start:end])
+		writeErr := r.Writer.Write(times)
+		if writeErr != nil {
+			r.Log.Warn("error writing batch delete record to CSV", "error", writeErr, "record", times)
+		}
+
+		if resp != nil {
+			deleted += len(resp.WashIDs)
+		}
+		if err != nil {
+			r.Log.Error("error deleting wash batch from queue", "error", err, "washIDs", washIDs[start:end])
+		}
 	}
-	r.MoveRoutine.UpdateTime(s)
-	go r.MoveRoutine.Run(r.RTC, r.Writer)
-	log.Info().Str("newTickerTime", s).Msg("successfully updated move routine's ticker time")
+	return deleted
 }
 
-func (r *Routines) UpdateGetTime(c *gin.Context) {
-	s := c.Param("seconds")
-	if s == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no time span specified"})
-		return
+// UpdateTime is the /update/<routine>/:seconds endpoint of a registered
+// routine, e.g. /update/queue/5 or relative to its interval, /update/get/+1s.
+func (r *Routines) UpdateTime(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.Param("seconds")
+		if s == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no time span specified"})
+			return
+		}
+		if isRelativeTime(s) {
+			r.adjustTime(c, name, func(current time.Duration) (time.Duration, error) {
+				return relativeTickerTime(current, s)
+			})
+			return
+		}
+		routine, ok := r.Timed.Get(name)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no routine named " + name})
+			return
+		}
+		err := routine.Ticked().UpdateTime(s, r.Strict)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		r.Log.Info("successfully updated routine's ticker time", "routine", name, "newTickerTime", s)
 	}
-	r.GetRoutine.UpdateTime(s)
-	go r.GetRoutine.Run(r.RTC, r.Writer)
-	log.Info().Str("newTickerTime", s).Msg("successfully updated get routine's ticker time")
 }
 
 func (r *Routines) UpdateAllTimes(c *gin.Context) {
@@ -221,180 +1687,287 @@ func (r *Routines) UpdateAllTimes(c *gin.Context) {
 		return
 	}
 
-	r.QueueRoutine.UpdateTime(q)
-	r.MoveRoutine.UpdateTime(m)
-	r.GetRoutine.UpdateTime(g)
-	r.RunAll()
+	if r.Strict {
+		for _, t := range []string{q, m, g} {
+			_, err := ParseIntervalSeconds(t)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	// sequences keep running on their own intervals, only the three timed routines change
+	for name, t := range map[string]string{"queue": q, "move": m, "get": g} {
+		routine, ok := r.Timed.Get(name)
+		if !ok {
+			continue
+		}
+		routine.Ticked().UpdateTime(t, r.Strict)
+	}
 }
 
-type QueueRoutine struct {
-	Done   chan bool
-	Ticker *time.Ticker
+// ScaleTime is the /update/<routine>/faster/:factor and /slower/:factor
+// endpoint, e.g. /update/queue/faster/2x halves the queue interval.
+func (r *Routines) ScaleTime(name string, faster bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		factor, err := parseMultiplier(c.Param("factor"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		r.adjustTime(c, name, func(current time.Duration) (time.Duration, error) {
+			if faster {
+				return time.Duration(float64(current) / factor), nil
+			}
+			return time.Duration(float64(current) * factor), nil
+		})
+	}
 }
 
-func CreateQueueRoutine(tickerTime int, doneChannel chan bool) *QueueRoutine {
-	t := strconv.Itoa(tickerTime)
+// adjustTime changes the interval of a registered routine relative to its
+// current one, in place.
+func (r *Routines) adjustTime(c *gin.Context, name string, change func(current time.Duration) (time.Duration, error)) {
+	if r.Mix != nil || r.Replay != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": name + " isn't running on its own interval"})
+		return
+	}
+	if state := r.lifecycle.State(); state != RoutinesRunning && state != RoutinesPaused {
+		c.JSON(http.StatusConflict, gin.H{"error": "routines are " + string(state), "state": state})
+		return
+	}
+
+	routine, ok := r.Timed.Get(name)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no routine named " + name})
+		return
+	}
+	current := routine.Ticked().Ticker.Interval()
 
-	d, err := time.ParseDuration(t)
+	d, err := change(current)
+	if err == nil && d <= 0 {
+		err = errors.Errorf("ticker time must be positive, got %s", d)
+	}
 	if err != nil {
-		log.Error().Err(err).Int("tickerTime", tickerTime).Str("convertedTime", t).Msg("error converting queue car time string to time.duration; forcing ticker duration to be default")
-		d = 2
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	return &QueueRoutine{
-		Done:   doneChannel,
-		Ticker: time.NewTicker(d * time.Second),
+	err = routine.UpdateInterval(d)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	r.Log.Info("adjusted routine's ticker time", "routine", name, "previous", current.String(), "newTickerTime", d.String())
+	c.JSON(http.StatusOK, gin.H{"routine": name, "previous": current.String(), "interval": d.String()})
 }
 
-func (q *QueueRoutine) Run(client *RTCClient, writer *csv.Writer) {
-	for {
-		select {
-		case <-q.Done:
-			log.Info().Msg("queue routine received done signal")
-			return
-		case <-q.Ticker.C:
-			req := WashRequest{
-				LaneID:      "4",
-				OrderID:     "LOAD-TESTING",
-				VehicleID:   "NO-VALID-ID",
-				WashPackage: 1,
-			}
+// burst runs op n times at once, holding every run back until all of them are
+// ready so they reach the rTC together, and waits for them to return.
+func burst(n int, op func()) {
+	if n <= 1 {
+		op()
+		return
+	}
 
-			records, err := client.QueueWash(req)
-			if err != nil {
-				log.Warn().Err(err).Msg("unable to queue wash in queue routine")
-			}
-			writer.Write(records)
-		}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			op()
+		}()
 	}
+	close(start)
+	wg.Wait()
 }
 
-func (q *QueueRoutine) UpdateTime(tickerTime string) {
-	q.Done <- true
+// waitOffset holds a routine back for offset and then restarts its ticker, so
+// its ticks fall offset after those of a routine started at the same time
+// without one. It returns false when the routine is stopped while waiting.
+func waitOffset(ctx context.Context, offset time.Duration, holder *TickerHolder) bool {
+	if offset <= 0 {
+		return true
+	}
+	ticker := holder.Ticker()
+	ticker.Stop()
+	// drop a tick that fired before the ticker was stopped
+	select {
+	case <-ticker.C():
+	default:
+	}
 
-	d, err := time.ParseDuration(tickerTime)
-	if err != nil {
-		log.Error().Err(err).Str("tickerTime", tickerTime).Msg("error converting queue car time string to time.duration; forcing ticker duration to be default")
-		d = 2
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(offset):
+		// at the interval it has now, which may have changed while waiting
+		holder.Set(holder.Interval())
+		return true
 	}
-	q.Ticker = time.NewTicker(d * time.Second)
 }
 
-type GetRoutine struct {
-	Done   chan bool
-	Ticker *time.Ticker
+type QueueRoutine struct {
+	TickedRoutine
+
+	IDs       IDAllocator
+	BatchSize int
+	// Retain bounds the washes left queued, and has queue workers leave theirs
+	// queued too, when set.
+	Retain *QueueRetention
+	// WashPackage is the package washes are queued with.
+	WashPackage int
+	// Lanes picks the lanes washes are queued to in place of the client's when set.
+	Lanes *LaneAssigner
+	// Stream counts the washes queued when the routine is a pay station's stream.
+	Stream *StreamCounts
 }
 
-func CreateGetRoutine(tickerTime int, doneChannel chan bool) *GetRoutine {
-	t := strconv.Itoa(tickerTime)
+func CreateQueueRoutine(tickerTime int, ids IDAllocator) *QueueRoutine {
+	q := &QueueRoutine{
+		IDs:         ids,
+		BatchSize:   1,
+		WashPackage: defaultWashPackage,
+	}
+	q.init("queue", tickerTime, 2*time.Second, q.queue)
+	return q
+}
+func (q *QueueRoutine) queue(client *RTCClient, writer *ResultWriter) {
+	if q.BatchSize > 1 {
+		q.queueBatch(client, writer)
+		return
+	}
+
+	orderID, err := q.IDs.NextOrderID()
+	if err != nil {
+		q.Log.Warn("unable to allocate order id, not attempting queue", "error", err, "strategy", q.IDs.Strategy())
+		return
+	}
 
-	d, err := time.ParseDuration(t)
+	resp, records, err := client.QueueWash(q.request(client, orderID))
 	if err != nil {
-		log.Error().Err(err).Int("tickerTime", tickerTime).Str("convertedTime", t).Msg("error converting get queue time string to time.duration; forcing ticker duration to be default")
-		d = 4
+		q.Log.Warn("unable to queue wash in queue routine", "error", err)
+	} else {
+		client.Rates.Achieve()
 	}
-	return &GetRoutine{
-		Done:   doneChannel,
-		Ticker: time.NewTicker(d * time.Second),
+	q.Stream.Observe(orderID, records)
+	writer.Write(records)
+	if err == nil && q.Retain != nil {
+		q.Retain.Retain(client, writer, resp.WashID)
 	}
 }
 
-func (g *GetRoutine) Run(client *RTCClient, writer *csv.Writer) {
-	for {
-		select {
-		case <-g.Done:
-			log.Info().Msg("get routine received done signal")
-			return
-		case <-g.Ticker.C:
-			_, records, err := client.GetQueue()
-			if err != nil {
-				log.Warn().Err(err).Msg("unable to get rtc queue in get queue routine")
-			}
-			writer.Write(records)
-		}
+// request is the wash queued with orderID, to the routine's package and lanes.
+func (q *QueueRoutine) request(client *RTCClient, orderID string) WashRequest {
+	lanes := q.Lanes
+	if lanes == nil {
+		lanes = client.Lanes
+	}
+	return WashRequest{
+		LaneID:      lanes.Next(),
+		OrderID:     orderID,
+		VehicleID:   "NO-VALID-ID",
+		WashPackage: q.WashPackage,
+		Lanes:       q.Lanes,
 	}
 }
 
-func (g *GetRoutine) UpdateTime(tickerTime string) {
-	g.Done <- true
+func (q *QueueRoutine) queueBatch(client *RTCClient, writer *ResultWriter) {
+	reqs := make([]WashRequest, 0, q.BatchSize)
+	for i := 0; i < q.BatchSize; i++ {
+		orderID, err := q.IDs.NextOrderID()
+		if err != nil {
+			q.Log.Warn("unable to allocate order id, not attempting batch queue", "error", err, "strategy", q.IDs.Strategy())
+			return
+		}
+		reqs = append(reqs, q.request(client, orderID))
+	}
 
-	d, err := time.ParseDuration(tickerTime)
+	resp, records, err := client.QueueWashBatch(reqs)
 	if err != nil {
-		log.Error().Err(err).Str("tickerTime", tickerTime).Msg("error converting get queue time string to time.duration; forcing ticker duration to be default")
-		d = 4
+		q.Log.Warn("unable to queue wash batch in queue routine", "error", err, "batchSize", q.BatchSize)
+	} else {
+		client.Rates.Achieve()
+	}
+	writer.Write(records)
+	if resp != nil && q.Retain != nil {
+		// washes of a partly added batch are queued all the same
+		q.Retain.Retain(client, writer, resp.WashIDs...)
 	}
-	g.Ticker = time.NewTicker(d * time.Second)
 }
 
-type MoveRoutine struct {
-	Done   chan bool
-	Ticker *time.Ticker
-}
+type GetRoutine struct {
+	TickedRoutine
 
-func CreateMoveRoutine(tickerTime int, doneChannel chan bool) *MoveRoutine {
-	t := strconv.Itoa(tickerTime)
+	// States tallies every queue read by state when set.
+	States *QueueStateTracker
+}
 
-	d, err := time.ParseDuration(t)
+func CreateGetRoutine(tickerTime int) *GetRoutine {
+	g := &GetRoutine{}
+	g.init("get", tickerTime, 4*time.Second, g.get)
+	return g
+}
+func (g *GetRoutine) get(client *RTCClient, writer *ResultWriter) {
+	queue, records, err := client.GetQueue()
 	if err != nil {
-		log.Error().Err(err).Int("tickerTime", tickerTime).Str("convertedTime", t).Msg("error converting move car time string to time.duration; forcing ticker duration to be default")
-		d = 6
-	}
-	return &MoveRoutine{
-		Done:   doneChannel,
-		Ticker: time.NewTicker(d * time.Second),
+		g.Log.Warn("unable to get rtc queue in get queue routine", "error", err)
+	} else {
+		client.Rates.Achieve()
+		if g.States != nil {
+			g.States.Observe(clock.Now(), queue.Queue.QueueItems)
+		}
 	}
+	writer.Write(records)
 }
 
-func (m *MoveRoutine) Run(client *RTCClient, writer *csv.Writer) {
-	for {
-		select {
-		case <-m.Done:
-			log.Info().Msg("move routine received done signal")
-			return
-		case <-m.Ticker.C:
-			queue, records, err := client.GetQueue()
-			if err != nil {
-				log.Warn().Err(err).Msg("error getting queue from rTC, not attempting move")
-				continue
-			}
-			writer.Write(records)
-
-			indexOfFirstLoadWash := 0
-			for i, wash := range queue.Queue.QueueItems {
-				if wash.WashPkgNum == 1 {
-					indexOfFirstLoadWash = i
-					break
-				}
-			}
+type MoveRoutine struct {
+	TickedRoutine
 
-			if indexOfFirstLoadWash == 0 {
-				log.Warn().Err(err).Msg("no washes queued by routines, not attempting move")
-			}
+	// Rand picks the position each wash is moved to.
+	Rand *SeededRand
+	// WashPackage is the package of the washes moved, those queued alongside.
+	WashPackage int
+}
 
-			numWashes := len(queue.Queue.QueueItems)
-			source := rand.NewSource(time.Now().UnixNano())
-			r := rand.New(source)
-			before := r.Intn(numWashes)
-			p := MoveWashReqParams{
-				WashID:   indexOfFirstLoadWash,
-				ToBefore: before,
-			}
-			_, records, err = client.MoveWash(p)
-			if err != nil {
-				log.Warn().Err(err).Int("toBefore", before).Msg("error moving wash 1 to before wash")
-			}
-			writer.Write(records)
+func CreateMoveRoutine(tickerTime int) *MoveRoutine {
+	m := &MoveRoutine{Rand: CreateSeededRand(time.Now().UnixNano(), "move"), WashPackage: defaultWashPackage}
+	m.init("move", tickerTime, 6*time.Second, m.move)
+	return m
+}
+func (m *MoveRoutine) move(client *RTCClient, writer *ResultWriter) {
+	queue, records, err := client.GetQueue()
+	if err != nil {
+		m.Log.Warn("error getting queue from rTC, not attempting move", "error", err)
+		return
+	}
+	writer.Write(records)
+
+	firstLoadWashID := 0
+	for _, wash := range queue.Queue.QueueItems {
+		if wash.WashPkgNum == m.WashPackage {
+			firstLoadWashID = wash.WashID
+			break
 		}
 	}
-}
 
-func (m *MoveRoutine) UpdateTime(tickerTime string) {
-	m.Done <- true
+	if firstLoadWashID == 0 {
+		m.Log.Warn("no washes queued by routines, not attempting move")
+		return
+	}
 
-	d, err := time.ParseDuration(tickerTime)
+	numWashes := len(queue.Queue.QueueItems)
+	before := m.Rand.Intn(numWashes)
+	p := MoveWashReqParams{
+		WashID:   firstLoadWashID,
+		ToBefore: before,
+	}
+	_, records, err = client.MoveWash(p)
 	if err != nil {
-		log.Error().Err(err).Str("tickerTime", tickerTime).Msg("error converting move car time string to time.duration; forcing ticker duration to be default")
-		d = 6
+		m.Log.Warn("error moving wash 1 to before wash", "error", err, "toBefore", before)
+	} else {
+		client.Rates.Achieve()
 	}
-	m.Ticker = time.NewTicker(d * time.Second)
+	writer.Write(records)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest describes how a run was configured so its results can be interpreted
+// and reproduced later. It is written as manifest.json next to the run's CSVs.
+type Manifest struct {
+	Started  time.Time `json:"started"`
+	Instance string    `json:"instance"`
+	// Timezone is the site's IANA time zone and UTCOffset its offset when the run
+	// started. Times in the results are UTC.
+	Timezone  string            `json:"timezone"`
+	UTCOffset string            `json:"utcOffset"`
+	GoVersion string            `json:"goVersion"`
+	Flags     map[string]string `json:"flags"`
+	Notes     RunNotes          `json:"notes"`
+	// Seed seeded the routines' random choices; --seed with it repeats them.
+	Seed int64 `json:"seed"`
+
+	// GOGC is the garbage collection target the run used, -1 when the collector was off.
+	GOGC         int   `json:"gogc"`
+	BallastBytes int64 `json:"ballastBytes"`
+
+	// Site is how the run's load compared to its site's caps, when checked.
+	Site *SiteCheck `json:"site,omitempty"`
+
+	// Shutdown is only set once the run has ended.
+	Shutdown *ShutdownReport `json:"shutdown,omitempty"`
+}
+
+// ballast is a large allocation that is never touched, raising the heap size the
+// collector paces itself against so very high rate runs collect less often.
+// Untouched pages are not backed by physical memory.
+var ballast []byte
+
+// tuneGC applies the GOGC and ballast options, returning the GOGC actually in
+// effect. A gogc of 0 leaves the runtime default (or the GOGC environment variable).
+func tuneGC(gogc int, ballastMB int) int {
+	if ballastMB > 0 {
+		ballast = make([]byte, ballastMB<<20)
+	}
+	if gogc != 0 {
+		debug.SetGCPercent(gogc)
+		return gogc
+	}
+	current := debug.SetGCPercent(100)
+	debug.SetGCPercent(current)
+	return current
+}
+
+// secretFlags are redacted in the manifest, which is shared with the results.
+var secretFlags = map[string]bool{"grafana-token": true, "site-code": true, "terminal-pin": true}
+
+func CreateManifest(started time.Time, instance string, gogc int) *Manifest {
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			flags[f.Name] = "REDACTED"
+			return
+		}
+		flags[f.Name] = f.Value.String()
+	})
+
+	m := &Manifest{
+		Started:      started.UTC(),
+		Instance:     instance,
+		GoVersion:    runtime.Version(),
+		Flags:        flags,
+		GOGC:         gogc,
+		BallastBytes: int64(len(ballast)),
+	}
+	if m.SetTimezone(localTimezone()) != nil {
+		m.Timezone, _ = started.Zone()
+		m.UTCOffset = started.Format("-07:00")
+	}
+	return m
+}
+
+// SetTimezone records the site's time zone by its IANA name.
+func (m *Manifest) SetTimezone(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return errors.Wrap(err, "unable to load time zone")
+	}
+	m.Timezone = loc.String()
+	m.UTCOffset = m.Started.In(loc).Format("-07:00")
+	return nil
+}
+
+// Location is the site's time zone, UTC when the manifest doesn't name a known one.
+func (m *Manifest) Location() *time.Location {
+	loc, err := time.LoadLocation(m.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// localTimezone is the IANA name of the tester's time zone, from TZ or the
+// /etc/localtime link, or "Local" when neither names one.
+func localTimezone() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		return tz
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+			return target[i+len("zoneinfo/"):]
+		}
+	}
+	return "Local"
+}
+
+func (m *Manifest) Write(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to encode manifest")
+	}
+	err = os.WriteFile(filepath.Join(dir, "manifest.json"), b, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to write manifest")
+	}
+	return nil
+}
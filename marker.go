@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// defaultMarkerXML is a getQueue tagged with an XML comment, which the rTC
+// ignores but keeps in its own message log.
+const defaultMarkerXML = "<src><!-- %s --><getQueue/></src>"
+
+// MarkerRoutine periodically sends a command carrying a unique correlation id.
+// The id is written to the results CSV and the tester's log, so the rTC's own
+// logs can be lined up with the tester's timeline when debugging with the vendor.
+type MarkerRoutine struct {
+	routineRunner
+
+	Ticker *TickerHolder
+	Log    Logger
+	// IDs allocates the correlation ids, from the run's order ids so they are
+	// unique across testers and runs the same way.
+	IDs IDAllocator
+	// XML is the command sent, with %s replaced by the correlation id.
+	XML string
+}
+
+func CreateMarkerRoutine(interval time.Duration, ids IDAllocator) *MarkerRoutine {
+	return &MarkerRoutine{
+		Ticker: CreateTickerHolder(interval),
+		Log:    ZerologLogger{},
+		IDs:    ids,
+		XML:    defaultMarkerXML,
+	}
+}
+
+func (m *MarkerRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	for {
+		select {
+		case <-ctx.Done():
+			m.Log.Info("marker routine stopped")
+			return
+		case <-m.Ticker.C():
+			id, err := m.IDs.NextOrderID()
+			if err != nil {
+				m.Log.Warn("unable to allocate marker id, not sending marker", "error", err, "strategy", m.IDs.Strategy())
+				continue
+			}
+			markerXML := strings.Replace(m.XML, "%s", id, 1)
+
+			m.Log.Info("sending marker command", "markerId", id, "sent", clock.Now().UTC().Format(time.RFC3339Nano))
+			_, records, err := client.SendCommand("MARKER "+id, markerXML, true)
+			if err != nil {
+				m.Log.Warn("unable to send marker command", "error", err, "markerId", id)
+			}
+			writer.Write(records)
+		}
+	}
+}
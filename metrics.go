@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// derivedFields are what a derived metric's expression can use of a results
+// record, in milliseconds between the record's times: write_ms from connecting
+// to sending the command, rtt_ms from sending it to reading the reply, close_ms
+// from the reply to closing the connection and total_ms from connecting to
+// closing. error is 1 for failed commands and 0 otherwise. A time the command
+// never reached leaves the fields using it None.
+var derivedFields = []string{"write_ms", "rtt_ms", "close_ms", "total_ms", "error"}
+
+// DerivedMetric is a metric computed from every results record by a starlark
+// expression over the derivedFields, e.g. "rtt_ms - write_ms". Records the
+// expression gives None for, or fails on, aren't counted. Commands limits the
+// metric to those commands, all of them when empty.
+type DerivedMetric struct {
+	Name     string   `json:"name"`
+	Expr     string   `json:"expr"`
+	Commands []string `json:"commands,omitempty"`
+
+	fn starlark.Callable
+}
+
+// DerivedMetrics is the file passed with --metrics, copied into the run
+// directory as metrics.json so reports compute the same metrics later.
+type DerivedMetrics struct {
+	Metrics []*DerivedMetric `json:"metrics"`
+}
+
+func LoadDerivedMetrics(path string) (*DerivedMetrics, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read metrics file %s", path)
+	}
+
+	var metrics DerivedMetrics
+	err = json.Unmarshal(b, &metrics)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse metrics file %s", path)
+	}
+	err = metrics.compile()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid metric in %s", path)
+	}
+	return &metrics, nil
+}
+
+func (d *DerivedMetrics) compile() error {
+	names := map[string]bool{}
+	for _, m := range d.Metrics {
+		if m.Name == "" {
+			return errors.New("metric has no name")
+		}
+		if strings.ContainsAny(m.Name, " \"\\\n") {
+			return errors.Errorf("metric name %q may not contain spaces, quotes or backslashes", m.Name)
+		}
+		if names[m.Name] {
+			return errors.Errorf("metric %s is defined twice", m.Name)
+		}
+		names[m.Name] = true
+		if strings.TrimSpace(m.Expr) == "" {
+			return errors.Errorf("metric %s has no expression", m.Name)
+		}
+
+		// the expression becomes the body of a lambda taking the fields, so it
+		// is parsed once and only called per record
+		src := "lambda " + strings.Join(derivedFields, ", ") + ": " + m.Expr
+		expr, err := starlark.ExprFuncOptions(&syntax.FileOptions{}, m.Name, src, nil)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse expression of metric %s", m.Name)
+		}
+		fn, err := starlark.Call(&starlark.Thread{Name: m.Name}, expr, nil, nil)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse expression of metric %s", m.Name)
+		}
+		m.fn = fn.(starlark.Callable)
+	}
+	return nil
+}
+
+// Write copies the metrics into a run directory.
+func (d *DerivedMetrics) Write(dir string) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to encode metrics")
+	}
+	err = os.WriteFile(filepath.Join(dir, "metrics.json"), b, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to write metrics")
+	}
+	return nil
+}
+
+func (m *DerivedMetric) applies(command string) bool {
+	if len(m.Commands) == 0 {
+		return true
+	}
+	for _, c := range m.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Eval computes the metric for a record's fields, false when it gives None.
+func (m *DerivedMetric) Eval(thread *starlark.Thread, fields starlark.Tuple) (float64, bool, error) {
+	v, err := starlark.Call(thread, m.fn, fields, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return 0, false, nil
+	case starlark.Float:
+		return float64(v), true, nil
+	case starlark.Int:
+		f, _ := starlark.AsFloat(v)
+		return f, true, nil
+	case starlark.Bool:
+		if v {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	}
+	return 0, false, errors.Errorf("metric %s gave a %s, not a number", m.Name, v.Type())
+}
+
+// derivedArgs are the derivedFields of a results record.
+func derivedArgs(record []string) starlark.Tuple {
+	var times [4]time.Time
+	for i := range times {
+		times[i], _ = parseRecordTime(record[1+i])
+	}
+	between := func(from, to int) starlark.Value {
+		if times[from].IsZero() || times[to].IsZero() {
+			return starlark.None
+		}
+		return starlark.Float(float64(times[to].Sub(times[from])) / float64(time.Millisecond))
+	}
+	failed := starlark.MakeInt(0)
+	if record[5] == "true" {
+		failed = starlark.MakeInt(1)
+	}
+	return starlark.Tuple{between(0, 1), between(1, 2), between(2, 3), between(0, 3), failed}
+}
+
+// DerivedStats is a derived metric of one command.
+type DerivedStats struct {
+	Metric  string  `json:"metric"`
+	Command string  `json:"command"`
+	Count   int     `json:"count"`
+	Sum     float64 `json:"sum"`
+	Mean    float64 `json:"mean"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+// derivedSeries accumulates the values of a metric. Percentiles are of the
+// last keep values, or of all of them when keep is 0.
+type derivedSeries struct {
+	keep     int
+	count    int
+	sum      float64
+	min, max float64
+	values   []float64
+	next     int
+}
+
+func (s *derivedSeries) add(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+	if s.keep == 0 || len(s.values) < s.keep {
+		s.values = append(s.values, v)
+		return
+	}
+	s.values[s.next] = v
+	s.next = (s.next + 1) % s.keep
+}
+
+func (s *derivedSeries) stats(metric, command string) DerivedStats {
+	sorted := append([]float64(nil), s.values...)
+	sort.Float64s(sorted)
+	stats := DerivedStats{
+		Metric:  metric,
+		Command: command,
+		Count:   s.count,
+		Sum:     s.sum,
+		Min:     s.min,
+		Max:     s.max,
+		P50:     percentile(sorted, 50),
+		P95:     percentile(sorted, 95),
+		P99:     percentile(sorted, 99),
+	}
+	if s.count > 0 {
+		stats.Mean = s.sum / float64(s.count)
+	}
+	return stats
+}
+
+// DerivedAggregator computes the derived metrics of the records as they are
+// written, for the status endpoint and Prometheus. Percentiles are of the most
+// recent Keep values of each command so a soak doesn't grow without bound.
+type DerivedAggregator struct {
+	Metrics *DerivedMetrics
+	Keep    int
+
+	mu     sync.Mutex
+	thread *starlark.Thread
+	series map[string]map[string]*derivedSeries
+	errors map[string]uint64
+}
+
+func CreateDerivedAggregator(metrics *DerivedMetrics) *DerivedAggregator {
+	return &DerivedAggregator{
+		Metrics: metrics,
+		Keep:    10000,
+		thread:  &starlark.Thread{Name: "metrics"},
+		series:  map[string]map[string]*derivedSeries{},
+		errors:  map[string]uint64{},
+	}
+}
+
+// Observe takes a results record as it is written.
+func (a *DerivedAggregator) Observe(record []string) {
+	if a == nil || len(record) < len(csvHeader) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.observe(record)
+}
+
+func (a *DerivedAggregator) observe(record []string) {
+	name := commandName(record[0])
+	var fields starlark.Tuple
+	for _, m := range a.Metrics.Metrics {
+		if !m.applies(name) {
+			continue
+		}
+		if fields == nil {
+			fields = derivedArgs(record)
+		}
+		v, ok, err := m.Eval(a.thread, fields)
+		if err != nil {
+			if a.errors[m.Name] == 0 {
+				log.Warn().Err(err).Str("metric", m.Name).Str("command", name).Msg("derived metric failed on a record, further failures are only counted")
+			}
+			a.errors[m.Name]++
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		commands := a.series[m.Name]
+		if commands == nil {
+			commands = map[string]*derivedSeries{}
+			a.series[m.Name] = commands
+		}
+		s := commands[name]
+		if s == nil {
+			s = &derivedSeries{keep: a.Keep}
+			commands[name] = s
+		}
+		s.add(v)
+	}
+}
+
+// Stats are every metric of every command with values, by metric and command.
+func (a *DerivedAggregator) Stats() []DerivedStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var stats []DerivedStats
+	for metric, commands := range a.series {
+		for command, s := range commands {
+			stats = append(stats, s.stats(metric, command))
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Metric != stats[j].Metric {
+			return stats[i].Metric < stats[j].Metric
+		}
+		return stats[i].Command < stats[j].Command
+	})
+	return stats
+}
+
+// Errors counts the records each metric's expression failed on.
+func (a *DerivedAggregator) Errors() map[string]uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	errs := make(map[string]uint64, len(a.errors))
+	for name, n := range a.errors {
+		errs[name] = n
+	}
+	return errs
+}
+
+// SummariseDerived computes the derived metrics over a run's results, warm-up
+// and re-baseline excluded like the rest of the report, with percentiles of every value.
+func SummariseDerived(dir string, metrics *DerivedMetrics) ([]DerivedStats, error) {
+	f, err := os.Open(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open results of run %s", dir)
+	}
+	defer f.Close()
+
+	a := CreateDerivedAggregator(metrics)
+	a.Keep = 0
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read results of run %s", dir)
+		}
+		if (line == 0 && record[0] == csvHeader[0]) || len(record) < len(csvHeader) {
+			continue
+		}
+		if baselinePhase(record) {
+			continue
+		}
+		a.observe(record)
+	}
+	return a.Stats(), nil
+}
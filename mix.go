@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OperationMix picks queue, get and move operations at random in proportion to
+// their weights, so a shared pool of workers sends the traffic mix of a site
+// rather than three independent schedules.
+type OperationMix struct {
+	Names   []string
+	Weights []int
+
+	// Rand picks each operation.
+	Rand *SeededRand
+
+	ops   []func(client *RTCClient, writer *ResultWriter)
+	total int
+}
+
+// parseMix reads --mix, e.g. queue=70,get=20,move=10. Weights are relative and
+// don't have to add up to 100.
+func parseMix(s string) (names []string, weights []int, err error) {
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, nil, errors.Errorf("mix entry %q is not routine=weight", part)
+		}
+		if seen[name] {
+			return nil, nil, errors.Errorf("%s appears more than once in the mix", name)
+		}
+		seen[name] = true
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, nil, errors.Errorf("mix weight of %s must be a non-negative integer, got %q", name, weight)
+		}
+		if w == 0 {
+			continue
+		}
+		names = append(names, name)
+		weights = append(weights, w)
+	}
+	if len(names) == 0 {
+		return nil, nil, errors.New("mix needs at least one routine with a positive weight")
+	}
+	return names, weights, nil
+}
+
+// Next picks the operation to send next.
+func (m *OperationMix) Next() (string, func(client *RTCClient, writer *ResultWriter)) {
+	n := m.Rand.Intn(m.total)
+	for i, w := range m.Weights {
+		if n < w {
+			return m.Names[i], m.ops[i]
+		}
+		n -= w
+	}
+	last := len(m.Names) - 1
+	return m.Names[last], m.ops[last]
+}
+
+// SetMix replaces the queue, get and move routines with a pool of workers
+// sending the operations of spec by weight.
+func (r *Routines) SetMix(spec string, workers int, think time.Duration) error {
+	if workers <= 0 {
+		return errors.Errorf("mix workers must be positive, got %d", workers)
+	}
+	names, weights, err := parseMix(spec)
+	if err != nil {
+		return err
+	}
+
+	mix := &OperationMix{Names: names, Weights: weights, Rand: CreateSeededRand(time.Now().UnixNano(), "mix")}
+	for i, name := range names {
+		op, err := r.workerOp(name)
+		if err != nil {
+			return err
+		}
+		mix.ops = append(mix.ops, op)
+		mix.total += weights[i]
+	}
+
+	r.Mix = CreateWorkerPool("mix", workers, think, nil)
+	r.Mix.Mix = mix
+	return nil
+}
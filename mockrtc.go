@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// MockRTC is a minimal in-process rTC for simulations and trying scenarios out
+// without a test rig. It understands addTail, addHead, move, delete,
+// setWashPkg, getQueue, getStatus, pauseTunnel and resumeTunnel, also batched,
+// and washes the car at the front of the queue every WashTime. Every tunnel
+// commands are addressed to has a queue of its own. Connections that subscribe
+// are pushed the events of their tunnel's washes.
+type MockRTC struct {
+	WashTime time.Duration
+	// Auth are the credentials every request has to carry when set.
+	Auth *CommandAuth
+
+	listener net.Listener
+	mu       sync.Mutex
+	tunnels  map[string]*mockTunnel
+	nextID   int
+	// packages are the wash packages of the cars queued, by id.
+	packages map[int]int
+	// subscribers are the connections subscribed to events, with the tunnel
+	// whose events they are pushed.
+	subscribers map[net.Conn]string
+	done        chan struct{}
+}
+
+// mockTunnel is the queue of one of the mock's tunnels, the default one being "".
+type mockTunnel struct {
+	name    string
+	queue   []int
+	washing time.Time
+	// paused tunnels wash nothing, and start the wash of the car at the front
+	// over once resumed
+	paused bool
+	// front is the car whose wash start was last pushed to subscribers.
+	front int
+}
+
+type mockRequest struct {
+	XMLName   xml.Name     `xml:"src"`
+	Tunnel    string       `xml:"tunnel"`
+	SiteCode  string       `xml:"siteCode"`
+	PIN       string       `xml:"terminalPin"`
+	Adds      []AddTail    `xml:"addTail"`
+	Heads     []AddTail    `xml:"addHead"`
+	Deletes   []DeleteItem `xml:"delete"`
+	Move      *mockMove    `xml:"move"`
+	GetQueue  *struct{}    `xml:"getQueue"`
+	Status    *struct{}    `xml:"getStatus"`
+	Pause     *struct{}    `xml:"pauseTunnel"`
+	Resume    *struct{}    `xml:"resumeTunnel"`
+	Modify    *mockModify  `xml:"setWashPkg"`
+	Subscribe *struct{}    `xml:"subscribe"`
+}
+
+type mockModify struct {
+	WashID     int `xml:"id"`
+	WashPkgNum int `xml:"washPkgNum"`
+}
+
+type mockMove struct {
+	WashID   int `xml:"id"`
+	ToBefore int `xml:"before"`
+}
+
+func CreateMockRTC(washTime time.Duration) *MockRTC {
+	return &MockRTC{WashTime: washTime, nextID: 100, tunnels: map[string]*mockTunnel{}, packages: map[int]int{}, subscribers: map[net.Conn]string{}}
+}
+
+// Start listens on addr, e.g. "127.0.0.1:0", and returns the address it got.
+func (m *MockRTC) Start(addr string) (*net.TCPAddr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start mock rTC")
+	}
+	m.listener = listener
+	m.done = make(chan struct{})
+	go m.serve()
+	go m.tick()
+	return listener.Addr().(*net.TCPAddr), nil
+}
+
+func (m *MockRTC) Close() error {
+	close(m.done)
+	return m.listener.Close()
+}
+
+func (m *MockRTC) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+// handle answers the requests of a connection until the tester closes it, one
+// per connection unless the tester keeps persistent connections.
+func (m *MockRTC) handle(conn net.Conn) {
+	defer conn.Close()
+	defer m.unsubscribe(conn)
+
+	decoder := xml.NewDecoder(conn)
+	for {
+		var req mockRequest
+		err := decoder.Decode(&req)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "<tc><error>%s</error></tc>\n", "malformed request")
+			return
+		}
+		if req.Subscribe != nil {
+			m.subscribe(conn, req)
+			continue
+		}
+		fmt.Fprintln(conn, m.Reply(req))
+	}
+}
+
+// Reply applies a request to the mock's queue and builds the rTC's answer.
+func (m *MockRTC) Reply(req mockRequest) string {
+	if !m.authorized(req) {
+		return "<tc><error>unauthorized</error></tc>"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clock.Now()
+	for _, t := range m.tunnels {
+		m.wash(t, now)
+	}
+	t, ok := m.tunnels[req.Tunnel]
+	if !ok {
+		t = &mockTunnel{name: req.Tunnel, washing: now}
+		m.tunnels[req.Tunnel] = t
+	}
+
+	var b strings.Builder
+	b.WriteString("<tc>")
+	switch {
+	case len(req.Adds) > 0:
+		for _, add := range req.Adds {
+			m.nextID++
+			if len(t.queue) == 0 {
+				t.washing = now
+			}
+			t.queue = append(t.queue, m.nextID)
+			m.packages[m.nextID] = add.WashPkgNum
+			fmt.Fprintf(&b, "<carAdded><id>%d</id></carAdded>", m.nextID)
+		}
+	case len(req.Heads) > 0:
+		for _, add := range req.Heads {
+			m.nextID++
+			// the car being washed stays at the front
+			head := 1
+			if len(t.queue) == 0 {
+				t.washing = now
+				head = 0
+			}
+			t.queue = append(t.queue[:head], append([]int{m.nextID}, t.queue[head:]...)...)
+			m.packages[m.nextID] = add.WashPkgNum
+			fmt.Fprintf(&b, "<carAdded><id>%d</id></carAdded>", m.nextID)
+		}
+	case req.Status != nil:
+		fmt.Fprintf(&b, "<status><state>%s</state></status>", t.state())
+	case req.Pause != nil || req.Resume != nil:
+		if t.paused && req.Resume != nil {
+			t.washing = now
+		}
+		t.paused = req.Pause != nil
+		fmt.Fprintf(&b, "<status><state>%s</state></status>", t.state())
+	case req.Modify != nil:
+		queued := false
+		for _, id := range t.queue {
+			queued = queued || id == req.Modify.WashID
+		}
+		if queued {
+			m.packages[req.Modify.WashID] = req.Modify.WashPkgNum
+			fmt.Fprintf(&b, "<carModified><id>%d</id><washPkgNum>%d</washPkgNum></carModified>", req.Modify.WashID, req.Modify.WashPkgNum)
+		} else {
+			fmt.Fprintf(&b, "<error>no such car %d</error>", req.Modify.WashID)
+		}
+	case len(req.Deletes) > 0:
+		for _, d := range req.Deletes {
+			if t.remove(d.WashID) {
+				delete(m.packages, d.WashID)
+				fmt.Fprintf(&b, "<carDeleted><id>%d</id></carDeleted>", d.WashID)
+			} else {
+				fmt.Fprintf(&b, "<error>no such car %d</error>", d.WashID)
+			}
+		}
+	default:
+		if req.Move != nil && req.Move.ToBefore >= 0 && req.Move.ToBefore <= len(t.queue) && t.remove(req.Move.WashID) {
+			before := req.Move.ToBefore
+			if before > len(t.queue) {
+				before = len(t.queue)
+			}
+			t.queue = append(t.queue[:before], append([]int{req.Move.WashID}, t.queue[before:]...)...)
+		}
+		b.WriteString("<queue>")
+		for i, id := range t.queue {
+			state := "queued"
+			if i == 0 {
+				state = "washing"
+			}
+			fmt.Fprintf(&b, "<car><id>%d</id><state>%s</state><position>%d</position><washPkgNum>%d</washPkgNum></car>", id, state, i+1, m.packages[id])
+		}
+		b.WriteString("</queue>")
+	}
+	b.WriteString("</tc>")
+	for _, t := range m.tunnels {
+		m.announce(t, now)
+	}
+	return b.String()
+}
+
+func (m *MockRTC) authorized(req mockRequest) bool {
+	return m.Auth == nil || (req.SiteCode == m.Auth.SiteCode && req.PIN == m.Auth.PIN)
+}
+
+// subscribe pushes the events of the request's tunnel to conn from now on.
+func (m *MockRTC) subscribe(conn net.Conn, req mockRequest) {
+	if !m.authorized(req) {
+		fmt.Fprintln(conn, "<tc><error>unauthorized</error></tc>")
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers[conn] = req.Tunnel
+	fmt.Fprintln(conn, "<tc><subscribed/></tc>")
+}
+
+func (m *MockRTC) unsubscribe(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subscribers, conn)
+}
+
+// tick washes on its own while connections are subscribed, so their events
+// are pushed as they happen rather than with the next request.
+func (m *MockRTC) tick() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		if len(m.subscribers) > 0 {
+			now := clock.Now()
+			for _, t := range m.tunnels {
+				m.wash(t, now)
+				m.announce(t, now)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// announce pushes the start of the wash of the car at the front of a tunnel
+// when it hasn't been yet; m.mu is held.
+func (m *MockRTC) announce(t *mockTunnel, at time.Time) {
+	if len(t.queue) == 0 {
+		t.front = 0
+		return
+	}
+	if t.paused || t.queue[0] == t.front {
+		return
+	}
+	t.front = t.queue[0]
+	m.push(t, EventCarEntered, t.front, at)
+	m.push(t, EventWashStarted, t.front, at)
+}
+
+// push writes an event to the subscribers of its tunnel, dropping those that
+// can't take it; m.mu is held.
+func (m *MockRTC) push(t *mockTunnel, event string, washID int, at time.Time) {
+	if len(m.subscribers) == 0 {
+		return
+	}
+	tunnel := ""
+	if t.name != "" {
+		tunnel = "<tunnel>" + t.name + "</tunnel>"
+	}
+	line := fmt.Sprintf("<tc><event><type>%s</type><id>%d</id>%s<time>%s</time></event></tc>", event, washID, tunnel, at.UTC().Format(time.RFC3339Nano))
+	for conn, subscribed := range m.subscribers {
+		if subscribed != t.name {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := fmt.Fprintln(conn, line)
+		if err != nil {
+			delete(m.subscribers, conn)
+		}
+	}
+}
+
+// wash takes every car off the front of a tunnel whose wash finished by now.
+func (m *MockRTC) wash(t *mockTunnel, now time.Time) {
+	if m.WashTime <= 0 || t.paused {
+		return
+	}
+	for len(t.queue) > 0 && !now.Before(t.washing.Add(m.WashTime)) {
+		done := t.washing.Add(m.WashTime)
+		m.push(t, EventWashCompleted, t.queue[0], done)
+		delete(m.packages, t.queue[0])
+		t.queue = t.queue[1:]
+		t.washing = done
+		m.announce(t, done)
+	}
+	if len(t.queue) == 0 {
+		t.washing = now
+	}
+}
+
+// state is the tunnel's state as getStatus reads it; the mock's never fault.
+func (t *mockTunnel) state() string {
+	if t.paused {
+		return TunnelStopped
+	}
+	return TunnelRunning
+}
+
+func (t *mockTunnel) remove(washID int) bool {
+	for i, id := range t.queue {
+		if id == washID {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// runMockRTC implements the `mock-rtc` subcommand.
+func runMockRTC(args []string) {
+	fs := flag.NewFlagSet("mock-rtc", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:20250", "address the mock rTC listens on")
+	washTime := fs.Duration("wash-time", time.Minute, "time the mock takes to wash the car at the front of the queue, 0 to never wash")
+	auth := addAuthFlags(fs, "every request has to carry")
+	fs.Parse(args)
+
+	mock := CreateMockRTC(*washTime)
+	mock.Auth = auth()
+	addr, err := mock.Start(*listen)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to start mock rTC")
+	}
+	log.Info().Str("addr", addr.String()).Msg("mock rTC listening")
+	select {}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ModifyRoutine changes the package of a random test wash every tick, the way
+// customers upgrade or downgrade at the pay station once their car is queued.
+// Washes are switched between Packages only, so every package they end up with
+// still tells them apart from a site's real washes. The wash being washed is
+// left alone.
+type ModifyRoutine struct {
+	TickedRoutine
+
+	// Rand picks the wash changed and its new package.
+	Rand *SeededRand
+	// Packages are the packages of the washes changed and the packages they
+	// are changed to, the queue routine's first.
+	Packages []int
+}
+
+func CreateModifyRoutine(tickerTime int, packages []int) *ModifyRoutine {
+	m := &ModifyRoutine{Rand: CreateSeededRand(time.Now().UnixNano(), "modify"), Packages: packages}
+	m.init("modify", tickerTime, 10*time.Second, m.modify)
+	return m
+}
+
+// ParseModifyPackages reads --modify-packages, e.g. "2,3", the packages test
+// washes queued with queuePackage are switched to.
+func ParseModifyPackages(list string, queuePackage int) ([]int, error) {
+	packages := []int{queuePackage}
+	seen := map[int]bool{queuePackage: true}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pkg, err := strconv.Atoi(item)
+		if err != nil || pkg <= 0 {
+			return nil, errors.Errorf("wash package %q must be a positive integer", item)
+		}
+		if !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, pkg)
+		}
+	}
+	if len(packages) < 2 {
+		return nil, errors.Errorf("no package to switch test washes to other than the queue routine's %d", queuePackage)
+	}
+	return packages, nil
+}
+
+func (m *ModifyRoutine) modify(client *RTCClient, writer *ResultWriter) {
+	queue, records, err := client.GetQueue()
+	if err != nil {
+		m.Log.Warn("error getting queue from rTC, not attempting modify", "error", err)
+		return
+	}
+	writer.Write(records)
+
+	var washes []WashQueueItem
+	for _, wash := range queue.Queue.QueueItems {
+		if wash.State != "washing" && m.isTestPackage(wash.WashPkgNum) {
+			washes = append(washes, wash)
+		}
+	}
+	if len(washes) == 0 {
+		m.Log.Warn("no washes queued by routines, not attempting modify")
+		return
+	}
+
+	wash := washes[m.Rand.Intn(len(washes))]
+	// any package but the wash's own
+	to := m.Packages[m.Rand.Intn(len(m.Packages)-1)]
+	if to == wash.WashPkgNum {
+		to = m.Packages[len(m.Packages)-1]
+	}
+	_, records, err = client.ModifyWash(wash.WashID, to)
+	if err != nil {
+		m.Log.Warn("error changing package of wash", "error", err, "washID", wash.WashID, "from", wash.WashPkgNum, "to", to)
+	} else {
+		client.Rates.Achieve()
+	}
+	writer.Write(records)
+}
+
+func (m *ModifyRoutine) isTestPackage(pkg int) bool {
+	for _, p := range m.Packages {
+		if p == pkg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// MutualTLS secures the connections between a coordinator and its agents, which
+// reach it from wash sites over networks we don't control. Both ends present a
+// certificate signed by the same CA, and neither accepts a peer that doesn't.
+type MutualTLS struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func (m MutualTLS) Enabled() bool {
+	return m.CertFile != "" || m.KeyFile != "" || m.CAFile != ""
+}
+
+func (m MutualTLS) load() (tls.Certificate, *x509.CertPool, error) {
+	if m.CertFile == "" || m.KeyFile == "" || m.CAFile == "" {
+		return tls.Certificate{}, nil, errors.New("mutual tls needs a certificate, its key and the ca certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, errors.Wrap(err, "unable to load tls certificate")
+	}
+	b, err := os.ReadFile(m.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, errors.Wrap(err, "unable to read ca certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return tls.Certificate{}, nil, errors.Errorf("no certificates found in %s", m.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// ServerConfig requires and verifies a client certificate from every agent.
+func (m MutualTLS) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig presents the agent's certificate and only trusts a coordinator
+// signed by the CA.
+func (m MutualTLS) ClientConfig() (*tls.Config, error) {
+	cert, pool, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// UseTLS makes the allocator reach its coordinator with config.
+func (r *RangeAllocator) UseTLS(config *tls.Config) {
+	r.client.Transport = &http.Transport{TLSClientConfig: config}
+}
+
+func writePEM(path, kind string, der []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s", path)
+	}
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: kind, Bytes: der})
+	if err != nil {
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+	return nil
+}
+
+// writeKeyPair encodes a certificate and its key as name.pem and name-key.pem in dir.
+func writeKeyPair(dir, name string, certDER []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode private key")
+	}
+	err = writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", certDER, 0644)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER, 0600)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// CreateCA writes a new CA certificate and key to dir as ca.pem and ca-key.pem.
+func CreateCA(dir string, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "unable to generate ca key")
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return errors.Wrap(err, "unable to generate serial number")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "rtc-load-test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return errors.Wrap(err, "unable to create ca certificate")
+	}
+	return writeKeyPair(dir, "ca", der, key)
+}
+
+// IssueCertificate signs a certificate for a coordinator or agent with the CA in
+// dir and writes it as name.pem and name-key.pem. The certificate is valid for
+// both ends of a connection; hosts are the names and addresses it is served on.
+func IssueCertificate(dir, name string, hosts []string, validFor time.Duration) error {
+	ca, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return errors.Wrap(err, "unable to load ca, create it with `certs ca` first")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "unable to parse ca certificate")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "unable to generate key")
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return errors.Wrap(err, "unable to generate serial number")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return errors.Wrap(err, "unable to sign certificate")
+	}
+	return writeKeyPair(dir, name, der, key)
+}
+
+// runCerts implements the `certs` subcommand: `certs ca` creates the CA and
+// `certs issue -name NAME` a certificate for a coordinator or agent.
+func runCerts(args []string) {
+	if len(args) == 0 || (args[0] != "ca" && args[0] != "issue") {
+		fmt.Fprintln(os.Stderr, "usage: certs ca [-dir DIR] | certs issue -name NAME [-hosts HOST,...] [-dir DIR]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("certs "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", "certs", "directory the CA and certificates are kept in")
+	validFor := fs.Duration("valid-for", 365*24*time.Hour, "how long the certificate is valid")
+	name := fs.String("name", "", "name of the coordinator or agent the certificate is for, also its file name")
+	hosts := fs.String("hosts", "", "comma separated host names and ip addresses the certificate is served on, needed by the coordinator")
+	fs.Parse(args[1:])
+
+	err := os.MkdirAll(*dir, 0700)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", *dir).Msg("unable to create certificate directory")
+	}
+
+	switch args[0] {
+	case "ca":
+		if _, err := os.Stat(filepath.Join(*dir, "ca.pem")); err == nil {
+			log.Fatal().Str("dir", *dir).Msg("a ca already exists, certificates it issued would stop working if it was replaced")
+		}
+		err = CreateCA(*dir, *validFor)
+	case "issue":
+		if *name == "" || *name == "ca" {
+			log.Fatal().Msg("-name is required and can't be ca")
+		}
+		var hostList []string
+		for _, host := range strings.Split(*hosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hostList = append(hostList, host)
+			}
+		}
+		err = IssueCertificate(*dir, *name, hostList, *validFor)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to provision certificate")
+	}
+	log.Info().Str("dir", *dir).Msg("certificate written")
+}
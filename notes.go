@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// RunNotes say who ran a test, why and against which rTC, since result files
+// copied off a site PC are otherwise anonymous.
+type RunNotes struct {
+	Purpose  string `json:"purpose,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// Missing lists the notes that haven't been given.
+func (n *RunNotes) Missing() []string {
+	var missing []string
+	for _, field := range n.fields() {
+		if *field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	return missing
+}
+
+type runNoteField struct {
+	name   string
+	prompt string
+	value  *string
+}
+
+func (n *RunNotes) fields() []runNoteField {
+	return []runNoteField{
+		{"purpose", "Purpose of this run", &n.Purpose},
+		{"operator", "Operator name", &n.Operator},
+		{"firmware", "rTC firmware version", &n.Firmware},
+	}
+}
+
+// Prompt asks for every note not given yet, one line each; an empty answer
+// leaves the note empty.
+func (n *RunNotes) Prompt(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	for _, field := range n.fields() {
+		if *field.value != "" {
+			continue
+		}
+		fmt.Fprintf(out, "%s: ", field.prompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		*field.value = strings.TrimSpace(scanner.Text())
+	}
+}
+
+// interactive is whether stdin is a terminal someone can answer prompts on.
+func interactive() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var ticksHeader = []string{"Time", "Routine", "Event", "Delay Ms"}
+
+// ScheduleTracker catches a routine falling behind its schedule. A ticker
+// drops the ticks a routine is too busy to take, e.g. while a call to a slow
+// rTC blocks, so without it those operations silently never happen and the
+// latencies only describe the ones that did (coordinated omission). Every
+// skipped tick is written to ticks.csv as missed, and a tick taken late as
+// delayed. With Backfill, a record per missed tick is also added to the
+// results, sent at the tick's intended time and completed when the operation
+// that did go out completed, so percentiles include the time spent waiting.
+type ScheduleTracker struct {
+	Command  string
+	Writer   *ResultWriter
+	Backfill bool
+
+	last    time.Time
+	missed  uint64
+	delayed uint64
+}
+
+func CreateScheduleTracker(command string, writer *ResultWriter) *ScheduleTracker {
+	return &ScheduleTracker{Command: command, Writer: writer}
+}
+
+// Reset forgets the previous tick, e.g. when the routine is restarted.
+func (s *ScheduleTracker) Reset() {
+	if s == nil {
+		return
+	}
+	s.last = time.Time{}
+}
+
+// Tick is called with every tick the routine takes and the interval it is
+// meant to tick at. It returns the intended times of the ticks skipped since
+// the previous one. It is safe to call on a nil tracker, which tracks nothing.
+func (s *ScheduleTracker) Tick(at time.Time, interval time.Duration) []time.Time {
+	if s == nil || interval <= 0 {
+		return nil
+	}
+	now := clock.Now()
+	if delay := now.Sub(at); delay > interval/2 {
+		atomic.AddUint64(&s.delayed, 1)
+		s.record(at, "delayed", delay)
+	}
+
+	last := s.last
+	s.last = at
+	if last.IsZero() {
+		return nil
+	}
+	skipped := int((at.Sub(last)+interval/2)/interval) - 1
+	var missed []time.Time
+	for i := 1; i <= skipped; i++ {
+		intended := last.Add(time.Duration(i) * interval)
+		missed = append(missed, intended)
+		s.record(intended, "missed", now.Sub(intended))
+	}
+	atomic.AddUint64(&s.missed, uint64(len(missed)))
+	return missed
+}
+
+func (s *ScheduleTracker) record(at time.Time, event string, delay time.Duration) {
+	ms := strconv.FormatFloat(float64(delay)/float64(time.Millisecond), 'f', 1, 64)
+	s.Writer.Write([]string{recordTime(at), s.Command, event, ms})
+}
+
+// BackfillMissed adds a results record for each missed tick once the operation
+// that went out in their place has completed. It does nothing unless Backfill
+// is set.
+func (s *ScheduleTracker) BackfillMissed(missed []time.Time, writer *ResultWriter) {
+	if s == nil || !s.Backfill || len(missed) == 0 {
+		return
+	}
+	completed := recordTime(clock.Now())
+	for _, intended := range missed {
+		at := recordTime(intended)
+		writer.Write([]string{s.Command, at, at, completed, completed, "false", "missed tick, back-filled"})
+	}
+}
+
+// Counts are the ticks missed and taken late so far.
+func (s *ScheduleTracker) Counts() (missed, delayed uint64) {
+	return atomic.LoadUint64(&s.missed), atomic.LoadUint64(&s.delayed)
+}
+
+// tickInterval is the interval a routine's ticker is currently meant to tick at.
+func tickInterval(ticker Ticker, base time.Duration) time.Duration {
+	if profiled, ok := ticker.(*ProfileTicker); ok {
+		return profiled.Interval()
+	}
+	return base
+}
+
+// TrackSchedules records the ticks the timed routines miss to writer.
+func (r *Routines) TrackSchedules(writer *ResultWriter, backfill bool) {
+	for _, routine := range r.Timed.All() {
+		t := routine.Ticked()
+		t.Schedule = CreateScheduleTracker(t.commandName(), writer)
+		t.Schedule.Backfill = backfill
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "sync/atomic"
+
+// OpenModel fires operations at their scheduled rate whether or not earlier
+// ones have completed, so a slow rTC shows up as latency and operations in
+// flight instead of silently lowering the rate. Operations over the cap are
+// dropped and counted. A nil OpenModel runs operations in the caller, which is
+// the closed model the routines use by default.
+type OpenModel struct {
+	Max int64
+
+	inFlight int64
+	dropped  uint64
+}
+
+func CreateOpenModel(max int) *OpenModel {
+	return &OpenModel{Max: int64(max)}
+}
+
+// Go runs op and returns false when it was dropped for the cap.
+func (o *OpenModel) Go(op func()) bool {
+	if o == nil {
+		op()
+		return true
+	}
+	if atomic.AddInt64(&o.inFlight, 1) > o.Max {
+		atomic.AddInt64(&o.inFlight, -1)
+		atomic.AddUint64(&o.dropped, 1)
+		return false
+	}
+	go func() {
+		defer atomic.AddInt64(&o.inFlight, -1)
+		op()
+	}()
+	return true
+}
+
+// InFlight is the number of operations started and not completed.
+func (o *OpenModel) InFlight() int64 {
+	return atomic.LoadInt64(&o.inFlight)
+}
+
+// Dropped is the number of operations dropped for the cap.
+func (o *OpenModel) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
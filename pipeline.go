@@ -0,0 +1,253 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PipelinedCommand is a command written to the rTC as part of a pipeline.
+type PipelinedCommand struct {
+	Command string
+	XML     string
+}
+
+// SendPipeline writes commands back to back on one connection and only then
+// reads their replies, in order, to measure how the rTC takes several framed
+// messages per connection rather than one connection per command. Every
+// command is recorded with the connection's connect and close times, the time
+// it was written and the time its reply was read, as e.g. "GET_PIPELINED
+// pos=2/5". A failed read fails its command and all those after it. Pipelines
+// take one in-flight slot and aren't retried. A pipeline that would go over the
+// run's --max-commands isn't sent at all.
+func (r *RTCClient) SendPipeline(commands []PipelinedCommand) ([]*string, [][]string, error) {
+	n := len(commands)
+	for i, c := range commands {
+		limited := commandName(c.Command)
+		if !r.CommandLimit.Take(limited) {
+			for _, taken := range commands[:i] {
+				r.CommandLimit.Cancel(commandName(taken.Command))
+			}
+			return make([]*string, n), make([][]string, n), ErrCommandLimit
+		}
+		defer r.CommandLimit.Done(limited)
+	}
+	names := make([]string, n)
+	payloads := make([]string, n)
+	for i, c := range commands {
+		names[i], payloads[i] = r.address(c.Command, c.XML)
+		names[i] += " pos=" + strconv.Itoa(i+1) + "/" + strconv.Itoa(n)
+	}
+	replies := make([]*string, n)
+	records := make([][]string, n)
+
+	atomic.AddInt64(&r.state.inFlight, 1)
+	defer atomic.AddInt64(&r.state.inFlight, -1)
+	seq := atomic.AddUint64(&r.state.commandSeq, 1)
+	r.state.pending.Store(seq, InFlightCommand{Command: "PIPELINE", Started: clock.Now()})
+	defer r.state.pending.Delete(seq)
+
+	ctx := r.commandContext()
+	timeouts := r.Timeouts.For("PIPELINE")
+	waited, err := r.MaxInFlight.Acquire(ctx)
+	if err != nil {
+		for i := range records {
+			records[i] = r.MaxInFlight.record(failedRecord(names[i], err), waited)
+		}
+		return replies, records, err
+	}
+	defer r.MaxInFlight.Release()
+
+	conn, err := r.StartConn(ctx, timeouts)
+	if err != nil {
+		r.Throttle.Observe(err)
+		for i := range records {
+			records[i] = r.MaxInFlight.record(failedRecord(names[i], err), waited)
+		}
+		return replies, records, err
+	}
+	stopAbort := abortOnCancel(ctx, conn)
+	connected := clock.Now()
+
+	sent := make([]time.Time, n)
+	for i := range payloads {
+		r.Trace.Trace(names[i], "sent", r.Auth.Redact(payloads[i]))
+		r.WriteToRTC(conn, payloads[i])
+		sent[i] = clock.Now()
+	}
+
+	reader := connReader(conn)
+	received := make([]time.Time, n)
+	read := 0
+	var readErr error
+	for ; read < n; read++ {
+		reply, err := r.readReply(conn, reader, timeouts.Read)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = errors.Wrap(ctx.Err(), "pipeline cancelled while waiting for the rTC")
+			}
+			var disconnect *DisconnectError
+			if errors.As(err, &disconnect) {
+				r.Disconnects.Observe(names[read], disconnect, clock.Now().Sub(sent[read]))
+			}
+			readErr = err
+			break
+		}
+		received[read] = clock.Now()
+		redactedReply := r.Auth.RedactReply(*reply)
+		replies[read] = &redactedReply
+		r.Trace.Trace(names[read], "received", redactedReply)
+	}
+	stopAbort()
+
+	closeErr := r.CloseConn(conn)
+	closed := clock.Now()
+	if readErr != nil {
+		r.Log.Error("error reading reply to pipelined command from rTC", "error", readErr, "command", names[read])
+		r.Throttle.Observe(readErr)
+	} else {
+		r.Throttle.Observe(nil)
+	}
+	if closeErr != nil {
+		r.Log.Error("error closing pipelined connection to rTC, handed off to background cleanup", "error", closeErr)
+		closed = time.Time{}
+	}
+
+	for i := range records {
+		record := []string{names[i], recordTime(connected), recordTime(sent[i])}
+		switch {
+		case i >= read:
+			record = append(record, recordTime(time.Time{}), recordTime(time.Time{}), "true", readErr.Error())
+		case closeErr != nil:
+			record = append(record, recordTime(received[i]), recordTime(closed), "true", closeErr.Error())
+		default:
+			record = append(record, recordTime(received[i]), recordTime(closed), "false", "")
+		}
+		records[i] = r.MaxInFlight.record(record, waited)
+	}
+	if readErr != nil {
+		return replies, records, readErr
+	}
+	return replies, records, closeErr
+}
+
+// pipelineCommands are the commands a pipeline can be filled with.
+var pipelineCommands = map[string]bool{"get": true, "queue": true}
+
+// ParsePipelineCommands parses a comma separated list of pipelined commands,
+// e.g. "get,queue".
+func ParsePipelineCommands(list string) ([]string, error) {
+	var commands []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !pipelineCommands[name] {
+			return nil, errors.Errorf("unknown pipelined command %q, expected get or queue", name)
+		}
+		commands = append(commands, name)
+	}
+	if len(commands) == 0 {
+		return nil, errors.New("no pipelined commands")
+	}
+	return commands, nil
+}
+
+// PipelineRoutine writes Depth commands on one connection every tick before
+// reading any of their replies, cycling through Commands to fill it. Washes
+// are queued with the ids, package and lanes of Queue and retained like its own.
+type PipelineRoutine struct {
+	TickedRoutine
+
+	Depth    int
+	Commands []string
+	Queue    *QueueRoutine
+}
+
+func CreatePipelineRoutine(tickerTime int, depth int, commands []string, queue *QueueRoutine) *PipelineRoutine {
+	p := &PipelineRoutine{Depth: depth, Commands: commands, Queue: queue}
+	p.init("pipeline", tickerTime, 5*time.Second, p.pipeline)
+	return p
+}
+
+func (p *PipelineRoutine) pipeline(client *RTCClient, writer *ResultWriter) {
+	commands := make([]PipelinedCommand, 0, p.Depth)
+	orderIDs := make([]string, p.Depth)
+	packages := make([]int, p.Depth)
+	for i := 0; i < p.Depth; i++ {
+		if p.Commands[i%len(p.Commands)] == "get" {
+			commands = append(commands, PipelinedCommand{Command: "GET_PIPELINED", XML: getQueueXML})
+			continue
+		}
+
+		orderID, err := p.Queue.IDs.NextOrderID()
+		if err != nil {
+			p.Log.Warn("unable to allocate order id, not attempting pipeline", "error", err, "strategy", p.Queue.IDs.Strategy())
+			return
+		}
+		req := p.Queue.request(client, orderID)
+		assigner := req.lanes(client)
+		var lanes []string
+		if assigner != nil {
+			lanes = []string{req.LaneID}
+		}
+		queueXML, err := client.BuildAddTailXML(req.washPackage(), strings.Join(lanes, ""))
+		if err != nil {
+			p.Log.Error("error building xml to queue pipelined wash", "error", err)
+			return
+		}
+		commands = append(commands, PipelinedCommand{Command: assigner.commandName("QUEUE_PIPELINED", lanes...), XML: queueXML})
+		orderIDs[i] = orderID
+		packages[i] = req.washPackage()
+	}
+
+	start := clock.Now()
+	replies, records, err := client.SendPipeline(commands)
+	if err != nil {
+		p.Log.Warn("pipeline to rTC failed", "error", err, "depth", p.Depth)
+	} else {
+		client.Rates.Achieve()
+	}
+
+	var washIDs []int
+	accepted := 0
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		var parseErr error
+		if orderIDs[i] == "" {
+			_, parseErr = client.ParseRTCGetQueueResponse(*reply)
+		} else {
+			var resp *AddQueueResponse
+			resp, parseErr = client.ParseRTCAddQueueResponse(*reply)
+			if parseErr == nil {
+				client.queued(resp.WashID, orderIDs[i], packages[i])
+				washIDs = append(washIDs, resp.WashID)
+			}
+		}
+		if parseErr == nil {
+			accepted++
+		}
+		if parseErr != nil && records[i][5] == "false" {
+			p.Log.Warn("rTC did not accept pipelined command", "error", parseErr, "command", records[i][0])
+			markFailed(records[i], parseErr)
+		}
+	}
+	if err == nil {
+		client.Throughput.Observe("PIPELINE", accepted, start)
+	}
+	for i, record := range records {
+		if orderIDs[i] != "" {
+			record = client.withOrderIDs(record, orderIDs[i])
+		}
+		writer.Write(record)
+	}
+	if len(washIDs) > 0 && p.Queue.Retain != nil {
+		p.Queue.Retain.Retain(client, writer, washIDs...)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PauseGate holds load generation while any reason to pause is active. Load
+// generating routines skip their ticks while it is closed; cleanup and
+// verification commands still go through.
+type PauseGate struct {
+	mu      sync.Mutex
+	reasons map[string]string
+}
+
+func CreatePauseGate() *PauseGate {
+	return &PauseGate{reasons: map[string]string{}}
+}
+
+// Pause closes the gate for reason, replacing its detail if it is already active.
+func (g *PauseGate) Pause(reason, detail string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reasons[reason] = detail
+}
+
+func (g *PauseGate) Resume(reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.reasons, reason)
+}
+
+// Paused is safe to call on a nil gate, which never pauses.
+func (g *PauseGate) Paused() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.reasons) > 0
+}
+
+// Reasons are the active reasons and their details.
+func (g *PauseGate) Reasons() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	reasons := make(map[string]string, len(g.reasons))
+	for reason, detail := range g.reasons {
+		reasons[reason] = detail
+	}
+	return reasons
+}
+
+var pauseHeader = []string{"Time", "Event", "Reason"}
+
+// PressureWatchdog pauses load generation while the tester's host is short of
+// cpu, memory or descriptors, so a run on a shared site PC can't take the POS
+// down with it. Load resumes once every value is back below ResumeRatio of
+// its limit. A limit of 0 is not checked.
+type PressureWatchdog struct {
+	Gate   *PauseGate
+	Writer *ResultWriter
+	Log    Logger
+
+	MaxHostCPUPercent    float64
+	MaxHostMemoryPercent float64
+	MaxOpenFDs           int
+	ResumeRatio          float64
+
+	pausedAt time.Time
+	reason   string
+}
+
+func CreatePressureWatchdog(gate *PauseGate, writer *ResultWriter) *PressureWatchdog {
+	return &PressureWatchdog{
+		Gate:        gate,
+		Writer:      writer,
+		Log:         ZerologLogger{},
+		ResumeRatio: 0.8,
+	}
+}
+
+func (w *PressureWatchdog) Enabled() bool {
+	return w.MaxHostCPUPercent > 0 || w.MaxHostMemoryPercent > 0 || w.MaxOpenFDs > 0
+}
+
+// exceeded lists the limits a sample is over, each scaled by ratio.
+func (w *PressureWatchdog) exceeded(sample ResourceSample, ratio float64) []string {
+	var over []string
+	if w.MaxHostCPUPercent > 0 && sample.HostCPUPercent > w.MaxHostCPUPercent*ratio {
+		over = append(over, fmt.Sprintf("host cpu %.0f%%", sample.HostCPUPercent))
+	}
+	if w.MaxHostMemoryPercent > 0 && sample.HostMemoryPercent > w.MaxHostMemoryPercent*ratio {
+		over = append(over, fmt.Sprintf("host memory %.0f%%", sample.HostMemoryPercent))
+	}
+	if w.MaxOpenFDs > 0 && float64(sample.OpenFDs) > float64(w.MaxOpenFDs)*ratio {
+		over = append(over, fmt.Sprintf("%d open fds", sample.OpenFDs))
+	}
+	sort.Strings(over)
+	return over
+}
+
+// Check is called with every resource sample.
+func (w *PressureWatchdog) Check(sample ResourceSample) {
+	if w.pausedAt.IsZero() {
+		over := w.exceeded(sample, 1)
+		if len(over) == 0 {
+			return
+		}
+		w.pausedAt = sample.Time
+		w.reason = strings.Join(over, ", ")
+		w.Gate.Pause("pressure", w.reason)
+		w.Log.Warn("tester host under pressure, pausing load", "reason", w.reason)
+		w.Writer.Write([]string{recordTime(sample.Time), "paused", w.reason})
+		return
+	}
+
+	if len(w.exceeded(sample, w.ResumeRatio)) > 0 {
+		return
+	}
+	w.Gate.Resume("pressure")
+	w.Log.Info("pressure on tester host subsided, resuming load", "reason", w.reason, "paused", sample.Time.Sub(w.pausedAt).String())
+	w.Writer.Write([]string{recordTime(sample.Time), "resumed", w.reason})
+	w.pausedAt = time.Time{}
+	w.reason = ""
+}
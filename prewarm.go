@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+)
+
+// prewarmConnections opens and probes the persistent connections before load
+// that needs them, logging what it found.
+func (r *Routines) prewarmConnections(reason string) {
+	if r.RTC.Pool == nil {
+		return
+	}
+	result := r.RTC.PrewarmPool(r.ctx)
+	keyvals := []interface{}{"reason", reason, "open", result.Open, "busy", result.Busy, "size", r.RTC.Pool.Size,
+		"dialled", result.Dialled, "replaced", result.Replaced, "tookMs", result.Took.Milliseconds()}
+	if result.Err != nil {
+		r.Log.Warn("connections prewarmed with failures", append(keyvals, "error", result.Err)...)
+		return
+	}
+	r.Log.Info("connections prewarmed", keyvals...)
+}
+
+// prewarmBeforePhases prewarms the connections lead before each phase of the
+// step profile after the first, until the routines stop.
+func (r *Routines) prewarmBeforePhases(steps *StepProfile, lead time.Duration) {
+	for _, phase := range steps.Phases {
+		if phase.From <= 0 {
+			continue
+		}
+		wait := steps.Start.Add(phase.From - lead).Sub(clock.Now())
+		if wait < 0 {
+			continue
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-clock.After(wait):
+		}
+		r.prewarmConnections("phase " + phase.Label)
+	}
+}
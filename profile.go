@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LoadProfile shapes a routine's rate over the run. Interval is the time until
+// the routine's next tick, elapsed into the run, for a routine configured to
+// tick every base.
+type LoadProfile interface {
+	Interval(elapsed, base time.Duration) time.Duration
+}
+
+// ProfileTicker ticks at the interval its profile gives for the time of each
+// tick, so a changing rate takes effect tick by tick without restarting a
+// ticker. Like time.Ticker it skips ticks the routine was too busy to take.
+type ProfileTicker struct {
+	Profile LoadProfile
+
+	mu      sync.Mutex
+	base    time.Duration
+	start   time.Time
+	last    time.Time
+	stopped bool
+}
+
+func CreateProfileTicker(profile LoadProfile, base time.Duration) *ProfileTicker {
+	now := clock.Now()
+	return &ProfileTicker{Profile: profile, base: base, start: now, last: now}
+}
+
+// C is called by the routine each time it starts waiting for a tick.
+func (t *ProfileTicker) C() <-chan time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return nil
+	}
+	now := clock.Now()
+	due := t.last.Add(t.Profile.Interval(t.last.Sub(t.start), t.base))
+	if due.Before(now) {
+		due = now
+	}
+	t.last = due
+	return clock.After(due.Sub(now))
+}
+
+// Interval is the interval the profile currently gives.
+func (t *ProfileTicker) Interval() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Profile.Interval(t.last.Sub(t.start), t.base)
+}
+
+// Reset changes the base interval the profile is applied to and, like
+// time.Ticker, restarts the wait for the next tick.
+func (t *ProfileTicker) Reset(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.base = d
+	t.last = clock.Now()
+	t.stopped = false
+}
+
+// Restart starts the profile over from its beginning on base.
+func (t *ProfileTicker) Restart(base time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.base = base
+	t.start = clock.Now()
+	t.last = t.start
+	t.stopped = false
+}
+
+func (t *ProfileTicker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+}
+
+// RampProfile moves from one interval to another over Duration and then stays
+// at To. The rate, not the interval, is interpolated, so a linear ramp adds
+// the same number of commands per second every second. Exponential ramps
+// multiply the rate by the same factor every second instead.
+type RampProfile struct {
+	From        time.Duration
+	To          time.Duration
+	Duration    time.Duration
+	Exponential bool
+}
+
+func CreateRampProfile(from, to, duration time.Duration, shape string) (*RampProfile, error) {
+	if from <= 0 || to <= 0 {
+		return nil, errors.Errorf("ramp intervals must be positive, got %s and %s", from, to)
+	}
+	if duration <= 0 {
+		return nil, errors.Errorf("ramp duration must be positive, got %s", duration)
+	}
+	if shape != "linear" && shape != "exponential" {
+		return nil, errors.Errorf("ramp shape must be linear or exponential, got %q", shape)
+	}
+	return &RampProfile{From: from, To: to, Duration: duration, Exponential: shape == "exponential"}, nil
+}
+
+func (p *RampProfile) Interval(elapsed, base time.Duration) time.Duration {
+	if elapsed >= p.Duration {
+		return p.To
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	f := float64(elapsed) / float64(p.Duration)
+	fromRate, toRate := 1/p.From.Seconds(), 1/p.To.Seconds()
+	var rate float64
+	if p.Exponential {
+		rate = fromRate * math.Pow(toRate/fromRate, f)
+	} else {
+		rate = fromRate + (toRate-fromRate)*f
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// SpikeProfile runs at the base rate and multiplies it by Factor for the last
+// Duration of every Every, e.g. a 1m spike at 5x every 10m.
+type SpikeProfile struct {
+	Every    time.Duration
+	Duration time.Duration
+	Factor   float64
+}
+
+func CreateSpikeProfile(every, duration time.Duration, factor float64) (*SpikeProfile, error) {
+	if every <= 0 || duration <= 0 || duration >= every {
+		return nil, errors.Errorf("spikes need 0 < duration < every, got %s every %s", duration, every)
+	}
+	if factor <= 0 {
+		return nil, errors.Errorf("spike factor must be positive, got %g", factor)
+	}
+	return &SpikeProfile{Every: every, Duration: duration, Factor: factor}, nil
+}
+
+// Spiking is whether elapsed falls into a spike.
+func (p *SpikeProfile) Spiking(elapsed time.Duration) bool {
+	return elapsed%p.Every >= p.Every-p.Duration
+}
+
+func (p *SpikeProfile) Interval(elapsed, base time.Duration) time.Duration {
+	if !p.Spiking(elapsed) {
+		return base
+	}
+	return time.Duration(float64(base) / p.Factor)
+}
+
+// SineProfile modulates the base rate on a sine wave that starts at its trough,
+// so a period of an hour runs a day of car wash traffic, from the quiet of the
+// night up to the midday peak and back, in an hour. Amplitude is the share of
+// the base rate the rate swings by either side of it.
+type SineProfile struct {
+	Period    time.Duration
+	Amplitude float64
+}
+
+func CreateSineProfile(period time.Duration, amplitude float64) (*SineProfile, error) {
+	if period <= 0 {
+		return nil, errors.Errorf("sine period must be positive, got %s", period)
+	}
+	if amplitude <= 0 || amplitude >= 1 {
+		return nil, errors.Errorf("sine amplitude must be between 0 and 1, got %g", amplitude)
+	}
+	return &SineProfile{Period: period, Amplitude: amplitude}, nil
+}
+
+func (p *SineProfile) Interval(elapsed, base time.Duration) time.Duration {
+	phase := 2 * math.Pi * float64(elapsed%p.Period) / float64(p.Period)
+	return time.Duration(float64(base) / (1 - p.Amplitude*math.Cos(phase)))
+}
+
+// ChainedProfile applies profiles in order, each to the interval the previous
+// one produced, e.g. spikes on top of a ramp.
+type ChainedProfile []LoadProfile
+
+func (c ChainedProfile) Interval(elapsed, base time.Duration) time.Duration {
+	for _, p := range c {
+		base = p.Interval(elapsed, base)
+	}
+	return base
+}
+
+// parseRoutineNames splits a comma separated list of queue, get and move.
+func parseRoutineNames(list string) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "queue", "get", "move":
+			names[name] = true
+		default:
+			return nil, errors.Errorf("unknown routine %q, expected queue, get or move", name)
+		}
+	}
+	return names, nil
+}
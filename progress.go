@@ -0,0 +1,103 @@
+package main
+
+import "time"
+
+// Progress is how far a finite run has come towards the bound that ends it
+// first: its deadline, its --max-ops or --max-commands or the end of its
+// replay. The commands remaining before a deadline, and the ETA of a bound
+// counted in commands, are estimated at the run's rate so far.
+type Progress struct {
+	// Bound is what ends the run: duration, ops, commands or replay.
+	Bound             string    `json:"bound"`
+	Percent           float64   `json:"percent"`
+	ETA               time.Time `json:"eta"`
+	Remaining         string    `json:"remaining"`
+	CommandsRemaining int64     `json:"commandsRemaining"`
+}
+
+// Progress is how far the run has come, false while it hasn't started, once
+// it stopped or when nothing bounds it.
+func (r *Routines) Progress() (Progress, bool) {
+	state := r.lifecycle.State()
+	started := r.lifecycle.Started()
+	if (state != RoutinesRunning && state != RoutinesPaused) || started.IsZero() {
+		return Progress{}, false
+	}
+	now := clock.Now()
+	elapsed := now.Sub(started)
+	written := int64(r.Writer.Stats().Written)
+
+	var bounds []Progress
+	if deadline := r.Deadline.Deadline(); !deadline.IsZero() {
+		p := Progress{Bound: "duration", ETA: deadline}
+		if total := deadline.Sub(started); total > 0 {
+			p.Percent = 100 * float64(elapsed) / float64(total)
+		}
+		if elapsed > 0 {
+			p.CommandsRemaining = int64(float64(written) * float64(deadline.Sub(now)) / float64(elapsed))
+		}
+		bounds = append(bounds, p)
+	}
+	if done, total := r.RTC.Limit.Progress(); total > 0 {
+		bounds = append(bounds, countedProgress("ops", int64(done), int64(total), now, elapsed))
+	}
+	if done, total := r.RTC.CommandLimit.Progress(); total > 0 {
+		bounds = append(bounds, countedProgress("commands", int64(done), int64(total), now, elapsed))
+	}
+	if r.Replay != nil && len(r.Replay.Events) > 0 {
+		bounds = append(bounds, countedProgress("replay", r.Replay.Sent(), int64(len(r.Replay.Events)), now, elapsed))
+	}
+	if len(bounds) == 0 {
+		return Progress{}, false
+	}
+
+	first := bounds[0]
+	for _, p := range bounds[1:] {
+		if !p.ETA.IsZero() && (first.ETA.IsZero() || p.ETA.Before(first.ETA)) {
+			first = p
+		}
+	}
+	if first.Percent > 100 {
+		first.Percent = 100
+	}
+	if !first.ETA.IsZero() && first.ETA.After(now) {
+		first.Remaining = first.ETA.Sub(now).Round(time.Second).String()
+	} else {
+		first.Remaining = "0s"
+	}
+	if first.CommandsRemaining < 0 {
+		first.CommandsRemaining = 0
+	}
+	return first, true
+}
+
+// countedProgress is the progress of a bound of total commands, done of which
+// were sent in elapsed. Its ETA is unknown until the first is done.
+func countedProgress(bound string, done, total int64, now time.Time, elapsed time.Duration) Progress {
+	p := Progress{Bound: bound, Percent: 100 * float64(done) / float64(total), CommandsRemaining: total - done}
+	if done > 0 {
+		p.ETA = now.Add(time.Duration(float64(elapsed) / float64(done) * float64(total-done)))
+	}
+	return p
+}
+
+// logProgress logs the run's progress every interval while it is bounded.
+func (r *Routines) logProgress(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if r.lifecycle.State() == RoutinesStopped {
+			return
+		}
+		p, ok := r.Progress()
+		if !ok {
+			continue
+		}
+		r.Log.Info("run progress",
+			"bound", p.Bound,
+			"percent", int(p.Percent),
+			"eta", p.ETA.Format(time.RFC3339),
+			"remaining", p.Remaining,
+			"commandsRemaining", p.CommandsRemaining)
+	}
+}
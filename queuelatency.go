@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// QueueRegression is a least squares fit of one command's latency against the
+// length of the queue when it was sent, taken from the nearest queue read.
+// RSquared is the share of the latency's variance explained by queue depth and
+// Explained the latency growth the fit puts down to the queue growing from its
+// shortest to its longest.
+type QueueRegression struct {
+	Command   string
+	Samples   int
+	MinLength float64
+	MaxLength float64
+	// MsPerCar is the slope of the fit, Intercept the latency of an empty queue.
+	MsPerCar  float64
+	Intercept float64
+	RSquared  float64
+	Explained float64
+}
+
+// queueLengths adds up the states of each queue read into the queue's length.
+func queueLengths(states map[string][]ChartPoint) []ChartPoint {
+	totals := map[int64]*ChartPoint{}
+	for _, points := range states {
+		for _, p := range points {
+			key := p.At.UnixNano()
+			if total, ok := totals[key]; ok {
+				total.Value += p.Value
+			} else {
+				totals[key] = &ChartPoint{At: p.At, Value: p.Value}
+			}
+		}
+	}
+
+	lengths := make([]ChartPoint, 0, len(totals))
+	for _, total := range totals {
+		lengths = append(lengths, *total)
+	}
+	sort.Slice(lengths, func(i, j int) bool { return lengths[i].At.Before(lengths[j].At) })
+	return lengths
+}
+
+// nearestLength is the length of the queue read closest to p, lengths sorted by time.
+func nearestLength(lengths []ChartPoint, p ChartPoint) float64 {
+	i := sort.Search(len(lengths), func(i int) bool { return !lengths[i].At.Before(p.At) })
+	if i == len(lengths) || (i > 0 && p.At.Sub(lengths[i-1].At) < lengths[i].At.Sub(p.At)) {
+		i--
+	}
+	return lengths[i].Value
+}
+
+// readCommandLatencies loads the latency of every successful command of a run
+// by the time it was sent, leaving out the warm-up and re-baseline like the summary does.
+func readCommandLatencies(dir string) (map[string][]ChartPoint, error) {
+	f, err := os.Open(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	latencies := map[string][]ChartPoint{}
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read results")
+		}
+		if baselinePhase(record) {
+			continue
+		}
+		ms, ok := recordLatency(record)
+		if !ok {
+			continue
+		}
+		initiated, _ := parseRecordTime(record[2])
+		name := commandName(record[0])
+		latencies[name] = append(latencies[name], ChartPoint{At: initiated, Value: ms})
+	}
+	return latencies, nil
+}
+
+// fitQueueRegressions fits every command's latencies against queue length.
+// Commands with too few samples or sent while the queue never changed length
+// are left out, there's nothing to fit.
+func fitQueueRegressions(latencies map[string][]ChartPoint, lengths []ChartPoint) []QueueRegression {
+	if len(lengths) == 0 {
+		return nil
+	}
+
+	var fits []QueueRegression
+	for name, points := range latencies {
+		if len(points) < 3 {
+			continue
+		}
+		xs := make([]float64, len(points))
+		ys := make([]float64, len(points))
+		for i, p := range points {
+			xs[i] = nearestLength(lengths, p)
+			ys[i] = p.Value
+		}
+
+		slope, intercept, rSquared, ok := fitLine(xs, ys)
+		if !ok {
+			continue
+		}
+		minX, maxX := xs[0], xs[0]
+		for _, x := range xs {
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+		}
+		fit := QueueRegression{
+			Command:   name,
+			Samples:   len(points),
+			MinLength: minX,
+			MaxLength: maxX,
+			MsPerCar:  slope,
+			Intercept: intercept,
+			RSquared:  rSquared,
+			Explained: slope * (maxX - minX),
+		}
+		fits = append(fits, fit)
+	}
+	sort.Slice(fits, func(i, j int) bool { return fits[i].Command < fits[j].Command })
+	return fits
+}
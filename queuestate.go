@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var queueStateHeader = []string{"Time", "State", "Count"}
+
+// QueueStateTracker tallies the cars of every queue the get routine reads by
+// state. Controller slowdowns tend to show up first as cars piling up in one
+// state, e.g. stuck in "washing".
+type QueueStateTracker struct {
+	Writer *ResultWriter
+
+	mu     sync.Mutex
+	latest map[string]int
+	at     time.Time
+}
+
+func CreateQueueStateTracker(writer *ResultWriter) *QueueStateTracker {
+	return &QueueStateTracker{Writer: writer, latest: map[string]int{}}
+}
+
+// Observe records the state distribution of one queue read, one row per state.
+func (t *QueueStateTracker) Observe(at time.Time, items []WashQueueItem) {
+	counts := map[string]int{}
+	for _, item := range items {
+		state := item.State
+		if state == "" {
+			state = "unknown"
+		}
+		counts[state]++
+	}
+
+	t.mu.Lock()
+	// states that emptied out are written as 0 so plots drop back down
+	for state := range t.latest {
+		if _, ok := counts[state]; !ok {
+			counts[state] = 0
+		}
+	}
+	t.latest = counts
+	t.at = at
+	t.mu.Unlock()
+
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		t.Writer.Write([]string{recordTime(at), state, strconv.Itoa(counts[state])})
+	}
+}
+
+// Latest is the distribution of the most recent queue read.
+func (t *QueueStateTracker) Latest() (map[string]int, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int, len(t.latest))
+	for state, n := range t.latest {
+		counts[state] = n
+	}
+	return counts, t.at
+}
+
+// readQueueStates loads queue-states.csv of a run as one series per state.
+func readQueueStates(dir string) (map[string][]ChartPoint, error) {
+	f, err := os.Open(filepath.Join(dir, "queue-states.csv"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	states := map[string][]ChartPoint{}
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read queue states")
+		}
+		if line == 0 && record[0] == queueStateHeader[0] {
+			continue
+		}
+
+		at, err := parseRecordTime(record[0])
+		if err != nil {
+			continue
+		}
+		count, err := strconv.Atoi(record[2])
+		if err != nil {
+			continue
+		}
+		states[record[1]] = append(states[record[1]], ChartPoint{At: at, Value: float64(count)})
+	}
+	return states, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var rateHeader = []string{"Time", "Offered", "Achieved"}
+
+// RateMeter compares, second by second, the operations the routines' schedules
+// offered with the ones that completed. A gap that lasts means either the
+// tester can't keep up or the rTC is pushing back. Its methods are safe to
+// call on a nil meter, which records nothing.
+type RateMeter struct {
+	Writer    *ResultWriter
+	Annotator *Annotator
+	Log       Logger
+	// A second is short when less than Tolerance of the offered operations were
+	// achieved; GapAfter short seconds in a row are flagged as a gap.
+	Tolerance float64
+	GapAfter  int
+
+	offered  uint64
+	achieved uint64
+
+	short    int
+	gapStart time.Time
+}
+
+func CreateRateMeter(writer *ResultWriter, annotator *Annotator) *RateMeter {
+	return &RateMeter{
+		Writer:    writer,
+		Annotator: annotator,
+		Log:       ZerologLogger{},
+		Tolerance: 0.9,
+		GapAfter:  10,
+	}
+}
+
+// Offer counts an operation a schedule asked for.
+func (m *RateMeter) Offer() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.offered, 1)
+}
+
+// Achieve counts an operation that completed.
+func (m *RateMeter) Achieve() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.achieved, 1)
+}
+
+// Run writes a row every second until done is closed.
+func (m *RateMeter) Run(done chan struct{}) {
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case at := <-ticker.C():
+			m.record(at, atomic.SwapUint64(&m.offered, 0), atomic.SwapUint64(&m.achieved, 0))
+		}
+	}
+}
+
+func (m *RateMeter) record(at time.Time, offered, achieved uint64) {
+	m.Writer.Write([]string{recordTime(at), strconv.FormatUint(offered, 10), strconv.FormatUint(achieved, 10)})
+
+	if float64(achieved) < float64(offered)*m.Tolerance {
+		if m.short == 0 {
+			m.gapStart = at.Add(-time.Second)
+		}
+		m.short++
+		if m.short == m.GapAfter {
+			m.Log.Warn("achieved rate has stayed below the offered rate", "since", m.gapStart, "offered", offered, "achieved", achieved)
+		}
+		return
+	}
+
+	if m.short >= m.GapAfter {
+		label := fmt.Sprintf("achieved rate below offered for %ds", m.short)
+		m.Log.Warn("achieved rate caught up with offered rate", "gap", label)
+		if m.Annotator != nil {
+			err := m.Annotator.Annotate(Annotation{Start: m.gapStart, End: at.Add(-time.Second), Label: label})
+			if err != nil {
+				m.Log.Warn("rate gap annotation not sent to grafana", "error", err)
+			}
+		}
+	}
+	m.short = 0
+}
+
+// readRates reads rates.csv of a run directory.
+func readRates(dir string) (offered, achieved []ChartPoint, err error) {
+	f, err := os.Open(filepath.Join(dir, "rates.csv"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to read rates")
+		}
+		if line == 0 && record[0] == rateHeader[0] {
+			continue
+		}
+
+		at, err := parseRecordTime(record[0])
+		if err != nil {
+			continue
+		}
+		o, oErr := strconv.ParseFloat(record[1], 64)
+		a, aErr := strconv.ParseFloat(record[2], 64)
+		if oErr != nil || aErr != nil {
+			continue
+		}
+		offered = append(offered, ChartPoint{At: at, Value: o})
+		achieved = append(achieved, ChartPoint{At: at, Value: a})
+	}
+	return offered, achieved, nil
+}
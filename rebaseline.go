@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rebaselinePhase labels the records of the re-baseline at the end of a run.
+// Summaries leave them out like the warm-up's.
+const rebaselinePhase = "re-baseline"
+
+// defaultRebaselineThreshold is how much worse than the warm-up's a
+// re-baseline's latency is before it is flagged, when the run doesn't say.
+const defaultRebaselineThreshold = 0.5
+
+// minDegradationMs is the least a latency has to be worse by to be flagged,
+// so the jitter of commands taking a millisecond or two isn't.
+const minDegradationMs = 5
+
+// minBaselineSamples is the fewest latencies of a command in both the warm-up
+// and the re-baseline for them to be compared.
+const minBaselineSamples = 10
+
+// Rebaseline repeats the load of the warm-up once the run's aggressive phases
+// are over: for as long as the warm-up, every routine ticks at the interval it
+// started with and its load profile, if any, starts over. The latencies of the
+// two are then compared, a re-baseline significantly slower than the warm-up
+// hinting at a controller that degraded under the stress, e.g. leaking memory
+// or fragmenting. Workers are left as they are.
+type Rebaseline struct {
+	Routines *Routines
+	WarmUp   *WarmUp
+	// Threshold is the share a command's p50 or p95 latency may be above the
+	// warm-up's before it is flagged, e.g. 0.5 for 50%.
+	Threshold float64
+	// Annotator marks the re-baseline on the timeline when set.
+	Annotator *Annotator
+
+	intervals map[string]time.Duration
+}
+
+// CreateRebaseline takes the intervals the routines start with, so it has to
+// be called once they are all set up.
+func CreateRebaseline(routines *Routines, warmUp *WarmUp, threshold float64) *Rebaseline {
+	b := &Rebaseline{Routines: routines, WarmUp: warmUp, Threshold: threshold, intervals: map[string]time.Duration{}}
+	for _, routine := range routines.Timed.All() {
+		b.intervals[routine.Name()] = routine.Ticked().Ticker.Interval()
+	}
+	return b
+}
+
+// Run sends the re-baseline's load for as long as the warm-up, unless the
+// routines aren't running any more. It is safe to call on a nil re-baseline,
+// which doesn't run.
+func (b *Rebaseline) Run() {
+	if b == nil {
+		return
+	}
+	r := b.Routines
+	if state := r.lifecycle.State(); state != RoutinesRunning {
+		r.Log.Warn("routines aren't running, not re-baselining", "state", state)
+		return
+	}
+	// the limits that ended the run don't bound the re-baseline
+	r.RTC.Limit.Lift()
+	r.RTC.CommandLimit.Lift()
+	for _, routine := range r.Timed.All() {
+		if d, ok := b.intervals[routine.Name()]; ok {
+			routine.Ticked().Ticker.Restart(d)
+		}
+	}
+	b.WarmUp.Rebaseline()
+	start := clock.Now()
+	r.Log.Info("re-baselining with the warm-up's load", "duration", b.WarmUp.Duration)
+	clock.Sleep(b.WarmUp.Duration)
+	if b.Annotator != nil {
+		err := b.Annotator.Annotate(Annotation{Start: start, End: clock.Now(), Label: rebaselinePhase})
+		if err != nil {
+			b.Annotator.Log.Warn("re-baseline annotation not sent to grafana", "error", err)
+		}
+	}
+}
+
+// BaselineComparison is a command's latency during the warm-up and during the
+// re-baseline. Degraded is set when the re-baseline's p50 or p95 is over the
+// warm-up's by more than the threshold, and by at least minDegradationMs.
+type BaselineComparison struct {
+	Command         string  `json:"command"`
+	WarmUpCount     int     `json:"warmUpCount"`
+	RebaselineCount int     `json:"rebaselineCount"`
+	WarmUpP50       float64 `json:"warmUpP50"`
+	WarmUpP95       float64 `json:"warmUpP95"`
+	RebaselineP50   float64 `json:"rebaselineP50"`
+	RebaselineP95   float64 `json:"rebaselineP95"`
+	Degraded        bool    `json:"degraded"`
+}
+
+// ChangePercent is how much slower the re-baseline's p95 is than the
+// warm-up's, in percent of it.
+func (c BaselineComparison) ChangePercent() float64 {
+	if c.WarmUpP95 <= 0 {
+		return 0
+	}
+	return 100 * (c.RebaselineP95/c.WarmUpP95 - 1)
+}
+
+// CompareBaselines compares the warm-up of a run to its re-baseline, by
+// command. Commands without enough latencies in both aren't compared. There
+// are no comparisons for runs that didn't re-baseline.
+func CompareBaselines(dir string, threshold float64) ([]BaselineComparison, error) {
+	f, err := os.Open(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open results of run %s", dir)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	latencies := map[string]map[string][]float64{warmUpPhase: {}, rebaselinePhase: {}}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read results of run %s", dir)
+		}
+		if len(record) <= len(csvHeader) {
+			continue
+		}
+		phase, ok := latencies[record[len(csvHeader)]]
+		if !ok {
+			continue
+		}
+		if ms, ok := recordLatency(record); ok {
+			name := commandName(record[0])
+			phase[name] = append(phase[name], ms)
+		}
+	}
+
+	var comparisons []BaselineComparison
+	for name, before := range latencies[warmUpPhase] {
+		after := latencies[rebaselinePhase][name]
+		if len(before) < minBaselineSamples || len(after) < minBaselineSamples {
+			continue
+		}
+		sort.Float64s(before)
+		sort.Float64s(after)
+		c := BaselineComparison{
+			Command:         name,
+			WarmUpCount:     len(before),
+			RebaselineCount: len(after),
+			WarmUpP50:       percentile(before, 50),
+			WarmUpP95:       percentile(before, 95),
+			RebaselineP50:   percentile(after, 50),
+			RebaselineP95:   percentile(after, 95),
+		}
+		c.Degraded = degraded(c.WarmUpP50, c.RebaselineP50, threshold) || degraded(c.WarmUpP95, c.RebaselineP95, threshold)
+		comparisons = append(comparisons, c)
+	}
+	sort.Slice(comparisons, func(i, j int) bool { return comparisons[i].Command < comparisons[j].Command })
+	return comparisons, nil
+}
+
+// degraded is whether a latency went from before to after by more than the
+// threshold and minDegradationMs.
+func degraded(before, after, threshold float64) bool {
+	return after > before*(1+threshold) && after-before >= minDegradationMs
+}
+
+// rebaselineThreshold is the threshold a run re-baselined with, from its
+// manifest's flags.
+func rebaselineThreshold(manifest *Manifest) float64 {
+	if manifest != nil {
+		if t, err := strconv.ParseFloat(manifest.Flags["rebaseline-threshold"], 64); err == nil && t > 0 {
+			return t
+		}
+	}
+	return defaultRebaselineThreshold
+}
+
+// degradedCommands are the commands flagged in comparisons.
+func degradedCommands(comparisons []BaselineComparison) []string {
+	var names []string
+	for _, c := range comparisons {
+		if c.Degraded {
+			names = append(names, c.Command)
+		}
+	}
+	return names
+}
+
+func printBaselineComparisons(out io.Writer, comparisons []BaselineComparison) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tWARM-UP P50\tP95\tRE-BASELINE P50\tP95\tCHANGE\t")
+	for _, c := range comparisons {
+		flag := ""
+		if c.Degraded {
+			flag = "DEGRADED"
+		}
+		fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%.1f\t%.1f\t%+.0f%%\t%s\n",
+			c.Command, c.WarmUpP50, c.WarmUpP95, c.RebaselineP50, c.RebaselineP95, c.ChangePercent(), flag)
+	}
+	w.Flush()
+}
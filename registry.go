@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var registryBucket = []byte("washes")
+
+// registryLockTimeout is how long an operation on the registry waits for
+// another process to let go of the file.
+const registryLockTimeout = 5 * time.Second
+
+// WashRegistry persists every wash this instance queued and hasn't deleted yet,
+// so a later `cleanup` run can remove exactly those washes if the tester crashed.
+// Washes are kept per instance name. bbolt locks the file to one process while
+// it is open, so it is only opened for each read or write: several testers can
+// share one file, and cleanup can run while they do.
+type WashRegistry struct {
+	Path     string
+	Instance string
+
+	// mu keeps this process's operations from waiting on each other's lock
+	mu sync.Mutex
+}
+
+type RegisteredWash struct {
+	WashID  int    `json:"washId"`
+	OrderID string `json:"orderId"`
+	// Tunnel is the tunnel the wash was queued to, when addressed.
+	Tunnel string `json:"tunnel,omitempty"`
+	// WashPackage is the package the wash was queued with, or last changed to,
+	// which tells it apart from a car the rTC reused its washID for.
+	WashPackage int       `json:"washPackage"`
+	Queued      time.Time `json:"queued"`
+}
+
+func OpenWashRegistry(path, instance string) (*WashRegistry, error) {
+	w := &WashRegistry{
+		Path:     path,
+		Instance: instance,
+	}
+
+	err := w.update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(registryBucket)
+		if err != nil {
+			return err
+		}
+		_, err = root.CreateBucketIfNotExists([]byte(instance))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create registry bucket for instance %s", instance)
+	}
+	return w, nil
+}
+
+// update opens the file for fn's read-write transaction, and closes it after.
+func (w *WashRegistry) update(fn func(tx *bolt.Tx) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	db, err := bolt.Open(w.Path, 0600, &bolt.Options{Timeout: registryLockTimeout})
+	if err != nil {
+		return errors.Wrapf(err, "unable to open wash registry %s", w.Path)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view opens the file for fn's read-only transaction, and closes it after.
+func (w *WashRegistry) view(fn func(tx *bolt.Tx) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	db, err := bolt.Open(w.Path, 0600, &bolt.Options{Timeout: registryLockTimeout})
+	if err != nil {
+		return errors.Wrapf(err, "unable to open wash registry %s", w.Path)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (w *WashRegistry) bucket(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket(registryBucket).Bucket([]byte(w.Instance))
+}
+
+func registryKey(washID int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(washID))
+	return key
+}
+
+func (w *WashRegistry) Add(washID int, orderID string, tunnel string, washPackage int) error {
+	value, err := json.Marshal(RegisteredWash{
+		WashID:      washID,
+		OrderID:     orderID,
+		Tunnel:      tunnel,
+		WashPackage: washPackage,
+		Queued:      time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal registered wash")
+	}
+
+	return w.update(func(tx *bolt.Tx) error {
+		return w.bucket(tx).Put(registryKey(washID), value)
+	})
+}
+
+// Repackage records the package a registered wash was changed to. Washes that
+// aren't registered are left alone.
+func (w *WashRegistry) Repackage(washID int, washPackage int) error {
+	return w.update(func(tx *bolt.Tx) error {
+		bucket := w.bucket(tx)
+		value := bucket.Get(registryKey(washID))
+		if value == nil {
+			return nil
+		}
+		var wash RegisteredWash
+		err := json.Unmarshal(value, &wash)
+		if err != nil {
+			return err
+		}
+		wash.WashPackage = washPackage
+		value, err = json.Marshal(wash)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(registryKey(washID), value)
+	})
+}
+
+func (w *WashRegistry) Remove(washID int) error {
+	return w.update(func(tx *bolt.Tx) error {
+		return w.bucket(tx).Delete(registryKey(washID))
+	})
+}
+
+func (w *WashRegistry) Outstanding() ([]RegisteredWash, error) {
+	var washes []RegisteredWash
+	err := w.view(func(tx *bolt.Tx) error {
+		return w.bucket(tx).ForEach(func(_, v []byte) error {
+			var wash RegisteredWash
+			err := json.Unmarshal(v, &wash)
+			if err != nil {
+				return err
+			}
+			washes = append(washes, wash)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read registered washes for instance %s", w.Instance)
+	}
+	return washes, nil
+}
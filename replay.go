@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReplayEvent is a command of a recorded run, At after the recording's first one.
+type ReplayEvent struct {
+	At      time.Duration
+	Command string
+}
+
+// LoadReplay reads the commands of a recorded load-test.csv, e.g. a day the
+// canary sampled at a site, in the order they were sent. Commands that never
+// connected have no time to replay them at and deletes only clean up the
+// recorded run's washes, so both are left out.
+func LoadReplay(path string) ([]ReplayEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open recording %s", path)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	var events []ReplayEvent
+	var first time.Time
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read recording %s", path)
+		}
+		if line == 0 || len(record) < 2 {
+			continue
+		}
+
+		command := commandName(record[0])
+		if command != "QUEUE" && command != "GET" && command != "MOVE" {
+			continue
+		}
+		connected, err := parseRecordTime(record[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time on line %d of recording %s", line+1, path)
+		}
+		if connected.IsZero() {
+			continue
+		}
+		if first.IsZero() {
+			first = connected
+		}
+		events = append(events, ReplayEvent{At: connected.Sub(first), Command: command})
+	}
+	if len(events) == 0 {
+		return nil, errors.Errorf("recording %s has no queue, get or move commands to replay", path)
+	}
+	return events, nil
+}
+
+// ReplayRoutine sends the commands of a recording in place of the queue, get
+// and move routines, with the gaps between them divided by Speed. MaxRate caps
+// the commands sent per second however fast the recording is replayed. Commands
+// go out one at a time so the rTC sees them in the recorded order; when the rTC
+// is too slow to keep up the replay falls behind rather than reorder them.
+type ReplayRoutine struct {
+	routineRunner
+
+	Events  []ReplayEvent
+	Speed   float64
+	MaxRate float64
+	// Finished is closed once every event was sent.
+	Finished chan struct{}
+	Log      Logger
+
+	ops  map[string]func(client *RTCClient, writer *ResultWriter)
+	sent int64
+}
+
+func CreateReplayRoutine(events []ReplayEvent, speed float64) *ReplayRoutine {
+	return &ReplayRoutine{
+		Events:   events,
+		Speed:    speed,
+		Finished: make(chan struct{}),
+		Log:      ZerologLogger{},
+	}
+}
+
+func (p *ReplayRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	start := clock.Now()
+	var last time.Time
+	var minGap time.Duration
+	if p.MaxRate > 0 {
+		minGap = time.Duration(float64(time.Second) / p.MaxRate)
+	}
+
+	for i, event := range p.Events {
+		due := start.Add(time.Duration(float64(event.At) / p.Speed))
+		if !last.IsZero() && due.Before(last.Add(minGap)) {
+			due = last.Add(minGap)
+		}
+		var next <-chan time.Time
+		if wait := due.Sub(clock.Now()); wait > 0 {
+			next = clock.After(wait)
+		} else {
+			// behind schedule, send it straight away
+			ready := make(chan time.Time, 1)
+			ready <- due
+			next = ready
+		}
+		select {
+		case <-ctx.Done():
+			p.Log.Info("replay routine stopped", "sent", i, "events", len(p.Events))
+			return
+		case <-next:
+		}
+		last = clock.Now()
+		atomic.AddInt64(&p.sent, 1)
+
+		if client.Gate.Paused() {
+			continue
+		}
+		p.ops[event.Command](client, writer)
+	}
+
+	p.Log.Info("replay finished", "events", len(p.Events), "took", clock.Now().Sub(start).String())
+	close(p.Finished)
+	<-ctx.Done()
+}
+
+// Sent is the number of events the replay got to, those skipped while paused included.
+func (p *ReplayRoutine) Sent() int64 {
+	return atomic.LoadInt64(&p.sent)
+}
+
+// SetReplay replays a recording in place of the queue, get and move routines.
+func (r *Routines) SetReplay(events []ReplayEvent, speed, maxRate float64) {
+	getOp, _ := r.workerOp("get")
+	r.Replay = CreateReplayRoutine(events, speed)
+	r.Replay.MaxRate = maxRate
+	r.Replay.ops = map[string]func(client *RTCClient, writer *ResultWriter){
+		"QUEUE": r.QueueRoutine.queue,
+		"GET":   getOp,
+		"MOVE":  r.MoveRoutine.move,
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RunReport is everything report.html shows about a single run.
+type RunReport struct {
+	Dir      string
+	Manifest *Manifest
+	Summary  *RunSummary
+	// Annotations are the surges and other marks on the run's timeline.
+	Annotations []Annotation
+	// SLO has a line per checked limit when the run has an slo.json.
+	SLO []SLOResult
+	// QueueRegressions relate each command's latency to the queue length.
+	QueueRegressions []QueueRegression
+	Charts           []template.HTML
+	// Derived are the derived metrics when the run has a metrics.json.
+	Derived []DerivedStats
+	// Baseline compares the warm-up to the re-baseline when the run re-baselined.
+	Baseline []BaselineComparison
+	// Leak is the verdict of a leak hunt, when the run was one.
+	Leak *LeakVerdict
+	// EventCorrelations split each command's latency by whether it was sent
+	// during tunnel activity, when the run listened to the rTC's events.
+	EventCorrelations []EventCorrelation
+	// Location is the time zone times are shown in.
+	Location *time.Location
+	// Template replaces the built in report template when set.
+	Template *template.Template
+}
+
+// BuildRunReport reads a run directory. Only the results CSV is required, the
+// other files add charts when the run recorded them. Times are shown in loc, or
+// when it is nil in the site's time zone from the manifest.
+func BuildRunReport(dir string, loc *time.Location) (*RunReport, error) {
+	summary, err := SummariseRun(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &RunReport{Dir: dir, Summary: summary, Location: loc}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		var manifest Manifest
+		if json.Unmarshal(b, &manifest) == nil {
+			report.Manifest = &manifest
+		}
+	}
+	if report.Location == nil {
+		report.Location = time.UTC
+		if report.Manifest != nil {
+			report.Location = report.Manifest.Location()
+		}
+	}
+	loc = report.Location
+
+	if slo, err := LoadSLO(filepath.Join(dir, "slo.json")); err == nil {
+		report.SLO = slo.Evaluate(summary)
+	}
+
+	if metrics, err := LoadDerivedMetrics(filepath.Join(dir, "metrics.json")); err == nil {
+		report.Derived, _ = SummariseDerived(dir, metrics)
+	}
+
+	report.Baseline, _ = CompareBaselines(dir, rebaselineThreshold(report.Manifest))
+	if thresholds, ok := leakHuntThresholds(report.Manifest); ok {
+		report.Leak, _ = AnalyseLeaks(dir, thresholds)
+	}
+
+	if annotations, err := readAnnotations(dir); err == nil {
+		for i := range annotations {
+			annotations[i].Start = annotations[i].Start.In(loc)
+			annotations[i].End = annotations[i].End.In(loc)
+		}
+		report.Annotations = annotations
+	}
+
+	if offered, achieved, err := readRates(dir); err == nil && len(offered) > 0 {
+		report.Charts = append(report.Charts, svgLineChart("Offered and achieved operations", "ops/s", loc, []ChartSeries{
+			{Name: "offered", Points: offered},
+			{Name: "achieved", Points: achieved},
+		}, report.Annotations...))
+	}
+
+	if states, err := readQueueStates(dir); err == nil && len(states) > 0 {
+		report.Charts = append(report.Charts, svgLineChart("Cars in the queue by state", "cars", loc, seriesByName(states), report.Annotations...))
+		if latencies, err := readCommandLatencies(dir); err == nil {
+			report.QueueRegressions = fitQueueRegressions(latencies, queueLengths(states))
+		}
+	}
+
+	if events, err := readEvents(dir); err == nil && len(events) > 0 {
+		report.Charts = append(report.Charts, svgLineChart("Tunnel events per minute", "events", loc, seriesByName(eventsPerMinute(events)), report.Annotations...))
+		if latencies, err := readCommandLatencies(dir); err == nil {
+			report.EventCorrelations = correlateEvents(latencies, events)
+		}
+	}
+
+	if cpu, rss, err := readResources(dir); err == nil && len(cpu)+len(rss) > 0 {
+		report.Charts = append(report.Charts,
+			svgLineChart("Tester cpu", "%", loc, []ChartSeries{{Name: "cpu", Points: cpu}}, report.Annotations...),
+			svgLineChart("Tester resident memory", "MiB", loc, []ChartSeries{{Name: "rss", Points: rss}}, report.Annotations...),
+		)
+	}
+	return report, nil
+}
+
+var runReportTemplate = assetTemplate("report.html")
+
+func (r *RunReport) Write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to create report")
+	}
+	defer f.Close()
+	return r.Render(f)
+}
+
+// Render writes the report's html to w.
+func (r *RunReport) Render(w io.Writer) error {
+	tmpl := runReportTemplate
+	if r.Template != nil {
+		tmpl = r.Template
+	}
+	return tmpl.Execute(w, r)
+}
+
+// runReport implements the `report` subcommand, writing report.html into a run directory.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	sloPath := fs.String("slo", "", "evaluate the run against this slo file instead of the one saved with it")
+	metricsPath := fs.String("metrics", "", "compute these derived metrics instead of the ones saved with the run")
+	templatePath := fs.String("template", "", "html template the report is written with instead of the built in one, e.g. a customised copy from --extract-assets")
+	timezone := fs.String("timezone", "", "IANA time zone times are shown in, e.g. UTC or Europe/London; defaults to the site's zone from the manifest")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: report <run dir>")
+		os.Exit(2)
+	}
+
+	var loc *time.Location
+	if *timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --timezone")
+		}
+	}
+	report, err := BuildRunReport(fs.Arg(0), loc)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read run")
+	}
+	if *sloPath != "" {
+		slo, err := LoadSLO(*sloPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load slo")
+		}
+		report.SLO = slo.Evaluate(report.Summary)
+	}
+	if *metricsPath != "" {
+		metrics, err := LoadDerivedMetrics(*metricsPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load metrics")
+		}
+		report.Derived, err = SummariseDerived(fs.Arg(0), metrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to compute metrics")
+		}
+	}
+	if *templatePath != "" {
+		report.Template, err = template.ParseFiles(*templatePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load report template")
+		}
+	}
+	if report.SLO != nil {
+		printSLOResults(os.Stdout, report.SLO)
+	}
+
+	path := filepath.Join(fs.Arg(0), "report.html")
+	err = report.Write(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to write report")
+	}
+	fmt.Printf("report written to %s\n", path)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var resourceHeader = []string{"Time", "CPU Percent", "RSS Bytes", "Open FDs", "Goroutines", "Bytes Sent", "Bytes Received", "Sent Bytes/s", "Received Bytes/s", "Host CPU Percent", "Host Memory Percent"}
+
+// ResourceSample is the tester's own resource usage at one point in time, so a
+// report can tell when the generator machine rather than the rTC was saturated.
+// Values a platform cannot measure are -1.
+type ResourceSample struct {
+	Time              time.Time `json:"time"`
+	CPUPercent        float64   `json:"cpuPercent"`
+	RSSBytes          int64     `json:"rssBytes"`
+	OpenFDs           int       `json:"openFDs"`
+	Goroutines        int       `json:"goroutines"`
+	BytesSent         uint64    `json:"bytesSent"`
+	BytesReceived     uint64    `json:"bytesReceived"`
+	SentPerSecond     float64   `json:"sentPerSecond"`
+	ReceivedPerSecond float64   `json:"receivedPerSecond"`
+	HostCPUPercent    float64   `json:"hostCpuPercent"`
+	HostMemoryPercent float64   `json:"hostMemoryPercent"`
+
+	cpuSeconds    float64
+	hostBusyTicks float64
+	hostTicks     float64
+}
+
+func (s ResourceSample) Record() []string {
+	return []string{
+		recordTime(s.Time),
+		strconv.FormatFloat(s.CPUPercent, 'f', 1, 64),
+		strconv.FormatInt(s.RSSBytes, 10),
+		strconv.Itoa(s.OpenFDs),
+		strconv.Itoa(s.Goroutines),
+		strconv.FormatUint(s.BytesSent, 10),
+		strconv.FormatUint(s.BytesReceived, 10),
+		strconv.FormatFloat(s.SentPerSecond, 'f', 1, 64),
+		strconv.FormatFloat(s.ReceivedPerSecond, 'f', 1, 64),
+		strconv.FormatFloat(s.HostCPUPercent, 'f', 1, 64),
+		strconv.FormatFloat(s.HostMemoryPercent, 'f', 1, 64),
+	}
+}
+
+type ResourceSampler struct {
+	Done   chan bool
+	Ticker *time.Ticker
+	Log    Logger
+	// Watchdog is given every sample when set.
+	Watchdog *PressureWatchdog
+
+	mu     sync.Mutex
+	last   ResourceSample
+	sample bool
+}
+
+func CreateResourceSampler(interval time.Duration, doneChannel chan bool) *ResourceSampler {
+	return &ResourceSampler{
+		Done:   doneChannel,
+		Ticker: time.NewTicker(interval),
+		Log:    ZerologLogger{},
+	}
+}
+
+// Sample reads the process' current usage; CPU and network rates are averaged
+// over the time since the previous sample.
+func (s *ResourceSampler) Sample(client *RTCClient) ResourceSample {
+	now := time.Now()
+	cpuSeconds, rss, fds, err := readProcessUsage()
+	if err != nil {
+		s.Log.Warn("unable to read process resource usage", "error", err)
+	}
+	busyTicks, ticks, memoryPercent, err := readHostUsage()
+	if err != nil {
+		s.Log.Warn("unable to read host resource usage", "error", err)
+	}
+
+	current := ResourceSample{
+		Time:              now,
+		CPUPercent:        -1,
+		RSSBytes:          rss,
+		OpenFDs:           fds,
+		Goroutines:        runtime.NumGoroutine(),
+		HostCPUPercent:    -1,
+		HostMemoryPercent: memoryPercent,
+		cpuSeconds:        cpuSeconds,
+		hostBusyTicks:     busyTicks,
+		hostTicks:         ticks,
+	}
+	if client != nil {
+		current.BytesSent, current.BytesReceived = client.NetworkBytes()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sample {
+		elapsed := now.Sub(s.last.Time).Seconds()
+		if elapsed > 0 {
+			if cpuSeconds >= 0 && s.last.cpuSeconds >= 0 {
+				current.CPUPercent = (cpuSeconds - s.last.cpuSeconds) / elapsed * 100
+			}
+			if ticks > s.last.hostTicks && s.last.hostTicks >= 0 {
+				current.HostCPUPercent = (busyTicks - s.last.hostBusyTicks) / (ticks - s.last.hostTicks) * 100
+			}
+			current.SentPerSecond = float64(current.BytesSent-s.last.BytesSent) / elapsed
+			current.ReceivedPerSecond = float64(current.BytesReceived-s.last.BytesReceived) / elapsed
+		}
+	}
+	s.last = current
+	s.sample = true
+	return current
+}
+
+// Latest is the most recent sample, false until the first one has been taken.
+func (s *ResourceSampler) Latest() (ResourceSample, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, s.sample
+}
+
+func (s *ResourceSampler) Run(client *RTCClient, writer *ResultWriter) {
+	s.Sample(client)
+	for {
+		select {
+		case <-s.Done:
+			s.Log.Info("resource sampler received done signal")
+			return
+		case <-s.Ticker.C:
+			sample := s.Sample(client)
+			writer.Write(sample.Record())
+			if s.Watchdog != nil {
+				s.Watchdog.Check(sample)
+			}
+		}
+	}
+}
+
+// readResources loads resources.csv of a run as cpu and memory series.
+func readResources(dir string) (cpu, rss []ChartPoint, err error) {
+	f, err := os.Open(filepath.Join(dir, "resources.csv"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to read resources")
+	}
+	for i, record := range records {
+		if i == 0 && record[0] == resourceHeader[0] {
+			continue
+		}
+		at, err := parseRecordTime(record[0])
+		if err != nil {
+			continue
+		}
+		if percent, err := strconv.ParseFloat(record[1], 64); err == nil && percent >= 0 {
+			cpu = append(cpu, ChartPoint{At: at, Value: percent})
+		}
+		if bytes, err := strconv.ParseFloat(record[2], 64); err == nil && bytes >= 0 {
+			rss = append(rss, ChartPoint{At: at, Value: bytes / (1 << 20)})
+		}
+	}
+	return cpu, rss, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// clockTicks is USER_HZ, the unit of the cpu times in /proc/self/stat. It is 100
+// on every architecture Linux supports.
+const clockTicks = 100
+
+func readProcessUsage() (cpuSeconds float64, rssBytes int64, openFDs int, err error) {
+	cpuSeconds, rssBytes, openFDs = -1, -1, -1
+
+	stat, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return cpuSeconds, rssBytes, openFDs, errors.Wrap(err, "unable to read /proc/self/stat")
+	}
+	// the command name may contain spaces, so fields are counted from its closing paren
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) > 21 {
+		utime, _ := strconv.ParseFloat(fields[11], 64)
+		stime, _ := strconv.ParseFloat(fields[12], 64)
+		cpuSeconds = (utime + stime) / clockTicks
+		pages, _ := strconv.ParseInt(fields[21], 10, 64)
+		rssBytes = pages * int64(os.Getpagesize())
+	}
+
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return cpuSeconds, rssBytes, openFDs, errors.Wrap(err, "unable to read /proc/self/fd")
+	}
+	// one of the entries is the descriptor used to read the directory itself
+	openFDs = len(entries) - 1
+
+	return cpuSeconds, rssBytes, openFDs, nil
+}
+
+// readHostUsage returns the host's cumulative busy and total cpu ticks from
+// /proc/stat and the share of memory in use from /proc/meminfo.
+func readHostUsage() (busyTicks, ticks, memoryPercent float64, err error) {
+	busyTicks, ticks, memoryPercent = -1, -1, -1
+
+	stat, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return busyTicks, ticks, memoryPercent, errors.Wrap(err, "unable to read /proc/stat")
+	}
+	line := string(stat)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 5 && fields[0] == "cpu" {
+		var total float64
+		for _, field := range fields[1:] {
+			v, _ := strconv.ParseFloat(field, 64)
+			total += v
+		}
+		idle, _ := strconv.ParseFloat(fields[4], 64)
+		iowait, _ := strconv.ParseFloat(fields[5], 64)
+		busyTicks, ticks = total-idle-iowait, total
+	}
+
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return busyTicks, ticks, memoryPercent, errors.Wrap(err, "unable to read /proc/meminfo")
+	}
+	var total, available float64
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseFloat(fields[1], 64)
+		case "MemAvailable:":
+			available, _ = strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	if total > 0 {
+		memoryPercent = (total - available) / total * 100
+	}
+
+	return busyTicks, ticks, memoryPercent, nil
+}
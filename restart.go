@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// restartMarker starts the row recorded when a restarted tester appends to
+// the results of its earlier start. The row is shorter than a command's, so
+// analysis, reports and replays skip it.
+const restartMarker = "RESTART"
+
+// ErrHeaderMismatch is returned when appending to a CSV file written with
+// other columns, e.g. by a run with a different --max-inflight or --steps.
+var ErrHeaderMismatch = errors.New("existing file has different columns")
+
+// openCSV opens the CSV file at path for records with header. When appending
+// to a file that has records already, the file is appended to as long as its
+// header is header, and true is returned; the caller writes the header
+// otherwise. Without appending an existing file is truncated.
+func openCSV(path string, header []string, appending bool) (*os.File, bool, error) {
+	if appending {
+		existing, err := readCSVHeader(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing != nil {
+			if strings.Join(existing, ",") != strings.Join(header, ",") {
+				return nil, false, errors.Wrapf(ErrHeaderMismatch, "%s has columns %q, expected %q", path, existing, header)
+			}
+			f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, false, errors.Wrapf(err, "unable to open %s to append to it", path)
+			}
+			err = endLine(f)
+			if err != nil {
+				f.Close()
+				return nil, false, errors.Wrapf(err, "unable to append to %s", path)
+			}
+			return f, true, nil
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "unable to create %s", path)
+	}
+	return f, false, nil
+}
+
+// readCSVHeader is the first row of the CSV file at path, nil when the file
+// doesn't exist or is empty.
+func readCSVHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open %s", path)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read header of %s", path)
+	}
+	return header, nil
+}
+
+// endLine ends the last line of f when the tester stopped in the middle of
+// writing it, so the first record appended isn't run into it.
+func endLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+	_, err = f.Write([]byte("\n"))
+	return err
+}
+
+// CreateCSVWriter is a writer of the CSV file at path with header, appended
+// to when appending and it has the same header already. It returns whether
+// it appended.
+func CreateCSVWriter(path string, header []string, appending bool) (*ResultWriter, bool, error) {
+	f, appended, err := openCSV(path, header, appending)
+	if err != nil {
+		return nil, false, err
+	}
+	w := CreateResultWriter(f)
+	if !appended {
+		err = w.Write(header)
+		if err != nil {
+			f.Close()
+			return nil, false, errors.Wrapf(err, "unable to write header of %s", path)
+		}
+	}
+	return w, appended, nil
+}
+
+// Open gives w the results file at path, which is appended to when appending
+// and it has w's header already, after a restart marker row. It returns
+// whether it appended.
+func (w *ResultWriter) Open(path string, appending bool) (*os.File, bool, error) {
+	f, appended, err := openCSV(path, w.Header(), appending)
+	if err != nil {
+		return nil, false, err
+	}
+	w.mu.Lock()
+	w.csv = csv.NewWriter(f)
+	w.mu.Unlock()
+	if !appended {
+		return f, false, w.WriteHeader()
+	}
+	return f, true, w.write([]string{restartMarker, recordTime(clock.Now()), "tester restarted, results appended to"})
+}
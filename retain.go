@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueRetention leaves the washes the queue routine and queue workers add
+// queued, so adds are tested against a queue that grows like a real site's
+// does rather than one emptied after every add. At most Max washes are left
+// queued, the oldest being deleted to make room, and washes queued for longer
+// than TTL are deleted by Run.
+type QueueRetention struct {
+	Max int
+	TTL time.Duration
+	Log Logger
+
+	mu     sync.Mutex
+	washes []retainedWash
+
+	evicted uint64
+	expired uint64
+	failed  uint64
+}
+
+type retainedWash struct {
+	WashID   int
+	QueuedAt time.Time
+	// client is the client the wash was queued with, which deletes it from
+	// the queue of the same tunnel.
+	client *RTCClient
+}
+
+func CreateQueueRetention(max int, ttl time.Duration) *QueueRetention {
+	return &QueueRetention{Max: max, TTL: ttl, Log: ZerologLogger{}}
+}
+
+// Retain keeps the washes just queued, deleting the oldest ones beyond Max.
+func (q *QueueRetention) Retain(client *RTCClient, writer *ResultWriter, washIDs ...int) {
+	now := clock.Now()
+	q.mu.Lock()
+	for _, washID := range washIDs {
+		q.washes = append(q.washes, retainedWash{WashID: washID, QueuedAt: now, client: client})
+	}
+	var evict []retainedWash
+	if q.Max > 0 && len(q.washes) > q.Max {
+		evict = append(evict, q.washes[:len(q.washes)-q.Max]...)
+		q.washes = append(q.washes[:0], q.washes[len(q.washes)-q.Max:]...)
+	}
+	q.mu.Unlock()
+
+	atomic.AddUint64(&q.evicted, uint64(len(evict)))
+	q.release(writer, evict, "outstanding washes above the max")
+}
+
+// expire takes the washes queued longer than TTL ago out of the retained ones.
+func (q *QueueRetention) expire(now time.Time) []retainedWash {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var expired []retainedWash
+	i := 0
+	for i < len(q.washes) && now.Sub(q.washes[i].QueuedAt) >= q.TTL {
+		expired = append(expired, q.washes[i])
+		i++
+	}
+	q.washes = append(q.washes[:0], q.washes[i:]...)
+	return expired
+}
+
+// Run deletes the washes that outlived TTL until ctx is done, each with the
+// client it was queued with. Washes still retained then stay queued for
+// /cleanup or the cleanup subcommand.
+func (q *QueueRetention) Run(ctx context.Context, writer *ResultWriter) {
+	if q.TTL <= 0 {
+		return
+	}
+	sweep := q.TTL / 4
+	if sweep < time.Second {
+		sweep = time.Second
+	}
+	ticker := clock.NewTicker(sweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case at := <-ticker.C():
+			expired := q.expire(at)
+			atomic.AddUint64(&q.expired, uint64(len(expired)))
+			q.release(writer, expired, "queued longer than the ttl")
+		}
+	}
+}
+
+func (q *QueueRetention) release(writer *ResultWriter, washes []retainedWash, reason string) {
+	for _, wash := range washes {
+		_, records, err := wash.client.DeleteQueuedCar(wash.WashID)
+		writer.Write(records)
+		if err != nil {
+			// the rTC may have washed or dropped it already
+			atomic.AddUint64(&q.failed, 1)
+			q.Log.Warn("unable to delete retained wash", "error", err, "washID", wash.WashID, "reason", reason)
+		}
+	}
+}
+
+// RetentionStats are the washes left queued and why the others were deleted.
+type RetentionStats struct {
+	Outstanding int    `json:"outstanding"`
+	Evicted     uint64 `json:"evicted"`
+	Expired     uint64 `json:"expired"`
+	Failed      uint64 `json:"failedDeletes"`
+}
+
+func (q *QueueRetention) Stats() RetentionStats {
+	q.mu.Lock()
+	outstanding := len(q.washes)
+	q.mu.Unlock()
+	return RetentionStats{
+		Outstanding: outstanding,
+		Evicted:     atomic.LoadUint64(&q.evicted),
+		Expired:     atomic.LoadUint64(&q.expired),
+		Failed:      atomic.LoadUint64(&q.failed),
+	}
+}
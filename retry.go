@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Failures a command can be retried on. A dial that was refused or timed out
+// never reached the rTC; a read that timed out may have, so retrying it can
+// e.g. queue a wash twice.
+const (
+	RetryDial        = "dial"
+	RetryReadTimeout = "read-timeout"
+)
+
+// RetryPolicy retries commands that failed in a way that is likely transient,
+// waiting Backoff doubled on every attempt up to MaxBackoff, give or take
+// Jitter of it. Retried commands are recorded with the number of retries after
+// their name, e.g. "GET retries=2", and with the times of the last attempt,
+// so their latencies can be told apart from first time successes.
+type RetryPolicy struct {
+	// Attempts is the most times a command is sent, the first one included.
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+	On         map[string]bool
+	// Budget bounds the retries of the whole run when set, so a struggling
+	// rTC isn't sent more load by retries than it already failed to take.
+	Budget *RetryBudget
+	Rand   *SeededRand
+	Log    Logger
+
+	retries  uint64
+	denied   uint64
+	gaveUp   uint64
+	attempts uint64
+}
+
+func CreateRetryPolicy(attempts int, backoff time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		Attempts:   attempts,
+		Backoff:    backoff,
+		MaxBackoff: 2 * time.Second,
+		Jitter:     0.2,
+		On:         map[string]bool{RetryDial: true},
+		Log:        ZerologLogger{},
+	}
+}
+
+// ParseRetryOn reads --retry-on, a comma separated list of dial and read-timeout.
+func ParseRetryOn(list string) (map[string]bool, error) {
+	on := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case RetryDial, RetryReadTimeout:
+			on[name] = true
+		default:
+			return nil, errors.Errorf("unknown failure %q to retry on, expected dial or read-timeout", name)
+		}
+	}
+	if len(on) == 0 {
+		return nil, errors.New("no failures to retry on")
+	}
+	return on, nil
+}
+
+// retryFailure is the kind of failure err of a command's stage is, or "" when
+// it isn't one retries are meant for.
+func retryFailure(stage string, err error) string {
+	var netErr net.Error
+	timeout := errors.As(err, &netErr) && netErr.Timeout()
+	switch {
+	case stage == RetryDial && (timeout || errors.Is(err, syscall.ECONNREFUSED)):
+		return RetryDial
+	case stage == "read" && timeout:
+		return RetryReadTimeout
+	}
+	return ""
+}
+
+// begin counts a command about to be sent.
+func (p *RetryPolicy) begin() {
+	if p == nil {
+		return
+	}
+	atomic.AddUint64(&p.attempts, 1)
+	p.Budget.Deposit()
+}
+
+// again decides whether a command that failed on its attempt-th try is sent
+// once more, waiting out the backoff first. It returns false without waiting
+// when the failure isn't retried, the attempts or budget are used up, or the
+// command was cancelled.
+func (p *RetryPolicy) again(ctx context.Context, command string, attempt int, failure string, err error) bool {
+	if p == nil || failure == "" || !p.On[failure] || ctx.Err() != nil {
+		return false
+	}
+	if attempt >= p.Attempts {
+		atomic.AddUint64(&p.gaveUp, 1)
+		return false
+	}
+	if !p.Budget.Withdraw() {
+		atomic.AddUint64(&p.denied, 1)
+		p.Log.Debug("retry budget used up, not retrying command", "command", command, "error", err)
+		return false
+	}
+
+	wait := p.delay(attempt)
+	p.Log.Debug("retrying command", "command", command, "attempt", attempt, "failure", failure, "error", err, "waitMs", wait.Milliseconds())
+	atomic.AddUint64(&p.retries, 1)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(wait):
+	}
+	return true
+}
+
+// delay is the backoff after the attempt-th try.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 && p.Rand != nil && d > 0 {
+		spread := int64(float64(d) * p.Jitter)
+		if spread > 0 {
+			d += time.Duration(p.Rand.Int63n(2*spread+1) - spread)
+		}
+	}
+	return d
+}
+
+// RetryStats count the retries of the run.
+type RetryStats struct {
+	Commands uint64 `json:"commands"`
+	Retries  uint64 `json:"retries"`
+	// GaveUp are commands that failed on their last attempt, BudgetDenied
+	// the retries the budget didn't allow.
+	GaveUp       uint64  `json:"gaveUp"`
+	BudgetDenied uint64  `json:"budgetDenied"`
+	BudgetLeft   float64 `json:"budgetLeft"`
+}
+
+func (p *RetryPolicy) Stats() RetryStats {
+	return RetryStats{
+		Commands:     atomic.LoadUint64(&p.attempts),
+		Retries:      atomic.LoadUint64(&p.retries),
+		GaveUp:       atomic.LoadUint64(&p.gaveUp),
+		BudgetDenied: atomic.LoadUint64(&p.denied),
+		BudgetLeft:   p.Budget.Left(),
+	}
+}
+
+// RetryBudget lets retries be at most Ratio of the commands sent, plus a
+// reserve of Burst so the first failures of a run can be retried too. Every
+// command adds Ratio of a retry to the budget, up to Burst, and every retry
+// takes a whole one.
+type RetryBudget struct {
+	Ratio float64
+	Burst float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func CreateRetryBudget(ratio, burst float64) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, Burst: burst, tokens: burst}
+}
+
+func (b *RetryBudget) Deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.Ratio
+	if b.tokens > b.Burst {
+		b.tokens = b.Burst
+	}
+}
+
+// Withdraw takes a retry from the budget, false when there is none left.
+func (b *RetryBudget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Left is the retries the budget still allows, -1 when there is no budget.
+func (b *RetryBudget) Left() float64 {
+	if b == nil {
+		return -1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Routine is an operation sent to the rTC on an interval of its own, such as
+// queueing, reading or moving washes. Routines are registered with the
+// routines container by name, which is all it takes for them to be started
+// with the run, toggled, retimed through /update/<name>/... and reported in
+// /status.
+type Routine interface {
+	Name() string
+	Stop()
+	// Run sends the routine's operation on every tick until ctx is done or
+	// Stop is called.
+	Run(ctx context.Context, client *RTCClient, writer *ResultWriter)
+	// UpdateInterval changes the time between the routine's ticks in place,
+	// leaving it running, or stopped, as it is.
+	UpdateInterval(d time.Duration) error
+	Stats() RoutineStats
+	// Ticked is the ticker and schedule the routine runs on.
+	Ticked() *TickedRoutine
+}
+
+// RoutineStats are a routine's interval and the operations it sent.
+type RoutineStats struct {
+	Interval string `json:"interval"`
+	Ops      uint64 `json:"ops"`
+	Missed   uint64 `json:"missedTicks"`
+	Delayed  uint64 `json:"delayedTicks"`
+}
+
+// TickedRoutine is embedded by the routines sending one operation per tick of
+// their ticker, and implements everything of a Routine but the operation.
+type TickedRoutine struct {
+	routineRunner
+
+	Ticker *TickerHolder
+	// Offset delays the routine's first tick so routines don't all tick together.
+	Offset time.Duration
+	Log    Logger
+	// Open fires operations without waiting for earlier ones when set.
+	Open *OpenModel
+	// Burst is the number of operations sent at once on each tick.
+	Burst int
+	// Schedule records the ticks the routine was too busy to take when set.
+	Schedule *ScheduleTracker
+	// Tunnel is the tunnel the routine's commands are addressed to, the run's when empty.
+	Tunnel string
+
+	name            string
+	instance        string
+	defaultInterval time.Duration
+	op              func(client *RTCClient, writer *ResultWriter)
+	ops             uint64
+}
+
+// init sets up a routine named name sending op every tickerTime seconds, or
+// every defaultInterval when tickerTime isn't positive.
+func (t *TickedRoutine) init(name string, tickerTime int, defaultInterval time.Duration, op func(client *RTCClient, writer *ResultWriter)) {
+	d := time.Duration(tickerTime) * time.Second
+	if tickerTime <= 0 {
+		log.Error().Int("tickerTime", tickerTime).Str("routine", name).Msg("routine time must be positive; forcing ticker duration to be default")
+		d = defaultInterval
+	}
+	t.name, t.defaultInterval, t.op = name, defaultInterval, op
+	t.Ticker = CreateTickerHolder(d)
+	t.Log = ZerologLogger{}
+}
+
+// Name is the routine's operation, such as queue, or the operation after the
+// scenario instance it belongs to, such as noise.queue.
+func (t *TickedRoutine) Name() string {
+	if t.instance != "" {
+		return t.instance + "." + t.name
+	}
+	return t.name
+}
+
+// Instance is the scenario instance the routine belongs to, empty for the
+// routines the flags configure.
+func (t *TickedRoutine) Instance() string {
+	return t.instance
+}
+
+func (t *TickedRoutine) Ticked() *TickedRoutine {
+	return t
+}
+
+func (t *TickedRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	if !waitOffset(ctx, t.Offset, t.Ticker) {
+		t.Log.Info(t.Name() + " routine stopped")
+		return
+	}
+	// a load profile replaces the ticker of the routine's next run, not this one's
+	ticker := t.Ticker.Ticker()
+	if t.instance != "" {
+		writer = writer.Tagged(scenarioHeader, t.instance)
+	}
+	client = client.OnTunnel(t.Tunnel)
+
+	interval := t.Ticker.Interval()
+	t.Schedule.Reset()
+	for {
+		select {
+		case <-ctx.Done():
+			t.Log.Info(t.Name() + " routine stopped")
+			return
+		case at := <-ticker.C():
+			if ctx.Err() != nil {
+				// stopped while a tick was due too
+				t.Log.Info(t.Name() + " routine stopped")
+				return
+			}
+			if changed := t.Ticker.Interval(); changed != interval {
+				// the ticks of the old interval weren't missed by the new one
+				interval = changed
+				t.Schedule.Reset()
+			}
+			missed := t.Schedule.Tick(at, t.Ticker.Current())
+			if client.Gate.Paused() {
+				continue
+			}
+			burst(t.Burst, func() {
+				if !client.Limit.Take(t.name) {
+					return
+				}
+				client.Rates.Offer()
+				if !t.Open.Go(func() {
+					t.op(client, writer)
+					atomic.AddUint64(&t.ops, 1)
+					client.Limit.Done(t.name)
+				}) {
+					client.Limit.Cancel(t.name)
+					t.Log.Warn("open model in-flight cap reached, dropping "+t.name, "max", t.Open.Max)
+				}
+			})
+			if t.Open == nil {
+				t.Schedule.BackfillMissed(missed, writer)
+			}
+		}
+	}
+}
+
+// UpdateTime changes the interval to tickerTime, such as "5" or "0.5"
+// seconds or "500ms". An invalid time is an error in strict mode and otherwise falls
+// back to the routine's default interval.
+func (t *TickedRoutine) UpdateTime(tickerTime string, strict bool) error {
+	d, err := ParseIntervalSeconds(tickerTime)
+	if err != nil {
+		if strict {
+			return errors.Wrapf(err, "invalid %s routine ticker time", t.Name())
+		}
+		t.Log.Error("error converting "+t.Name()+" routine time string to time.duration; forcing ticker duration to be default", "error", err, "tickerTime", tickerTime)
+		d = t.defaultInterval
+	}
+	return t.UpdateInterval(d)
+}
+
+func (t *TickedRoutine) UpdateInterval(d time.Duration) error {
+	if d <= 0 {
+		return errors.Errorf("%s ticker time must be positive, got %s", t.Name(), d)
+	}
+	t.Ticker.Set(d)
+	return nil
+}
+
+func (t *TickedRoutine) Stats() RoutineStats {
+	stats := RoutineStats{
+		Interval: t.Ticker.Current().String(),
+		Ops:      atomic.LoadUint64(&t.ops),
+	}
+	if t.Schedule != nil {
+		stats.Missed, stats.Delayed = t.Schedule.Counts()
+	}
+	return stats
+}
+
+// RoutineRegistry is the routines of a run by name, in the order they were
+// registered and are started in.
+type RoutineRegistry struct {
+	routines []Routine
+}
+
+func (g *RoutineRegistry) Register(routine Routine) error {
+	if _, ok := g.Get(routine.Name()); ok {
+		return errors.Errorf("a routine named %s is registered already", routine.Name())
+	}
+	g.routines = append(g.routines, routine)
+	return nil
+}
+
+func (g *RoutineRegistry) Get(name string) (Routine, bool) {
+	for _, routine := range g.routines {
+		if routine.Name() == name {
+			return routine, true
+		}
+	}
+	return nil, false
+}
+
+func (g *RoutineRegistry) All() []Routine {
+	return g.routines
+}
+
+func (g *RoutineRegistry) Names() []string {
+	names := make([]string, 0, len(g.routines))
+	for _, routine := range g.routines {
+		names = append(names, routine.Name())
+	}
+	return names
+}
+
+// commandName is what the routine's operations are recorded as, e.g. QUEUE.
+func (t *TickedRoutine) commandName() string {
+	return strings.ToUpper(t.name)
+}
+
+// TimedStats are the stats of every timed routine by name.
+func (r *Routines) TimedStats() map[string]RoutineStats {
+	stats := map[string]RoutineStats{}
+	for _, routine := range r.Timed.All() {
+		stats[routine.Name()] = routine.Stats()
+	}
+	return stats
+}
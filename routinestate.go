@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// RoutinesState is where the routines are in their lifecycle: waiting to be
+// started, running, paused or stopped. Pausing closes the client's gate so the
+// routines skip their ticks but keep their goroutines, tickers, intervals,
+// operation counts and in-flight commands; resuming opens it again. Stopping
+// ends the goroutines for good and can only happen once.
+type RoutinesState string
+
+const (
+	RoutinesWaiting RoutinesState = "waiting"
+	RoutinesRunning RoutinesState = "running"
+	RoutinesPaused  RoutinesState = "paused"
+	RoutinesStopped RoutinesState = "stopped"
+)
+
+// operatorPause is the gate reason of a pause asked for through /pause.
+const operatorPause = "operator"
+
+type routinesLifecycle struct {
+	mu      sync.Mutex
+	state   RoutinesState
+	started time.Time
+}
+
+// transition moves to state to when the current state is one of from and
+// returns the state it left.
+func (l *routinesLifecycle) transition(to RoutinesState, from ...RoutinesState) (RoutinesState, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := l.current()
+	for _, state := range from {
+		if current == state {
+			l.state = to
+			if current == RoutinesWaiting && to == RoutinesRunning {
+				l.started = clock.Now()
+			}
+			return current, nil
+		}
+	}
+	return current, errors.Errorf("routines are %s, can't change to %s", current, to)
+}
+
+func (l *routinesLifecycle) State() RoutinesState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current()
+}
+
+// Started is when the routines were started, zero until they are.
+func (l *routinesLifecycle) Started() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.started
+}
+
+func (l *routinesLifecycle) current() RoutinesState {
+	if l.state == "" {
+		return RoutinesWaiting
+	}
+	return l.state
+}
+
+// routineRunner is embedded by the routines that are stopped by cancelling
+// their context. Stopping never blocks and does nothing to a routine that
+// isn't running, so a /stop can't hang on a routine that already ended.
+type routineRunner struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// start derives the context of a new run of the routine from parent, ending
+// the previous run if there still is one.
+func (r *routineRunner) start(parent context.Context) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	r.cancel = cancel
+	return ctx
+}
+
+// Stop ends the routine's current run, if any.
+func (r *routineRunner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// Pause holds load generation until Resume. The reason is recorded in pauses.csv.
+func (r *Routines) Pause(reason string) error {
+	_, err := r.lifecycle.transition(RoutinesPaused, RoutinesRunning)
+	if err != nil {
+		return err
+	}
+	r.RTC.Gate.Pause(operatorPause, reason)
+	r.Log.Info("routines paused", "reason", reason)
+	r.recordPause("paused", reason)
+	return nil
+}
+
+func (r *Routines) Resume() error {
+	_, err := r.lifecycle.transition(RoutinesRunning, RoutinesPaused)
+	if err != nil {
+		return err
+	}
+	reason := r.RTC.Gate.Reasons()[operatorPause]
+	r.RTC.Gate.Resume(operatorPause)
+	r.Log.Info("routines resumed", "reason", reason)
+	r.recordPause("resumed", reason)
+	return nil
+}
+
+func (r *Routines) recordPause(event, reason string) {
+	if r.Pauses == nil {
+		return
+	}
+	r.Pauses.Write([]string{recordTime(clock.Now()), event, operatorPause + ": " + reason})
+}
+
+// PauseEndpoint pauses the routines, with an optional ?reason= recorded alongside.
+func (r *Routines) PauseEndpoint(c *gin.Context) {
+	reason := c.DefaultQuery("reason", "paused through the api")
+	err := r.Pause(reason)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "state": r.lifecycle.State()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"state": r.lifecycle.State(), "reason": reason})
+}
+
+func (r *Routines) ResumeEndpoint(c *gin.Context) {
+	err := r.Resume()
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "state": r.lifecycle.State()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"state": r.lifecycle.State()})
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
 )
 
 var getQueueXML = "<src><getQueue/></src>"
@@ -21,21 +25,65 @@ type WashRequest struct {
 	VehicleID   string `json:"vehicleId"`
 	VehicleKey  string `json:"vehicleKey"`
 	WashPackage int    `json:"package"`
+	// Lanes is the assigner LaneID came from when it isn't the client's, such
+	// as a scenario instance's.
+	Lanes *LaneAssigner `json:"-"`
+}
+
+// defaultWashPackage is the package the tester's washes are queued with
+// unless a scenario instance says otherwise.
+const defaultWashPackage = 1
+
+// washPackage is the package the wash is queued with.
+func (w WashRequest) washPackage() int {
+	if w.WashPackage <= 0 {
+		return defaultWashPackage
+	}
+	return w.WashPackage
+}
+
+// lanes is the assigner the wash's lane came from, nil when lanes aren't configured.
+func (w WashRequest) lanes(client *RTCClient) *LaneAssigner {
+	if w.Lanes != nil {
+		return w.Lanes
+	}
+	return client.Lanes
 }
 
 type AddQueueRequest struct {
 	XMLName    xml.Name `xml:"src"`
 	WashPkgNum int      `xml:"addTail>washPkgNum"`
+	Lane       string   `xml:"addTail>lane,omitempty"`
+}
+
+// AddHeadRequest adds a wash at the head of the queue, ahead of every wash
+// queued but the one being washed.
+type AddHeadRequest struct {
+	XMLName    xml.Name `xml:"src"`
+	WashPkgNum int      `xml:"addHead>washPkgNum"`
+	Lane       string   `xml:"addHead>lane,omitempty"`
 }
 
 type AddQueueResponse struct {
 	XMLName xml.Name `xml:"tc"`
 	WashID  int      `xml:"carAdded>id"`
+	Error   string   `xml:"error"`
 }
 
-func (r *RTCClient) BuildAddTailXML(washPackage int) (string, error) {
+// ErrMissingWashID is returned when the rTC acknowledges an add without saying
+// which washID it assigned, so the wash can't be moved or deleted later.
+var ErrMissingWashID = errors.New("rTC reply to add has no wash id")
+
+// ErrCommandLimit is returned for commands that weren't sent because the
+// run's --max-commands were all taken. They have no record.
+var ErrCommandLimit = errors.New("command limit reached, not sent")
+
+// BuildAddTailXML builds an add of a wash to the tail of the queue. The lane
+// is left out when empty, for the rTC to pick.
+func (r *RTCClient) BuildAddTailXML(washPackage int, lane string) (string, error) {
 	washRequest := AddQueueRequest{
 		WashPkgNum: washPackage,
+		Lane:       lane,
 	}
 
 	enc, err := xml.Marshal(washRequest)
@@ -45,6 +93,16 @@ func (r *RTCClient) BuildAddTailXML(washPackage int) (string, error) {
 	return string(enc), nil
 }
 
+// BuildAddHeadXML builds an add of a wash to the head of the queue. The lane
+// is left out when empty, for the rTC to pick.
+func (r *RTCClient) BuildAddHeadXML(washPackage int, lane string) (string, error) {
+	enc, err := xml.Marshal(AddHeadRequest{WashPkgNum: washPackage, Lane: lane})
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to marshal")
+	}
+	return string(enc), nil
+}
+
 func (r *RTCClient) ParseRTCAddQueueResponse(message string) (*AddQueueResponse, error) {
 	readBytes := []byte(message)
 	var wash AddQueueResponse
@@ -53,60 +111,81 @@ func (r *RTCClient) ParseRTCAddQueueResponse(message string) (*AddQueueResponse,
 		return nil, convertErr
 	}
 
+	if wash.Error != "" {
+		return nil, &RTCError{Command: "QUEUE", Message: wash.Error}
+	}
+	if wash.WashID <= 0 {
+		return nil, ErrMissingWashID
+	}
+
 	return &wash, nil
 }
 
-func (r *RTCClient) QueueWash(washRequest WashRequest) ([]string, error) {
-	record := []string{"QUEUE"}
-	queueXML, xmlErr := r.BuildAddTailXML(1)
-	if xmlErr != nil {
-		log.Error().Err(xmlErr).Msg("error building xml to queue wash")
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", xmlErr.Error())
-		return record, xmlErr
-	}
+func (r *RTCClient) QueueWash(washRequest WashRequest) (*AddQueueResponse, []string, error) {
+	resp, record, err := r.addWash(washRequest, "QUEUE", r.BuildAddTailXML)
+	return resp, r.withOrderIDs(record, washRequest.OrderID), err
+}
 
-	log.Info().Str("method", "QueueWash").Str("xml", queueXML).Msg("successfully created queue XML")
+// QueueWashAtHead queues a wash at the head of the queue rather than its tail,
+// recorded as QUEUE_HEAD, to have the rTC reorder the washes queued already.
+func (r *RTCClient) QueueWashAtHead(washRequest WashRequest) (*AddQueueResponse, []string, error) {
+	resp, record, err := r.addWash(washRequest, "QUEUE_HEAD", r.BuildAddHeadXML)
+	return resp, r.withOrderIDs(record, washRequest.OrderID), err
+}
 
-	client, connectErr := r.StartConn()
-	if connectErr != nil {
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", connectErr.Error())
-		return record, connectErr
+// addWash queues a wash with the add buildXML builds, recorded as command.
+func (r *RTCClient) addWash(washRequest WashRequest, command string, buildXML func(washPackage int, lane string) (string, error)) (*AddQueueResponse, []string, error) {
+	// the lane is only sent when lanes are configured, as it never was before
+	assigner := washRequest.lanes(r)
+	var lanes []string
+	if assigner != nil {
+		lanes = []string{washRequest.LaneID}
+	}
+	name := command
+	command = assigner.commandName(command, lanes...)
+	queueXML, xmlErr := buildXML(washRequest.washPackage(), strings.Join(lanes, ""))
+	if xmlErr != nil {
+		r.Log.Error("error building xml to queue wash", "error", xmlErr, "command", name)
+		return nil, failedRecord(command, xmlErr), xmlErr
 	}
-	defer client.Close()
-	// connect time
-	record = append(record, time.Now().String())
 
-	r.WriteToRTC(client, queueXML)
-	// init request time
-	record = append(record, time.Now().String())
+	r.Log.Info("successfully created queue XML", "method", "QueueWash", "orderId", washRequest.OrderID, "xml", queueXML)
 
-	_, readErr := r.ReadFromServer(client)
-	if readErr != nil {
-		record = append(record, time.Time{}.String(), time.Time{}.String(), "true", readErr.Error())
-		return record, readErr
+	start := clock.Now()
+	readMessage, record, err := r.SendCommand(command, queueXML, true)
+	if err != nil {
+		return nil, record, err
 	}
-	// retrieve request time
-	record = append(record, time.Now().String())
 
-	closeErr := client.Close()
-	if closeErr != nil {
-		log.Error().Err(closeErr).Msg("error closing connection to rTC when queueing wash")
-		err := client.SetDeadline(time.Now())
+	resp, err := r.ParseRTCAddQueueResponse(*readMessage)
+	if err != nil {
+		r.Log.Warn("rTC did not accept queued wash", "error", err, "orderId", washRequest.OrderID, "reply", *readMessage)
+		return nil, markFailed(record, err), err
+	}
+	r.Throughput.Observe(name, 1, start)
+	if r.Verify.Sample("queue") {
+		err = r.verifyQueued(resp.WashID)
 		if err != nil {
-			log.Info().Err(err).Msg("error setting deadline when force closing rtc connection")
+			r.Log.Warn("queued wash did not take effect", "error", err, "orderId", washRequest.OrderID, "washID", resp.WashID)
+			return resp, markFailed(record, err), err
 		}
-		time.Sleep(5 * time.Second)
+	}
+
+	r.queued(resp.WashID, washRequest.OrderID, washRequest.washPackage())
+	return resp, record, nil
+}
 
-		closeErr = client.Close()
-		if closeErr != nil {
-			record = append(record, time.Time{}.String(), "true", closeErr.Error())
-			log.Error().Err(closeErr).Msg("error forcefully closing connection to rTC")
-			return record, closeErr
+// queued tracks and registers a wash the rTC confirmed it queued.
+func (r *RTCClient) queued(washID int, orderID string, washPackage int) {
+	if r.WashIDs != nil {
+		r.WashIDs.Issued(washID)
+	}
+	if r.Registry != nil {
+		regErr := r.Registry.Add(washID, orderID, r.Tunnel, washPackage)
+		if regErr != nil {
+			r.Log.Warn("unable to record queued wash in registry", "error", regErr, "washID", washID)
 		}
 	}
-
-	record = append(record, time.Now().String(), "false", "")
-	return record, nil
 }
 
 // MoveWashReqParams is used for taking the params in JSON form, without requiring
@@ -135,58 +214,28 @@ func (r *RTCClient) BuildMoveXML(washID int, toBefore int) (string, error) {
 }
 
 func (r *RTCClient) MoveWash(moveRequest MoveWashReqParams) (*GetQueueResponse, []string, error) {
-	record := []string{"MOVE"}
 	moveXML, xmlErr := r.BuildMoveXML(moveRequest.WashID, moveRequest.ToBefore)
 	if xmlErr != nil {
-		log.Error().Err(xmlErr).Int("washID", moveRequest.WashID).Int("moveToBefore", moveRequest.ToBefore).Msg("error creating XML to move wash in rTC")
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", xmlErr.Error())
-		return nil, record, xmlErr
-	}
-
-	log.Info().Int("washID", moveRequest.WashID).Int("moveToBefore", moveRequest.ToBefore).Msg("successfully created move XmL")
-
-	client, connectErr := r.StartConn()
-	if connectErr != nil {
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", connectErr.Error())
-		return nil, record, connectErr
+		r.Log.Error("error creating XML to move wash in rTC", "error", xmlErr, "washID", moveRequest.WashID, "moveToBefore", moveRequest.ToBefore)
+		return nil, failedRecord("MOVE", xmlErr), xmlErr
 	}
-	defer client.Close()
-	// connect time
-	record = append(record, time.Now().String())
 
-	r.WriteToRTC(client, moveXML)
-	// init request time
-	record = append(record, time.Now().String())
+	r.Log.Info("successfully created move XmL", "washID", moveRequest.WashID, "moveToBefore", moveRequest.ToBefore)
 
-	readMessage, readErr := r.ReadFromServer(client)
-	if readErr != nil {
-		log.Error().Err(readErr).Int("washID", moveRequest.WashID).Int("moveToBefore", moveRequest.ToBefore).Msg("error reading move request from rTC")
-		record = append(record, time.Time{}.String(), time.Time{}.String(), "true", readErr.Error())
-		return nil, record, readErr
+	readMessage, record, err := r.SendCommand("MOVE", moveXML, true)
+	if err != nil {
+		r.Log.Error("error sending move request to rTC", "error", err, "washID", moveRequest.WashID, "moveToBefore", moveRequest.ToBefore)
+		return nil, record, err
 	}
-	// retrieve request time
-	record = append(record, time.Now().String())
 
-	closeErr := client.Close()
-	if closeErr != nil {
-		log.Error().Err(closeErr).Msg("error closing connection to rTC when moving wash")
-		err := client.SetDeadline(time.Now())
+	resp, err := r.ParseRTCGetQueueResponse(*readMessage)
+	if err == nil && r.Verify.Sample("move") {
+		err = r.verifyMoved(moveRequest.WashID, resp)
 		if err != nil {
-			log.Info().Err(err).Msg("error setting deadline when force closing rtc connection")
-		}
-		time.Sleep(5 * time.Second)
-
-		closeErr = client.Close()
-		if closeErr != nil {
-			record = append(record, time.Time{}.String(), "true", closeErr.Error())
-			log.Error().Err(closeErr).Msg("error forcefully closing connection to rTC")
-			return nil, record, closeErr
+			r.Log.Warn("move did not take effect", "error", err, "washID", moveRequest.WashID)
+			return resp, markFailed(record, err), err
 		}
 	}
-	// close time
-	record = append(record, time.Now().String(), "false", "")
-
-	resp, err := r.ParseRTCGetQueueResponse(*readMessage)
 	return resp, record, err
 }
 
@@ -195,6 +244,15 @@ type DeleteWashRequest struct {
 	WashID  int      `xml:"delete>id"`
 }
 
+// DeleteWashResponse is the rTC's confirmation of a delete. Verified is set when the
+// client re-read the queue afterwards and the wash was gone.
+type DeleteWashResponse struct {
+	XMLName  xml.Name `xml:"tc"`
+	WashID   int      `xml:"carDeleted>id"`
+	Error    string   `xml:"error"`
+	Verified bool     `xml:"-"`
+}
+
 func (r *RTCClient) BuildDeleteXML(washID int) (string, error) {
 	DeleteRequest := DeleteWashRequest{
 		WashID: washID,
@@ -208,49 +266,146 @@ func (r *RTCClient) BuildDeleteXML(washID int) (string, error) {
 	return string(enc), nil
 }
 
-func (r *RTCClient) DeleteQueuedCar(washID int) ([]string, error) {
-	record := []string{"DELETE"}
+func (r *RTCClient) ParseRTCDeleteResponse(washID int, message string) (*DeleteWashResponse, error) {
+	if message == "" {
+		return nil, &RTCError{Command: "DELETE", Message: "no confirmation received"}
+	}
+
+	var resp DeleteWashResponse
+	convertErr := xml.Unmarshal([]byte(message), &resp)
+	if convertErr != nil {
+		return nil, convertErr
+	}
+
+	if resp.Error != "" {
+		return &resp, &RTCError{Command: "DELETE", Message: resp.Error}
+	}
+	if resp.WashID != washID {
+		return &resp, &RTCError{Command: "DELETE", Message: fmt.Sprintf("confirmation is for wash %d, expected %d", resp.WashID, washID)}
+	}
+
+	return &resp, nil
+}
+
+func (r *RTCClient) DeleteQueuedCar(washID int) (*DeleteWashResponse, []string, error) {
 	deleteXML, xmlErr := r.BuildDeleteXML(washID)
 	if xmlErr != nil {
-		log.Error().Err(xmlErr).Int("washID", washID).Msg("error creating XML to delete wash from rTC")
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", xmlErr.Error())
-		return record, xmlErr
+		r.Log.Error("error creating XML to delete wash from rTC", "error", xmlErr, "washID", washID)
+		return nil, failedRecord("DELETE", xmlErr), xmlErr
 	}
 
-	log.Info().Str("method", "DeleteWash").Str("xml", deleteXML).Msg("successfully created XML")
+	r.Log.Info("successfully created XML", "method", "DeleteWash", "xml", deleteXML)
 
-	client, connectErr := r.StartConn()
-	if connectErr != nil {
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", xmlErr.Error())
-		return record, connectErr
+	start := clock.Now()
+	readMessage, record, err := r.SendCommand("DELETE", deleteXML, true)
+	if err != nil {
+		return nil, record, err
 	}
-	defer client.Close()
-	// connect time
-	record = append(record, time.Now().String())
 
-	r.WriteToRTC(client, deleteXML)
-	// init request time
-	record = append(record, time.Now().String(), time.Now().String())
+	resp, err := r.ParseRTCDeleteResponse(washID, *readMessage)
+	if err == nil {
+		r.Throughput.Observe("DELETE", 1, start)
+	}
+	if err == nil && r.Verify.Sample("delete") {
+		err = r.verifyDeleted(washID)
+		resp.Verified = err == nil
+	}
+	if err != nil {
+		r.Log.Warn("rTC did not confirm delete", "error", err, "washID", washID)
+		return resp, markFailed(record, err), err
+	}
 
-	closeErr := client.Close()
-	if closeErr != nil {
-		log.Error().Err(closeErr).Int("washID", washID).Msg("error closing connection to rTC when deleting from queue")
-		err := client.SetDeadline(time.Now())
-		if err != nil {
-			log.Info().Err(err).Int("washID", washID).Msg("error setting deadline when force closing connection")
+	if r.WashIDs != nil {
+		r.WashIDs.Deleted(washID)
+	}
+	if r.Registry != nil {
+		regErr := r.Registry.Remove(washID)
+		if regErr != nil {
+			r.Log.Warn("unable to remove deleted wash from registry", "error", regErr, "washID", washID)
 		}
-		time.Sleep(5 * time.Second)
+	}
+	return resp, record, nil
+}
 
-		closeErr = client.Close()
-		if closeErr != nil {
-			record = append(record, time.Time{}.String(), "true", closeErr.Error())
-			log.Error().Err(closeErr).Msg("error forcefully closing connection to rTC")
-			return record, closeErr
-		}
+// SetWashPkgRequest changes the wash package of a car already queued, e.g. a
+// customer upgrading at the pay station.
+type SetWashPkgRequest struct {
+	XMLName    xml.Name `xml:"src"`
+	WashID     int      `xml:"setWashPkg>id"`
+	WashPkgNum int      `xml:"setWashPkg>washPkgNum"`
+}
+
+// ModifyWashResponse is the rTC's confirmation of a package change.
+type ModifyWashResponse struct {
+	XMLName    xml.Name `xml:"tc"`
+	WashID     int      `xml:"carModified>id"`
+	WashPkgNum int      `xml:"carModified>washPkgNum"`
+	Error      string   `xml:"error"`
+}
+
+func (r *RTCClient) BuildSetWashPkgXML(washID int, washPackage int) (string, error) {
+	enc, err := xml.Marshal(SetWashPkgRequest{WashID: washID, WashPkgNum: washPackage})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal to XML")
+	}
+	return string(enc), nil
+}
+
+func (r *RTCClient) ParseRTCModifyResponse(washID int, message string) (*ModifyWashResponse, error) {
+	if message == "" {
+		return nil, &RTCError{Command: "MODIFY", Message: "no confirmation received"}
+	}
+
+	var resp ModifyWashResponse
+	convertErr := xml.Unmarshal([]byte(message), &resp)
+	if convertErr != nil {
+		return nil, convertErr
 	}
-	record = append(record, time.Now().String(), "false", "")
 
-	return record, nil
+	if resp.Error != "" {
+		return &resp, &RTCError{Command: "MODIFY", Message: resp.Error}
+	}
+	if resp.WashID != washID {
+		return &resp, &RTCError{Command: "MODIFY", Message: fmt.Sprintf("confirmation is for wash %d, expected %d", resp.WashID, washID)}
+	}
+
+	return &resp, nil
+}
+
+// ModifyWash changes the package of a queued wash, recorded as MODIFY.
+func (r *RTCClient) ModifyWash(washID int, washPackage int) (*ModifyWashResponse, []string, error) {
+	modifyXML, xmlErr := r.BuildSetWashPkgXML(washID, washPackage)
+	if xmlErr != nil {
+		r.Log.Error("error creating XML to modify wash in rTC", "error", xmlErr, "washID", washID, "washPackage", washPackage)
+		return nil, failedRecord("MODIFY", xmlErr), xmlErr
+	}
+
+	r.Log.Info("successfully created XML", "method", "ModifyWash", "xml", modifyXML)
+
+	start := clock.Now()
+	readMessage, record, err := r.SendCommand("MODIFY", modifyXML, true)
+	if err != nil {
+		return nil, record, err
+	}
+
+	resp, err := r.ParseRTCModifyResponse(washID, *readMessage)
+	if err == nil {
+		r.Throughput.Observe("MODIFY", 1, start)
+	}
+	if err == nil && r.Verify.Sample("modify") {
+		err = r.verifyModified(washID, washPackage)
+	}
+	if err != nil {
+		r.Log.Warn("rTC did not confirm package change", "error", err, "washID", washID, "washPackage", washPackage)
+		return resp, markFailed(record, err), err
+	}
+	if r.Registry != nil {
+		regErr := r.Registry.Repackage(washID, washPackage)
+		if regErr != nil {
+			r.Log.Warn("unable to record package change in registry", "error", regErr, "washID", washID)
+		}
+	}
+	return resp, record, nil
 }
 
 type GetQueueResponse struct {
@@ -267,6 +422,8 @@ type WashQueueItem struct {
 	State      string `xml:"state"`
 	Position   int    `xml:"position"`
 	WashPkgNum int    `xml:"washPkgNum"`
+	// Tunnel is the tunnel whose queue the wash was read from, when addressed.
+	Tunnel string `xml:"-" json:",omitempty"`
 }
 
 func (r *RTCClient) ParseRTCGetQueueResponse(message string) (*GetQueueResponse, error) {
@@ -282,91 +439,481 @@ func (r *RTCClient) ParseRTCGetQueueResponse(message string) (*GetQueueResponse,
 }
 
 func (r *RTCClient) GetQueue() (*GetQueueResponse, []string, error) {
-	record := []string{"GET"}
-	client, connectErr := r.StartConn()
+	readMessage, record, err := r.SendCommand("GET", getQueueXML, true)
+	if err != nil {
+		return nil, record, err
+	}
+
+	message, err := r.ParseRTCGetQueueResponse(*readMessage)
+	return message, record, err
+}
+
+// SendCommand writes an arbitrary, already built XML command to the rTC and
+// records it under the given command name, after which the tunnel it was
+// addressed to follows. The reply is only read when the command is expected
+// to produce one.
+func (r *RTCClient) SendCommand(command string, commandXML string, expectReply bool) (*string, []string, error) {
+	limited := commandName(command)
+	if !r.CommandLimit.Take(limited) {
+		return nil, nil, ErrCommandLimit
+	}
+	defer r.CommandLimit.Done(limited)
+	command, commandXML = r.address(command, commandXML)
+	atomic.AddInt64(&r.state.inFlight, 1)
+	defer atomic.AddInt64(&r.state.inFlight, -1)
+	seq := atomic.AddUint64(&r.state.commandSeq, 1)
+	r.state.pending.Store(seq, InFlightCommand{Command: command, Started: clock.Now()})
+	defer r.state.pending.Delete(seq)
+
+	ctx := r.commandContext()
+	timeouts := r.Timeouts.For(command)
+	r.Retry.begin()
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		wait, err := r.MaxInFlight.Acquire(ctx)
+		waited += wait
+		if err != nil {
+			return nil, r.MaxInFlight.record(failedRecord(command, err), waited), err
+		}
+		reply, record, stage, err := r.sendAttempt(ctx, command, commandXML, expectReply, timeouts)
+		r.MaxInFlight.Release()
+		if err == nil || !r.Retry.again(ctx, command, attempt, retryFailure(stage, err), err) {
+			if attempt > 1 {
+				record[0] = command + " retries=" + strconv.Itoa(attempt-1)
+			}
+			return reply, r.MaxInFlight.record(record, waited), err
+		}
+	}
+}
+
+// address addresses a command to the client's tunnel and adds the
+// credentials, giving the command as it is recorded and the XML sent.
+func (r *RTCClient) address(command, commandXML string) (string, string) {
+	if r.Tunnel != "" {
+		command += " tunnel=" + r.Tunnel
+		commandXML = addressTunnel(commandXML, r.Tunnel)
+	}
+	return command, r.Auth.Authorize(commandXML)
+}
+
+// sendAttempt sends a command once. On failure it also returns the stage that
+// failed, dial or read, for retries to tell transient failures apart.
+func (r *RTCClient) sendAttempt(ctx context.Context, command string, commandXML string, expectReply bool, timeouts Timeouts) (*string, []string, string, error) {
+	record := []string{command}
+	client, connectErr := r.StartConn(ctx, timeouts)
 	if connectErr != nil {
-		record = append(record, time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), time.Time{}.String(), "true", connectErr.Error())
-		return nil, record, connectErr
+		r.Throttle.Observe(connectErr)
+		return nil, failedRecord(command, connectErr), RetryDial, connectErr
 	}
-	defer client.Close()
+	stopAbort := abortOnCancel(ctx, client)
 	// connection time
-	record = append(record, time.Now().String())
+	record = append(record, recordTime(clock.Now()))
 
-	r.WriteToRTC(client, getQueueXML)
+	r.Trace.Trace(command, "sent", r.Auth.Redact(commandXML))
+	r.WriteToRTC(client, commandXML)
 	// initialize request time
-	record = append(record, time.Now().String())
-
-	readMessage, readErr := r.ReadFromServer(client)
-	if readErr != nil {
-		record = append(record, time.Time{}.String(), time.Time{}.String(), "true", readErr.Error())
-		return nil, record, readErr
+	sent := clock.Now()
+	record = append(record, recordTime(sent))
+
+	var readMessage *string
+	if expectReply {
+		var readErr error
+		readMessage, readErr = r.ReadFromServer(client, timeouts.Read)
+		if readErr != nil && ctx.Err() != nil {
+			readErr = errors.Wrap(ctx.Err(), "command cancelled while waiting for the rTC")
+		}
+		var disconnect *DisconnectError
+		if errors.As(readErr, &disconnect) {
+			r.Disconnects.Observe(command, disconnect, clock.Now().Sub(sent))
+		}
+		if readErr != nil {
+			r.Log.Error("error reading reply to command from rTC", "error", readErr, "command", command)
+			stopAbort()
+			r.CloseConn(client)
+			r.Throttle.Observe(readErr)
+			record = append(record, recordTime(time.Time{}), recordTime(time.Time{}), "true", readErr.Error())
+			return nil, record, "read", readErr
+		}
 	}
 	// retrieval time
-	record = append(record, time.Now().String())
+	record = append(record, recordTime(clock.Now()))
+	stopAbort()
+	if pooled, ok := client.(*pooledConn); ok && !expectReply {
+		// whatever the rTC answers would be read as the next command's reply
+		pooled.broken = true
+	}
+	r.Throttle.Observe(nil)
+	if readMessage != nil {
+		reply := r.Auth.RedactReply(*readMessage)
+		readMessage = &reply
+		r.Trace.Trace(command, "received", reply)
+	}
 
-	closeErr := client.Close()
+	closeErr := r.CloseConn(client)
 	if closeErr != nil {
-		err := client.SetDeadline(time.Now())
-		if err != nil {
-			log.Info().Err(err).Msg("error setting deadline when force closing connection")
-		}
-		time.Sleep(5 * time.Second)
-
-		closeErr = client.Close()
-		if closeErr != nil {
-			record = append(record, time.Time{}.String(), "true", closeErr.Error())
-			log.Err(closeErr).Msg("error forcefully closing connection")
-			return nil, record, closeErr
-		}
+		r.Log.Error("error closing connection to rTC, handed off to background cleanup", "error", closeErr, "command", command)
+		record = append(record, recordTime(time.Time{}), "true", closeErr.Error())
+		return readMessage, record, "close", closeErr
 	}
 	// close time
-	record = append(record, time.Now().String(), "false", "")
-	message, err := r.ParseRTCGetQueueResponse(*readMessage)
-	return message, record, err
+	record = append(record, recordTime(clock.Now()), "false", "")
+	return readMessage, record, "", nil
+}
+
+// RTCError is returned when the rTC answers a command with an error or with a
+// reply that doesn't confirm the command took effect.
+type RTCError struct {
+	Command string
+	Message string
+}
+
+func (e *RTCError) Error() string {
+	return fmt.Sprintf("rTC rejected %s: %s", e.Command, e.Message)
+}
+
+// markFailed flags an otherwise complete record as failed.
+func markFailed(record []string, err error) []string {
+	record[5] = "true"
+	record[6] = err.Error()
+	return record
+}
+
+// failedRecord is the CSV record of a command that never got a connection.
+func failedRecord(command string, err error) []string {
+	return []string{command, recordTime(time.Time{}), recordTime(time.Time{}), recordTime(time.Time{}), recordTime(time.Time{}), "true", err.Error()}
 }
 
 type RTCClient struct {
-	Host string
-	Port int
+	Host     string
+	Port     int
+	Registry *WashRegistry
+	// Gate pauses the load generating routines using this client while closed.
+	Gate *PauseGate
+	// Rates compares the operations the routines offered with the ones achieved.
+	Rates *RateMeter
+	// Limit ends the run after a set number of routine operations when set.
+	Limit *OpLimit
+	// CommandLimit ends the run after a set number of rTC commands when set.
+	CommandLimit *OpLimit
+	// MaxInFlight caps the commands sent at once when set.
+	MaxInFlight *InFlightLimiter
+	// WashIDs checks the ids the rTC issues for reuse and ordering problems when set.
+	WashIDs *WashIDTracker
+	// Throttle counts the commands the rTC failed to take or answer when set.
+	Throttle *Throttle
+	// Trace logs the payloads of commands and replies while enabled.
+	Trace *PayloadTracer
+	// Disconnects records the rTC ending connections before replying when set.
+	Disconnects *DisconnectTracker
+	// Timeouts are the dial, write and read deadlines of each command; the
+	// defaults apply when nil.
+	Timeouts *CommandTimeouts
+	// Retry retries commands that failed transiently when set.
+	Retry *RetryPolicy
+	// Lanes picks the lane of every wash queued when set, otherwise washes are
+	// queued to lane 4 without sending it.
+	Lanes *LaneAssigner
+	// Pool keeps persistent connections commands are sent over when set,
+	// otherwise every command dials its own.
+	Pool *ConnPool
+
+	// CloseMode is either "graceful" (half close, drain, close) or "immediate"
+	// (reset the connection). CloseTimeout bounds how long a graceful close waits.
+	CloseMode    string
+	CloseTimeout time.Duration
+
+	// Verify re-reads the queue after a share of the adds, moves, deletes and
+	// package changes to check they took effect when set.
+	Verify *VerifySampler
+
+	// Tunnel addresses every command to one of the rTC's tunnels when set,
+	// see OnTunnel.
+	Tunnel string
+	// Tunnels counts the commands sent to each tunnel when set.
+	Tunnels *TunnelStats
+	// Auth is the credentials sent in every command to secured rTCs when set.
+	Auth *CommandAuth
+	// OrderIDs records the order ids of queued washes in the column
+	// orderIDHeader when set.
+	OrderIDs bool
+
+	Throughput *ThroughputStats
+	Log        Logger
+
+	// state is shared with the clients OnTunnel returns.
+	state *clientState
+}
+
+// clientState is what a client and the views of it for other tunnels count
+// and cancel together.
+type clientState struct {
+	zombies       int64
+	inFlight      int64
+	commandSeq    uint64
+	pending       sync.Map
+	bytesSent     uint64
+	bytesReceived uint64
+
+	cmdMu     sync.Mutex
+	cmdCtx    context.Context
+	cmdCancel context.CancelFunc
 }
 
 func CreateRTCClient(host string, port int) *RTCClient {
 	return &RTCClient{
-		Host: host,
-		Port: port,
+		Host:         host,
+		Port:         port,
+		CloseMode:    "graceful",
+		CloseTimeout: 500 * time.Millisecond,
+		Throughput:   CreateThroughputStats(),
+		Gate:         CreatePauseGate(),
+		Log:          ZerologLogger{},
+		state:        &clientState{},
 	}
 }
 
-func (r *RTCClient) StartConn() (net.Conn, error) {
-	client, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", r.Host, r.Port), 3000*time.Millisecond)
+// StartConn opens a connection for a command, or takes one of the pool's when
+// the client keeps persistent connections, with the command's write deadline set.
+func (r *RTCClient) StartConn(ctx context.Context, timeouts Timeouts) (net.Conn, error) {
+	var client net.Conn
+	var err error
+	if r.Pool == nil {
+		client, err = r.dial(ctx, timeouts.Dial)
+	} else {
+		client, err = r.Pool.Acquire(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
-	log.Debug().Str("host", r.Host).Int("port", r.Port).Msg("connection opened on port")
-
-	err = client.SetDeadline(time.Now().Add(1500 * time.Millisecond))
+	err = client.SetDeadline(time.Now().Add(timeouts.Write))
 	if err != nil {
-		log.Error().Err(err).Int("millisecondDeadline", 1500).Msg("error setting read/write deadlines for I/O ops")
+		r.Log.Error("error setting read/write deadlines for I/O ops", "error", err, "millisecondDeadline", timeouts.Write.Milliseconds())
 	}
+	return client, nil
+}
 
+// PrewarmPool opens and probes the persistent connections ahead of load, so
+// the first commands measure the rTC and not a storm of dials. The probe reads
+// the queue, the lightest command the rTC answers.
+func (r *RTCClient) PrewarmPool(ctx context.Context) PrewarmResult {
+	timeouts := r.Timeouts.For("GET")
+	return r.Pool.Prewarm(ctx, func(conn *pooledConn) error {
+		err := conn.SetDeadline(time.Now().Add(timeouts.Write))
+		if err != nil {
+			return err
+		}
+		r.WriteToRTC(conn, getQueueXML)
+		_, err = r.ReadFromServer(conn, timeouts.Read)
+		return err
+	})
+}
+
+// dialConn dials the rTC with the default dial timeout, for the connection pool.
+func (r *RTCClient) dialConn(ctx context.Context) (net.Conn, error) {
+	return r.dial(ctx, r.Timeouts.For("").Dial)
+}
+
+func (r *RTCClient) dial(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	client, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", r.Host, r.Port))
+	if err != nil {
+		return nil, err
+	}
+	r.Log.Debug("connection opened on port", "host", r.Host, "port", r.Port)
 	return client, nil
 }
 
 func (r *RTCClient) WriteToRTC(client net.Conn, xml string) {
-	fmt.Fprint(client, xml)
+	n, err := fmt.Fprint(client, xml)
+	atomic.AddUint64(&r.state.bytesSent, uint64(n))
+	if pooled, ok := client.(*pooledConn); ok && err != nil {
+		pooled.broken = true
+	}
+}
+
+func (r *RTCClient) ReadFromServer(client net.Conn, timeout time.Duration) (*string, error) {
+	return r.readReply(client, connReader(client), timeout)
 }
 
-func (r *RTCClient) ReadFromServer(client net.Conn) (*string, error) {
-	err := client.SetDeadline(time.Now().Add(3000 * time.Millisecond))
+// connReader is the reader replies are read from on client, which has to be
+// kept for as long as several replies are read from a connection.
+func connReader(client net.Conn) *bufio.Reader {
+	if pooled, ok := client.(*pooledConn); ok {
+		return pooled.reader
+	}
+	return bufio.NewReader(client)
+}
+
+func (r *RTCClient) readReply(client net.Conn, reader *bufio.Reader, timeout time.Duration) (*string, error) {
+	err := client.SetDeadline(time.Now().Add(timeout))
 	if err != nil {
-		log.Error().Err(err).Msg("error setting read deadline in ReadFromServer()")
+		r.Log.Error("error setting read deadline in ReadFromServer()", "error", err)
 	}
-	rtcMessage, messageErr := bufio.NewReader(client).ReadString('\n')
-	if messageErr != nil && messageErr != io.EOF {
-		log.Error().Err(messageErr).Msg("error reading string retrieved from rTC")
-		return nil, err
+	pooled, isPooled := client.(*pooledConn)
+	rtcMessage, messageErr := reader.ReadString('\n')
+	atomic.AddUint64(&r.state.bytesReceived, uint64(len(rtcMessage)))
+	if messageErr != nil {
+		if isPooled {
+			// a persistent connection the rTC ended is no good for the next command
+			pooled.broken = true
+		}
+		partial := len(strings.TrimSpace(rtcMessage))
+		if messageErr == io.EOF && partial > 0 && !isPooled {
+			// the rTC may close straight after a reply it didn't end with a newline
+			messageErr = nil
+		} else if disconnect := classifyDisconnect(messageErr, partial, isPooled); disconnect != nil {
+			messageErr = disconnect
+		}
+	}
+	if messageErr != nil {
+		r.Log.Error("error reading string retrieved from rTC", "error", messageErr)
+		return nil, messageErr
 	}
 
 	rtcMessage = strings.TrimSpace(rtcMessage)
 	return &rtcMessage, nil
 }
+
+// CloseConn closes a connection to the rTC without ever blocking the caller for
+// longer than CloseTimeout. A graceful close half closes the write side, drains
+// whatever the rTC still sends until it closes its end, then closes; an immediate
+// close resets the connection. Connections that fail to close are handed to a
+// background goroutine so a flaky close never stalls load generation.
+// Pooled connections go back to their pool instead.
+func (r *RTCClient) CloseConn(client net.Conn) error {
+	if pooled, ok := client.(*pooledConn); ok {
+		r.Pool.Release(pooled)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.CloseTimeout)
+	defer cancel()
+
+	tcp, isTCP := client.(*net.TCPConn)
+	switch {
+	case isTCP && r.CloseMode == "immediate":
+		err := tcp.SetLinger(0)
+		if err != nil {
+			r.Log.Debug("error setting linger before resetting rtc connection", "error", err)
+		}
+	case isTCP:
+		deadline, _ := ctx.Deadline()
+		err := client.SetDeadline(deadline)
+		if err != nil {
+			r.Log.Debug("error setting close deadline on rtc connection", "error", err)
+		}
+
+		err = tcp.CloseWrite()
+		if err == nil {
+			_, err = io.Copy(io.Discard, tcp)
+		}
+		if err != nil && ctx.Err() == nil {
+			r.Log.Debug("error during graceful close handshake with rTC", "error", err)
+		}
+	}
+
+	err := client.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		go r.reap(client)
+		return err
+	}
+	return nil
+}
+
+// reap keeps retrying to close a zombie connection in the background.
+func (r *RTCClient) reap(client net.Conn) {
+	zombies := atomic.AddInt64(&r.state.zombies, 1)
+	defer atomic.AddInt64(&r.state.zombies, -1)
+	r.Log.Warn("cleaning up zombie rtc connection in background", "zombies", zombies)
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		time.Sleep(time.Duration(attempt) * time.Second)
+
+		err := client.SetDeadline(time.Now())
+		if err != nil {
+			r.Log.Debug("error setting deadline on zombie connection", "error", err)
+		}
+		err = client.Close()
+		if err == nil || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		r.Log.Warn("error closing zombie rtc connection", "error", err, "attempt", attempt)
+	}
+	r.Log.Error("giving up closing zombie rtc connection")
+}
+
+// NetworkBytes is the number of bytes written to and read from the rTC so far.
+func (r *RTCClient) NetworkBytes() (sent, received uint64) {
+	return atomic.LoadUint64(&r.state.bytesSent), atomic.LoadUint64(&r.state.bytesReceived)
+}
+
+// InFlightCommand is a command sent to the rTC that hasn't completed. Markers
+// carry their correlation id in the command name.
+type InFlightCommand struct {
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// InFlightCommands lists the commands currently in flight, oldest first.
+func (r *RTCClient) InFlightCommands() []InFlightCommand {
+	commands := []InFlightCommand{}
+	r.state.pending.Range(func(_, v interface{}) bool {
+		commands = append(commands, v.(InFlightCommand))
+		return true
+	})
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Started.Before(commands[j].Started) })
+	return commands
+}
+
+// InFlight is the number of commands currently being sent or awaiting a reply.
+func (r *RTCClient) InFlight() int64 {
+	return atomic.LoadInt64(&r.state.inFlight)
+}
+
+// Zombies is the number of connections currently being closed in the background.
+func (r *RTCClient) Zombies() int64 {
+	return atomic.LoadInt64(&r.state.zombies)
+}
+
+// commandContext is the context commands are sent under until CancelInFlight.
+func (r *RTCClient) commandContext() context.Context {
+	r.state.cmdMu.Lock()
+	defer r.state.cmdMu.Unlock()
+	if r.state.cmdCtx == nil {
+		r.state.cmdCtx, r.state.cmdCancel = context.WithCancel(context.Background())
+	}
+	return r.state.cmdCtx
+}
+
+// CancelInFlight aborts the dials and reads of every command currently being
+// sent. Commands sent afterwards aren't affected, so e.g. cleanup can still
+// delete the run's washes after a stop gave up waiting on a hung rTC.
+func (r *RTCClient) CancelInFlight() {
+	r.state.cmdMu.Lock()
+	defer r.state.cmdMu.Unlock()
+	if r.state.cmdCancel != nil {
+		r.state.cmdCancel()
+	}
+	r.state.cmdCtx, r.state.cmdCancel = context.WithCancel(context.Background())
+}
+
+// abortOnCancel unblocks reads and writes on conn once ctx is cancelled. The
+// returned stop has to be called before conn is closed or handed back to its
+// pool, and only returns once conn is no longer watched.
+func abortOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var getStatusXML = "<src><getStatus/></src>"
+
+// The states the rTC reports a tunnel in.
+const (
+	TunnelRunning = "running"
+	TunnelStopped = "stopped"
+	TunnelFault   = "fault"
+)
+
+// RTCStatusResponse is the rTC's reply to getStatus, e.g.
+// <tc><status><state>fault</state><fault>conveyor jam</fault></status></tc>.
+type RTCStatusResponse struct {
+	XMLName xml.Name `xml:"tc"`
+	State   string   `xml:"status>state"`
+	// Fault is the rTC's description of the fault the tunnel is in, if any.
+	Fault string `xml:"status>fault"`
+	Error string `xml:"error"`
+}
+
+func (r *RTCClient) ParseRTCStatusResponse(message string) (*RTCStatusResponse, error) {
+	var status RTCStatusResponse
+	err := xml.Unmarshal([]byte(message), &status)
+	if err != nil {
+		return nil, err
+	}
+	if status.Error != "" {
+		return nil, &RTCError{Command: "STATUS", Message: status.Error}
+	}
+	status.State = strings.ToLower(strings.TrimSpace(status.State))
+	switch status.State {
+	case TunnelRunning, TunnelStopped, TunnelFault:
+		return &status, nil
+	case "":
+		return nil, &RTCError{Command: "STATUS", Message: "reply has no tunnel state"}
+	}
+	return nil, &RTCError{Command: "STATUS", Message: "unknown tunnel state " + status.State}
+}
+
+// GetStatus reads the state of the tunnel, recorded as STATUS. A stopped or
+// faulted tunnel is a successful read, only a reply without a known state
+// fails it.
+func (r *RTCClient) GetStatus() (*RTCStatusResponse, []string, error) {
+	readMessage, record, err := r.SendCommand("STATUS", getStatusXML, true)
+	if err != nil {
+		return nil, record, err
+	}
+
+	status, err := r.ParseRTCStatusResponse(*readMessage)
+	if err != nil {
+		r.Log.Warn("unable to read tunnel state from rTC", "error", err, "reply", *readMessage)
+		return nil, markFailed(record, err), err
+	}
+	return status, record, nil
+}
+
+// TunnelState is the tunnel state last read, since when the tunnel is in it
+// and the number of reads that found it in each state.
+type TunnelState struct {
+	State  string            `json:"state"`
+	Fault  string            `json:"fault,omitempty"`
+	At     time.Time         `json:"at"`
+	Since  time.Time         `json:"since"`
+	Counts map[string]uint64 `json:"counts"`
+}
+
+// StatusRoutine reads the tunnel's state every tick, logging every change of
+// it, so a run shows when the tunnel stopped or faulted under load.
+type StatusRoutine struct {
+	TickedRoutine
+
+	mu    sync.Mutex
+	state TunnelState
+}
+
+func CreateStatusRoutine(tickerTime int) *StatusRoutine {
+	s := &StatusRoutine{state: TunnelState{Counts: map[string]uint64{}}}
+	s.init("status", tickerTime, 10*time.Second, s.status)
+	return s
+}
+
+func (s *StatusRoutine) status(client *RTCClient, writer *ResultWriter) {
+	status, records, err := client.GetStatus()
+	if err != nil {
+		s.Log.Warn("unable to get tunnel state in status routine", "error", err)
+	} else {
+		client.Rates.Achieve()
+		s.Observe(status)
+	}
+	writer.Write(records)
+}
+
+// Observe takes a tunnel state read, by the routine or the status endpoint.
+// It is safe to call on a nil routine, which leaves it alone.
+func (s *StatusRoutine) Observe(status *RTCStatusResponse) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	if status.State != s.state.State {
+		if s.state.State != "" {
+			s.Log.Warn("tunnel state changed", "from", s.state.State, "to", status.State, "fault", status.Fault)
+		}
+		s.state.Since = now
+	}
+	s.state.State, s.state.Fault, s.state.At = status.State, status.Fault, now
+	s.state.Counts[status.State]++
+}
+
+// State is the tunnel state last read, false before the first read.
+func (s *StatusRoutine) State() (TunnelState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.State == "" {
+		return TunnelState{}, false
+	}
+	state := s.state
+	state.Counts = map[string]uint64{}
+	for name, n := range s.state.Counts {
+		state.Counts[name] = n
+	}
+	return state, true
+}
+
+// RTCStatus is GET /rtc/status, which reads the tunnel's state straight away.
+// The read is recorded like any other STATUS.
+func (r *Routines) RTCStatus(c *gin.Context) {
+	status, records, err := r.RTC.GetStatus()
+	writeErr := r.Writer.Write(records)
+	if writeErr != nil {
+		r.Log.Warn("error writing status record to CSV", "error", writeErr, "record", records)
+	}
+	if err != nil {
+		r.Log.Error("error getting tunnel state for api", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch rtc status: " + err.Error()})
+		return
+	}
+	r.TunnelStatus.Observe(status)
+	c.JSON(http.StatusOK, gin.H{"at": clock.Now(), "state": status.State, "fault": status.Fault})
+}
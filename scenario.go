@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Scenario holds the workloads that run alongside the queue, get and move
+// routines. It is loaded from the JSON file passed with --scenario.
+type Scenario struct {
+	Name      string                  `json:"name"`
+	Sequences []SequenceConfig        `json:"sequences"`
+	Scripts   []ScriptConfig          `json:"scripts"`
+	Commands  []TemplateCommandConfig `json:"commands"`
+	// Instances run queue, get and move routines of their own alongside the
+	// ones the flags configure.
+	Instances []InstanceConfig `json:"instances"`
+	// Streams queue washes as pay stations of their own alongside the queue
+	// routine the flags configure.
+	Streams []StreamConfig `json:"streams"`
+	// SLA sets the levels the dashboard shows commands amber and red at.
+	SLA *SLAConfig `json:"sla"`
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read scenario file %s", path)
+	}
+
+	var s Scenario
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse scenario file %s", path)
+	}
+
+	for i, seq := range s.Sequences {
+		err = seq.Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid sequence %d (%s) in scenario %s", i, seq.Name, path)
+		}
+	}
+
+	for i, script := range s.Scripts {
+		err = script.Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid script %d (%s) in scenario %s", i, script.Name, path)
+		}
+		// script paths are relative to the scenario file
+		if !filepath.IsAbs(script.File) {
+			s.Scripts[i].File = filepath.Join(filepath.Dir(path), script.File)
+		}
+	}
+
+	for i, command := range s.Commands {
+		err = command.Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid command %d (%s) in scenario %s", i, command.Name, path)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, instance := range s.Instances {
+		err = instance.Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid instance %d (%s) in scenario %s", i, instance.Name, path)
+		}
+		if names[instance.Name] {
+			return nil, errors.Errorf("instance %s is in scenario %s twice", instance.Name, path)
+		}
+		names[instance.Name] = true
+	}
+	for i, stream := range s.Streams {
+		err = stream.Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid stream %d (%s) in scenario %s", i, stream.Name, path)
+		}
+		if names[stream.Name] {
+			return nil, errors.Errorf("stream %s shares its name with another instance or stream of scenario %s", stream.Name, path)
+		}
+		names[stream.Name] = true
+	}
+
+	if s.SLA != nil {
+		err = s.SLA.Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid sla in scenario %s", path)
+		}
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// nextScheduled is when a --start-at or --stop-at time next comes after from.
+// It is either an RFC 3339 timestamp or a local time of day such as 02:00,
+// which means the next time the clock shows it.
+func nextScheduled(s string, from time.Time) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, s); err == nil {
+		if !at.After(from) {
+			return time.Time{}, errors.Errorf("scheduled time %s has already passed", s)
+		}
+		return at, nil
+	}
+
+	timeOfDay, err := parseTimeOfDay(s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("scheduled time must be a time of day like 02:00 or an RFC 3339 timestamp, got %q", s)
+	}
+	midnight := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	at := midnight.Add(timeOfDay)
+	if !at.After(from) {
+		at = midnight.AddDate(0, 0, 1).Add(timeOfDay)
+	}
+	return at, nil
+}
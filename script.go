@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// ScriptConfig points at a starlark file that decides what the tester does next.
+// The file must define next(last) returning a dict such as
+// {"action": "move", "wash": 12, "before": 0}; it may also define validate(result)
+// returning True, False or an error message string.
+type ScriptConfig struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Interval string `json:"interval"`
+	// Tunnel is the tunnel the script's commands are addressed to, the run's by default.
+	Tunnel string `json:"tunnel"`
+}
+
+func (c ScriptConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("script has no name")
+	}
+	if c.File == "" {
+		return errors.New("script has no file")
+	}
+	if _, err := ParseIntervalSeconds(c.Interval); err != nil {
+		return errors.Wrapf(err, "invalid interval %q", c.Interval)
+	}
+	return ValidateTunnel(c.Tunnel)
+}
+
+// maxScriptSteps bounds the starlark steps of a script's load and of each of
+// its calls, so a next() that never returns can't wedge its routine.
+const maxScriptSteps = 10000000
+
+type ScriptRoutine struct {
+	routineRunner
+
+	Ticker *TickerHolder
+	IDs    IDAllocator
+	Config ScriptConfig
+	Log    Logger
+
+	next     starlark.Callable
+	validate starlark.Callable
+	last     *starlark.Dict
+}
+
+func CreateScriptRoutine(config ScriptConfig, ids IDAllocator) (*ScriptRoutine, error) {
+	d, err := ParseIntervalSeconds(config.Interval)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid interval for script %s", config.Name)
+	}
+
+	s := &ScriptRoutine{
+		Ticker: CreateTickerHolder(d),
+		IDs:    ids,
+		Config: config,
+		Log:    ZerologLogger{},
+	}
+	thread := s.newThread()
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	globals, err := starlark.ExecFile(thread, config.File, nil, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to load script %s", config.File)
+	}
+
+	next, ok := globals["next"].(starlark.Callable)
+	if !ok {
+		return nil, errors.Errorf("script %s does not define next(last)", config.File)
+	}
+	s.next = next
+	s.validate, _ = globals["validate"].(starlark.Callable)
+
+	s.last = starlark.NewDict(1)
+	s.last.SetKey(starlark.String("action"), starlark.None)
+	return s, nil
+}
+
+// newThread is a thread for the script's calls. A thread stays cancelled, so
+// every run of the routine gets one of its own.
+func (s *ScriptRoutine) newThread() *starlark.Thread {
+	thread := &starlark.Thread{Name: s.Config.Name}
+	thread.Print = func(_ *starlark.Thread, msg string) {
+		s.Log.Info(msg, "script", s.Config.Name)
+	}
+	return thread
+}
+
+// callScript calls fn on thread, with maxScriptSteps steps to return.
+func callScript(thread *starlark.Thread, fn starlark.Callable, arg starlark.Value) (starlark.Value, error) {
+	thread.SetMaxExecutionSteps(thread.ExecutionSteps() + maxScriptSteps)
+	return starlark.Call(thread, fn, starlark.Tuple{arg}, nil)
+}
+
+func (s *ScriptRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	client = client.OnTunnel(s.Config.Tunnel)
+	thread := s.newThread()
+	// stopping cancels a call the script is stuck in
+	running := make(chan struct{})
+	defer close(running)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel("script routine stopped")
+		case <-running:
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.Log.Info("script routine stopped", "script", s.Config.Name)
+			return
+		case <-s.Ticker.C():
+			if client.Gate.Paused() {
+				continue
+			}
+			v, err := callScript(thread, s.next, s.last)
+			if err != nil {
+				s.Log.Warn("error calling next() in script", "error", err, "script", s.Config.Name)
+				continue
+			}
+
+			action, ok := v.(*starlark.Dict)
+			if !ok {
+				s.Log.Warn("next() must return a dict, skipping tick", "script", s.Config.Name, "type", v.Type())
+				continue
+			}
+
+			result, err := s.perform(action, client, writer)
+			if err != nil {
+				s.Log.Warn("next() returned an invalid action, skipping tick", "error", err, "script", s.Config.Name, "action", action.String())
+				continue
+			}
+			s.check(thread, result)
+			s.last = result
+		}
+	}
+}
+
+// perform sends the action next() returned. An action missing the washes it
+// needs is an error, and nothing is sent for it.
+func (s *ScriptRoutine) perform(action *starlark.Dict, client *RTCClient, writer *ResultWriter) (*starlark.Dict, error) {
+	name := dictString(action, "action")
+	result := starlark.NewDict(4)
+	result.SetKey(starlark.String("action"), starlark.String(name))
+
+	var err error
+	switch name {
+	case "add":
+		var orderID string
+		orderID, err = s.IDs.NextOrderID()
+		if err != nil {
+			break
+		}
+		req := WashRequest{
+			LaneID:      client.Lanes.Next(),
+			OrderID:     orderID,
+			VehicleID:   "NO-VALID-ID",
+			WashPackage: 1,
+		}
+		var resp *AddQueueResponse
+		var records []string
+		resp, records, err = client.QueueWash(req)
+		writer.Write(records)
+		if resp != nil {
+			result.SetKey(starlark.String("wash"), starlark.MakeInt(resp.WashID))
+		}
+	case "move":
+		wash, keyErr := dictInt(action, "wash")
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		before, keyErr := dictInt(action, "before")
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		p := MoveWashReqParams{
+			WashID:   wash,
+			ToBefore: before,
+		}
+		var records []string
+		_, records, err = client.MoveWash(p)
+		writer.Write(records)
+	case "delete":
+		wash, keyErr := dictInt(action, "wash")
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		var records []string
+		_, records, err = client.DeleteQueuedCar(wash)
+		writer.Write(records)
+	case "get":
+		var queue *GetQueueResponse
+		var records []string
+		queue, records, err = client.GetQueue()
+		writer.Write(records)
+		if queue != nil {
+			result.SetKey(starlark.String("queue"), queueToStarlark(queue))
+		}
+	case "skip":
+	default:
+		err = errors.Errorf("unknown action %q returned by next()", name)
+	}
+
+	result.SetKey(starlark.String("ok"), starlark.Bool(err == nil))
+	if err != nil {
+		s.Log.Warn("script action failed", "error", err, "script", s.Config.Name, "action", name)
+		result.SetKey(starlark.String("error"), starlark.String(err.Error()))
+	}
+	return result, nil
+}
+
+func (s *ScriptRoutine) check(thread *starlark.Thread, result *starlark.Dict) {
+	if s.validate == nil {
+		return
+	}
+
+	v, err := callScript(thread, s.validate, result)
+	if err != nil {
+		s.Log.Warn("error calling validate() in script", "error", err, "script", s.Config.Name)
+		return
+	}
+
+	switch v := v.(type) {
+	case starlark.Bool:
+		if !v {
+			s.Log.Warn("script validation failed", "script", s.Config.Name, "result", result.String())
+		}
+	case starlark.String:
+		s.Log.Warn("script validation failed", "script", s.Config.Name, "result", result.String(), "reason", string(v))
+	}
+}
+
+func queueToStarlark(queue *GetQueueResponse) *starlark.List {
+	items := make([]starlark.Value, 0, len(queue.Queue.QueueItems))
+	for _, wash := range queue.Queue.QueueItems {
+		d := starlark.NewDict(4)
+		d.SetKey(starlark.String("id"), starlark.MakeInt(wash.WashID))
+		d.SetKey(starlark.String("state"), starlark.String(wash.State))
+		d.SetKey(starlark.String("position"), starlark.MakeInt(wash.Position))
+		d.SetKey(starlark.String("washPkgNum"), starlark.MakeInt(wash.WashPkgNum))
+		items = append(items, d)
+	}
+	return starlark.NewList(items)
+}
+
+func dictString(d *starlark.Dict, key string) string {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found {
+		return ""
+	}
+	s, _ := starlark.AsString(v)
+	return s
+}
+
+func dictInt(d *starlark.Dict, key string) (int, error) {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found {
+		return 0, errors.Errorf("action has no %q", key)
+	}
+	var i int
+	err := starlark.AsInt(v, &i)
+	if err != nil {
+		return 0, errors.Wrapf(err, "action's %q must be an int", key)
+	}
+	return i, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// SearchStep is how one command held up at one offered rate.
+type SearchStep struct {
+	Rate       float64 `json:"rate"`
+	Achieved   float64 `json:"achieved"`
+	Operations int     `json:"operations"`
+	ErrorRate  float64 `json:"errorRate"`
+	P99Ms      float64 `json:"p99Ms"`
+	Sustained  bool    `json:"sustained"`
+}
+
+// SearchResult is the highest rate a command was sustained at, 0 when it
+// wasn't sustained even at the start rate.
+type SearchResult struct {
+	Command string       `json:"command"`
+	MaxRate float64      `json:"maxRate"`
+	Steps   []SearchStep `json:"steps"`
+}
+
+// ThroughputSearch finds the highest rate each of queue, move and get can be
+// sent at before the rTC's error rate or p99 latency crosses its limit. The rate
+// grows by Growth every Step until a step fails, then Refine more steps bisect
+// between the last rate sustained and the first one that wasn't. Operations are
+// fired at the offered rate whether or not earlier ones completed, so a rate
+// the rTC can't keep up with shows as latency instead of a lower rate.
+type ThroughputSearch struct {
+	Client *RTCClient
+	Writer *ResultWriter
+	Log    Logger
+	IDs    IDAllocator
+
+	Step         time.Duration
+	StartRate    float64
+	MaxRate      float64
+	Growth       float64
+	Refine       int
+	MaxErrorRate float64
+	MaxP99       time.Duration
+	// MinAchieved is the share of the offered rate that has to complete within
+	// the step for the rate to count as sustained.
+	MinAchieved float64
+}
+
+// Run searches each command in turn.
+func (s *ThroughputSearch) Run(commands []string) ([]SearchResult, error) {
+	var results []SearchResult
+	for _, command := range commands {
+		result, err := s.search(command)
+		if err != nil {
+			return results, err
+		}
+		s.Log.Info("max sustainable rate found", "command", command, "rate", result.MaxRate)
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+func (s *ThroughputSearch) search(command string) (*SearchResult, error) {
+	op, cleanup, err := s.operation(command)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	result := &SearchResult{Command: command}
+	step := func(rate float64) bool {
+		st := s.runStep(command, rate, op)
+		result.Steps = append(result.Steps, st)
+		s.Log.Info("search step finished", "command", command, "rate", rate, "achieved", st.Achieved, "errorRate", st.ErrorRate, "p99Ms", st.P99Ms, "sustained", st.Sustained)
+		return st.Sustained
+	}
+
+	pass, fail := 0.0, 0.0
+	for rate := s.StartRate; rate <= s.MaxRate; rate *= s.Growth {
+		if !step(rate) {
+			fail = rate
+			break
+		}
+		pass = rate
+	}
+	if fail > 0 && pass > 0 {
+		for i := 0; i < s.Refine; i++ {
+			rate := (pass + fail) / 2
+			if step(rate) {
+				pass = rate
+			} else {
+				fail = rate
+			}
+		}
+	}
+	result.MaxRate = pass
+	return result, nil
+}
+
+// operation is what is sent for a command and how the washes it leaves behind
+// are deleted afterwards.
+func (s *ThroughputSearch) operation(command string) (op func() ([]string, error), cleanup func(), err error) {
+	var mu sync.Mutex
+	var queued []int
+	cleanup = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, washID := range queued {
+			_, records, err := s.Client.DeleteQueuedCar(washID)
+			s.Writer.Write(records)
+			if err != nil {
+				s.Log.Warn("unable to delete wash queued by search", "error", err, "washID", washID)
+			}
+		}
+		queued = nil
+	}
+
+	queue := func() ([]string, error) {
+		orderID, err := s.IDs.NextOrderID()
+		if err != nil {
+			return nil, err
+		}
+		resp, records, err := s.Client.QueueWash(WashRequest{LaneID: s.Client.Lanes.Next(), OrderID: orderID, VehicleID: "NO-VALID-ID", WashPackage: 1})
+		if err == nil {
+			mu.Lock()
+			queued = append(queued, resp.WashID)
+			mu.Unlock()
+		}
+		return records, err
+	}
+
+	switch command {
+	case "queue":
+		return queue, cleanup, nil
+	case "get":
+		return func() ([]string, error) {
+			_, records, err := s.Client.GetQueue()
+			return records, err
+		}, cleanup, nil
+	case "move":
+		// moves need washes of our own to move around
+		for i := 0; i < 2; i++ {
+			records, err := queue()
+			s.Writer.Write(records)
+			if err != nil {
+				cleanup()
+				return nil, nil, errors.Wrap(err, "unable to queue the washes to move")
+			}
+		}
+		return func() ([]string, error) {
+			mu.Lock()
+			washID := queued[rand.Intn(len(queued))]
+			mu.Unlock()
+			_, records, err := s.Client.MoveWash(MoveWashReqParams{WashID: washID, ToBefore: rand.Intn(2)})
+			return records, err
+		}, cleanup, nil
+	}
+	return nil, nil, errors.Errorf("unknown command %q, expected queue, move or get", command)
+}
+
+// runStep fires op at rate for one step and waits for the operations to finish.
+func (s *ThroughputSearch) runStep(command string, rate float64, op func() ([]string, error)) SearchStep {
+	interval := time.Duration(float64(time.Second) / rate)
+	phase := fmt.Sprintf("%s %.4g/s", command, rate)
+	s.Writer.Phase = func() string { return phase }
+
+	var mu sync.Mutex
+	var latencies []float64
+	errs := 0
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	fired := 0
+	for time.Since(start) < s.Step {
+		<-ticker.C
+		fired++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			began := time.Now()
+			records, err := op()
+			took := time.Since(began)
+			s.Writer.Write(records)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs++
+				return
+			}
+			latencies = append(latencies, float64(took)/float64(time.Millisecond))
+		}()
+	}
+	ticker.Stop()
+
+	// operations still running MaxP99 after the last one was fired don't count
+	// towards the achieved rate
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(s.MaxP99):
+	}
+	mu.Lock()
+	completed := len(latencies)
+	mu.Unlock()
+	<-finished
+
+	sort.Float64s(latencies)
+	st := SearchStep{
+		Rate:       rate,
+		Achieved:   float64(completed) / (float64(fired) * interval.Seconds()),
+		Operations: fired,
+		P99Ms:      percentile(latencies, 99),
+	}
+	if fired > 0 {
+		st.ErrorRate = float64(errs) / float64(fired)
+	}
+	st.Sustained = st.ErrorRate <= s.MaxErrorRate &&
+		st.P99Ms <= float64(s.MaxP99)/float64(time.Millisecond) &&
+		st.Achieved >= rate*s.MinAchieved
+	return st
+}
+
+func printSearchResults(out io.Writer, results []SearchResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tMAX SUSTAINABLE OPS/S\tSTEPS")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%.4g\t%d\n", r.Command, r.MaxRate, len(r.Steps))
+	}
+	w.Flush()
+}
+
+// runMaxThroughput implements the `max-throughput` subcommand.
+func runMaxThroughput(args []string) {
+	fs := flag.NewFlagSet("max-throughput", flag.ExitOnError)
+	rtcHost := fs.String("client", "192.168.1.80", "ip of rTC")
+	rtcPort := fs.Int("port", 20250, "port for rTC")
+	commandList := fs.String("routines", "queue,move,get", "comma separated commands to search the maximum rate of, one after the other")
+	stepDuration := fs.Duration("step", 30*time.Second, "how long each rate is held")
+	startRate := fs.Float64("start-rate", 1, "operations per second the search starts at")
+	maxRate := fs.Float64("max-rate", 1000, "operations per second the search stops at")
+	growth := fs.Float64("growth", 2, "factor the rate grows by every step until a step fails")
+	refine := fs.Int("refine", 3, "steps spent bisecting between the last sustained rate and the first failed one")
+	maxErrorRate := fs.Float64("max-error-rate", 0.01, "highest error rate a sustained step may have")
+	maxP99 := fs.Duration("max-p99", time.Second, "highest p99 latency a sustained step may have")
+	minAchieved := fs.Float64("min-achieved", 0.95, "share of the offered rate that has to complete within a step for it to be sustained")
+	resultsDir := fs.String("results-dir", "", "directory the search's results are written to, defaults to max-throughput-<date>-<time>")
+	idPrefix := fs.String("id-prefix", defaultIDPrefix(defaultInstanceName()), "prefix for order ids generated by the search")
+	auth := addAuthFlags(fs, authUse)
+	fs.Parse(args)
+
+	if *startRate <= 0 || *maxRate < *startRate || *growth <= 1 || *stepDuration <= 0 {
+		log.Fatal().Msg("the search needs 0 < --start-rate <= --max-rate, --growth > 1 and a positive --step")
+	}
+	names, err := parseRoutineNames(*commandList)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid routines")
+	}
+	var commands []string
+	for _, name := range []string{"queue", "move", "get"} {
+		if names[name] {
+			commands = append(commands, name)
+		}
+	}
+
+	dir := *resultsDir
+	if dir == "" {
+		dir = "max-throughput-" + time.Now().Format("2006-01-02-150405")
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create results directory")
+	}
+	f, err := os.Create(filepath.Join(dir, "load-test.csv"))
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("unable to create csv file")
+	}
+	defer f.Close()
+
+	writer := CreateResultWriter(f)
+	writer.Phase = func() string { return "" }
+	err = writer.WriteHeader()
+	if err != nil {
+		log.Fatal().Err(err).Msg("error writing headers to csv file")
+	}
+
+	search := &ThroughputSearch{
+		Client:       CreateRTCClient(*rtcHost, *rtcPort),
+		Writer:       writer,
+		Log:          ZerologLogger{},
+		IDs:          CreatePrefixAllocator(*idPrefix),
+		Step:         *stepDuration,
+		StartRate:    *startRate,
+		MaxRate:      *maxRate,
+		Growth:       *growth,
+		Refine:       *refine,
+		MaxErrorRate: *maxErrorRate,
+		MaxP99:       *maxP99,
+		MinAchieved:  *minAchieved,
+	}
+	search.Client.Log = NopLogger{}
+	search.Client.Auth = auth()
+	results, err := search.Run(commands)
+	if err != nil {
+		log.Error().Err(err).Msg("search stopped early")
+	}
+
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "max-throughput.json"), b, 0644)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("dir", dir).Msg("unable to write search results")
+	}
+	printSearchResults(os.Stdout, results)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"text/template"
+)
+
+// SeededRand is one routine's stream of random choices. Each stream is seeded
+// from the run's seed and its own name, so a run started with the same --seed
+// makes the same choices in every routine, and adding or removing a routine
+// doesn't shift the choices of the others. It is safe for concurrent use, e.g.
+// by open model moves or a pool of workers.
+type SeededRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func CreateSeededRand(seed int64, stream string) *SeededRand {
+	h := fnv.New64a()
+	h.Write([]byte(stream))
+	return &SeededRand{r: rand.New(rand.NewSource(seed ^ int64(h.Sum64())))}
+}
+
+func (s *SeededRand) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Intn(n)
+}
+
+func (s *SeededRand) Int63n(n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Int63n(n)
+}
+
+// Seed gives every routine with random choices its own stream seeded from seed.
+func (r *Routines) Seed(seed int64) {
+	r.MoveRoutine.Rand = CreateSeededRand(seed, "move")
+	if r.Modify != nil {
+		r.Modify.Rand = CreateSeededRand(seed, "modify")
+	}
+	for _, routine := range r.Timed.All() {
+		t := routine.Ticked()
+		if t.instance == "" {
+			continue
+		}
+		// an instance's choices don't shift those of the routines the flags configure
+		switch routine := routine.(type) {
+		case *MoveRoutine:
+			routine.Rand = CreateSeededRand(seed, "move:"+t.instance)
+		case *QueueRoutine:
+			if routine.Lanes != nil {
+				routine.Lanes.Rand = CreateSeededRand(seed, "lanes:"+t.instance)
+			}
+		}
+	}
+	if r.RTC != nil && r.RTC.Retry != nil {
+		r.RTC.Retry.Rand = CreateSeededRand(seed, "retries")
+	}
+	if r.RTC != nil && r.RTC.Verify != nil {
+		r.RTC.Verify.Rand = CreateSeededRand(seed, "verify")
+	}
+	if r.RTC != nil && r.RTC.Lanes != nil {
+		r.RTC.Lanes.Rand = CreateSeededRand(seed, "lanes")
+	}
+	if r.Mix != nil {
+		r.Mix.Mix.Rand = CreateSeededRand(seed, "mix")
+	}
+	for _, command := range r.Commands {
+		rng := CreateSeededRand(seed, "command:"+command.Config.Name)
+		command.tmpl.Funcs(template.FuncMap{
+			"randInt": func(n int) int {
+				if n <= 0 {
+					return 0
+				}
+				return rng.Intn(n)
+			},
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// SequenceConfig is a scripted chain of rTC commands run once per interval, e.g.
+// add -> wait 2s -> move to front -> verify position -> delete. Wash IDs returned
+// by add steps are saved into named variables that later steps refer to.
+type SequenceConfig struct {
+	Name     string         `json:"name"`
+	Interval string         `json:"interval"`
+	Steps    []SequenceStep `json:"steps"`
+	// Tunnel is the tunnel the sequence's commands are addressed to, the run's by default.
+	Tunnel string `json:"tunnel"`
+}
+
+type SequenceStep struct {
+	Action   string `json:"action"`
+	Duration string `json:"duration,omitempty"`
+	Wash     string `json:"wash,omitempty"`
+	Before   string `json:"before,omitempty"`
+	Position *int   `json:"position,omitempty"`
+	Save     string `json:"save,omitempty"`
+}
+
+func (c SequenceConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("sequence has no name")
+	}
+	if _, err := ParseIntervalSeconds(c.Interval); err != nil {
+		return errors.Wrapf(err, "invalid interval %q", c.Interval)
+	}
+	if err := ValidateTunnel(c.Tunnel); err != nil {
+		return err
+	}
+	if len(c.Steps) == 0 {
+		return errors.New("sequence has no steps")
+	}
+
+	saved := map[string]bool{}
+	for i, step := range c.Steps {
+		switch step.Action {
+		case "add":
+			if step.Save != "" {
+				saved[step.Save] = true
+			}
+		case "get":
+		case "wait":
+			if _, err := time.ParseDuration(step.Duration); err != nil {
+				return errors.Wrapf(err, "step %d: invalid wait duration %q", i, step.Duration)
+			}
+		case "move", "verify", "delete":
+			if !saved[step.Wash] {
+				return errors.Errorf("step %d: %s refers to wash variable %q before it is saved by an add step", i, step.Action, step.Wash)
+			}
+			if step.Action == "move" && step.Before != "front" && step.Before != "back" {
+				if _, err := strconv.Atoi(step.Before); err != nil {
+					return errors.Errorf("step %d: move target must be front, back or a queue index, got %q", i, step.Before)
+				}
+			}
+			if step.Action == "verify" && step.Position == nil {
+				return errors.Errorf("step %d: verify requires an expected position", i)
+			}
+		default:
+			return errors.Errorf("step %d: unknown action %q", i, step.Action)
+		}
+	}
+
+	return nil
+}
+
+type SequenceRoutine struct {
+	routineRunner
+
+	Ticker *TickerHolder
+	IDs    IDAllocator
+	Config SequenceConfig
+	Log    Logger
+}
+
+func CreateSequenceRoutine(config SequenceConfig, ids IDAllocator) *SequenceRoutine {
+	d, err := ParseIntervalSeconds(config.Interval)
+	if err != nil {
+		log.Error().Err(err).Str("sequence", config.Name).Str("interval", config.Interval).Msg("error parsing sequence interval; forcing ticker duration to be default")
+		d = 10 * time.Second
+	}
+	return &SequenceRoutine{
+		Ticker: CreateTickerHolder(d),
+		IDs:    ids,
+		Config: config,
+		Log:    ZerologLogger{},
+	}
+}
+
+func (s *SequenceRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	client = client.OnTunnel(s.Config.Tunnel)
+	for {
+		select {
+		case <-ctx.Done():
+			s.Log.Info("sequence routine stopped", "sequence", s.Config.Name)
+			return
+		case <-s.Ticker.C():
+			if client.Gate.Paused() {
+				continue
+			}
+			s.execute(ctx, client, writer)
+		}
+	}
+}
+
+func (s *SequenceRoutine) execute(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	vars := map[string]int{}
+	queued := map[string]bool{}
+
+	for i, step := range s.Config.Steps {
+		err := s.runStep(ctx, step, vars, queued, client, writer)
+		if err != nil {
+			s.Log.Warn("sequence step failed, aborting sequence", "error", err, "sequence", s.Config.Name, "step", i, "action", step.Action)
+			s.cleanup(vars, queued, client, writer)
+			return
+		}
+	}
+
+	// anything added but never deleted by the script stays queued on purpose
+	s.Log.Debug("sequence completed", "sequence", s.Config.Name, "variables", vars)
+}
+
+func (s *SequenceRoutine) runStep(ctx context.Context, step SequenceStep, vars map[string]int, queued map[string]bool, client *RTCClient, writer *ResultWriter) error {
+	switch step.Action {
+	case "add":
+		orderID, err := s.IDs.NextOrderID()
+		if err != nil {
+			return err
+		}
+		req := WashRequest{
+			LaneID:      client.Lanes.Next(),
+			OrderID:     orderID,
+			VehicleID:   "NO-VALID-ID",
+			WashPackage: 1,
+		}
+		resp, records, err := client.QueueWash(req)
+		writer.Write(records)
+		if err != nil {
+			return err
+		}
+		if step.Save != "" {
+			vars[step.Save] = resp.WashID
+			queued[step.Save] = true
+		}
+	case "wait":
+		d, _ := time.ParseDuration(step.Duration)
+		select {
+		case <-clock.After(d):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "sequence stopped while waiting")
+		}
+	case "get":
+		_, records, err := client.GetQueue()
+		writer.Write(records)
+		return err
+	case "move":
+		before, err := s.resolveBefore(step.Before, client, writer)
+		if err != nil {
+			return err
+		}
+		p := MoveWashReqParams{
+			WashID:   vars[step.Wash],
+			ToBefore: before,
+		}
+		_, records, err := client.MoveWash(p)
+		writer.Write(records)
+		return err
+	case "verify":
+		queue, records, err := client.GetQueue()
+		writer.Write(records)
+		if err != nil {
+			return err
+		}
+		washID := vars[step.Wash]
+		for _, wash := range queue.Queue.QueueItems {
+			if wash.WashID == washID {
+				if wash.Position != *step.Position {
+					return errors.Errorf("wash %d (%s) is at position %d, expected %d", washID, step.Wash, wash.Position, *step.Position)
+				}
+				return nil
+			}
+		}
+		return errors.Errorf("wash %d (%s) not found in queue", washID, step.Wash)
+	case "delete":
+		_, records, err := client.DeleteQueuedCar(vars[step.Wash])
+		writer.Write(records)
+		if err != nil {
+			return err
+		}
+		delete(queued, step.Wash)
+	}
+
+	return nil
+}
+
+func (s *SequenceRoutine) resolveBefore(before string, client *RTCClient, writer *ResultWriter) (int, error) {
+	switch before {
+	case "front":
+		return 0, nil
+	case "back":
+		queue, records, err := client.GetQueue()
+		writer.Write(records)
+		if err != nil {
+			return 0, err
+		}
+		return len(queue.Queue.QueueItems), nil
+	default:
+		return strconv.Atoi(before)
+	}
+}
+
+// cleanup removes the washes an aborted sequence left behind so failed runs
+// don't slowly fill the rTC queue.
+func (s *SequenceRoutine) cleanup(vars map[string]int, queued map[string]bool, client *RTCClient, writer *ResultWriter) {
+	for name := range queued {
+		_, records, err := client.DeleteQueuedCar(vars[name])
+		writer.Write(records)
+		if err != nil {
+			s.Log.Error("error deleting wash left behind by aborted sequence", "error", err, "sequence", s.Config.Name, "washID", vars[name])
+		}
+	}
+}
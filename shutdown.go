@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ShutdownReport is the work a run left unfinished when it ended, so an aborted
+// run can be reconciled against the rTC and the POS afterwards.
+type ShutdownReport struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+	// InFlight are the commands that were sent but hadn't completed.
+	InFlight []InFlightCommand `json:"inFlight"`
+	// Writers has the records of every results file that were never written.
+	Writers map[string]WriterStats `json:"writers"`
+	// OutstandingWashes were queued by this instance and never deleted; order ids
+	// are only known when the wash registry is enabled.
+	OutstandingWashes []RegisteredWash `json:"outstandingWashes"`
+}
+
+// BuildShutdownReport collects the unfinished work of the run. writers maps
+// each results file name to its writer.
+func (r *Routines) BuildShutdownReport(reason string, writers map[string]*ResultWriter) *ShutdownReport {
+	report := &ShutdownReport{
+		At:       clock.Now().UTC(),
+		Reason:   reason,
+		InFlight: r.RTC.InFlightCommands(),
+		Writers:  map[string]WriterStats{},
+	}
+
+	for name, writer := range writers {
+		if writer == nil {
+			continue
+		}
+		writer.Flush()
+		report.Writers[name] = writer.Stats()
+	}
+
+	if r.RTC.Registry != nil {
+		washes, err := r.RTC.Registry.Outstanding()
+		if err != nil {
+			r.Log.Warn("unable to list outstanding washes for shutdown report", "error", err)
+		}
+		report.OutstandingWashes = washes
+	} else if r.RTC.WashIDs != nil {
+		for _, washID := range r.RTC.WashIDs.Outstanding() {
+			report.OutstandingWashes = append(report.OutstandingWashes, RegisteredWash{WashID: washID})
+		}
+	}
+	return report
+}
+
+// writeShutdown records the shutdown report in the run's manifest and signs the
+// run when a signing key is configured.
+func (r *Routines) writeShutdown(manifest *Manifest, dir, reason string, writers map[string]*ResultWriter) {
+	manifest.Shutdown = r.BuildShutdownReport(reason, writers)
+	err := manifest.Write(dir)
+	if err != nil {
+		log.Error().Err(err).Str("dir", dir).Msg("unable to write shutdown report to manifest")
+		return
+	}
+	log.Info().
+		Str("reason", reason).
+		Int("inFlight", len(manifest.Shutdown.InFlight)).
+		Int("outstandingWashes", len(manifest.Shutdown.OutstandingWashes)).
+		Msg("shutdown report written to manifest")
+
+	if r.SigningKey != nil {
+		err = SignRun(dir, r.SigningKey)
+		if err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("unable to sign run")
+			return
+		}
+		log.Info().Str("dir", dir).Msg("run signed")
+	}
+}
+
+// drain waits for the operations already under way when the routines were
+// stopped to finish, up to DrainTimeout, and then flushes their records, so
+// cleanup doesn't race commands still on the wire and no record is cut short.
+// Once every routine is stopped it also waits for their goroutines to return,
+// so the records they write on their way out, such as released washes, make
+// it into the flush. Operations still running at the timeout are cancelled
+// and drain returns false.
+func (r *Routines) drain() bool {
+	settled := r.settled(time.Now().Add(r.DrainTimeout))
+	if !settled {
+		r.Log.Warn("operations still running after drain timeout, cancelling them", "pending", r.pendingOps(), "timeout", r.DrainTimeout.String())
+		r.RTC.CancelInFlight()
+		// give the cancelled commands a moment to write their records
+		r.settled(time.Now().Add(time.Second))
+	} else {
+		r.Log.Info("in-flight operations drained")
+	}
+	err := r.Writer.Flush()
+	if err != nil {
+		r.Log.Error("unable to flush results after drain", "error", err)
+	}
+	return settled
+}
+
+// settled waits until deadline for the pending operations to finish and, when
+// the routines are stopped, for their goroutines to return. It returns whether
+// they did.
+func (r *Routines) settled(deadline time.Time) bool {
+	for r.pendingOps() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if r.pendingOps() > 0 {
+		return false
+	}
+	if r.lifecycle.State() != RoutinesStopped {
+		return true
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		return true
+	case <-time.After(time.Until(deadline)):
+		r.Log.Warn("routines still running after drain timeout", "timeout", r.DrainTimeout.String())
+		return false
+	}
+}
+
+// pendingOps counts the commands on the wire and the open model operations
+// that haven't finished, which can be between two of their commands.
+func (r *Routines) pendingOps() int64 {
+	pending := r.RTC.InFlight()
+	if r.QueueRoutine.Open != nil {
+		pending += r.QueueRoutine.Open.InFlight()
+	}
+	return pending
+}
+
+// shutdownOnSignal writes the shutdown report and exits when the tester is
+// interrupted or terminated.
+func (r *Routines) shutdownOnSignal(manifest *Manifest, dir string, writers map[string]*ResultWriter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+
+	if r.stopRoutines() {
+		r.drain()
+	}
+	r.writeShutdown(manifest, dir, "signal: "+sig.String(), writers)
+	os.Exit(1)
+}
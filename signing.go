@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// signatureFile holds the signed digests of a run directory.
+const signatureFile = "signature.json"
+
+// RunDigests are the SHA-256 digests of every file of a run at the time it was
+// signed, keyed by path relative to the run directory.
+type RunDigests struct {
+	SignedAt  time.Time         `json:"signedAt"`
+	Algorithm string            `json:"algorithm"`
+	Files     map[string]string `json:"files"`
+}
+
+// RunSignature is written to signature.json. The signature covers the JSON
+// encoding of the digests, so changing, removing or renaming any signed file
+// shows up when the run is verified against the signer's public key.
+type RunSignature struct {
+	Digests   RunDigests `json:"digests"`
+	Signature []byte     `json:"signature"`
+}
+
+// digestRun hashes every file under dir except the signature itself.
+func digestRun(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == signatureFile {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		files[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to hash files of run %s", dir)
+	}
+	return files, nil
+}
+
+// SignRun writes signature.json for the files currently in dir.
+func SignRun(dir string, key ed25519.PrivateKey) error {
+	files, err := digestRun(dir)
+	if err != nil {
+		return err
+	}
+	digests := RunDigests{SignedAt: time.Now().UTC(), Algorithm: "ed25519", Files: files}
+	payload, err := json.Marshal(digests)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode run digests")
+	}
+
+	b, err := json.MarshalIndent(RunSignature{Digests: digests, Signature: ed25519.Sign(key, payload)}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to encode run signature")
+	}
+	err = os.WriteFile(filepath.Join(dir, signatureFile), b, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to write run signature")
+	}
+	return nil
+}
+
+// RunVerification is the outcome of checking a run against its signature.
+type RunVerification struct {
+	SignedAt time.Time
+	// Changed and Missing are signed files whose contents differ or that are gone.
+	Changed []string
+	Missing []string
+	// Unsigned were added after the run was signed, e.g. a report built later.
+	Unsigned []string
+}
+
+func (v *RunVerification) Valid() bool {
+	return len(v.Changed) == 0 && len(v.Missing) == 0
+}
+
+// VerifyRun checks the signature of dir with the signer's public key and then
+// compares the signed digests with the files as they are now.
+func VerifyRun(dir string, key ed25519.PublicKey) (*RunVerification, error) {
+	b, err := os.ReadFile(filepath.Join(dir, signatureFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read run signature")
+	}
+	var sig RunSignature
+	err = json.Unmarshal(b, &sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse run signature")
+	}
+	if sig.Digests.Algorithm != "ed25519" {
+		return nil, errors.Errorf("unsupported signature algorithm %q", sig.Digests.Algorithm)
+	}
+	payload, err := json.Marshal(sig.Digests)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode run digests")
+	}
+	if !ed25519.Verify(key, payload, sig.Signature) {
+		return nil, errors.New("signature doesn't match the digests or wasn't made with this key")
+	}
+
+	current, err := digestRun(dir)
+	if err != nil {
+		return nil, err
+	}
+	v := &RunVerification{SignedAt: sig.Digests.SignedAt}
+	for name, digest := range sig.Digests.Files {
+		now, ok := current[name]
+		switch {
+		case !ok:
+			v.Missing = append(v.Missing, name)
+		case now != digest:
+			v.Changed = append(v.Changed, name)
+		}
+	}
+	for name := range current {
+		if _, ok := sig.Digests.Files[name]; !ok {
+			v.Unsigned = append(v.Unsigned, name)
+		}
+	}
+	sort.Strings(v.Changed)
+	sort.Strings(v.Missing)
+	sort.Strings(v.Unsigned)
+	return v, nil
+}
+
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse signing key %s", path)
+	}
+	signing, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("signing key %s is not an ed25519 key", path)
+	}
+	return signing, nil
+}
+
+func LoadVerifyingKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse public key %s", path)
+	}
+	verifying, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("public key %s is not an ed25519 key", path)
+	}
+	return verifying, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read key %s", path)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.Errorf("no PEM encoded key found in %s", path)
+	}
+	return block, nil
+}
+
+// generateSigningKey writes a new key pair to dir as signing-key.pem, which
+// stays with the tester, and signing.pem, which is shared with whoever verifies.
+func generateSigningKey(dir string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "unable to generate signing key")
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode signing key")
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode public key")
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "unable to create key directory")
+	}
+	keyPath := filepath.Join(dir, "signing-key.pem")
+	if _, err := os.Stat(keyPath); err == nil {
+		return errors.Errorf("%s already exists, runs it signed could no longer be verified if it was replaced", keyPath)
+	}
+	err = writePEM(keyPath, "PRIVATE KEY", privateDER, 0600)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, "signing.pem"), "PUBLIC KEY", publicDER, 0644)
+}
+
+// runSign implements the `sign` subcommand: `sign keygen` creates a key pair
+// and `sign -key KEY DIR` signs a run again, e.g. after building its report.
+func runSign(args []string) {
+	if len(args) > 0 && args[0] == "keygen" {
+		fs := flag.NewFlagSet("sign keygen", flag.ExitOnError)
+		dir := fs.String("dir", "keys", "directory the key pair is written to")
+		fs.Parse(args[1:])
+		err := generateSigningKey(*dir)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to create signing key")
+		}
+		log.Info().Str("dir", *dir).Msg("signing key written")
+		return
+	}
+
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "keys/signing-key.pem", "ed25519 private key the run is signed with")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: sign keygen [-dir DIR] | sign [-key KEY] RUN_DIR")
+		os.Exit(2)
+	}
+
+	key, err := LoadSigningKey(*keyPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load signing key")
+	}
+	err = SignRun(fs.Arg(0), key)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to sign run")
+	}
+	log.Info().Str("dir", fs.Arg(0)).Msg("run signed")
+}
+
+// runVerify implements the `verify` subcommand.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyPath := fs.String("key", "keys/signing.pem", "public key of the tester that signed the run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: verify [-key PUBLIC_KEY] RUN_DIR")
+		os.Exit(2)
+	}
+
+	key, err := LoadVerifyingKey(*keyPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load public key")
+	}
+	v, err := VerifyRun(fs.Arg(0), key)
+	if err != nil {
+		fmt.Println("INVALID:", err)
+		os.Exit(1)
+	}
+
+	for _, name := range v.Changed {
+		fmt.Println("changed: ", name)
+	}
+	for _, name := range v.Missing {
+		fmt.Println("missing: ", name)
+	}
+	for _, name := range v.Unsigned {
+		fmt.Println("unsigned:", name)
+	}
+	if !v.Valid() {
+		fmt.Println("INVALID: signed files were changed or removed")
+		os.Exit(1)
+	}
+	fmt.Printf("valid: signed %s\n", v.SignedAt.Format(time.RFC3339))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// Simulation runs the routines on a FakeClock against a MockRTC, jumping the
+// clock from one scheduled tick to the next once the routines have handled the
+// previous one. A day of scenario runs in minutes, which is enough to check
+// scenario logic, phase changes and reports before booking the test rig.
+type Simulation struct {
+	Clock    *FakeClock
+	Client   *RTCClient
+	Duration time.Duration
+	Log      Logger
+	// Stop, when closed, ends the simulation early.
+	Stop <-chan struct{}
+}
+
+func CreateSimulation(fake *FakeClock, client *RTCClient, duration time.Duration) *Simulation {
+	return &Simulation{
+		Clock:    fake,
+		Client:   client,
+		Duration: duration,
+		Log:      ZerologLogger{},
+	}
+}
+
+func (s *Simulation) Run() {
+	start := s.Clock.Now()
+	end := start.Add(s.Duration)
+	began := time.Now()
+	reported := start
+
+	// profiled routines only schedule their next tick once they wait for it
+	s.settle()
+	for {
+		select {
+		case <-s.Stop:
+			s.Log.Info("simulation stopped early", "simulated", s.Clock.Now().Sub(start).String())
+			return
+		default:
+		}
+
+		now := s.Clock.Now()
+		next, ok := s.Clock.NextEvent()
+		if !ok || next.After(end) {
+			s.Clock.Advance(end.Sub(now))
+			break
+		}
+		s.Clock.Advance(next.Sub(now))
+		s.settle()
+
+		if next.Sub(reported) >= time.Hour {
+			reported = next
+			s.Log.Info("simulation progress", "simulated", next.Sub(start).String(), "elapsed", time.Since(began).String())
+		}
+	}
+
+	s.Log.Info("simulation finished", "simulated", s.Duration.String(), "elapsed", time.Since(began).String())
+}
+
+// settle waits until every fired tick has been picked up and no command is in
+// flight, several checks in a row to cover the gap between a routine receiving
+// its tick and sending its command. Handing a tick over only needs a yield, but
+// waiting on the network has to block so the runtime polls the connections.
+func (s *Simulation) settle() {
+	quiet := 0
+	for quiet < 3 {
+		if s.Client.InFlight() > 0 {
+			time.Sleep(50 * time.Microsecond)
+		} else {
+			runtime.Gosched()
+		}
+
+		if s.Clock.Pending() == 0 && s.Client.InFlight() == 0 {
+			quiet++
+		} else {
+			quiet = 0
+		}
+	}
+}
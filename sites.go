@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// peakSpan is how far ahead the load profiles of a run are looked at for the
+// highest rate they reach, a day covering diurnal runs.
+const peakSpan = 24 * time.Hour
+
+// SiteCaps is the most load a site's controller is known to take safely.
+// Rates are operations per second as the routines send them, a move being one
+// operation although it reads the queue first. Caps left at 0 don't apply.
+type SiteCaps struct {
+	// MaxOpsPerSecond caps the operations of every routine together.
+	MaxOpsPerSecond float64 `json:"maxOpsPerSecond"`
+	// MaxRates caps the operations of a kind, such as queue or get, summed
+	// over the routines sending it, e.g. a scenario instance's and a stream's
+	// queue routines.
+	MaxRates map[string]float64 `json:"maxRates"`
+	// MaxQueueDepth caps the washes the run leaves queued, which only
+	// --retain with a --retain-max bounds.
+	MaxQueueDepth int `json:"maxQueueDepth"`
+	// MaxWorkers caps the closed-model workers, which send as fast as the
+	// rTC replies. Sites with a rate cap take none unless it allows them.
+	MaxWorkers int `json:"maxWorkers"`
+	// Note says why the site is capped, e.g. "single tunnel on the 2019
+	// controller".
+	Note string `json:"note"`
+}
+
+// SiteConfig is the caps of every site, by site id, read from --site-config, e.g.
+// {"sites": {"S-104": {"maxOpsPerSecond": 2, "maxRates": {"queue": 0.5}, "maxQueueDepth": 40}}}
+type SiteConfig struct {
+	Sites map[string]SiteCaps `json:"sites"`
+}
+
+func LoadSiteConfig(path string) (*SiteConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read site config %s", path)
+	}
+	var config SiteConfig
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse site config %s", path)
+	}
+	for site, caps := range config.Sites {
+		if caps.MaxOpsPerSecond < 0 || caps.MaxQueueDepth < 0 || caps.MaxWorkers < 0 {
+			return nil, errors.Errorf("caps of site %s in %s can't be negative", site, path)
+		}
+		for op, rate := range caps.MaxRates {
+			if rate < 0 {
+				return nil, errors.Errorf("max %s rate of site %s in %s can't be negative", op, site, path)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// PlannedLoad is the most load a run is configured to send: the peak
+// operations per second of every kind and in total, the most washes it leaves
+// queued and its workers. QueueDepth is 0 when nothing bounds the washes left
+// queued, and Unbounded names what sends at a rate nothing bounds.
+type PlannedLoad struct {
+	Rates      map[string]float64 `json:"rates"`
+	Total      float64            `json:"total"`
+	QueueDepth int                `json:"queueDepth"`
+	Workers    int                `json:"workers"`
+	Unbounded  []string           `json:"unbounded,omitempty"`
+}
+
+// PlannedLoad is the load the routines are configured to send at their peak.
+func (r *Routines) PlannedLoad() PlannedLoad {
+	load := PlannedLoad{Rates: map[string]float64{}}
+	add := func(op string, ticker *TickerHolder, burst int) {
+		if burst < 1 {
+			burst = 1
+		}
+		if peak := ticker.Peak(peakSpan); peak > 0 {
+			load.Rates[op] += float64(burst) / peak.Seconds()
+		}
+	}
+
+	switch {
+	case r.Mix != nil:
+		// the mix's workers replace the timed routines
+		load.Workers += r.Mix.Size()
+	case r.Replay != nil:
+		if r.Replay.MaxRate > 0 {
+			load.Rates["replay"] = r.Replay.MaxRate
+		} else {
+			load.Unbounded = append(load.Unbounded, "replay without --replay-max-rate")
+		}
+	default:
+		for _, routine := range r.Timed.All() {
+			t := routine.Ticked()
+			add(t.name, t.Ticker, t.Burst)
+		}
+	}
+	for _, seq := range r.Sequences {
+		add("sequence", seq.Ticker, 1)
+	}
+	for _, script := range r.Scripts {
+		add("script", script.Ticker, 1)
+	}
+	for _, command := range r.Commands {
+		add("command", command.Ticker, 1)
+	}
+	for _, pool := range r.Workers {
+		load.Workers += pool.Size()
+	}
+	for _, rate := range load.Rates {
+		load.Total += rate
+	}
+	if r.QueueRoutine.Retain != nil {
+		load.QueueDepth = r.QueueRoutine.Retain.Max
+	}
+	return load
+}
+
+// Violations are the ways load goes over the caps, none when it doesn't.
+func (c SiteCaps) Violations(load PlannedLoad) []string {
+	var violations []string
+	if c.MaxOpsPerSecond > 0 && load.Total > c.MaxOpsPerSecond {
+		violations = append(violations, fmt.Sprintf("%.2f operations per second in total, the site's max is %.2f", load.Total, c.MaxOpsPerSecond))
+	}
+	ops := make([]string, 0, len(c.MaxRates))
+	for op := range c.MaxRates {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		if max := c.MaxRates[op]; max > 0 && load.Rates[op] > max {
+			violations = append(violations, fmt.Sprintf("%.2f %s operations per second, the site's max is %.2f", load.Rates[op], op, max))
+		}
+	}
+	capped := c.MaxOpsPerSecond > 0 || len(c.MaxRates) > 0
+	if capped {
+		for _, what := range load.Unbounded {
+			violations = append(violations, what+" sends at a rate nothing bounds, the site's is capped")
+		}
+		if load.Workers > c.MaxWorkers {
+			violations = append(violations, fmt.Sprintf("%d workers sending as fast as the rTC replies, the site's max is %d", load.Workers, c.MaxWorkers))
+		}
+	} else if c.MaxWorkers > 0 && load.Workers > c.MaxWorkers {
+		violations = append(violations, fmt.Sprintf("%d workers, the site's max is %d", load.Workers, c.MaxWorkers))
+	}
+	if c.MaxQueueDepth > 0 {
+		switch {
+		case load.QueueDepth == 0:
+			violations = append(violations, fmt.Sprintf("nothing bounds the washes left queued, the site's max is %d; use --retain with --retain-max", c.MaxQueueDepth))
+		case load.QueueDepth > c.MaxQueueDepth:
+			violations = append(violations, fmt.Sprintf("up to %d washes left queued, the site's max is %d", load.QueueDepth, c.MaxQueueDepth))
+		}
+	}
+	return violations
+}
+
+// SiteCheck is how a run's load compared to its site's caps, recorded in the
+// manifest.
+type SiteCheck struct {
+	Site       string      `json:"site"`
+	Caps       *SiteCaps   `json:"caps,omitempty"`
+	Planned    PlannedLoad `json:"planned"`
+	Violations []string    `json:"violations,omitempty"`
+	// Overridden is set when the run went ahead over the caps.
+	Overridden bool `json:"overridden"`
+}
+
+// CheckSite compares the planned load to the caps of site. Without caps for
+// the site the check passes with Caps nil. Over the caps it fails unless
+// override, with which the run goes ahead all the same.
+func (r *Routines) CheckSite(config *SiteConfig, site string, override bool) (*SiteCheck, error) {
+	check := &SiteCheck{Site: site, Planned: r.PlannedLoad()}
+	caps, ok := config.Sites[site]
+	if !ok {
+		return check, nil
+	}
+	check.Caps = &caps
+	check.Violations = caps.Violations(check.Planned)
+	if len(check.Violations) == 0 {
+		return check, nil
+	}
+	if override {
+		check.Overridden = true
+		return check, nil
+	}
+	return check, errors.Errorf("load is over the caps of site %s: %s", site, strings.Join(check.Violations, "; "))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// SLALevels are the amber and red limits of a command on the dashboard. A
+// command turns amber once its latency at Percentile or its error rate over
+// the window reaches the amber limit, and red at the red one. Unset limits
+// aren't checked.
+type SLALevels struct {
+	Percentile     float64  `json:"percentile,omitempty"`
+	AmberMs        *float64 `json:"amberMs,omitempty"`
+	RedMs          *float64 `json:"redMs,omitempty"`
+	AmberErrorRate *float64 `json:"amberErrorRate,omitempty"`
+	RedErrorRate   *float64 `json:"redErrorRate,omitempty"`
+}
+
+// merge returns l with the limits it doesn't set taken from defaults.
+func (l SLALevels) merge(defaults SLALevels) SLALevels {
+	if l.Percentile == 0 {
+		l.Percentile = defaults.Percentile
+	}
+	if l.Percentile == 0 {
+		l.Percentile = 95
+	}
+	if l.AmberMs == nil {
+		l.AmberMs = defaults.AmberMs
+	}
+	if l.RedMs == nil {
+		l.RedMs = defaults.RedMs
+	}
+	if l.AmberErrorRate == nil {
+		l.AmberErrorRate = defaults.AmberErrorRate
+	}
+	if l.RedErrorRate == nil {
+		l.RedErrorRate = defaults.RedErrorRate
+	}
+	return l
+}
+
+// SLAConfig is the "sla" section of a scenario. Like an SLO, Commands override
+// the default levels limit by limit. Window is how far back the dashboard
+// looks, a minute unless set.
+type SLAConfig struct {
+	Window   string               `json:"window"`
+	Default  SLALevels            `json:"default"`
+	Commands map[string]SLALevels `json:"commands"`
+
+	window time.Duration
+}
+
+func (c *SLAConfig) Validate() error {
+	c.window = time.Minute
+	if c.Window != "" {
+		d, err := time.ParseDuration(c.Window)
+		if err != nil || d <= 0 {
+			return errors.Errorf("sla window must be a positive duration, got %q", c.Window)
+		}
+		c.window = d
+	}
+	for name, levels := range c.Commands {
+		levels = levels.merge(c.Default)
+		if levels.Percentile <= 0 || levels.Percentile > 100 {
+			return errors.Errorf("sla percentile of %s must be between 0 and 100, got %g", name, levels.Percentile)
+		}
+		if levels.AmberMs != nil && levels.RedMs != nil && *levels.RedMs < *levels.AmberMs {
+			return errors.Errorf("sla red latency of %s is below its amber one", name)
+		}
+		if levels.AmberErrorRate != nil && levels.RedErrorRate != nil && *levels.RedErrorRate < *levels.AmberErrorRate {
+			return errors.Errorf("sla red error rate of %s is below its amber one", name)
+		}
+	}
+	return nil
+}
+
+func (c *SLAConfig) Levels(command string) SLALevels {
+	return c.Commands[command].merge(c.Default)
+}
+
+const (
+	SLAGreen   = "green"
+	SLAAmber   = "amber"
+	SLARed     = "red"
+	SLAUnknown = "unknown"
+)
+
+// SLAState is how a command is doing against its levels over the window.
+type SLAState struct {
+	Command       string    `json:"command"`
+	State         string    `json:"state"`
+	Reason        string    `json:"reason,omitempty"`
+	Samples       int       `json:"samples"`
+	Percentile    float64   `json:"percentile"`
+	LatencyMs     float64   `json:"latencyMs"`
+	ErrorRate     float64   `json:"errorRate"`
+	Levels        SLALevels `json:"levels"`
+	WindowSeconds float64   `json:"windowSeconds"`
+}
+
+type slaSample struct {
+	at        time.Time
+	latencyMs float64
+	failed    bool
+}
+
+// SLAMonitor keeps the results of the last window of every command so the
+// dashboard can show whether the controller is keeping up while a test runs.
+type SLAMonitor struct {
+	Config *SLAConfig
+
+	mu      sync.Mutex
+	samples map[string][]slaSample
+}
+
+func CreateSLAMonitor(config *SLAConfig) *SLAMonitor {
+	return &SLAMonitor{Config: config, samples: map[string][]slaSample{}}
+}
+
+// Observe takes a results record as it is written.
+func (m *SLAMonitor) Observe(record []string) {
+	if len(record) < len(csvHeader) {
+		return
+	}
+	sample := slaSample{at: clock.Now(), failed: record[5] == "true"}
+	if !sample.failed {
+		ms, ok := recordLatency(record)
+		if !ok {
+			return
+		}
+		sample.latencyMs = ms
+	}
+	name := commandName(record[0])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[name] = append(m.prune(name, sample.at), sample)
+}
+
+// prune drops the samples of a command that fell out of the window.
+func (m *SLAMonitor) prune(name string, now time.Time) []slaSample {
+	samples := m.samples[name]
+	cutoff := now.Add(-m.Config.window)
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(cutoff) })
+	return append(samples[:0], samples[i:]...)
+}
+
+// States evaluates every command with results or levels, sorted by name.
+func (m *SLAMonitor) States() []SLAState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := clock.Now()
+	names := map[string]bool{}
+	for name := range m.samples {
+		names[name] = true
+	}
+	for name := range m.Config.Commands {
+		names[name] = true
+	}
+
+	states := make([]SLAState, 0, len(names))
+	for name := range names {
+		m.samples[name] = m.prune(name, now)
+		states = append(states, m.evaluate(name, m.samples[name]))
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Command < states[j].Command })
+	return states
+}
+
+func (m *SLAMonitor) evaluate(name string, samples []slaSample) SLAState {
+	levels := m.Config.Levels(name)
+	state := SLAState{
+		Command:       name,
+		State:         SLAUnknown,
+		Samples:       len(samples),
+		Percentile:    levels.Percentile,
+		Levels:        levels,
+		WindowSeconds: m.Config.window.Seconds(),
+	}
+	if len(samples) == 0 {
+		state.Reason = "no results in the window"
+		return state
+	}
+
+	var latencies []float64
+	failed := 0
+	for _, s := range samples {
+		if s.failed {
+			failed++
+			continue
+		}
+		latencies = append(latencies, s.latencyMs)
+	}
+	sort.Float64s(latencies)
+	state.LatencyMs = percentile(latencies, levels.Percentile)
+	state.ErrorRate = float64(failed) / float64(len(samples))
+
+	state.State = SLAGreen
+	severity := map[string]int{SLAGreen: 0, SLAAmber: 1, SLARed: 2}
+	raise := func(to, reason string) {
+		if severity[to] > severity[state.State] {
+			state.State = to
+			state.Reason = reason
+		}
+	}
+	if len(latencies) > 0 {
+		if levels.AmberMs != nil && state.LatencyMs >= *levels.AmberMs {
+			raise(SLAAmber, "latency")
+		}
+		if levels.RedMs != nil && state.LatencyMs >= *levels.RedMs {
+			raise(SLARed, "latency")
+		}
+	}
+	if levels.AmberErrorRate != nil && state.ErrorRate >= *levels.AmberErrorRate {
+		raise(SLAAmber, "errors")
+	}
+	if levels.RedErrorRate != nil && state.ErrorRate >= *levels.RedErrorRate {
+		raise(SLARed, "errors")
+	}
+	return state
+}
+
+// SLAEndpoint is GET /api/v1/sla.
+func (m *SLAMonitor) SLAEndpoint(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"at": clock.Now(), "commands": m.States()})
+}
+
+var dashboardPage = assetTemplate("dashboard.html")
+
+// Dashboard is GET /dashboard, a page showing every command green, amber or
+// red for people watching a test who don't read latency tables.
+func (m *SLAMonitor) Dashboard(c *gin.Context) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err := dashboardPage.Execute(c.Writer, map[string]interface{}{"Window": m.Config.window.String()})
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+	}
+}
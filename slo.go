@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// SLOThresholds are the limits a command has to stay within. Unset limits
+// aren't checked.
+type SLOThresholds struct {
+	P50Ms        *float64 `json:"p50Ms,omitempty"`
+	P95Ms        *float64 `json:"p95Ms,omitempty"`
+	P99Ms        *float64 `json:"p99Ms,omitempty"`
+	MaxErrorRate *float64 `json:"maxErrorRate,omitempty"`
+}
+
+// merge returns t with the limits it doesn't set taken from defaults.
+func (t SLOThresholds) merge(defaults SLOThresholds) SLOThresholds {
+	if t.P50Ms == nil {
+		t.P50Ms = defaults.P50Ms
+	}
+	if t.P95Ms == nil {
+		t.P95Ms = defaults.P95Ms
+	}
+	if t.P99Ms == nil {
+		t.P99Ms = defaults.P99Ms
+	}
+	if t.MaxErrorRate == nil {
+		t.MaxErrorRate = defaults.MaxErrorRate
+	}
+	return t
+}
+
+// SLO holds the thresholds of a run. Commands, keyed by command name such as
+// GET or DELETE, override the default thresholds limit by limit, since e.g.
+// reading the queue is normally slower than deleting a wash.
+type SLO struct {
+	Default  SLOThresholds            `json:"default"`
+	Commands map[string]SLOThresholds `json:"commands"`
+}
+
+func LoadSLO(path string) (*SLO, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read slo file %s", path)
+	}
+
+	var slo SLO
+	err = json.Unmarshal(b, &slo)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse slo file %s", path)
+	}
+	return &slo, nil
+}
+
+// Write copies the SLO into a run directory so reports can evaluate it later.
+func (s *SLO) Write(dir string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to encode slo")
+	}
+	err = os.WriteFile(filepath.Join(dir, "slo.json"), b, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to write slo")
+	}
+	return nil
+}
+
+// Thresholds are the limits that apply to a command.
+func (s *SLO) Thresholds(command string) SLOThresholds {
+	return s.Commands[command].merge(s.Default)
+}
+
+// SLOResult is one checked limit of one command.
+type SLOResult struct {
+	Command string
+	Check   string
+	Limit   float64
+	Actual  float64
+	// NotRun is set when the run never sent the command.
+	NotRun bool
+}
+
+func (r SLOResult) Pass() bool {
+	return !r.NotRun && r.Actual <= r.Limit
+}
+
+// Evaluate checks every command of a run against its thresholds, in command
+// order. Commands the SLO names that the run never sent fail their checks.
+func (s *SLO) Evaluate(summary *RunSummary) []SLOResult {
+	names := summary.CommandNames()
+	for name := range s.Commands {
+		if _, ok := summary.Commands[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var results []SLOResult
+	for _, name := range names {
+		t := s.Thresholds(name)
+		command, ran := summary.Commands[name]
+		check := func(label string, limit *float64, actual func() float64) {
+			if limit == nil {
+				return
+			}
+			result := SLOResult{Command: name, Check: label, Limit: *limit, NotRun: !ran}
+			if ran {
+				result.Actual = actual()
+			}
+			results = append(results, result)
+		}
+		check("p50 ms", t.P50Ms, func() float64 { return command.Percentile(50) })
+		check("p95 ms", t.P95Ms, func() float64 { return command.Percentile(95) })
+		check("p99 ms", t.P99Ms, func() float64 { return command.Percentile(99) })
+		check("error rate", t.MaxErrorRate, command.ErrorRate)
+	}
+	return results
+}
+
+// sloPassed is whether every result passed.
+func sloPassed(results []SLOResult) bool {
+	for _, r := range results {
+		if !r.Pass() {
+			return false
+		}
+	}
+	return true
+}
+
+func printSLOResults(out io.Writer, results []SLOResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tCHECK\tLIMIT\tACTUAL\tRESULT")
+	for _, r := range results {
+		actual, verdict := fmt.Sprintf("%.4g", r.Actual), "pass"
+		if r.NotRun {
+			actual = "not run"
+		}
+		if !r.Pass() {
+			verdict = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.4g\t%s\t%s\n", r.Command, r.Check, r.Limit, actual, verdict)
+	}
+	w.Flush()
+}
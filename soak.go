@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// RunDeadline ends a soak run after a fixed wall-clock time: the routines are
+// stopped, the results flushed, the test washes deleted from the rTC and a
+// summary printed before the tester exits.
+type RunDeadline struct {
+	Routines *Routines
+	Manifest *Manifest
+	Dir      string
+	Writers  map[string]*ResultWriter
+	// SLO, when set, is evaluated on the finished run.
+	SLO *SLO
+	// Reporter, when set, is sent the run's last results once it finished.
+	Reporter *AgentReporter
+	// Rebaseline, when set, repeats the warm-up before the routines stop.
+	Rebaseline *Rebaseline
+	// Leak, when set, gives the verdict of a leak hunt with its thresholds.
+	Leak *LeakThresholds
+
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func CreateRunDeadline(routines *Routines, manifest *Manifest, dir string, writers map[string]*ResultWriter) *RunDeadline {
+	return &RunDeadline{Routines: routines, Manifest: manifest, Dir: dir, Writers: writers}
+}
+
+// Set ends the run duration from now, replacing any earlier deadline.
+func (d *RunDeadline) Set(duration time.Duration) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.deadline = time.Now().Add(duration)
+	d.timer = time.AfterFunc(duration, func() {
+		d.End(fmt.Sprintf("run duration of %s elapsed", duration))
+	})
+	log.Info().Dur("duration", duration).Time("deadline", d.deadline).Msg("run will stop at deadline")
+	return d.deadline
+}
+
+// End finishes the run and exits, with status 1 when it failed its SLO.
+func (d *RunDeadline) End(reason string) {
+	if !d.Finish(reason) {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Finish stops the routines, deletes the washes they queued and writes the
+// shutdown report and summary. It returns false when the run failed its SLO.
+func (d *RunDeadline) Finish(reason string) bool {
+	r := d.Routines
+	d.Rebaseline.Run()
+	if r.stopRoutines() {
+		r.drain()
+	}
+	r.Log.Info("routines stopped", "reason", reason)
+	d.Reporter.Flush()
+	// the deletes of the washes left aren't part of the run's commands
+	r.RTC.CommandLimit.Lift()
+
+	washes, err := r.cleanupCandidates()
+	if err != nil {
+		r.Log.Error("unable to delete test washes at end of run", "error", err)
+	} else {
+		deleted := r.deleteWashes(washes)
+		r.Log.Info("deleted test washes at end of run", "deleted", deleted, "candidates", len(washes))
+	}
+
+	r.writeShutdown(d.Manifest, d.Dir, reason, d.Writers)
+
+	summary, err := SummariseRun(d.Dir)
+	if err != nil {
+		log.Error().Err(err).Str("dir", d.Dir).Msg("unable to summarise run")
+		return d.SLO == nil
+	}
+	printRunSummary(os.Stdout, summary)
+	if d.Rebaseline != nil {
+		comparisons, err := CompareBaselines(d.Dir, d.Rebaseline.Threshold)
+		if err != nil {
+			log.Error().Err(err).Str("dir", d.Dir).Msg("unable to compare re-baseline to warm-up")
+		} else if len(comparisons) > 0 {
+			fmt.Println()
+			printBaselineComparisons(os.Stdout, comparisons)
+			if degraded := degradedCommands(comparisons); len(degraded) > 0 {
+				log.Warn().Strs("commands", degraded).Float64("threshold", d.Rebaseline.Threshold).Msg("re-baseline slower than warm-up, the controller may have degraded under stress, e.g. leaking memory or fragmenting")
+			}
+		}
+	}
+	if d.Leak != nil {
+		verdict, err := AnalyseLeaks(d.Dir, *d.Leak)
+		if err != nil {
+			log.Error().Err(err).Str("dir", d.Dir).Msg("unable to fit leak hunt trends")
+		} else {
+			fmt.Println()
+			printLeakVerdict(os.Stdout, verdict)
+			if verdict.Suspected() {
+				log.Warn().Strs("reasons", verdict.Reasons).Msg("latency or failures trended up over the leak hunt, the controller may be leaking")
+			}
+		}
+	}
+	if d.SLO == nil {
+		return true
+	}
+
+	results := d.SLO.Evaluate(summary)
+	fmt.Println()
+	printSLOResults(os.Stdout, results)
+	return sloPassed(results)
+}
+
+// Deadline is when the run ends, zero when it has no deadline or d is nil.
+func (d *RunDeadline) Deadline() time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deadline
+}
+
+// SetDuration is the /run/:duration endpoint, e.g. /run/8h.
+func (d *RunDeadline) SetDuration(c *gin.Context) {
+	duration, err := time.ParseDuration(c.Param("duration"))
+	if err != nil || duration <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be positive, e.g. 30m or 8h"})
+		return
+	}
+	deadline := d.Set(duration)
+	c.JSON(http.StatusOK, gin.H{"deadline": deadline})
+}
+
+func printRunSummary(out io.Writer, summary *RunSummary) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tN\tERRORS\tRATE/S\tP50 MS\tP95 MS\tP99 MS")
+	for _, name := range summary.CommandNames() {
+		s := summary.Commands[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%.1f\t%.1f\t%.1f\n",
+			name, s.Count, s.Errors, s.Rate(), s.Percentile(50), s.Percentile(95), s.Percentile(99))
+	}
+	w.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// mannWhitneyU tests whether values in a tend to be larger or smaller than those
+// in b without assuming either is normally distributed, which latencies never
+// are. It returns the U statistic of a and the two sided p-value from the normal
+// approximation with tie correction, fine for the sample sizes of a load test.
+func mannWhitneyU(a, b []float64) (u float64, p float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 0, 1
+	}
+
+	type ranked struct {
+		value float64
+		fromA bool
+	}
+	all := make([]ranked, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, ranked{v, true})
+	}
+	for _, v := range b {
+		all = append(all, ranked{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	// tied values share the average of the ranks they span
+	var rankSumA, tieTerm float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].value == all[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		tieTerm += t*t*t - t
+		i = j
+	}
+
+	n := n1 + n2
+	u = rankSumA - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	if variance <= 0 {
+		return u, 1
+	}
+
+	// continuity correction
+	diff := math.Abs(u-mean) - 0.5
+	if diff < 0 {
+		diff = 0
+	}
+	z := diff / math.Sqrt(variance)
+	return u, math.Erfc(z / math.Sqrt2)
+}
+
+// bootstrapPercentileDiff estimates a 95% confidence interval of
+// percentile(b, pct) - percentile(a, pct) by resampling both with replacement.
+func bootstrapPercentileDiff(a, b []float64, pct float64, iterations int, rng *rand.Rand) (low, high float64) {
+	if len(a) == 0 || len(b) == 0 || iterations <= 0 {
+		return 0, 0
+	}
+
+	diffs := make([]float64, iterations)
+	sampleA := make([]float64, len(a))
+	sampleB := make([]float64, len(b))
+	for i := range diffs {
+		for j := range sampleA {
+			sampleA[j] = a[rng.Intn(len(a))]
+		}
+		for j := range sampleB {
+			sampleB[j] = b[rng.Intn(len(b))]
+		}
+		sort.Float64s(sampleA)
+		sort.Float64s(sampleB)
+		diffs[i] = percentile(sampleB, pct) - percentile(sampleA, pct)
+	}
+	sort.Float64s(diffs)
+	return percentile(diffs, 2.5), percentile(diffs, 97.5)
+}
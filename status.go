@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (r *Routines) Status(c *gin.Context) {
+	status := gin.H{
+		"state":             r.lifecycle.State(),
+		"paused":            r.RTC.Gate.Reasons(),
+		"writer":            r.Writer.Stats(),
+		"zombieConnections": r.RTC.Zombies(),
+		"throughput":        r.RTC.Throughput.Snapshot(),
+		"workers":           r.WorkerCounts(),
+		"routines":          r.RoutineStates(),
+		"timed":             r.TimedStats(),
+	}
+	if progress, ok := r.Progress(); ok {
+		status["progress"] = progress
+	}
+	if r.Resources != nil {
+		if sample, ok := r.Resources.Latest(); ok {
+			status["resources"] = sample
+		}
+	}
+	if r.RTC.Verify != nil {
+		status["verification"] = r.RTC.Verify.Counts()
+	}
+	if r.RTC.MaxInFlight != nil {
+		status["maxInFlight"] = r.RTC.MaxInFlight.Stats()
+	}
+	if r.RTC.Retry != nil {
+		status["retries"] = r.RTC.Retry.Stats()
+	}
+	if r.RTC.Disconnects != nil {
+		status["disconnects"] = r.RTC.Disconnects.Counts()
+	}
+	if r.RTC.Pool != nil {
+		status["connections"] = r.RTC.Pool.Stats()
+	}
+	if r.RTC.WashIDs != nil {
+		status["washIdAnomalies"] = r.RTC.WashIDs.Anomalies()
+	}
+	if r.QueueRoutine.Retain != nil {
+		status["retained"] = r.QueueRoutine.Retain.Stats()
+	}
+	if r.QueueRoutine.Open != nil {
+		status["openModel"] = gin.H{"inFlight": r.QueueRoutine.Open.InFlight(), "max": r.QueueRoutine.Open.Max, "dropped": r.QueueRoutine.Open.Dropped()}
+	}
+	if r.GetRoutine.States != nil {
+		states, at := r.GetRoutine.States.Latest()
+		status["queueStates"] = gin.H{"at": at, "counts": states}
+	}
+	if r.QueueRoutine.Schedule != nil {
+		ticks := gin.H{}
+		for _, routine := range r.Timed.All() {
+			stats := routine.Stats()
+			ticks[routine.Name()] = gin.H{"missed": stats.Missed, "delayed": stats.Delayed}
+		}
+		status["ticks"] = ticks
+	}
+	if r.RTC.Tunnels != nil {
+		status["tunnels"] = r.RTC.Tunnels.Stats()
+	}
+	if len(r.Streams) > 0 {
+		status["streams"] = r.StreamStats()
+	}
+	if r.TunnelStatus != nil {
+		if state, ok := r.TunnelStatus.State(); ok {
+			status["tunnelState"] = state
+		}
+	}
+	if r.TunnelChaos != nil {
+		status["tunnelChaos"] = r.TunnelChaos.ChaosStats()
+	}
+	if r.Events != nil {
+		status["events"] = r.Events.Stats()
+	}
+	if r.Derived != nil {
+		status["derived"] = gin.H{"metrics": r.Derived.Stats(), "errors": r.Derived.Errors()}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// Queue reads the rTC's queue and returns it as JSON, so verification scripts
+// and dashboards can check the controller's state through the tester instead
+// of speaking the XML protocol. The read is recorded like any other GET.
+func (r *Routines) Queue(c *gin.Context) {
+	queue, times, err := r.RTC.GetQueue()
+	writeErr := r.Writer.Write(times)
+	if writeErr != nil {
+		r.Log.Warn("error writing get queue record to CSV", "error", writeErr, "record", times)
+	}
+	if err != nil {
+		r.Log.Error("error getting queue for api", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch rtc queue: " + err.Error()})
+		return
+	}
+
+	cars := queue.Queue.QueueItems
+	if cars == nil {
+		cars = []WashQueueItem{}
+	}
+	c.JSON(http.StatusOK, gin.H{"at": clock.Now(), "count": len(cars), "cars": cars})
+}
+
+// Metrics serves the tester's counters in the Prometheus text format.
+func (r *Routines) Metrics(c *gin.Context) {
+	var b strings.Builder
+
+	writer := r.Writer.Stats()
+	writeMetric(&b, "rtc_load_csv_records_written_total", "counter", "CSV records written to the results file", nil, float64(writer.Written))
+	writeMetric(&b, "rtc_load_csv_write_failures_total", "counter", "CSV records that failed to be written", nil, float64(writer.Failed))
+	writeMetric(&b, "rtc_load_csv_consecutive_write_failures", "gauge", "CSV writes failed since the last successful one", nil, float64(writer.ConsecutiveFailure))
+	writeMetric(&b, "rtc_load_zombie_connections", "gauge", "connections to the rTC being closed in the background", nil, float64(r.RTC.Zombies()))
+
+	paused := 0.0
+	if r.RTC.Gate.Paused() {
+		paused = 1
+	}
+	writeMetric(&b, "rtc_load_paused", "gauge", "1 while load generation is paused", nil, paused)
+
+	if r.QueueRoutine.Open != nil {
+		writeMetric(&b, "rtc_load_open_model_in_flight", "gauge", "open model queue and move operations in flight", nil, float64(r.QueueRoutine.Open.InFlight()))
+		writeMetric(&b, "rtc_load_open_model_dropped_total", "counter", "open model operations dropped at the in-flight cap", nil, float64(r.QueueRoutine.Open.Dropped()))
+	}
+
+	if r.RTC.Disconnects != nil {
+		counts := r.RTC.Disconnects.Counts()
+		writeMetric(&b, "rtc_load_rtc_disconnects_total", "counter", "connections the rTC closed or reset before replying", map[string]string{"kind": DisconnectClosed}, float64(counts.Closed))
+		writeMetric(&b, "rtc_load_rtc_disconnects_total", "counter", "", map[string]string{"kind": DisconnectReset}, float64(counts.Reset))
+	}
+
+	if r.QueueRoutine.Retain != nil {
+		retained := r.QueueRoutine.Retain.Stats()
+		writeMetric(&b, "rtc_load_retained_washes", "gauge", "washes left queued by the queue routine and workers", nil, float64(retained.Outstanding))
+		for i, reason := range []string{"evicted", "expired"} {
+			help := "retained washes deleted, evicted to stay under the max or expired after the ttl"
+			if i > 0 {
+				help = ""
+			}
+			n := map[string]uint64{"evicted": retained.Evicted, "expired": retained.Expired}[reason]
+			writeMetric(&b, "rtc_load_retained_deleted_total", "counter", help, map[string]string{"reason": reason}, float64(n))
+		}
+	}
+	if r.RTC.Verify != nil {
+		counts := r.RTC.Verify.Counts()
+		help := "adds, moves, deletes and package changes verified with a follow-up queue read, by whether the queue showed their effect"
+		for _, op := range verifiedOps {
+			c, ok := counts[op]
+			if !ok {
+				continue
+			}
+			writeMetric(&b, "rtc_load_verifications_total", "counter", help, map[string]string{"op": op, "result": "ok"}, float64(c.Verified-c.Failed))
+			writeMetric(&b, "rtc_load_verifications_total", "counter", "", map[string]string{"op": op, "result": "failed"}, float64(c.Failed))
+			help = ""
+		}
+	}
+	if r.RTC.MaxInFlight != nil {
+		limit := r.RTC.MaxInFlight.Stats()
+		writeMetric(&b, "rtc_load_inflight_limit_waiting", "gauge", "commands waiting for an in-flight slot under --max-inflight", nil, float64(limit.Waiting))
+		writeMetric(&b, "rtc_load_inflight_limit_wait_seconds_total", "counter", "time commands waited for an in-flight slot", nil, limit.WaitMs/1000)
+	}
+	if r.RTC.Retry != nil {
+		retries := r.RTC.Retry.Stats()
+		writeMetric(&b, "rtc_load_retries_total", "counter", "commands sent again after failing transiently", nil, float64(retries.Retries))
+		writeMetric(&b, "rtc_load_retries_gave_up_total", "counter", "commands that failed on their last attempt", nil, float64(retries.GaveUp))
+		writeMetric(&b, "rtc_load_retries_budget_denied_total", "counter", "retries the retry budget didn't allow", nil, float64(retries.BudgetDenied))
+	}
+	if r.RTC.Tunnels != nil {
+		tunnels := r.RTC.Tunnels.Stats()
+		names := make([]string, 0, len(tunnels))
+		for tunnel := range tunnels {
+			names = append(names, tunnel)
+		}
+		sort.Strings(names)
+		help := "commands sent to each of the rTC's tunnels by whether they failed"
+		for _, tunnel := range names {
+			c := tunnels[tunnel]
+			writeMetric(&b, "rtc_load_tunnel_commands_total", "counter", help, map[string]string{"tunnel": tunnel, "result": "ok"}, float64(c.Commands-c.Errors))
+			writeMetric(&b, "rtc_load_tunnel_commands_total", "counter", "", map[string]string{"tunnel": tunnel, "result": "error"}, float64(c.Errors))
+			help = ""
+		}
+	}
+
+	if len(r.Streams) > 0 {
+		help := "washes queued by each pay station stream by whether they failed"
+		for _, q := range r.Streams {
+			c := q.Stream.Snapshot()
+			writeMetric(&b, "rtc_load_stream_queued_total", "counter", help, map[string]string{"stream": q.Instance(), "result": "ok"}, float64(c.Queued-c.Errors))
+			writeMetric(&b, "rtc_load_stream_queued_total", "counter", "", map[string]string{"stream": q.Instance(), "result": "error"}, float64(c.Errors))
+			help = ""
+		}
+	}
+
+	if r.TunnelStatus != nil {
+		if state, ok := r.TunnelStatus.State(); ok {
+			help := "1 for the state the tunnel was last read in, running, stopped or fault"
+			for _, name := range []string{TunnelRunning, TunnelStopped, TunnelFault} {
+				current := 0.0
+				if state.State == name {
+					current = 1
+				}
+				writeMetric(&b, "rtc_load_tunnel_state", "gauge", help, map[string]string{"state": name}, current)
+				help = ""
+			}
+		}
+	}
+
+	if r.Events != nil {
+		events := r.Events.Stats()
+		connected := 0.0
+		if events.Connected {
+			connected = 1
+		}
+		writeMetric(&b, "rtc_load_events_connected", "gauge", "1 while the event listener is subscribed to the rTC's events", nil, connected)
+		writeMetric(&b, "rtc_load_events_reconnects_total", "counter", "times the event listener subscribed again after losing its connection", nil, float64(events.Reconnects))
+		names := make([]string, 0, len(events.Counts))
+		for name := range events.Counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		help := "events the rTC pushed by type, such as washStarted"
+		for _, name := range names {
+			writeMetric(&b, "rtc_load_events_total", "counter", help, map[string]string{"event": name}, float64(events.Counts[name]))
+			help = ""
+		}
+	}
+
+	sent, received := r.RTC.NetworkBytes()
+	writeMetric(&b, "rtc_load_network_sent_bytes_total", "counter", "bytes written to the rTC", nil, float64(sent))
+	writeMetric(&b, "rtc_load_network_received_bytes_total", "counter", "bytes read from the rTC", nil, float64(received))
+	if r.RTC.WashIDs != nil {
+		anomalies := r.RTC.WashIDs.Anomalies()
+		for i, kind := range []string{WashIDNonMonotonic, WashIDWraparound, WashIDJump, WashIDDuplicate, WashIDReuse} {
+			help := "unexpected wash ids issued by the rTC by kind"
+			if i > 0 {
+				help = ""
+			}
+			writeMetric(&b, "rtc_load_wash_id_anomalies_total", "counter", help, map[string]string{"kind": kind}, float64(anomalies[kind]))
+		}
+	}
+	if r.GetRoutine.States != nil {
+		counts, _ := r.GetRoutine.States.Latest()
+		states := make([]string, 0, len(counts))
+		for state := range counts {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		for i, state := range states {
+			help := "cars in the last queue read by state"
+			if i > 0 {
+				help = ""
+			}
+			writeMetric(&b, "rtc_load_queue_cars", "gauge", help, map[string]string{"state": state}, float64(counts[state]))
+		}
+	}
+	if r.Resources != nil {
+		if sample, ok := r.Resources.Latest(); ok {
+			writeMetric(&b, "rtc_load_process_cpu_percent", "gauge", "cpu used by the tester over the last sample interval", nil, sample.CPUPercent)
+			writeMetric(&b, "rtc_load_process_resident_memory_bytes", "gauge", "resident memory of the tester", nil, float64(sample.RSSBytes))
+			writeMetric(&b, "rtc_load_process_open_fds", "gauge", "file descriptors open in the tester", nil, float64(sample.OpenFDs))
+			writeMetric(&b, "rtc_load_goroutines", "gauge", "goroutines running in the tester", nil, float64(sample.Goroutines))
+		}
+	}
+
+	workers := r.WorkerCounts()
+	pools := make([]string, 0, len(workers))
+	for pool := range workers {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	help := "operations sent by each timed routine"
+	for _, routine := range r.Timed.All() {
+		writeMetric(&b, "rtc_load_routine_ops_total", "counter", help, map[string]string{"routine": routine.Name()}, float64(routine.Stats().Ops))
+		help = ""
+	}
+	for i, pool := range pools {
+		help := "closed-model virtual users by pool"
+		if i > 0 {
+			help = ""
+		}
+		writeMetric(&b, "rtc_load_workers", "gauge", help, map[string]string{"pool": pool}, float64(workers[pool]))
+	}
+
+	throughput := r.RTC.Throughput.Snapshot()
+	commands := make([]string, 0, len(throughput))
+	for command := range throughput {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for i, command := range commands {
+		labels := map[string]string{"command": command}
+		help := "rTC operations completed"
+		if i > 0 {
+			help = ""
+		}
+		writeMetric(&b, "rtc_load_operations_total", "counter", help, labels, float64(throughput[command].Operations))
+	}
+
+	if r.Derived != nil {
+		for i, stats := range r.Derived.Stats() {
+			help := "derived metrics of --metrics by command, over the most recent values"
+			if i > 0 {
+				help = ""
+			}
+			for j, q := range []struct {
+				quantile string
+				value    float64
+			}{{"0.5", stats.P50}, {"0.95", stats.P95}, {"0.99", stats.P99}} {
+				if j > 0 {
+					help = ""
+				}
+				writeMetric(&b, "rtc_load_derived", "summary", help, map[string]string{"metric": stats.Metric, "command": stats.Command, "quantile": q.quantile}, q.value)
+			}
+			labels := map[string]string{"metric": stats.Metric, "command": stats.Command}
+			writeMetric(&b, "rtc_load_derived_sum", "", "", labels, stats.Sum)
+			writeMetric(&b, "rtc_load_derived_count", "", "", labels, float64(stats.Count))
+		}
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
+
+// writeMetric appends one sample; HELP and TYPE are only written when help is set
+// so several labelled samples of one metric share a single header.
+func writeMetric(b *strings.Builder, name, kind, help string, labels map[string]string, value float64) {
+	if help != "" {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	if len(labels) == 0 {
+		fmt.Fprintf(b, "%s %g\n", name, value)
+		return
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	fmt.Fprintf(b, "%s{%s} %g\n", name, strings.Join(pairs, ","), value)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// StepPhase sets the intervals of the queue, get and move routines between
+// From and To into the run. A routine without an interval in the phase runs at
+// its configured interval.
+type StepPhase struct {
+	Label     string
+	From      time.Duration
+	To        time.Duration
+	Intervals map[string]time.Duration
+}
+
+// StepProfile runs phases such as "0-5m: queue every 2s; 5-10m: every 500ms"
+// one after the other. Each routine gets its own LoadProfile from Routine, and
+// results are labelled with the phase they were recorded in.
+type StepProfile struct {
+	Phases []StepPhase
+	Start  time.Time
+}
+
+type stepFile struct {
+	Phases []struct {
+		Label string `yaml:"label"`
+		From  string `yaml:"from"`
+		To    string `yaml:"to"`
+		Queue string `yaml:"queue"`
+		Get   string `yaml:"get"`
+		Move  string `yaml:"move"`
+	} `yaml:"phases"`
+}
+
+var stepColumns = []string{"label", "from", "to", "queue", "get", "move"}
+
+// LoadStepProfile reads a step profile from a YAML file, or a CSV file with
+// the columns label, from, to, queue, get and move. Durations are Go durations
+// like 5m or 500ms and empty intervals leave the routine at its configured one.
+func LoadStepProfile(path string) (*StepProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open step profile %s", path)
+	}
+	defer f.Close()
+
+	var rows [][]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		rows, err = readStepYAML(f)
+	case ".csv":
+		rows, err = readStepCSV(f)
+	default:
+		return nil, errors.Errorf("step profile %s must be a .yaml, .yml or .csv file", path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read step profile %s", path)
+	}
+
+	profile := &StepProfile{Start: clock.Now()}
+	for i, row := range rows {
+		phase, err := parseStepPhase(row)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid phase %d in step profile %s", i+1, path)
+		}
+		profile.Phases = append(profile.Phases, phase)
+	}
+	if len(profile.Phases) == 0 {
+		return nil, errors.Errorf("step profile %s has no phases", path)
+	}
+
+	sort.SliceStable(profile.Phases, func(i, j int) bool { return profile.Phases[i].From < profile.Phases[j].From })
+	for i := 1; i < len(profile.Phases); i++ {
+		if profile.Phases[i].From < profile.Phases[i-1].To {
+			return nil, errors.Errorf("phases %q and %q of step profile %s overlap", profile.Phases[i-1].Label, profile.Phases[i].Label, path)
+		}
+	}
+	return profile, nil
+}
+
+// readStepYAML and readStepCSV return a row per phase in stepColumns order.
+func readStepYAML(r io.Reader) ([][]string, error) {
+	var file stepFile
+	err := yaml.NewDecoder(r).Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	for _, p := range file.Phases {
+		rows = append(rows, []string{p.Label, p.From, p.To, p.Queue, p.Get, p.Move})
+	}
+	return rows, nil
+}
+
+func readStepCSV(r io.Reader) ([][]string, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"from", "to"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.Errorf("missing %s column", name)
+		}
+	}
+
+	var rows [][]string
+	for _, record := range records[1:] {
+		row := make([]string, len(stepColumns))
+		for i, name := range stepColumns {
+			if c, ok := columns[name]; ok && c < len(record) {
+				row[i] = strings.TrimSpace(record[c])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseStepPhase(row []string) (StepPhase, error) {
+	phase := StepPhase{Label: row[0], Intervals: map[string]time.Duration{}}
+
+	var err error
+	phase.From, err = time.ParseDuration(row[1])
+	if err != nil {
+		return phase, errors.Wrap(err, "invalid from")
+	}
+	phase.To, err = time.ParseDuration(row[2])
+	if err != nil {
+		return phase, errors.Wrap(err, "invalid to")
+	}
+	if phase.From < 0 || phase.To <= phase.From {
+		return phase, errors.Errorf("phase must end after it starts, got %s to %s", phase.From, phase.To)
+	}
+	if phase.Label == "" {
+		phase.Label = phase.From.String() + "-" + phase.To.String()
+	}
+
+	for i, name := range stepColumns[3:] {
+		s := row[3+i]
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return phase, errors.Wrapf(err, "invalid %s interval", name)
+		}
+		if d <= 0 {
+			return phase, errors.Errorf("%s interval must be positive, got %s", name, d)
+		}
+		phase.Intervals[name] = d
+	}
+	return phase, nil
+}
+
+// phaseAt is the phase elapsed falls into, nil between and after phases.
+func (p *StepProfile) phaseAt(elapsed time.Duration) *StepPhase {
+	for i := range p.Phases {
+		if p.Phases[i].From <= elapsed && elapsed < p.Phases[i].To {
+			return &p.Phases[i]
+		}
+	}
+	return nil
+}
+
+// Label is the phase the run is in now, empty between and after phases.
+func (p *StepProfile) Label() string {
+	phase := p.phaseAt(clock.Now().Sub(p.Start))
+	if phase == nil {
+		return ""
+	}
+	return phase.Label
+}
+
+// Routines are the routines any phase sets an interval for.
+func (p *StepProfile) Routines() map[string]bool {
+	names := map[string]bool{}
+	for _, phase := range p.Phases {
+		for name := range phase.Intervals {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Routine is the profile of one routine, queue, get or move.
+func (p *StepProfile) Routine(name string) LoadProfile {
+	return stepRoutineProfile{steps: p, name: name}
+}
+
+type stepRoutineProfile struct {
+	steps *StepProfile
+	name  string
+}
+
+// Interval cuts the wait short at the next phase boundary so every phase
+// starts on time, even after a phase with long intervals.
+func (s stepRoutineProfile) Interval(elapsed, base time.Duration) time.Duration {
+	interval := base
+	if phase := s.steps.phaseAt(elapsed); phase != nil {
+		if d, ok := phase.Intervals[s.name]; ok {
+			interval = d
+		}
+	}
+
+	for _, phase := range s.steps.Phases {
+		for _, boundary := range []time.Duration{phase.From, phase.To} {
+			if boundary > elapsed && boundary < elapsed+interval {
+				interval = boundary - elapsed
+			}
+		}
+	}
+	return interval
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// StreamConfig is a pay station queueing washes on lanes of its own, with
+// order ids of its own and at a pace of its own, e.g. a "ps1" stream queueing
+// to lane 1 every 2s with order ids PS1-000001 on, and a "ps2" stream queueing
+// to lane 2 every 3.5s. Streams run as queue routines named after them, e.g.
+// ps1.queue, alongside the ones the flags configure, so the rTC sees their
+// washes interleaved rather than from one uniform generator. Their commands are
+// tagged with their name in the results like a scenario instance's.
+type StreamConfig struct {
+	Name string `json:"name"`
+	// OrderPrefix is the prefix of the stream's order ids, the run's
+	// --id-prefix followed by the stream's name by default.
+	OrderPrefix string `json:"orderPrefix"`
+	// Queue is the interval the stream queues on, in seconds like "2" or as a
+	// duration like "3500ms".
+	Queue string `json:"queue"`
+	// Offset delays the stream's first wash, e.g. so streams on the same
+	// interval don't queue together.
+	Offset string `json:"offset"`
+	// Lanes are the comma separated lanes the stream queues to, in LaneOrder,
+	// round-robin by default.
+	Lanes     string `json:"lanes"`
+	LaneOrder string `json:"laneOrder"`
+}
+
+func (c StreamConfig) Validate() error {
+	if !instanceName.MatchString(c.Name) {
+		return errors.Errorf("stream name %q must be letters, digits, - and _", c.Name)
+	}
+	if c.Queue == "" {
+		return errors.New("stream has no queue interval")
+	}
+	if _, err := ParseIntervalSeconds(c.Queue); err != nil {
+		return errors.Wrap(err, "invalid queue interval")
+	}
+	if c.Offset != "" {
+		if _, err := ParseIntervalSeconds(c.Offset); err != nil {
+			return errors.Wrap(err, "invalid offset")
+		}
+	}
+	if c.Lanes == "" {
+		return errors.New("stream has no lanes")
+	}
+	_, err := c.lanes()
+	return err
+}
+
+func (c StreamConfig) lanes() (*LaneAssigner, error) {
+	order := c.LaneOrder
+	if order == "" {
+		order = "round-robin"
+	}
+	return ParseLanes(c.Lanes, order)
+}
+
+// StreamCounts are the washes a stream queued, the ones that failed, the sum
+// of the latencies of the others and the last order id it queued with.
+type StreamCounts struct {
+	mu sync.Mutex
+
+	Queued      uint64  `json:"queued"`
+	Errors      uint64  `json:"errors"`
+	LatencyMs   float64 `json:"latencyMs"`
+	LastOrderID string  `json:"lastOrderId"`
+}
+
+// Observe takes the record of a wash the stream queued with orderID. It is
+// safe to call on nil counts, which leave it alone.
+func (s *StreamCounts) Observe(orderID string, record []string) {
+	if s == nil || len(record) < len(csvHeader) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Queued++
+	s.LastOrderID = orderID
+	if record[5] == "true" {
+		s.Errors++
+	} else if ms, ok := recordLatency(record); ok {
+		s.LatencyMs += ms
+	}
+}
+
+// Snapshot is a copy of the counts taken under their lock.
+func (s *StreamCounts) Snapshot() StreamCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StreamCounts{Queued: s.Queued, Errors: s.Errors, LatencyMs: s.LatencyMs, LastOrderID: s.LastOrderID}
+}
+
+// AddStreams creates and registers the queue routine of every stream. newIDs
+// creates the order id allocator of a stream's prefix; streams without one of
+// their own take prefix, the run's, followed by their name. Streams queue with
+// the package and retention of the queue routine the flags configure, so it
+// has to be set up first.
+func (r *Routines) AddStreams(streams []StreamConfig, prefix string, newIDs func(prefix string) (IDAllocator, error)) error {
+	for _, config := range streams {
+		orderPrefix := config.OrderPrefix
+		if orderPrefix == "" {
+			orderPrefix = prefix + "-" + config.Name
+		}
+		ids, err := newIDs(orderPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "unable to create order ids of stream %s", config.Name)
+		}
+		lanes, err := config.lanes()
+		if err != nil {
+			return errors.Wrapf(err, "invalid lanes of stream %s", config.Name)
+		}
+		interval, err := ParseIntervalSeconds(config.Queue)
+		if err != nil {
+			return errors.Wrapf(err, "invalid queue interval of stream %s", config.Name)
+		}
+
+		q := CreateQueueRoutine(1, ids)
+		q.Retain = r.QueueRoutine.Retain
+		q.WashPackage = r.QueueRoutine.WashPackage
+		q.Lanes = lanes
+		q.Stream = &StreamCounts{}
+		q.instance = config.Name
+		q.Log = r.Log
+		q.Ticker.Set(interval)
+		if config.Offset != "" {
+			q.Offset, err = ParseIntervalSeconds(config.Offset)
+			if err != nil {
+				return errors.Wrapf(err, "invalid offset of stream %s", config.Name)
+			}
+		}
+		err = r.Timed.Register(q)
+		if err != nil {
+			return errors.Wrapf(err, "unable to add stream %s", config.Name)
+		}
+		r.Streams = append(r.Streams, q)
+	}
+	return nil
+}
+
+// StreamStats are the counts of every stream by name.
+func (r *Routines) StreamStats() map[string]StreamCounts {
+	stats := map[string]StreamCounts{}
+	for _, q := range r.Streams {
+		stats[q.Instance()] = q.Stream.Snapshot()
+	}
+	return stats
+}
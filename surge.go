@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SurgeWindow multiplies the rate by Factor for Duration from At into the run,
+// e.g. the rush of cars once the rain stops.
+type SurgeWindow struct {
+	Label    string
+	At       time.Duration
+	Duration time.Duration
+	Factor   float64
+}
+
+// parseSurgeWindow parses START:DURATION:FACTOR[:LABEL], e.g. 2h:45m:3:post-rain.
+func parseSurgeWindow(s string) (SurgeWindow, error) {
+	parts := strings.SplitN(s, ":", 4)
+	if len(parts) < 3 {
+		return SurgeWindow{}, errors.Errorf("surge must look like START:DURATION:FACTOR[:LABEL], got %q", s)
+	}
+
+	var w SurgeWindow
+	var err error
+	w.At, err = time.ParseDuration(parts[0])
+	if err != nil || w.At < 0 {
+		return w, errors.Errorf("invalid surge start in %q", s)
+	}
+	w.Duration, err = time.ParseDuration(parts[1])
+	if err != nil || w.Duration <= 0 {
+		return w, errors.Errorf("invalid surge duration in %q", s)
+	}
+	w.Factor, err = strconv.ParseFloat(strings.TrimSuffix(parts[2], "x"), 64)
+	if err != nil || w.Factor <= 0 {
+		return w, errors.Errorf("invalid surge factor in %q", s)
+	}
+	if len(parts) == 4 && parts[3] != "" {
+		w.Label = parts[3]
+	} else {
+		w.Label = fmt.Sprintf("%gx surge", w.Factor)
+	}
+	return w, nil
+}
+
+// surgeFlags collects repeated --surge flags.
+type surgeFlags []SurgeWindow
+
+func (f *surgeFlags) String() string {
+	windows := make([]string, 0, len(*f))
+	for _, w := range *f {
+		windows = append(windows, fmt.Sprintf("%s:%s:%g:%s", w.At, w.Duration, w.Factor, w.Label))
+	}
+	return strings.Join(windows, ",")
+}
+
+func (f *surgeFlags) Set(s string) error {
+	w, err := parseSurgeWindow(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, w)
+	return nil
+}
+
+// SurgeProfile multiplies a routine's rate during its windows. Overlapping
+// surges multiply each other.
+type SurgeProfile struct {
+	Windows []SurgeWindow
+}
+
+func (p *SurgeProfile) Interval(elapsed, base time.Duration) time.Duration {
+	factor := 1.0
+	for _, w := range p.Windows {
+		if w.At <= elapsed && elapsed < w.At+w.Duration {
+			factor *= w.Factor
+		}
+	}
+	return time.Duration(float64(base) / factor)
+}
+
+// Annotate writes each surge to the results timeline as it starts, so a run cut
+// short only shows the surges it went through.
+func (p *SurgeProfile) Annotate(start time.Time, annotator *Annotator) {
+	windows := append([]SurgeWindow(nil), p.Windows...)
+	sort.SliceStable(windows, func(i, j int) bool { return windows[i].At < windows[j].At })
+	for _, w := range windows {
+		at := start.Add(w.At)
+		if wait := at.Sub(clock.Now()); wait > 0 {
+			clock.Sleep(wait)
+		}
+		err := annotator.Annotate(Annotation{Start: at, End: at.Add(w.Duration), Label: w.Label})
+		if err != nil {
+			annotator.Log.Warn("surge annotation not sent to grafana", "error", err, "label", w.Label)
+		}
+	}
+}
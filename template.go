@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TemplateCommandConfig describes an rTC command by its XML rather than a builder
+// in rtc.go, so new or vendor specific commands can be load tested straight away.
+// The template is rendered with text/template against TemplateData, e.g.
+// <src><lookup><order>{{.OrderID}}</order><lane>{{.Params.lane}}</lane></lookup></src>
+type TemplateCommandConfig struct {
+	Name        string            `json:"name"`
+	Template    string            `json:"template"`
+	Interval    string            `json:"interval"`
+	ExpectReply bool              `json:"expectReply"`
+	Params      map[string]string `json:"params"`
+	// Tunnel is the tunnel the command is addressed to, the run's by default.
+	Tunnel string `json:"tunnel"`
+}
+
+type TemplateData struct {
+	OrderID string
+	Seq     uint64
+	Now     time.Time
+	Params  map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"randInt": func(n int) int {
+		if n <= 0 {
+			return 0
+		}
+		return rand.Intn(n)
+	},
+}
+
+func (c TemplateCommandConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("command has no name")
+	}
+	if _, err := ParseIntervalSeconds(c.Interval); err != nil {
+		return errors.Wrapf(err, "invalid interval %q", c.Interval)
+	}
+	if err := ValidateTunnel(c.Tunnel); err != nil {
+		return err
+	}
+	if _, err := c.parse(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c TemplateCommandConfig) parse() (*template.Template, error) {
+	tmpl, err := template.New(c.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(c.Template)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse template for command %s", c.Name)
+	}
+	return tmpl, nil
+}
+
+type TemplateCommandRoutine struct {
+	routineRunner
+
+	Ticker *TickerHolder
+	IDs    IDAllocator
+	Config TemplateCommandConfig
+	Log    Logger
+
+	tmpl *template.Template
+	seq  uint64
+}
+
+func CreateTemplateCommandRoutine(config TemplateCommandConfig, ids IDAllocator) (*TemplateCommandRoutine, error) {
+	d, err := ParseIntervalSeconds(config.Interval)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid interval for command %s", config.Name)
+	}
+	tmpl, err := config.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemplateCommandRoutine{
+		Ticker: CreateTickerHolder(d),
+		IDs:    ids,
+		Config: config,
+		Log:    ZerologLogger{},
+		tmpl:   tmpl,
+	}, nil
+}
+
+func (t *TemplateCommandRoutine) Render() (string, error) {
+	orderID, err := t.IDs.NextOrderID()
+	if err != nil {
+		return "", err
+	}
+	t.seq++
+
+	data := TemplateData{
+		OrderID: orderID,
+		Seq:     t.seq,
+		Now:     clock.Now(),
+		Params:  t.Config.Params,
+	}
+
+	var buf bytes.Buffer
+	err = t.tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to render template for command %s", t.Config.Name)
+	}
+	return buf.String(), nil
+}
+
+func (t *TemplateCommandRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	client = client.OnTunnel(t.Config.Tunnel)
+	for {
+		select {
+		case <-ctx.Done():
+			t.Log.Info("template command routine stopped", "command", t.Config.Name)
+			return
+		case <-t.Ticker.C():
+			if client.Gate.Paused() {
+				continue
+			}
+			commandXML, err := t.Render()
+			if err != nil {
+				t.Log.Warn("unable to render command, not sending", "error", err, "command", t.Config.Name)
+				continue
+			}
+
+			reply, records, err := client.SendCommand(t.Config.Name, commandXML, t.Config.ExpectReply)
+			if err != nil {
+				t.Log.Warn("unable to send template command", "error", err, "command", t.Config.Name)
+			} else if reply != nil {
+				t.Log.Debug("template command reply", "command", t.Config.Name, "reply", *reply)
+			}
+			writer.Write(records)
+		}
+	}
+}
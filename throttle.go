@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var throttleHeader = []string{"Time", "Rate Factor", "Error Rate", "Reason"}
+
+// Throttle is a feedback controller that backs the throttled routines off when
+// the rTC starts failing commands, instead of a run hammering a struggling rTC
+// until it falls over. Every Window the share of commands that couldn't
+// connect or got no reply is compared with Threshold: above it the rate is
+// multiplied by Backoff, otherwise Recovery of the configured rate is added
+// back until it is reached again. Each change is recorded in throttle.csv.
+type Throttle struct {
+	Threshold float64
+	Window    time.Duration
+	Backoff   float64
+	Recovery  float64
+	MinFactor float64
+	// MinCommands is how many commands a window needs before its error rate is trusted.
+	MinCommands uint64
+	Writer      *ResultWriter
+	Log         Logger
+
+	sent   uint64
+	failed uint64
+
+	mu     sync.Mutex
+	factor float64
+}
+
+func CreateThrottle(threshold float64, writer *ResultWriter) *Throttle {
+	return &Throttle{
+		Threshold:   threshold,
+		Window:      10 * time.Second,
+		Backoff:     0.5,
+		Recovery:    0.1,
+		MinFactor:   0.05,
+		MinCommands: 5,
+		Writer:      writer,
+		Log:         ZerologLogger{},
+		factor:      1,
+	}
+}
+
+// Observe counts a command the client sent. It is safe to call on a nil
+// throttle, which counts nothing.
+func (t *Throttle) Observe(err error) {
+	if t == nil {
+		return
+	}
+	atomic.AddUint64(&t.sent, 1)
+	if err != nil {
+		atomic.AddUint64(&t.failed, 1)
+	}
+}
+
+// Factor is the share of the configured rate the throttled routines run at.
+func (t *Throttle) Factor() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.factor
+}
+
+func (t *Throttle) Interval(elapsed, base time.Duration) time.Duration {
+	return time.Duration(float64(base) / t.Factor())
+}
+
+// Run adjusts the rate every Window until done is closed.
+func (t *Throttle) Run(done chan struct{}) {
+	ticker := clock.NewTicker(t.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case at := <-ticker.C():
+			t.adjust(at, atomic.SwapUint64(&t.sent, 0), atomic.SwapUint64(&t.failed, 0))
+		}
+	}
+}
+
+func (t *Throttle) adjust(at time.Time, sent, failed uint64) {
+	if sent < t.MinCommands {
+		return
+	}
+	errorRate := float64(failed) / float64(sent)
+
+	t.mu.Lock()
+	previous := t.factor
+	var reason string
+	if errorRate > t.Threshold {
+		t.factor *= t.Backoff
+		if t.factor < t.MinFactor {
+			t.factor = t.MinFactor
+		}
+		reason = fmt.Sprintf("error rate above %.4g", t.Threshold)
+	} else if t.factor < 1 {
+		t.factor += t.Recovery
+		if t.factor > 1 {
+			t.factor = 1
+		}
+		reason = "recovering"
+	}
+	factor := t.factor
+	t.mu.Unlock()
+
+	if factor == previous {
+		return
+	}
+	if factor < previous {
+		t.Log.Warn("rtc failing commands, backing off", "errorRate", errorRate, "factor", factor)
+	} else {
+		t.Log.Info("rtc error rate recovered, ramping back up", "errorRate", errorRate, "factor", factor)
+	}
+	t.Writer.Write([]string{recordTime(at), fmt.Sprintf("%.4g", factor), fmt.Sprintf("%.4g", errorRate), reason})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Timeouts bound the steps of a command: dialling the rTC, writing the command
+// once connected and reading the reply once written. Zero ones are taken from
+// the defaults.
+type Timeouts struct {
+	Dial  time.Duration
+	Write time.Duration
+	Read  time.Duration
+}
+
+// defaultTimeouts are the deadlines the tester always used.
+var defaultTimeouts = Timeouts{Dial: 3 * time.Second, Write: 1500 * time.Millisecond, Read: 3 * time.Second}
+
+func (t Timeouts) merge(defaults Timeouts) Timeouts {
+	if t.Dial == 0 {
+		t.Dial = defaults.Dial
+	}
+	if t.Write == 0 {
+		t.Write = defaults.Write
+	}
+	if t.Read == 0 {
+		t.Read = defaults.Read
+	}
+	return t
+}
+
+// set changes one of the timeouts by its name, dial, write or read.
+func (t *Timeouts) set(kind string, d time.Duration) error {
+	if d < 0 {
+		return errors.Errorf("%s timeout can't be negative, got %s", kind, d)
+	}
+	switch kind {
+	case "dial":
+		t.Dial = d
+	case "write":
+		t.Write = d
+	case "read":
+		t.Read = d
+	default:
+		return errors.Errorf("unknown timeout %q, expected dial, write or read", kind)
+	}
+	return nil
+}
+
+// CommandTimeouts are the timeouts of every command, by command name such as
+// GET or QUEUE. Like an SLO, a command's timeouts override the defaults one
+// by one. They can be changed while a test runs to see how the rTC behaves
+// under tighter or looser client deadlines.
+type CommandTimeouts struct {
+	Default  Timeouts
+	Commands map[string]Timeouts
+
+	mu sync.RWMutex
+}
+
+func CreateCommandTimeouts(defaults Timeouts) *CommandTimeouts {
+	return &CommandTimeouts{Default: defaults.merge(defaultTimeouts), Commands: map[string]Timeouts{}}
+}
+
+// For is the timeouts of a command, recorded as e.g. "QUEUE lane=2".
+func (c *CommandTimeouts) For(command string) Timeouts {
+	if c == nil {
+		return defaultTimeouts
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Commands[commandName(command)].merge(c.Default)
+}
+
+// Set changes the timeouts of a command, or the defaults when command is empty.
+func (c *CommandTimeouts) Set(command string, t Timeouts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if command == "" {
+		c.Default = t.merge(c.Default)
+		return
+	}
+	c.Commands[command] = t.merge(c.Commands[command])
+}
+
+// Reset drops the overrides of a command, or all of them when command is empty.
+func (c *CommandTimeouts) Reset(command string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if command == "" {
+		c.Commands = map[string]Timeouts{}
+		return
+	}
+	delete(c.Commands, command)
+}
+
+// Parse reads --timeouts, e.g. "GET.read=500ms,QUEUE.dial=1s".
+func (c *CommandTimeouts) Parse(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		command, kind, hasKind := strings.Cut(key, ".")
+		if !ok || !hasKind || command == "" {
+			return errors.Errorf("timeout %q must look like GET.read=500ms", item)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timeout %q", item)
+		}
+		var t Timeouts
+		err = t.set(kind, d)
+		if err != nil {
+			return err
+		}
+		c.Set(command, t)
+	}
+	return nil
+}
+
+type timeoutsState struct {
+	Default  timeoutsJSON            `json:"default"`
+	Commands map[string]timeoutsJSON `json:"commands"`
+}
+
+// timeoutsJSON are timeouts as durations such as "1.5s".
+type timeoutsJSON struct {
+	Dial  string `json:"dial,omitempty"`
+	Write string `json:"write,omitempty"`
+	Read  string `json:"read,omitempty"`
+}
+
+func formatTimeouts(t Timeouts) timeoutsJSON {
+	var j timeoutsJSON
+	for _, f := range []struct {
+		d   time.Duration
+		out *string
+	}{{t.Dial, &j.Dial}, {t.Write, &j.Write}, {t.Read, &j.Read}} {
+		if f.d > 0 {
+			*f.out = f.d.String()
+		}
+	}
+	return j
+}
+
+func (c *CommandTimeouts) state() timeoutsState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	state := timeoutsState{Default: formatTimeouts(c.Default), Commands: map[string]timeoutsJSON{}}
+	for command := range c.Commands {
+		state.Commands[command] = formatTimeouts(c.Commands[command].merge(c.Default))
+	}
+	return state
+}
+
+type timeoutsRequest struct {
+	Command string `json:"command"`
+	timeoutsJSON
+	Reset bool `json:"reset"`
+}
+
+// TimeoutsEndpoint is POST /api/v1/timeouts. {"command": "GET", "read": "500ms"}
+// tightens the read deadline of GET, without a command the defaults change;
+// {"command": "GET", "reset": true} goes back to the defaults.
+func (c *CommandTimeouts) TimeoutsEndpoint(ctx *gin.Context) {
+	var req timeoutsRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "body must be JSON like {\"command\": \"GET\", \"dial\": \"1s\", \"write\": \"1s\", \"read\": \"500ms\"}"})
+		return
+	}
+	if req.Reset {
+		c.Reset(req.Command)
+		ctx.JSON(http.StatusOK, c.state())
+		return
+	}
+
+	var t Timeouts
+	for kind, value := range map[string]string{"dial": req.Dial, "write": req.Write, "read": req.Read} {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			err = t.set(kind, d)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + kind + " timeout: " + err.Error()})
+			return
+		}
+	}
+	c.Set(req.Command, t)
+	ctx.JSON(http.StatusOK, c.state())
+}
+
+// TimeoutsStatus is GET /api/v1/timeouts.
+func (c *CommandTimeouts) TimeoutsStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.state())
+}
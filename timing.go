@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ParseIntervalSeconds reads an interval in seconds, whole or fractional
+// ("5", "0.5") as the /update endpoints take them, or a Go duration ("500ms",
+// "1m").
+func ParseIntervalSeconds(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var d time.Duration
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(seconds) || math.Abs(seconds) > float64(math.MaxInt64)/float64(time.Second) {
+			return 0, errors.Errorf("%q seconds is out of range", s)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	} else {
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, errors.Errorf("%q is neither seconds like 5 or 0.5 nor a duration like 500ms", s)
+		}
+	}
+
+	if d <= 0 {
+		return 0, errors.Errorf("interval must be positive, got %q", s)
+	}
+	return d, nil
+}
+
+// TickerHolder is the ticker a routine runs on and the interval it was set
+// to. Changing the interval resets the ticker in place, so a routine running
+// on it carries on at the new interval; applying a load profile replaces it,
+// so it's only reached through the holder.
+type TickerHolder struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	interval time.Duration
+}
+
+func CreateTickerHolder(d time.Duration) *TickerHolder {
+	return &TickerHolder{ticker: clock.NewTicker(d), interval: d}
+}
+
+func (h *TickerHolder) Ticker() Ticker {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ticker
+}
+
+// C is the ticks of the current ticker.
+func (h *TickerHolder) C() <-chan time.Time {
+	return h.Ticker().C()
+}
+
+// Interval is the interval the ticker was set to, which a load profile
+// varies the actual time between ticks around.
+func (h *TickerHolder) Interval() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.interval
+}
+
+// Current is the interval the ticker is meant to tick at right now.
+func (h *TickerHolder) Current() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return tickInterval(h.ticker, h.interval)
+}
+
+// Set changes the interval, resetting the ticker without stopping whatever
+// runs on it; the next tick is d from now. A profiled ticker keeps its
+// profile, applied to the new interval.
+func (h *TickerHolder) Set(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interval = d
+	h.ticker.Reset(d)
+}
+
+// Profile shapes the ticks with profile, applied on top of the profile the
+// ticker already has.
+func (h *TickerHolder) Profile(profile LoadProfile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ticker.Stop()
+	if profiled, ok := h.ticker.(*ProfileTicker); ok {
+		profile = ChainedProfile{profiled.Profile, profile}
+	}
+	h.ticker = CreateProfileTicker(profile, h.interval)
+}
+
+// Restart sets the interval back to d and starts its profile, if any, over
+// from the beginning, so the ticks repeat those from the start of the run.
+func (h *TickerHolder) Restart(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interval = d
+	if profiled, ok := h.ticker.(*ProfileTicker); ok {
+		profiled.Restart(d)
+		return
+	}
+	h.ticker.Reset(d)
+}
+
+// Profiled is whether a load profile shapes the ticks.
+func (h *TickerHolder) Profiled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.ticker.(*ProfileTicker)
+	return ok
+}
+
+// Peak is the shortest interval the ticker's profile gives over span from its
+// start, looked at every second, the interval itself without a profile.
+func (h *TickerHolder) Peak(span time.Duration) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	profiled, ok := h.ticker.(*ProfileTicker)
+	if !ok {
+		return h.interval
+	}
+	var peak time.Duration
+	for elapsed := time.Duration(0); elapsed <= span; elapsed += time.Second {
+		if d := profiled.Profile.Interval(elapsed, h.interval); d > 0 && (peak == 0 || d < peak) {
+			peak = d
+		}
+	}
+	if peak == 0 {
+		return h.interval
+	}
+	return peak
+}
+
+func (h *TickerHolder) Stop() {
+	h.Ticker().Stop()
+}
+
+// parseMultiplier accepts a positive multiplier such as 2x, 0.5x or 2.
+func parseMultiplier(s string) (float64, error) {
+	m, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "x"), 64)
+	if err != nil || m <= 0 {
+		return 0, errors.Errorf("multiplier must be positive like 2x or 0.5x, got %q", s)
+	}
+	return m, nil
+}
+
+// isRelativeTime is whether an /update time such as +500ms or -1s changes the
+// current interval rather than replacing it.
+func isRelativeTime(s string) bool {
+	return strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-")
+}
+
+// relativeTickerTime applies a change like +500ms or -1s to the current interval.
+func relativeTickerTime(current time.Duration, change string) (time.Duration, error) {
+	d, err := ParseIntervalSeconds(change[1:])
+	if err != nil {
+		return 0, err
+	}
+	if change[0] == '-' {
+		d = -d
+	}
+	if current+d <= 0 {
+		return 0, errors.Errorf("%s would leave a ticker time of %s, it must stay positive", change, current+d)
+	}
+	return current + d, nil
+}
+
+// validateStrictConfig checks the numeric flags that lenient mode would silently
+// replace with defaults.
+func validateStrictConfig(positive map[string]int, closeTimeout time.Duration) error {
+	for name, v := range positive {
+		if v <= 0 {
+			return errors.Errorf("--%s must be positive, got %d", name, v)
+		}
+	}
+	if closeTimeout <= 0 {
+		return errors.Errorf("--close-timeout must be positive, got %s", closeTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// routineDependencies are the routines each routine only runs alongside. move
+// moves the washes it finds in the queue, which is only read on a schedule of
+// its own, and recorded as such, while get runs.
+var routineDependencies = map[string][]string{
+	"move": {"get"},
+}
+
+var errUnknownRoutine = errors.New("unknown routine")
+
+// routineRequires are the routines a routine requires, those of its own
+// scenario instance for an instance's routine, e.g. noise.move requires noise.get.
+func routineRequires(name string) []string {
+	instance, base, ok := strings.Cut(name, ".")
+	if !ok {
+		return routineDependencies[name]
+	}
+	var requires []string
+	for _, required := range routineDependencies[base] {
+		requires = append(requires, instance+"."+required)
+	}
+	return requires
+}
+
+// toggleableRoutine is a routine that can be stopped and started on its own
+// while the test runs. Routines are named queue, get, move and marker,
+// <instance>.queue and so on after their scenario instance, and
+// sequence:<name>, script:<name>, command:<name> and workers:<pool> after the
+// name in their config or of their pool.
+type toggleableRoutine struct {
+	Name     string
+	Requires []string
+	start    func()
+	stop     func()
+}
+
+// toggleable lists the routines that can be toggled; r.toggleMu is held.
+func (r *Routines) toggleable() map[string]toggleableRoutine {
+	routines := map[string]toggleableRoutine{}
+	add := func(name string, start, stop func()) {
+		routines[name] = toggleableRoutine{Name: name, Requires: routineRequires(name), start: start, stop: stop}
+	}
+
+	if r.Mix == nil && r.Replay == nil {
+		for _, routine := range r.Timed.All() {
+			routine := routine
+			add(routine.Name(), func() { r.startTimed(routine) }, routine.Stop)
+		}
+	}
+	if r.Marker != nil {
+		add("marker", func() {
+			r.startRun(&r.Marker.routineRunner, func(ctx context.Context) { r.Marker.Run(ctx, r.RTC, r.Writer) })
+		}, r.Marker.Stop)
+	}
+	for _, seq := range r.Sequences {
+		seq := seq
+		add("sequence:"+seq.Config.Name, func() {
+			r.startRun(&seq.routineRunner, func(ctx context.Context) { seq.Run(ctx, r.RTC, r.Writer) })
+		}, seq.Stop)
+	}
+	for _, script := range r.Scripts {
+		script := script
+		add("script:"+script.Config.Name, func() {
+			r.startRun(&script.routineRunner, func(ctx context.Context) { script.Run(ctx, r.RTC, r.Writer) })
+		}, script.Stop)
+	}
+	for _, command := range r.Commands {
+		command := command
+		add("command:"+command.Config.Name, func() {
+			r.startRun(&command.routineRunner, func(ctx context.Context) { command.Run(ctx, r.RTC, r.Writer) })
+		}, command.Stop)
+	}
+	r.workersMu.Lock()
+	for _, pool := range r.Workers {
+		pool := pool
+		add("workers:"+pool.Name, func() {
+			r.startRun(&pool.routineRunner, func(ctx context.Context) { pool.Run(ctx, r.RTC, r.Writer) })
+		}, pool.Stop)
+	}
+	r.workersMu.Unlock()
+
+	// an instance may not run the routines its others would require
+	for name, routine := range routines {
+		var requires []string
+		for _, required := range routine.Requires {
+			if _, ok := routines[required]; ok {
+				requires = append(requires, required)
+			}
+		}
+		routine.Requires = requires
+		routines[name] = routine
+	}
+	return routines
+}
+
+// routineOff is whether a routine was stopped through the api; r.toggleMu is held.
+func (r *Routines) routineOff(name string) bool {
+	return r.stoppedRoutines[name]
+}
+
+// StartRoutine starts a routine stopped through the api again. With cascade,
+// the routines it requires are started first when they're stopped too;
+// without, starting it fails. It returns the routines it started.
+func (r *Routines) StartRoutine(name string, cascade bool) ([]string, error) {
+	r.toggleMu.Lock()
+	defer r.toggleMu.Unlock()
+	if state := r.lifecycle.State(); state != RoutinesRunning && state != RoutinesPaused {
+		return nil, errors.Errorf("routines are %s", state)
+	}
+	return r.startRoutine(r.toggleable(), name, cascade, nil)
+}
+
+func (r *Routines) startRoutine(routines map[string]toggleableRoutine, name string, cascade bool, started []string) ([]string, error) {
+	routine, ok := routines[name]
+	if !ok {
+		return started, errors.Wrapf(errUnknownRoutine, "%s", name)
+	}
+	if !r.routineOff(name) {
+		return started, errors.Errorf("%s is already running", name)
+	}
+
+	var missing []string
+	for _, required := range routine.Requires {
+		if _, ok := routines[required]; ok && r.routineOff(required) {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) > 0 && !cascade {
+		return started, errors.Errorf("%s requires %s, start it first or pass cascade=true", name, strings.Join(missing, ", "))
+	}
+	for _, required := range missing {
+		var err error
+		started, err = r.startRoutine(routines, required, cascade, started)
+		if err != nil {
+			return started, err
+		}
+	}
+
+	routine.start()
+	delete(r.stoppedRoutines, name)
+	r.Log.Info("routine started through the api", "routine", name)
+	return append(started, name), nil
+}
+
+// StopRoutine stops a single routine until it's started again or the test
+// ends. With cascade, the routines requiring it are stopped first; without,
+// stopping it fails while they run. It returns the routines it stopped.
+func (r *Routines) StopRoutine(name string, cascade bool) ([]string, error) {
+	r.toggleMu.Lock()
+	defer r.toggleMu.Unlock()
+	if state := r.lifecycle.State(); state != RoutinesRunning && state != RoutinesPaused {
+		return nil, errors.Errorf("routines are %s", state)
+	}
+	return r.stopRoutine(r.toggleable(), name, cascade, nil)
+}
+
+func (r *Routines) stopRoutine(routines map[string]toggleableRoutine, name string, cascade bool, stopped []string) ([]string, error) {
+	routine, ok := routines[name]
+	if !ok {
+		return stopped, errors.Wrapf(errUnknownRoutine, "%s", name)
+	}
+	if r.routineOff(name) {
+		return stopped, errors.Errorf("%s is already stopped", name)
+	}
+
+	var dependents []string
+	for _, other := range routines {
+		if r.routineOff(other.Name) {
+			continue
+		}
+		for _, required := range other.Requires {
+			if required == name {
+				dependents = append(dependents, other.Name)
+			}
+		}
+	}
+	sort.Strings(dependents)
+	if len(dependents) > 0 && !cascade {
+		return stopped, errors.Errorf("%s is required by %s, stop it first or pass cascade=true", name, strings.Join(dependents, ", "))
+	}
+	for _, dependent := range dependents {
+		var err error
+		stopped, err = r.stopRoutine(routines, dependent, cascade, stopped)
+		if err != nil {
+			return stopped, err
+		}
+	}
+
+	routine.stop()
+	if r.stoppedRoutines == nil {
+		r.stoppedRoutines = map[string]bool{}
+	}
+	r.stoppedRoutines[name] = true
+	r.Log.Info("routine stopped through the api", "routine", name)
+	return append(stopped, name), nil
+}
+
+// RoutineStates are whether every routine runs, by name, and what it requires.
+func (r *Routines) RoutineStates() gin.H {
+	r.toggleMu.Lock()
+	defer r.toggleMu.Unlock()
+	state := r.lifecycle.State()
+	states := gin.H{}
+	for name, routine := range r.toggleable() {
+		running := (state == RoutinesRunning || state == RoutinesPaused) && !r.routineOff(name)
+		requires := routine.Requires
+		if requires == nil {
+			requires = []string{}
+		}
+		states[name] = gin.H{"running": running, "requires": requires}
+	}
+	return states
+}
+
+// RoutinesEndpoint is GET /api/v1/routines.
+func (r *Routines) RoutinesEndpoint(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"state": r.lifecycle.State(), "routines": r.RoutineStates()})
+}
+
+// ToggleRoutineEndpoint is POST /api/v1/routines/:name/start and /stop, e.g.
+// /api/v1/routines/move/stop. ?cascade=true also starts the routines it
+// requires, or stops the routines requiring it.
+func (r *Routines) ToggleRoutineEndpoint(start bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r.toggleRoutines(c, start, c.Param("name"))
+	}
+}
+
+// ToggleRoutines stops or starts a fixed set of routines, such as
+// /stop/queue-and-move, leaving those already stopped or started as they are.
+func (r *Routines) ToggleRoutines(start bool, names ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r.toggleMu.Lock()
+		var toggle []string
+		for _, name := range names {
+			if r.routineOff(name) == start {
+				toggle = append(toggle, name)
+			}
+		}
+		r.toggleMu.Unlock()
+		r.toggleRoutines(c, start, toggle...)
+	}
+}
+
+func (r *Routines) toggleRoutines(c *gin.Context, start bool, names ...string) {
+	cascade := c.Query("cascade") == "true"
+	changed := []string{}
+	for _, name := range names {
+		var done []string
+		var err error
+		if start {
+			done, err = r.StartRoutine(name, cascade)
+		} else {
+			done, err = r.StopRoutine(name, cascade)
+		}
+		changed = append(changed, done...)
+		if err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, errUnknownRoutine) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{"error": err.Error(), "changed": changed, "routines": r.RoutineStates()})
+			return
+		}
+	}
+	status, body := http.StatusOK, gin.H{}
+	if !start {
+		r.drain()
+		for _, name := range changed {
+			if name == "queue" {
+				// the washes are only deleted with nothing left queueing them
+				status, body = r.cleanupStopped()
+			}
+		}
+	}
+	body["changed"], body["routines"] = changed, r.RoutineStates()
+	c.JSON(status, body)
+}
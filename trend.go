@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// TrendDB is the summary of every run under a results root, kept in
+// trend.json next to the runs so weeks of them can be compared without
+// reading all of their results again. A run is only summarised again when its
+// results changed.
+type TrendDB struct {
+	Path string               `json:"-"`
+	Runs map[string]*TrendRun `json:"runs"`
+}
+
+// TrendRun is what the trend report needs of a run, by its directory relative
+// to the root.
+type TrendRun struct {
+	Dir      string    `json:"dir"`
+	Started  time.Time `json:"started"`
+	Instance string    `json:"instance"`
+	Firmware string    `json:"firmware"`
+	Purpose  string    `json:"purpose"`
+	// Modified is when the run's results were last written.
+	Modified time.Time               `json:"modified"`
+	Commands map[string]TrendCommand `json:"commands"`
+}
+
+// TrendCommand is one command's latencies in a run, in milliseconds.
+type TrendCommand struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"`
+	P50    float64 `json:"p50"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+}
+
+// LoadTrendDB reads the trend database at path, or starts an empty one when
+// there isn't one yet.
+func LoadTrendDB(path string) (*TrendDB, error) {
+	db := &TrendDB{Path: path, Runs: map[string]*TrendRun{}}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read trend database")
+	}
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse trend database %s", path)
+	}
+	if db.Runs == nil {
+		db.Runs = map[string]*TrendRun{}
+	}
+	return db, nil
+}
+
+// Update summarises the runs of the history that are new or whose results
+// changed, and forgets the runs that were deleted. It returns how many runs
+// were summarised.
+func (db *TrendDB) Update(history *RunHistory) (int, error) {
+	runs, err := history.Runs()
+	if err != nil {
+		return 0, err
+	}
+	found := map[string]bool{}
+	updated := 0
+	for _, run := range runs {
+		if !run.Report {
+			continue
+		}
+		found[run.Dir] = true
+		dir := filepath.Join(history.Root, filepath.FromSlash(run.Dir))
+		info, err := os.Stat(filepath.Join(dir, "load-test.csv"))
+		if err != nil {
+			continue
+		}
+		if cached, ok := db.Runs[run.Dir]; ok && cached.Modified.Equal(info.ModTime()) {
+			continue
+		}
+
+		summary, err := SummariseRun(dir)
+		if err != nil {
+			// a run still being written or cut short shouldn't stop the report
+			log.Warn().Err(err).Str("run", run.Dir).Msg("skipping run in trend")
+			continue
+		}
+		entry := &TrendRun{
+			Dir:      run.Dir,
+			Started:  run.Started,
+			Instance: run.Instance,
+			Firmware: run.Notes.Firmware,
+			Purpose:  run.Notes.Purpose,
+			Modified: info.ModTime(),
+			Commands: map[string]TrendCommand{},
+		}
+		for name, command := range summary.Commands {
+			entry.Commands[name] = TrendCommand{
+				Count:  command.Count,
+				Errors: command.Errors,
+				P50:    command.Percentile(50),
+				P95:    command.Percentile(95),
+				P99:    command.Percentile(99),
+			}
+		}
+		db.Runs[run.Dir] = entry
+		updated++
+	}
+	for dir := range db.Runs {
+		if !found[dir] {
+			delete(db.Runs, dir)
+		}
+	}
+	return updated, nil
+}
+
+func (db *TrendDB) Save() error {
+	b, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to encode trend database")
+	}
+	return errors.Wrap(os.WriteFile(db.Path, b, 0644), "unable to write trend database")
+}
+
+// Sorted are the runs started at or after since, oldest first.
+func (db *TrendDB) Sorted(since time.Time) []*TrendRun {
+	var runs []*TrendRun
+	for _, run := range db.Runs {
+		if !run.Started.Before(since) {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs
+}
+
+// TrendGroup is the runs of one firmware, day or week.
+type TrendGroup struct {
+	Key      string
+	First    time.Time
+	Last     time.Time
+	Runs     int
+	Commands map[string]*TrendGroupCommand
+}
+
+// TrendGroupCommand is a command over the runs of a group. P95 is the median
+// of the runs' p95s, so one bad run doesn't stand for a whole firmware, and
+// WorstP95 the highest of them.
+type TrendGroupCommand struct {
+	Runs     int
+	Count    int
+	Errors   int
+	P95      float64
+	WorstP95 float64
+	p95s     []float64
+}
+
+func (c *TrendGroupCommand) ErrorRate() float64 {
+	if c.Count == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Count)
+}
+
+// trendKey is the group a run falls in: its firmware, or the day or iso week
+// it started on in loc.
+func trendKey(run *TrendRun, by string, loc *time.Location) string {
+	switch by {
+	case "day":
+		return run.Started.In(loc).Format("2006-01-02")
+	case "week":
+		year, week := run.Started.In(loc).ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	if run.Firmware == "" {
+		return "unknown"
+	}
+	return run.Firmware
+}
+
+// GroupTrend groups runs, oldest first, by firmware, day or week. Groups are
+// ordered by their first run, so firmware appear in the order they were tested.
+func GroupTrend(runs []*TrendRun, by string, loc *time.Location) []*TrendGroup {
+	var groups []*TrendGroup
+	byKey := map[string]*TrendGroup{}
+	for _, run := range runs {
+		key := trendKey(run, by, loc)
+		group, ok := byKey[key]
+		if !ok {
+			group = &TrendGroup{Key: key, First: run.Started, Commands: map[string]*TrendGroupCommand{}}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.Last = run.Started
+		group.Runs++
+		for name, command := range run.Commands {
+			c, ok := group.Commands[name]
+			if !ok {
+				c = &TrendGroupCommand{}
+				group.Commands[name] = c
+			}
+			c.Runs++
+			c.Count += command.Count
+			c.Errors += command.Errors
+			c.p95s = append(c.p95s, command.P95)
+			if command.P95 > c.WorstP95 {
+				c.WorstP95 = command.P95
+			}
+		}
+	}
+	for _, group := range groups {
+		for _, c := range group.Commands {
+			sort.Float64s(c.p95s)
+			c.P95 = percentile(c.p95s, 50)
+		}
+	}
+	return groups
+}
+
+// trendCommands are the commands of any of the groups in a stable order.
+func trendCommands(groups []*TrendGroup) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, group := range groups {
+		for name := range group.Commands {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runTrend is the trend subcommand, which follows rTC latency across every run
+// under a results root, grouped by firmware or by the day or week they ran.
+func runTrend(args []string) {
+	fs := flag.NewFlagSet("trend", flag.ExitOnError)
+	dbPath := fs.String("db", "", "trend database of the runs' summaries; defaults to trend.json in the results root")
+	by := fs.String("by", "firmware", "what runs are grouped by: firmware, day or week")
+	since := fs.String("since", "", "only runs started on or after this date, e.g. 2024-01-31")
+	instance := fs.String("instance", "", "only runs of this instance")
+	htmlPath := fs.String("html", "", "also write the trend as an html report to this file")
+	csvPath := fs.String("csv", "", "also write the groups as a csv to this file, e.g. for a release spreadsheet")
+	timezone := fs.String("timezone", "Local", "IANA time zone days and weeks are counted in, e.g. UTC or Europe/London")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: trend [flags] <results root>")
+		os.Exit(2)
+	}
+	if *by != "firmware" && *by != "day" && *by != "week" {
+		log.Fatal().Str("by", *by).Msg("--by must be firmware, day or week")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid --timezone")
+	}
+	var from time.Time
+	if *since != "" {
+		from, err = time.ParseInLocation("2006-01-02", *since, loc)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --since")
+		}
+	}
+
+	root := fs.Arg(0)
+	if *dbPath == "" {
+		*dbPath = filepath.Join(root, "trend.json")
+	}
+	db, err := LoadTrendDB(*dbPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load trend database")
+	}
+	updated, err := db.Update(CreateRunHistory(root))
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read runs")
+	}
+	if err := db.Save(); err != nil {
+		log.Fatal().Err(err).Msg("unable to save trend database")
+	}
+	log.Info().Int("runs", len(db.Runs)).Int("summarised", updated).Str("db", *dbPath).Msg("trend database updated")
+
+	var runs []*TrendRun
+	for _, run := range db.Sorted(from) {
+		if *instance == "" || run.Instance == *instance {
+			runs = append(runs, run)
+		}
+	}
+	groups := GroupTrend(runs, *by, loc)
+	writeTrendText(os.Stdout, groups)
+
+	if *csvPath != "" {
+		if err := writeTrendCSV(*csvPath, groups); err != nil {
+			log.Fatal().Err(err).Msg("unable to write trend csv")
+		}
+	}
+	if *htmlPath != "" {
+		if err := writeTrendHTML(*htmlPath, root, *by, loc, runs, groups); err != nil {
+			log.Fatal().Err(err).Msg("unable to write trend report")
+		}
+	}
+}
+
+func writeTrendText(out io.Writer, groups []*TrendGroup) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tCOMMAND\tRUNS\tN\tERRORS\tP95 MS\tWORST P95 MS")
+	for _, group := range groups {
+		for _, name := range trendCommands([]*TrendGroup{group}) {
+			c := group.Commands[name]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f%%\t%.1f\t%.1f\n", group.Key, name, c.Runs, c.Count, c.ErrorRate()*100, c.P95, c.WorstP95)
+		}
+	}
+	w.Flush()
+}
+
+func writeTrendCSV(path string, groups []*TrendGroup) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to create trend csv")
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Group", "First Run", "Last Run", "Command", "Runs", "Count", "Error Rate", "P95 Ms", "Worst P95 Ms"})
+	for _, group := range groups {
+		for _, name := range trendCommands([]*TrendGroup{group}) {
+			c := group.Commands[name]
+			w.Write([]string{
+				group.Key,
+				group.First.UTC().Format(time.RFC3339),
+				group.Last.UTC().Format(time.RFC3339),
+				name,
+				strconv.Itoa(c.Runs),
+				strconv.Itoa(c.Count),
+				strconv.FormatFloat(c.ErrorRate(), 'f', 4, 64),
+				strconv.FormatFloat(c.P95, 'f', 1, 64),
+				strconv.FormatFloat(c.WorstP95, 'f', 1, 64),
+			})
+		}
+	}
+	w.Flush()
+	return errors.Wrap(w.Error(), "unable to write trend csv")
+}
+
+var trendReportTemplate = assetTemplate("trend.html")
+
+func writeTrendHTML(path, root, by string, loc *time.Location, runs []*TrendRun, groups []*TrendGroup) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to create trend report")
+	}
+	defer f.Close()
+
+	// every run's p95 over time, with the firmware it ran marked where it changed
+	commands := trendCommands(groups)
+	series := make([]ChartSeries, len(commands))
+	for i, name := range commands {
+		series[i].Name = name
+		for _, run := range runs {
+			if command, ok := run.Commands[name]; ok {
+				series[i].Points = append(series[i].Points, ChartPoint{At: run.Started, Value: command.P95})
+			}
+		}
+	}
+	var annotations []Annotation
+	firmware := ""
+	for _, run := range runs {
+		if run.Firmware != "" && run.Firmware != firmware {
+			annotations = append(annotations, Annotation{Start: run.Started, End: run.Started, Label: run.Firmware})
+			firmware = run.Firmware
+		}
+	}
+
+	return trendReportTemplate.Execute(f, map[string]interface{}{
+		"Root":     root,
+		"By":       by,
+		"Runs":     len(runs),
+		"Commands": commands,
+		"Groups":   groups,
+		"Chart":    svgLineChart("p95 latency per run", "ms", loc, series, annotations...),
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var tunnelName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateTunnel checks a tunnel id is fit to be sent in a command.
+func ValidateTunnel(tunnel string) error {
+	if tunnel != "" && !tunnelName.MatchString(tunnel) {
+		return errors.Errorf("tunnel %q must be letters, digits, - and _", tunnel)
+	}
+	return nil
+}
+
+// OnTunnel is the client addressing its commands to tunnel, for rTCs that
+// run several tunnels with a queue each. It shares everything but the tunnel
+// with r, so the commands of every tunnel are limited, counted and cancelled
+// together. An empty tunnel is r itself.
+func (r *RTCClient) OnTunnel(tunnel string) *RTCClient {
+	if tunnel == "" || tunnel == r.Tunnel {
+		return r
+	}
+	c := *r
+	c.Tunnel = tunnel
+	return &c
+}
+
+// addressTunnel puts the tunnel a command is for first in its envelope, e.g.
+// <src><tunnel>2</tunnel><getQueue/></src>. A command that isn't in a plain
+// <src> envelope is sent as it is.
+func addressTunnel(commandXML, tunnel string) string {
+	if tunnel == "" || !strings.HasPrefix(commandXML, "<src>") {
+		return commandXML
+	}
+	return "<src><tunnel>" + tunnel + "</tunnel>" + strings.TrimPrefix(commandXML, "<src>")
+}
+
+// tunnelOf is the tunnel a command was recorded against, e.g. 2 for
+// "GET tunnel=2", and empty for commands that weren't addressed to one.
+func tunnelOf(column string) string {
+	for _, field := range strings.Fields(column) {
+		if tunnel, ok := strings.CutPrefix(field, "tunnel="); ok {
+			return tunnel
+		}
+	}
+	return ""
+}
+
+// TunnelStats are the commands recorded against each tunnel, so tunnels loaded
+// together can be told apart in /status and /metrics. Commands that weren't
+// addressed to a tunnel count against the default one, "".
+type TunnelStats struct {
+	mu      sync.Mutex
+	tunnels map[string]*TunnelCounts
+}
+
+// TunnelCounts are a tunnel's commands, the ones that failed and the sum of
+// the latencies of the others.
+type TunnelCounts struct {
+	Commands  uint64  `json:"commands"`
+	Errors    uint64  `json:"errors"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+func CreateTunnelStats() *TunnelStats {
+	return &TunnelStats{tunnels: map[string]*TunnelCounts{}}
+}
+
+// Observe takes a results record as it is written.
+func (t *TunnelStats) Observe(record []string) {
+	if t == nil || len(record) < len(csvHeader) {
+		return
+	}
+	tunnel := tunnelOf(record[0])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.tunnels[tunnel]
+	if !ok {
+		c = &TunnelCounts{}
+		t.tunnels[tunnel] = c
+	}
+	c.Commands++
+	if record[5] == "true" {
+		c.Errors++
+	} else if ms, ok := recordLatency(record); ok {
+		c.LatencyMs += ms
+	}
+}
+
+// Stats are the counts of every tunnel by id, the default tunnel being "default".
+func (t *TunnelStats) Stats() map[string]TunnelCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := map[string]TunnelCounts{}
+	for tunnel, c := range t.tunnels {
+		if tunnel == "" {
+			tunnel = "default"
+		}
+		stats[tunnel] = *c
+	}
+	return stats
+}
+
+// tunnels are the tunnels the routines send to, the client's own first.
+func (r *Routines) tunnels() []string {
+	seen := map[string]bool{r.RTC.Tunnel: true}
+	tunnels := []string{r.RTC.Tunnel}
+	add := func(tunnel string) {
+		if tunnel != "" && !seen[tunnel] {
+			seen[tunnel] = true
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	var extra []string
+	for _, instance := range r.Instances {
+		extra = append(extra, instance.Tunnel)
+	}
+	for _, seq := range r.Sequences {
+		extra = append(extra, seq.Config.Tunnel)
+	}
+	for _, script := range r.Scripts {
+		extra = append(extra, script.Config.Tunnel)
+	}
+	for _, command := range r.Commands {
+		extra = append(extra, command.Config.Tunnel)
+	}
+	sort.Strings(extra)
+	for _, tunnel := range extra {
+		add(tunnel)
+	}
+	return tunnels
+}
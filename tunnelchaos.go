@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var pauseTunnelXML = "<src><pauseTunnel/></src>"
+var resumeTunnelXML = "<src><resumeTunnel/></src>"
+
+// resumeAttempts is how often the chaos routine tries to resume a tunnel it
+// paused before giving up and leaving it halted.
+const resumeAttempts = 3
+
+// TunnelControlResponse is the rTC's reply to a pause or resume of the tunnel,
+// which only says anything when it refused.
+type TunnelControlResponse struct {
+	XMLName xml.Name `xml:"tc"`
+	State   string   `xml:"status>state"`
+	Error   string   `xml:"error"`
+}
+
+// PauseTunnel halts the tunnel, recorded as PAUSE_TUNNEL. Washes stay queued
+// and can still be queued, moved and deleted while it is halted.
+func (r *RTCClient) PauseTunnel() (*TunnelControlResponse, []string, error) {
+	return r.controlTunnel("PAUSE_TUNNEL", pauseTunnelXML)
+}
+
+// ResumeTunnel restarts a halted tunnel, recorded as RESUME_TUNNEL.
+func (r *RTCClient) ResumeTunnel() (*TunnelControlResponse, []string, error) {
+	return r.controlTunnel("RESUME_TUNNEL", resumeTunnelXML)
+}
+
+func (r *RTCClient) controlTunnel(command, controlXML string) (*TunnelControlResponse, []string, error) {
+	readMessage, record, err := r.SendCommand(command, controlXML, true)
+	if err != nil {
+		return nil, record, err
+	}
+
+	var resp TunnelControlResponse
+	err = xml.Unmarshal([]byte(*readMessage), &resp)
+	if err == nil && resp.Error != "" {
+		err = &RTCError{Command: command, Message: resp.Error}
+	}
+	if err != nil {
+		r.Log.Warn("rTC did not take tunnel command", "error", err, "command", command, "reply", *readMessage)
+		return nil, markFailed(record, err), err
+	}
+	return &resp, record, nil
+}
+
+// TunnelChaosStats are the windows the chaos routine halted the tunnel for,
+// the pauses and resumes the rTC refused and whether the tunnel is halted now.
+type TunnelChaosStats struct {
+	Windows       uint64 `json:"windows"`
+	PausedFor     string `json:"pausedFor"`
+	FailedPauses  uint64 `json:"failedPauses"`
+	FailedResumes uint64 `json:"failedResumes"`
+	Paused        bool   `json:"paused"`
+}
+
+// TunnelChaosRoutine halts the tunnel for Window every tick while the other
+// routines keep sending their load, to measure how queue operations behave
+// while nothing is washed. Every window is annotated on the results timeline.
+// A routine stopped in the middle of a window resumes the tunnel straight
+// away rather than leave it halted.
+type TunnelChaosRoutine struct {
+	TickedRoutine
+
+	Window time.Duration
+	// Annotator marks the windows on the timeline when set.
+	Annotator *Annotator
+
+	// ctx is the context the routine is running with, to end a window early
+	ctx context.Context
+
+	mu        sync.Mutex
+	stats     TunnelChaosStats
+	pausedFor time.Duration
+}
+
+func CreateTunnelChaosRoutine(tickerTime int, window time.Duration) *TunnelChaosRoutine {
+	c := &TunnelChaosRoutine{Window: window, ctx: context.Background()}
+	c.init("tunnel-chaos", tickerTime, 5*time.Minute, c.chaos)
+	return c
+}
+
+// Validate makes sure a window ends before the next one is due.
+func (c *TunnelChaosRoutine) Validate() error {
+	if c.Window <= 0 {
+		return errors.Errorf("tunnel chaos window must be positive, got %s", c.Window)
+	}
+	if interval := c.Ticker.Interval(); c.Window >= interval {
+		return errors.Errorf("tunnel chaos window %s must be shorter than its interval %s", c.Window, interval)
+	}
+	return nil
+}
+
+func (c *TunnelChaosRoutine) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	// windows are only taken on the routine's own goroutine, after this
+	c.ctx = ctx
+	c.TickedRoutine.Run(ctx, client, writer)
+}
+
+func (c *TunnelChaosRoutine) chaos(client *RTCClient, writer *ResultWriter) {
+	_, records, err := client.PauseTunnel()
+	writer.Write(records)
+	if err != nil {
+		c.Log.Warn("unable to pause tunnel in tunnel chaos routine", "error", err)
+		c.mu.Lock()
+		c.stats.FailedPauses++
+		c.mu.Unlock()
+		return
+	}
+	client.Rates.Achieve()
+	start := clock.Now()
+	c.Log.Warn("tunnel paused by tunnel chaos routine", "window", c.Window)
+	c.mu.Lock()
+	c.stats.Paused = true
+	c.mu.Unlock()
+
+	select {
+	case <-clock.After(c.Window):
+	case <-c.ctx.Done():
+		c.Log.Info("tunnel chaos routine stopped during window, resuming tunnel early")
+	}
+
+	resumed := false
+	for attempt := 1; attempt <= resumeAttempts && !resumed; attempt++ {
+		_, records, err = client.ResumeTunnel()
+		writer.Write(records)
+		if err != nil {
+			c.Log.Error("unable to resume tunnel paused by tunnel chaos routine", "error", err, "attempt", attempt)
+			c.mu.Lock()
+			c.stats.FailedResumes++
+			c.mu.Unlock()
+			continue
+		}
+		resumed = true
+	}
+	end := clock.Now()
+	if resumed {
+		c.Log.Info("tunnel resumed by tunnel chaos routine", "pausedFor", end.Sub(start))
+	} else {
+		c.Log.Error("tunnel left paused by tunnel chaos routine", "attempts", resumeAttempts)
+	}
+
+	c.mu.Lock()
+	c.stats.Windows++
+	c.stats.Paused = !resumed
+	c.pausedFor += end.Sub(start)
+	c.mu.Unlock()
+	if c.Annotator != nil {
+		err = c.Annotator.Annotate(Annotation{Start: start, End: end, Label: "tunnel paused"})
+		if err != nil {
+			c.Log.Warn("tunnel chaos annotation not sent to grafana", "error", err)
+		}
+	}
+}
+
+func (c *TunnelChaosRoutine) ChaosStats() TunnelChaosStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.PausedFor = c.pausedFor.Round(time.Millisecond).String()
+	return stats
+}
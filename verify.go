@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Operations whose effect can be verified with a follow-up queue read.
+var verifiedOps = []string{"queue", "move", "delete", "modify"}
+
+// VerifySampler picks the adds, moves, deletes and package changes verified by
+// reading the queue straight after them, a percentage of each, so a long run
+// still checks the rTC did what it confirmed without doubling the load it is
+// sent. The follow-up reads aren't recorded as commands of their own. Its methods are
+// safe to call on a nil sampler, which verifies nothing.
+type VerifySampler struct {
+	// Percent is the share of each operation verified, from 0 to 100.
+	Percent map[string]float64
+	Rand    *SeededRand
+
+	mu     sync.Mutex
+	counts map[string]*VerifyCounts
+}
+
+// VerifyCounts are the operations of a kind verified and the ones whose
+// effect the queue didn't show.
+type VerifyCounts struct {
+	Verified uint64 `json:"verified"`
+	Failed   uint64 `json:"failed"`
+}
+
+// ParseVerify reads --verify, e.g. "queue=10,move=5,delete=100%".
+func ParseVerify(spec string, rand *SeededRand) (*VerifySampler, error) {
+	v := &VerifySampler{Percent: map[string]float64{}, Rand: rand, counts: map[string]*VerifyCounts{}}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		op, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errors.Errorf("verify %q must look like queue=10", item)
+		}
+		known := false
+		for _, name := range verifiedOps {
+			known = known || name == op
+		}
+		if !known {
+			return nil, errors.Errorf("unknown operation %q to verify, expected queue, move, delete or modify", op)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, errors.Errorf("share of %s verified must be a percentage from 0 to 100, got %q", op, value)
+		}
+		v.Percent[op] = percent
+	}
+	return v, nil
+}
+
+// Sample is whether an operation of the kind is verified this time.
+func (v *VerifySampler) Sample(op string) bool {
+	if v == nil {
+		return false
+	}
+	percent := v.Percent[op]
+	switch {
+	case percent <= 0:
+		return false
+	case percent >= 100 || v.Rand == nil:
+		return true
+	}
+	return float64(v.Rand.Intn(10000)) < percent*100
+}
+
+// Observe counts the outcome of a verification.
+func (v *VerifySampler) Observe(op string, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counts[op]
+	if !ok {
+		c = &VerifyCounts{}
+		v.counts[op] = c
+	}
+	c.Verified++
+	if err != nil {
+		c.Failed++
+	}
+}
+
+func (v *VerifySampler) Counts() map[string]VerifyCounts {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	counts := map[string]VerifyCounts{}
+	for op := range v.Percent {
+		if c, ok := v.counts[op]; ok {
+			counts[op] = *c
+		} else {
+			counts[op] = VerifyCounts{}
+		}
+	}
+	return counts
+}
+
+// verifyQueue reads the queue for a verification of the op, finding washID in
+// it. It returns nil and no error when the wash isn't queued.
+func (r *RTCClient) verifyQueue(op string, washID int) (*WashQueueItem, error) {
+	queue, _, err := r.GetQueue()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get queue to verify %s", op)
+	}
+	for i := range queue.Queue.QueueItems {
+		if queue.Queue.QueueItems[i].WashID == washID {
+			return &queue.Queue.QueueItems[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// verifyQueued makes sure a confirmed add actually queued the wash.
+func (r *RTCClient) verifyQueued(washID int) error {
+	wash, err := r.verifyQueue("add", washID)
+	if err == nil && wash == nil {
+		err = &RTCError{Command: "QUEUE", Message: fmt.Sprintf("wash %d not queued after confirmed add", washID)}
+	}
+	r.Verify.Observe("queue", err)
+	return err
+}
+
+// verifyMoved makes sure a moved wash is where the rTC's reply to the move
+// put it. Without the wash in the reply it only has to still be queued.
+func (r *RTCClient) verifyMoved(washID int, reply *GetQueueResponse) error {
+	wash, err := r.verifyQueue("move", washID)
+	if err == nil && wash == nil {
+		err = &RTCError{Command: "MOVE", Message: fmt.Sprintf("wash %d not queued after move", washID)}
+	}
+	if err == nil && reply != nil {
+		for _, moved := range reply.Queue.QueueItems {
+			if moved.WashID == washID && moved.Position != wash.Position {
+				err = &RTCError{Command: "MOVE", Message: fmt.Sprintf("wash %d is at position %d, the move put it at %d", washID, wash.Position, moved.Position)}
+			}
+		}
+	}
+	r.Verify.Observe("move", err)
+	return err
+}
+
+// verifyModified makes sure a wash whose package change was confirmed is still
+// queued with the new package.
+func (r *RTCClient) verifyModified(washID int, washPackage int) error {
+	wash, err := r.verifyQueue("modify", washID)
+	if err == nil && wash == nil {
+		err = &RTCError{Command: "MODIFY", Message: fmt.Sprintf("wash %d not queued after package change", washID)}
+	}
+	if err == nil && wash.WashPkgNum != washPackage {
+		err = &RTCError{Command: "MODIFY", Message: fmt.Sprintf("wash %d has package %d after confirmed change to %d", washID, wash.WashPkgNum, washPackage)}
+	}
+	r.Verify.Observe("modify", err)
+	return err
+}
+
+// verifyDeleted re-reads the queue to make sure a confirmed delete actually took effect.
+func (r *RTCClient) verifyDeleted(washID int) error {
+	wash, err := r.verifyQueue("delete", washID)
+	if err == nil && wash != nil {
+		err = &RTCError{Command: "DELETE", Message: fmt.Sprintf("wash %d still queued after confirmed delete", washID)}
+	}
+	r.Verify.Observe("delete", err)
+	return err
+}
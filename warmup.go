@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// warmUpPhase labels the records sent during the warm-up. Summaries, and so
+// reports, SLOs and diffs, leave them out.
+const warmUpPhase = "warm-up"
+
+// baselinePhase is whether a record was sent during the warm-up or the
+// re-baseline, which summaries leave out.
+func baselinePhase(record []string) bool {
+	if len(record) <= len(csvHeader) {
+		return false
+	}
+	return record[len(csvHeader)] == warmUpPhase || record[len(csvHeader)] == rebaselinePhase
+}
+
+// WarmUp is the start of a run, when new connections and the rTC warming its
+// caches make latencies unrepresentative. Its records are either tagged with
+// the warm-up phase or not written at all. The records of a re-baseline at
+// the end of the run are tagged with its phase while it lasts.
+type WarmUp struct {
+	Duration time.Duration
+	// Label is the phase of records after the warm-up, nil for none.
+	Label func() string
+
+	start int64
+	// rebaseline is when the re-baseline began, 0 before it did
+	rebaseline int64
+}
+
+func CreateWarmUp(duration time.Duration, label func() string) *WarmUp {
+	w := &WarmUp{Duration: duration, Label: label}
+	w.Begin()
+	return w
+}
+
+// Begin starts the warm-up again, for runs that wait for a scheduled start.
+func (w *WarmUp) Begin() {
+	atomic.StoreInt64(&w.start, clock.Now().UnixNano())
+}
+
+func (w *WarmUp) Active() bool {
+	start := time.Unix(0, atomic.LoadInt64(&w.start))
+	return clock.Now().Before(start.Add(w.Duration))
+}
+
+// Rebaseline labels the records of the next Duration with the re-baseline
+// phase.
+func (w *WarmUp) Rebaseline() {
+	atomic.StoreInt64(&w.rebaseline, clock.Now().UnixNano())
+}
+
+// Phase labels records with the warm-up phase until it is over, and with the
+// re-baseline phase while that lasts.
+func (w *WarmUp) Phase() string {
+	if rebaseline := atomic.LoadInt64(&w.rebaseline); rebaseline != 0 {
+		if clock.Now().Before(time.Unix(0, rebaseline).Add(w.Duration)) {
+			return rebaselinePhase
+		}
+	}
+	if w.Active() {
+		return warmUpPhase
+	}
+	if w.Label == nil {
+		return ""
+	}
+	return w.Label()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var washIDAnomalyHeader = []string{"Time", "Wash ID", "Previous", "Kind"}
+
+// Kinds of washID anomalies. POS systems assume the rTC hands out increasing,
+// never reused ids; these have caused POS side bugs that only show up under
+// sustained load.
+const (
+	WashIDNonMonotonic = "non-monotonic"
+	WashIDWraparound   = "wraparound"
+	WashIDJump         = "jump"
+	WashIDDuplicate    = "duplicate"
+	WashIDReuse        = "reuse"
+)
+
+// WashIDTracker checks every washID the rTC issues against the ones issued and
+// deleted before it in the run.
+type WashIDTracker struct {
+	Writer *ResultWriter
+	Log    Logger
+	// Jump is the gap between consecutive ids that is flagged; other lanes and
+	// testers queue cars too, so small gaps are normal. 0 disables the check.
+	Jump int
+	// ReorderWindow is how far below the highest id a new one may be before it
+	// is flagged, since concurrent routines can process their replies out of order.
+	ReorderWindow int
+	// ReuseWindow is how long deleted ids are remembered.
+	ReuseWindow time.Duration
+
+	mu          sync.Mutex
+	highest     int
+	outstanding map[int]bool
+	deleted     map[int]time.Time
+	pruned      time.Time
+	counts      map[string]uint64
+}
+
+func CreateWashIDTracker(writer *ResultWriter) *WashIDTracker {
+	return &WashIDTracker{
+		Writer:        writer,
+		Log:           ZerologLogger{},
+		Jump:          1000,
+		ReorderWindow: 16,
+		ReuseWindow:   10 * time.Minute,
+		outstanding:   map[int]bool{},
+		deleted:       map[int]time.Time{},
+		counts:        map[string]uint64{},
+	}
+}
+
+// Issued checks a washID the rTC just assigned to one of our washes.
+func (t *WashIDTracker) Issued(washID int) {
+	now := clock.Now()
+
+	t.mu.Lock()
+	var kind string
+	previous := t.highest
+	deletedAt, wasDeleted := t.deleted[washID]
+	switch {
+	case t.outstanding[washID]:
+		kind = WashIDDuplicate
+	case wasDeleted && now.Sub(deletedAt) <= t.ReuseWindow:
+		kind = WashIDReuse
+	case t.highest > 0 && washID < t.highest/2:
+		kind = WashIDWraparound
+	case t.highest > 0 && washID < t.highest-t.ReorderWindow:
+		kind = WashIDNonMonotonic
+	case t.highest > 0 && t.Jump > 0 && washID-t.highest > t.Jump:
+		kind = WashIDJump
+	}
+
+	t.outstanding[washID] = true
+	delete(t.deleted, washID)
+	if washID > t.highest || kind == WashIDWraparound {
+		t.highest = washID
+	}
+	if kind != "" {
+		t.counts[kind]++
+	}
+	t.mu.Unlock()
+
+	if kind != "" {
+		t.Log.Warn("rTC issued an unexpected wash id", "washID", washID, "previous", previous, "kind", kind)
+		t.Writer.Write([]string{recordTime(now), strconv.Itoa(washID), strconv.Itoa(previous), kind})
+	}
+}
+
+// Deleted remembers a washID the rTC confirmed deleting so its reuse can be spotted.
+func (t *WashIDTracker) Deleted(washID int) {
+	now := clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.outstanding, washID)
+	t.deleted[washID] = now
+	if now.Sub(t.pruned) < time.Minute {
+		return
+	}
+	for id, at := range t.deleted {
+		if now.Sub(at) > t.ReuseWindow {
+			delete(t.deleted, id)
+		}
+	}
+	t.pruned = now
+}
+
+// Outstanding are the washIDs issued and not deleted since, lowest first.
+func (t *WashIDTracker) Outstanding() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	washIDs := make([]int, 0, len(t.outstanding))
+	for washID := range t.outstanding {
+		washIDs = append(washIDs, washID)
+	}
+	sort.Ints(washIDs)
+	return washIDs
+}
+
+// Anomalies is the number of anomalies seen so far by kind.
+func (t *WashIDTracker) Anomalies() map[string]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]uint64, len(t.counts))
+	for kind, n := range t.counts {
+		counts[kind] = n
+	}
+	return counts
+}
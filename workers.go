@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// WorkerPool runs Workers virtual users, each repeating Op as soon as its last
+// one completed and Think passed. Unlike the ticker driven routines, the load
+// grows with the number of workers rather than the schedule, which is what it
+// takes to stress the rTC from a single tester.
+type WorkerPool struct {
+	routineRunner
+
+	Name    string
+	Workers int
+	Think   time.Duration
+	Log     Logger
+	Op      func(client *RTCClient, writer *ResultWriter)
+	// Mix, when set, picks each operation instead of Op.
+	Mix *OperationMix
+
+	mu      sync.Mutex
+	running bool
+	client  *RTCClient
+	writer  *ResultWriter
+	// stops has a channel per running worker, closed to stop it.
+	stops []chan struct{}
+	wg    sync.WaitGroup
+}
+
+func CreateWorkerPool(name string, workers int, think time.Duration, op func(client *RTCClient, writer *ResultWriter)) *WorkerPool {
+	return &WorkerPool{
+		Name:    name,
+		Workers: workers,
+		Think:   think,
+		Log:     ZerologLogger{},
+		Op:      op,
+	}
+}
+
+func (p *WorkerPool) Run(ctx context.Context, client *RTCClient, writer *ResultWriter) {
+	p.mu.Lock()
+	if p.running {
+		// started already, by the routines starting while it was scaled up
+		p.mu.Unlock()
+		return
+	}
+	p.running, p.client, p.writer = true, client, writer
+	p.resize()
+	p.mu.Unlock()
+
+	<-ctx.Done()
+	p.mu.Lock()
+	p.running = false
+	for _, stop := range p.stops {
+		close(stop)
+	}
+	p.stops = nil
+	workers := p.Workers
+	p.mu.Unlock()
+	p.wg.Wait()
+	p.Log.Info("worker pool stopped", "pool", p.Name, "workers", workers)
+}
+
+// Scale changes the number of workers, starting or stopping workers straight
+// away when the pool is running. Stopped workers finish the operation they
+// are sending first.
+func (p *WorkerPool) Scale(workers int) (int, error) {
+	if workers < 0 {
+		return 0, errors.Errorf("%s workers can't be negative, got %d", p.Name, workers)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.Workers
+	p.Workers = workers
+	if p.running {
+		p.resize()
+	}
+	return previous, nil
+}
+
+// Size is the number of workers the pool runs.
+func (p *WorkerPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Workers
+}
+
+// resize starts or stops workers until Workers are running; p.mu is held.
+func (p *WorkerPool) resize() {
+	for len(p.stops) < p.Workers {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.work(p.client, p.writer, stop)
+		}()
+	}
+	for len(p.stops) > p.Workers {
+		close(p.stops[len(p.stops)-1])
+		p.stops = p.stops[:len(p.stops)-1]
+	}
+}
+
+func (p *WorkerPool) work(client *RTCClient, writer *ResultWriter, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		name, op := p.Name, p.Op
+		if p.Mix != nil {
+			name, op = p.Mix.Next()
+		}
+
+		wait := p.Think
+		if client.Gate.Paused() {
+			// don't spin while load is paused
+			if wait < 100*time.Millisecond {
+				wait = 100 * time.Millisecond
+			}
+		} else if client.Limit.Take(name) {
+			op(client, writer)
+			client.Limit.Done(name)
+		} else if p.Mix == nil {
+			// this routine's operations are used up
+			return
+		}
+
+		if wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-clock.After(wait):
+			}
+		}
+	}
+}
+
+// AddWorkers adds a pool of workers for the queue, get or move routine. Queue
+// workers delete each wash they queue before queueing the next one.
+func (r *Routines) AddWorkers(name string, workers int, think time.Duration) error {
+	if workers <= 0 {
+		return errors.Errorf("%s workers must be positive, got %d", name, workers)
+	}
+
+	op, err := r.workerOp(name)
+	if err != nil {
+		return err
+	}
+	r.workersMu.Lock()
+	defer r.workersMu.Unlock()
+	r.Workers = append(r.Workers, CreateWorkerPool(name, workers, think, op))
+	return nil
+}
+
+// ScaleWorkers is GET /scale/:pool/:workers, setting the number of workers of
+// the queue, get, move or mix pool while the test runs. A queue, get or move
+// pool is added when there is none yet, with --worker-think between operations.
+func (r *Routines) ScaleWorkers(c *gin.Context) {
+	name := c.Param("pool")
+	workers, err := strconv.Atoi(c.Param("workers"))
+	if err != nil || workers < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workers must be a whole number of at least 0, got " + c.Param("workers")})
+		return
+	}
+
+	if name == "mix" {
+		if r.Mix == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "no operation mix is running, start the tester with --mix"})
+			return
+		}
+		previous, _ := r.Mix.Scale(workers)
+		r.Log.Info("worker pool scaled", "pool", name, "from", previous, "to", workers)
+		c.JSON(http.StatusOK, gin.H{"pool": name, "previous": previous, "workers": workers})
+		return
+	}
+
+	r.workersMu.Lock()
+	defer r.workersMu.Unlock()
+	var pool *WorkerPool
+	for _, p := range r.Workers {
+		if p.Name == name {
+			pool = p
+			break
+		}
+	}
+	if pool == nil {
+		op, err := r.workerOp(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		pool = CreateWorkerPool(name, 0, r.WorkerThink, op)
+		pool.Log = r.Log
+		r.Workers = append(r.Workers, pool)
+		if state := r.lifecycle.State(); state == RoutinesRunning || state == RoutinesPaused {
+			r.startRun(&pool.routineRunner, func(ctx context.Context) { pool.Run(ctx, r.RTC, r.Writer) })
+		}
+	}
+
+	previous, _ := pool.Scale(workers)
+	r.Log.Info("worker pool scaled", "pool", name, "from", previous, "to", workers)
+	c.JSON(http.StatusOK, gin.H{"pool": name, "previous": previous, "workers": workers})
+}
+
+// WorkerCounts are the workers of every pool by name.
+func (r *Routines) WorkerCounts() map[string]int {
+	r.workersMu.Lock()
+	defer r.workersMu.Unlock()
+
+	counts := map[string]int{}
+	for _, pool := range r.Workers {
+		counts[pool.Name] = pool.Size()
+	}
+	if r.Mix != nil {
+		counts["mix"] = r.Mix.Size()
+	}
+	return counts
+}
+
+// workerOp is one iteration of a worker of the queue, get or move routine.
+func (r *Routines) workerOp(name string) (func(client *RTCClient, writer *ResultWriter), error) {
+	switch name {
+	case "queue":
+		return r.QueueRoutine.queueAndDelete, nil
+	case "get":
+		return func(client *RTCClient, writer *ResultWriter) {
+			_, records, err := client.GetQueue()
+			if err != nil {
+				r.GetRoutine.Log.Warn("error getting queue in get worker", "error", err)
+			}
+			writer.Write(records)
+		}, nil
+	case "move":
+		return r.MoveRoutine.move, nil
+	}
+	return nil, errors.Errorf("unknown routine %q, expected queue, get or move", name)
+}
+
+// queueAndDelete is one iteration of a queue worker.
+func (q *QueueRoutine) queueAndDelete(client *RTCClient, writer *ResultWriter) {
+	orderID, err := q.IDs.NextOrderID()
+	if err != nil {
+		q.Log.Warn("unable to allocate order id, not attempting queue", "error", err, "strategy", q.IDs.Strategy())
+		return
+	}
+
+	resp, records, err := client.QueueWash(WashRequest{
+		LaneID:      client.Lanes.Next(),
+		OrderID:     orderID,
+		VehicleID:   "NO-VALID-ID",
+		WashPackage: 1,
+	})
+	writer.Write(records)
+	if err != nil {
+		q.Log.Warn("unable to queue wash in queue worker", "error", err)
+		return
+	}
+	if q.Retain != nil {
+		q.Retain.Retain(client, writer, resp.WashID)
+		return
+	}
+
+	_, records, err = client.DeleteQueuedCar(resp.WashID)
+	writer.Write(records)
+	if err != nil {
+		q.Log.Warn("unable to delete wash in queue worker", "error", err, "washID", resp.WashID)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+var csvHeader = []string{"rTC Command", "Connected", "Command Initiated", "Command Retrieved", "Closed", "Error", "Error Message"}
+
+// ResultWriter is the CSV sink shared by all routines. Writes are serialised and
+// flushed one record at a time so a failing disk shows up on the record that hit
+// it. Failures are counted and sent on Errors without ever blocking a routine.
+type ResultWriter struct {
+	Errors chan error
+	// Phase, when set, labels every record with the load phase it was written in.
+	Phase func() string
+	// Exclude, when set, drops records while it returns true.
+	Exclude func() bool
+	// Observe, when set, is shown every record that isn't excluded.
+	Observe func(record []string)
+	// Columns are recorded after the standard ones and the phase, such as the
+	// wait of commands under --max-inflight. Records without them, like those
+	// of commands that were never sent, are padded. Columns the records of
+	// commands fill in come before the ones set by Tagged writers.
+	Columns []string
+
+	// parent is the writer a Tagged writer records to, with tagValue in
+	// the column tagColumn.
+	parent    *ResultWriter
+	tagColumn string
+	tagValue  string
+
+	mu          sync.Mutex
+	csv         *csv.Writer
+	written     uint64
+	failed      uint64
+	consecutive uint64
+	lastErr     error
+}
+
+type WriterStats struct {
+	Written            uint64 `json:"written"`
+	Failed             uint64 `json:"failed"`
+	ConsecutiveFailure uint64 `json:"consecutiveFailures"`
+	LastError          string `json:"lastError,omitempty"`
+}
+
+// CreateResultWriter is a writer recording to out, which may be nil for a
+// writer given its results file by Open once its columns are set.
+func CreateResultWriter(out io.Writer) *ResultWriter {
+	w := &ResultWriter{Errors: make(chan error, 16)}
+	if out != nil {
+		w.csv = csv.NewWriter(out)
+	}
+	return w
+}
+
+// Header is the standard columns, the phase when set and the Columns.
+func (w *ResultWriter) Header() []string {
+	header := csvHeader[:len(csvHeader):len(csvHeader)]
+	if w.Phase != nil {
+		header = append(header, "Phase")
+	}
+	return append(header, w.Columns...)
+}
+
+func (w *ResultWriter) WriteHeader() error {
+	return w.write(w.Header())
+}
+
+// Tagged is a writer recording to w with value in column, one of w's
+// Columns, such as the scenario instance whose routine sent a command.
+func (w *ResultWriter) Tagged(column, value string) *ResultWriter {
+	return &ResultWriter{parent: w, tagColumn: column, tagValue: value}
+}
+
+func (w *ResultWriter) Write(record []string) error {
+	if w.parent != nil {
+		return w.parent.writeTagged(record, w.tagColumn, w.tagValue)
+	}
+	return w.writeTagged(record, "", "")
+}
+
+func (w *ResultWriter) writeTagged(record []string, column, value string) error {
+	if record == nil {
+		// a command that was never sent, such as one over --max-commands
+		return nil
+	}
+	if w.Exclude != nil && w.Exclude() {
+		return nil
+	}
+	if w.Observe != nil {
+		w.Observe(record)
+	}
+	if w.Phase != nil {
+		// the phase stays right after the standard columns, where analysis looks for it
+		record = insertColumn(record, len(csvHeader), w.Phase())
+	}
+	if len(w.Columns) > 0 {
+		width := len(csvHeader) + len(w.Columns)
+		if w.Phase != nil {
+			width++
+		}
+		for len(record) < width {
+			record = append(record[:len(record):len(record)], "")
+		}
+		for i, name := range w.Columns {
+			if name == column {
+				// the record may still be the caller's
+				record = append([]string(nil), record...)
+				record[width-len(w.Columns)+i] = value
+			}
+		}
+	}
+	return w.write(record)
+}
+
+func (w *ResultWriter) write(record []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.csv.Write(record)
+	if err == nil {
+		w.csv.Flush()
+		err = w.csv.Error()
+	}
+
+	if err != nil {
+		atomic.AddUint64(&w.failed, 1)
+		atomic.AddUint64(&w.consecutive, 1)
+		w.lastErr = err
+		select {
+		case w.Errors <- err:
+		default:
+		}
+		return err
+	}
+
+	atomic.AddUint64(&w.written, 1)
+	atomic.StoreUint64(&w.consecutive, 0)
+	return nil
+}
+
+func (w *ResultWriter) Flush() error {
+	if w.parent != nil {
+		return w.parent.Flush()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// ConsecutiveFailures is the number of writes that failed since the last one that succeeded.
+func (w *ResultWriter) ConsecutiveFailures() uint64 {
+	if w.parent != nil {
+		return w.parent.ConsecutiveFailures()
+	}
+	return atomic.LoadUint64(&w.consecutive)
+}
+
+func (w *ResultWriter) Stats() WriterStats {
+	if w.parent != nil {
+		return w.parent.Stats()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := WriterStats{
+		Written:            atomic.LoadUint64(&w.written),
+		Failed:             atomic.LoadUint64(&w.failed),
+		ConsecutiveFailure: atomic.LoadUint64(&w.consecutive),
+	}
+	if w.lastErr != nil {
+		stats.LastError = w.lastErr.Error()
+	}
+	return stats
+}
+
+// watchWriteErrors logs failed CSV writes and ends the run once failLimit writes
+// in a row have failed, e.g. because the disk is full. A limit of 0 never stops.
+func watchWriteErrors(w *ResultWriter, failLimit int) {
+	for err := range w.Errors {
+		consecutive := w.ConsecutiveFailures()
+		log.Error().Err(err).Uint64("consecutiveFailures", consecutive).Msg("error writing record to CSV")
+		if failLimit > 0 && consecutive >= uint64(failLimit) {
+			log.Fatal().Err(err).Int("failLimit", failLimit).Msg("results file is unwritable, stopping run")
+		}
+	}
+}
+
+// insertColumn is record with value at column i, padding record to i columns
+// first when it's shorter.
+func insertColumn(record []string, i int, value string) []string {
+	out := make([]string, 0, len(record)+1)
+	if len(record) <= i {
+		out = append(out, record...)
+		for len(out) < i {
+			out = append(out, "")
+		}
+		return append(out, value)
+	}
+	out = append(out, record[:i]...)
+	out = append(out, value)
+	return append(out, record[i:]...)
+}
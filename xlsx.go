@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// xlsxMaxRows is the most rows a worksheet can have.
+const xlsxMaxRows = 1048576
+
+// XLSXWorkbook writes a minimal Office Open XML workbook: worksheets of
+// numbers and inline strings, no styles or shared strings. That is all the
+// exports need and keeps the tester free of a spreadsheet library.
+type XLSXWorkbook struct {
+	zip    *zip.Writer
+	sheets []string
+	sheet  *bufio.Writer
+	rows   int
+}
+
+func CreateXLSXWorkbook(w io.Writer) *XLSXWorkbook {
+	return &XLSXWorkbook{zip: zip.NewWriter(w)}
+}
+
+// AddSheet starts a new worksheet; rows are written to it until the next one.
+func (b *XLSXWorkbook) AddSheet(name string) error {
+	err := b.endSheet()
+	if err != nil {
+		return err
+	}
+	b.sheets = append(b.sheets, name)
+	f, err := b.zip.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(b.sheets)))
+	if err != nil {
+		return errors.Wrapf(err, "unable to add sheet %s", name)
+	}
+	b.sheet = bufio.NewWriter(f)
+	b.rows = 0
+	_, err = b.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return err
+}
+
+// WriteRow adds a row to the current sheet. Ints and floats become numbers,
+// everything else text. It returns false once the sheet is full.
+func (b *XLSXWorkbook) WriteRow(cells ...interface{}) (bool, error) {
+	if b.rows >= xlsxMaxRows {
+		return false, nil
+	}
+	b.rows++
+	fmt.Fprintf(b.sheet, `<row r="%d">`, b.rows)
+	for i, cell := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(b.rows)
+		switch v := cell.(type) {
+		case int:
+			fmt.Fprintf(b.sheet, `<c r="%s"><v>%d</v></c>`, ref, v)
+		case float64:
+			fmt.Fprintf(b.sheet, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			fmt.Fprintf(b.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(b.sheet, []byte(fmt.Sprint(v)))
+			b.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := b.sheet.WriteString(`</row>`)
+	return true, err
+}
+
+func (b *XLSXWorkbook) endSheet() error {
+	if b.sheet == nil {
+		return nil
+	}
+	b.sheet.WriteString(`</sheetData></worksheet>`)
+	err := b.sheet.Flush()
+	b.sheet = nil
+	return err
+}
+
+// Close writes the workbook's index of sheets and finishes the file.
+func (b *XLSXWorkbook) Close() error {
+	err := b.endSheet()
+	if err != nil {
+		return err
+	}
+
+	var contentTypes, workbook, rels strings.Builder
+	contentTypes.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, name := range b.sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		workbook.WriteString(`<sheet name="`)
+		xml.EscapeText(&workbook, []byte(name))
+		fmt.Fprintf(&workbook, `" sheetId="%d" r:id="rId%d"/>`, n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	rels.WriteString(`</Relationships>`)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+	}
+	for _, part := range parts {
+		f, err := b.zip.Create(part.name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to add %s to workbook", part.name)
+		}
+		_, err = io.WriteString(f, part.content)
+		if err != nil {
+			return errors.Wrapf(err, "unable to write %s of workbook", part.name)
+		}
+	}
+	return b.zip.Close()
+}
+
+// xlsxColumn is the letters of the zero based column i, e.g. 0 is A and 26 AA.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}